@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// actorHeader is the header clients set to say who's making the request, like
+// a user or the name of another service, which is recorded with every change
+// the request makes to an order's status
+const actorHeader = "X-Actor"
+
+// defaultActor is who changes are attributed to if the request doesn't have an
+// actorHeader
+const defaultActor = "api"
+
+// maxActorLen limits how big of an actor we'll store in every status change
+const maxActorLen = 255
+
+// actor is a middleware for every route that attributes any changes the
+// request makes to the orders to the actorHeader. If the request's context
+// already has an actor then that's kept instead.
+func (i *instance) actor(c *gin.Context) {
+	ctx := c.Request.Context()
+	if storage.ActorFromContext(ctx) != "" {
+		c.Next()
+		return
+	}
+
+	actor := c.GetHeader(actorHeader)
+	if len(actor) > maxActorLen {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be at most %d characters", actorHeader, maxActorLen)})
+		return
+	}
+	if actor == "" {
+		actor = defaultActor
+	}
+	c.Request = c.Request.WithContext(storage.WithActor(ctx, actor))
+	c.Next()
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestActor(t *testing.T) {
+	withActor := func(actor string) interface{} {
+		return mock.MatchedBy(func(ctx context.Context) bool {
+			return storage.ActorFromContext(ctx) == actor
+		})
+	}
+	order := storage.Order{ID: "order-1234"}
+
+	// the header is passed along to storage
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", withActor("warehouse-1"), order.ID).Return(order, nil).Once()
+		r := httptest.NewRequest("GET", "/orders/"+order.ID, nil)
+		r.Header.Set(actorHeader, "warehouse-1")
+		w := httptest.NewRecorder()
+		Handler(stor, nil, nil).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// requests without the header are attributed to the default actor
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", withActor(defaultActor), order.ID).Return(order, nil).Once()
+		r := httptest.NewRequest("GET", "/orders/"+order.ID, nil)
+		w := httptest.NewRecorder()
+		Handler(stor, nil, nil).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an actor already on the context is kept
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", withActor("test"), order.ID).Return(order, nil).Once()
+		ctx := storage.WithActor(context.Background(), "test")
+		r := httptest.NewRequest("GET", "/orders/"+order.ID, nil).WithContext(ctx)
+		r.Header.Set(actorHeader, "warehouse-1")
+		w := httptest.NewRecorder()
+		Handler(stor, nil, nil).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an actor that's too long is rejected
+	{
+		stor := new(mocks.MockStorageInstance)
+		r := httptest.NewRequest("GET", "/orders/"+order.ID, nil)
+		r.Header.Set(actorHeader, strings.Repeat("a", maxActorLen+1))
+		w := httptest.NewRecorder()
+		Handler(stor, nil, nil).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
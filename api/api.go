@@ -5,16 +5,24 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/chargeclient"
 	"github.com/levenlabs/order-up/mocks"
 	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/webhook"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // instance represents an API instance. Typically this is exported but for our
@@ -24,33 +32,146 @@ type instance struct {
 	stor               mocks.StorageInstance
 	router             *gin.Engine
 	fulfillmentService *http.Client
-	chargeService      *http.Client
-	chargeMutex        sync.Mutex
+	fulfillmentURL     string
+	charges            *chargeclient.Client
+	idempotencyKeyTTL  time.Duration
+	idempotencyLease   time.Duration
+	authorizationTTL   time.Duration
+	streams            *streamHub
+	streamInterval     time.Duration
+	exportTimeout      time.Duration
+	webhookResolver    webhook.Resolver
+}
+
+// Option changes how the handler returned by Handler behaves
+type Option func(*instance)
+
+// WithIdempotencyKeyTTL sets how long the responses to requests with an
+// Idempotency-Key header are kept, after which the key can be used again. It
+// defaults to 24 hours.
+func WithIdempotencyKeyTTL(ttl time.Duration) Option {
+	return func(i *instance) {
+		i.idempotencyKeyTTL = ttl
+	}
+}
+
+// WithIdempotencyKeyLease sets how long a request with an Idempotency-Key
+// header holds the key while it's being handled. If the request is abandoned
+// before its response is stored, like when the process crashes, retries with
+// the key are rejected as still in progress until the lease runs out. It should
+// be longer than any request takes and defaults to 2 minutes.
+func WithIdempotencyKeyLease(lease time.Duration) Option {
+	return func(i *instance) {
+		i.idempotencyLease = lease
+	}
+}
+
+// WithAuthorizationTTL sets how long an authorization can be captured for
+// after the order is authorized, after which the order moves back to pending.
+// It should be no longer than the charge service holds authorizations for. It
+// defaults to 7 days.
+func WithAuthorizationTTL(ttl time.Duration) Option {
+	return func(i *instance) {
+		i.authorizationTTL = ttl
+	}
+}
+
+// WithStreamInterval sets how often new order events are looked for while
+// there are clients connected to GET /orders/stream or GET /orders/:id/stream.
+// It defaults to 1 second.
+func WithStreamInterval(interval time.Duration) Option {
+	return func(i *instance) {
+		i.streamInterval = interval
+	}
+}
+
+// WithExportTimeout sets the longest GET /orders/export can take. The export
+// holds a database cursor open the whole time so one that's cut off by the
+// timeout ends like any other failed export, with the connection closed before
+// the end of the response. It defaults to 10 minutes.
+func WithExportTimeout(timeout time.Duration) Option {
+	return func(i *instance) {
+		i.exportTimeout = timeout
+	}
+}
+
+// WithFulfillmentURL sets the base URL of the fulfillment service, like
+// http://fulfillment.internal, which is prepended to the path of every request
+// made to it. It defaults to nothing, which only works with a client that
+// handles the requests itself like mocks.NewMockedService.
+func WithFulfillmentURL(baseURL string) Option {
+	return func(i *instance) {
+		i.fulfillmentURL = baseURL
+	}
+}
+
+// WithWebhookResolver sets what resolves the hosts of webhook URLs when
+// they're subscribed, to check they don't point inside our own network. It
+// defaults to net.DefaultResolver.
+func WithWebhookResolver(resolver webhook.Resolver) Option {
+	return func(i *instance) {
+		i.webhookResolver = resolver
+	}
 }
 
 // Handler returns an implementation of the http.Handler interface that can be
 // passed to an http.Server to handle incoming HTTP requests. This accepts
-// an interface for the storage.Instance and http.Client's for the 2 dependent
-// services. Typically this would accept just a *storage.Instance but the mock
-// allows us to separate the api tests from the storage tests.
-func Handler(stor mocks.StorageInstance, fulfillmentService, chargeService *http.Client) http.Handler {
+// an interface for the storage.Instance, an http.Client for the fulfillment
+// service and a client for the charge service. Typically this would accept just
+// a *storage.Instance but the mock allows us to separate the api tests from the
+// storage tests. Any options are applied in order.
+func Handler(stor mocks.StorageInstance, fulfillmentService *http.Client, charges *chargeclient.Client, opts ...Option) http.Handler {
 	// inst is pointer to a new instance that's holding a new storage.Instance for
 	// talking to the underlying database
 	inst := &instance{
 		stor:               stor,
 		router:             gin.Default(),
 		fulfillmentService: fulfillmentService,
-		chargeService:      chargeService,
+		charges:            charges,
+		idempotencyKeyTTL:  24 * time.Hour,
+		idempotencyLease:   2 * time.Minute,
+		authorizationTTL:   7 * 24 * time.Hour,
+		streamInterval:     time.Second,
+		exportTimeout:      10 * time.Minute,
+		webhookResolver:    net.DefaultResolver,
+	}
+	for _, opt := range opts {
+		opt(inst)
 	}
+	// every stream shares a single hub so there's only one poller
+	inst.streams = newStreamHub(stor, inst.streamInterval)
+
+	// every request goes through the actor middleware so the changes it makes to
+	// orders are attributed to whoever made it
+	inst.router.Use(inst.actor)
 
 	// set up the various REST endpoints that are exposed publicly over HTTP
 	// go implicitly binds these functions to inst
 	inst.router.GET("/orders", inst.getOrders)
-	inst.router.POST("/orders", inst.postOrders)
+	// every POST and PUT goes through the idempotency middleware so clients can
+	// safely retry them with the same Idempotency-Key header
+	inst.router.POST("/orders", inst.idempotency, inst.postOrders)
+	inst.router.GET("/orders/stream", inst.streamOrders)
+	inst.router.GET("/orders/export", inst.exportOrders)
 	inst.router.GET("/orders/:id", inst.getOrder)
-	inst.router.POST("/orders/:id/charge", inst.chargeOrder)
-	inst.router.POST("/orders/:id/cancel", inst.cancelOrder)
-	inst.router.PUT("/fulfill", inst.fulfillOrder)
+	inst.router.GET("/orders/:id/stream", inst.streamOrder)
+	inst.router.GET("/orders/:id/transitions", inst.getOrderTransitions)
+	inst.router.GET("/orders/:id/events", inst.getOrderEvents)
+	inst.router.POST("/orders/:id/charge", inst.idempotency, inst.chargeOrder)
+	inst.router.POST("/orders/:id/cancel", inst.idempotency, inst.cancelOrder)
+	inst.router.POST("/orders/:id/refunds", inst.idempotency, inst.refundOrder)
+	inst.router.POST("/orders/:id/authorize", inst.idempotency, inst.authorizeOrder)
+	inst.router.POST("/orders/:id/capture", inst.idempotency, inst.captureOrder)
+	inst.router.POST("/orders/:id/void", inst.idempotency, inst.voidOrder)
+	inst.router.PUT("/fulfill", inst.idempotency, inst.fulfillOrder)
+
+	// partners manage their webhook subscriptions and look through what was
+	// sent to them with these
+	inst.router.POST("/webhooks", inst.idempotency, inst.postWebhook)
+	inst.router.GET("/webhooks", inst.getWebhooks)
+	inst.router.GET("/webhooks/:id", inst.getWebhook)
+	inst.router.DELETE("/webhooks/:id", inst.deleteWebhook)
+	inst.router.GET("/webhooks/:id/deliveries", inst.getWebhookDeliveries)
 
 	// *instance implements the http.Handler interface with the ServeHTTP method
 	// below so we can just return inst
@@ -65,8 +186,15 @@ func (i *instance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// defaultOrdersLimit is how many orders GET /orders returns if the request
+// doesn't have a limit
+const defaultOrdersLimit = 100
+
 type getOrdersRes struct {
 	Orders []storage.Order `json:"orders"`
+	// NextCursor is passed as the cursor to get the next page of orders and is
+	// empty once there aren't any more
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 // getOrders is called by incoming HTTP GET requests to /orders
@@ -76,31 +204,27 @@ func (i *instance) getOrders(c *gin.Context) {
 	// the tracing context is kept throughout the whole request
 	ctx := c.Request.Context()
 
-	// get and parse the optional status query parameter from the request
-	// this lets you do /orders?status=pending to limit the orders to only those that
-	// are currently pending
-	var status storage.OrderStatus
-	switch c.Query("status") {
-	case "pending":
-		status = storage.OrderStatusPending
-		// the final break is implied if there's no fallthrough keyword
-	case "charged":
-		status = storage.OrderStatusCharged
-	case "fulfilled":
-		status = storage.OrderStatusFulfilled
-	case "":
-		// GetAllOrders accepts a -1 to indicate that all orders should be returned
-		status = -1
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown value for status: %v"})
+	// every query parameter is parsed before responding so a request with more
+	// than one problem gets told about all of them at once
+	p := newQueryParser(c)
+	query := p.orderQuery()
+	page := p.orderPage()
+	if !p.ok() {
 		return
 	}
 
-	// pass along the status and get all of the resulting orders from the storage
-	// instance
-	orders, err := i.stor.GetOrders(ctx, status)
+	// pass along the query and page and get the resulting orders from the
+	// storage instance
+	orders, next, err := i.stor.GetOrders(ctx, query, page)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting orders: %v", err)})
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, invalidParams(paramError{
+				Param: "cursor",
+				Error: "must be the nextCursor of a page with the same sort",
+			}))
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting orders: %v", err)})
+		}
 		return
 	}
 
@@ -113,7 +237,8 @@ func (i *instance) getOrders(c *gin.Context) {
 
 	// respond with a success and return the orders
 	c.JSON(http.StatusOK, getOrdersRes{
-		Orders: orders,
+		Orders:     orders,
+		NextCursor: next,
 	})
 }
 
@@ -125,6 +250,10 @@ func (i *instance) getOrders(c *gin.Context) {
 // anything else alongside that we can't think of right now
 type getOrderRes struct {
 	Order storage.Order `json:"order"`
+	// these are calculated from the order so clients don't have to
+	TotalCents    int64 `json:"totalCents"`
+	RefundedCents int64 `json:"refundedCents"`
+	NetCents      int64 `json:"netCents"`
 }
 
 // getOrder is called by incoming HTTP GET requests to /orders/:id
@@ -152,12 +281,167 @@ func (i *instance) getOrder(c *gin.Context) {
 
 	// respond with a success and return the order
 	c.JSON(http.StatusOK, getOrderRes{
-		Order: order,
+		Order:         order,
+		TotalCents:    order.TotalCents(),
+		RefundedCents: order.RefundedCents(),
+		NetCents:      order.NetCents(),
 	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// orderActions maps the name of each action a client can take on an order to
+// the statuses that action can move the order to first. An action is possible
+// if the order can move to any of them.
+var orderActions = []struct {
+	name     string
+	statuses []storage.OrderStatus
+}{
+	{"charge", []storage.OrderStatus{storage.OrderStatusCharging}},
+	{"authorize", []storage.OrderStatus{storage.OrderStatusAuthorizing}},
+	{"capture", []storage.OrderStatus{storage.OrderStatusCapturing}},
+	{"void", []storage.OrderStatus{storage.OrderStatusVoiding}},
+	// authorized orders are captured before they're fulfilled
+	{"fulfill", []storage.OrderStatus{storage.OrderStatusFulfilled, storage.OrderStatusPartiallyFulfilled, storage.OrderStatusCapturing}},
+	// pending orders are cancelled immediately but charged orders need to be
+	// refunded first and authorized orders need to be voided first
+	{"cancel", []storage.OrderStatus{storage.OrderStatusCancelled, storage.OrderStatusRefunding, storage.OrderStatusVoiding}},
+}
+
+// getOrderTransitionsRes is the result of the GET /orders/:id/transitions
+// handler
+type getOrderTransitionsRes struct {
+	OrderID      string   `json:"id"`
+	Status       string   `json:"status"`
+	NextStatuses []string `json:"nextStatuses"`
+	Actions      []string `json:"actions"`
+}
+
+// getOrderTransitions is called by incoming HTTP GET requests to
+// /orders/:id/transitions and lists the statuses the order can move to next
+// and which actions would move it there
+func (i *instance) getOrderTransitions(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	order, err := i.stor.GetOrder(ctx, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting order: %v", err)})
+		}
+		return
+	}
+
+	// these are initialized as empty slices so they're encoded as [] instead of
+	// null for final statuses
+	res := getOrderTransitionsRes{
+		OrderID:      order.ID,
+		Status:       order.Status.String(),
+		NextStatuses: []string{},
+		Actions:      []string{},
+	}
+	for _, status := range storage.NextStatuses(order.Status) {
+		res.NextStatuses = append(res.NextStatuses, status.String())
+	}
+	for _, action := range orderActions {
+		for _, status := range action.statuses {
+			if storage.CanTransition(order.Status, status) {
+				res.Actions = append(res.Actions, action.name)
+				break
+			}
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// defaultOrderEventsLimit is how many events GET /orders/:id/events returns if
+// the request doesn't have a limit
+const defaultOrderEventsLimit = 50
+
+// getOrderEventsRes is the result of the GET /orders/:id/events handler
+type getOrderEventsRes struct {
+	Events []storage.OrderEvent `json:"events"`
+	// NextCursor is passed as the cursor to get the next page of events and is
+	// empty once there aren't any more
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// queryLimit returns the limit query parameter of the request, or def if it
+// doesn't have one. If the limit isn't between 1 and max then it responds with
+// a 400 and returns false.
+func queryLimit(c *gin.Context, def, max int) (int, bool) {
+	limit, err := parseLimit(c.Query("limit"), def, max)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit " + err.Error()})
+		return 0, false
+	}
+	return limit, true
+}
+
+// parseLimit parses a limit query parameter, returning def if it's empty. If
+// the limit isn't between 1 and max then an error saying so is returned.
+func parseLimit(v string, def, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 || limit > max {
+		return 0, fmt.Errorf("must be a number between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+// getOrderEvents is called by incoming HTTP GET requests to /orders/:id/events
+// and returns a page of the order's event log, oldest first
+func (i *instance) getOrderEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	limit, ok := queryLimit(c, defaultOrderEventsLimit, storage.MaxOrderEventsLimit)
+	if !ok {
+		return
+	}
+	// the cursor is the ID of the last event of the previous page but clients
+	// should treat it as opaque
+	cursor := c.Query("cursor")
+
+	events, err := i.stor.GetOrderEvents(ctx, id, cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting order events: %v", err)})
+		return
+	}
+	// every order has at least the event for when it was created, except ones
+	// created before there was an event log, so only then do we need to check
+	// whether the order exists
+	if len(events) == 0 && cursor == "" {
+		if _, err := i.stor.GetOrder(ctx, id); err != nil {
+			if errors.Is(err, storage.ErrOrderNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting order: %v", err)})
+			}
+			return
+		}
+	}
+
+	res := getOrderEventsRes{Events: events}
+	if res.Events == nil {
+		res.Events = []storage.OrderEvent{}
+	}
+	// a full page might have more events after it, if it doesn't then the next
+	// page is just empty
+	if len(events) == limit {
+		res.NextCursor = events[len(events)-1].ID
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // postOrderArgs is the expected body for the POST /orders handler
 type postOrderArgs struct {
 	CustomerEmail string             `json:"customerEmail"`
@@ -202,6 +486,22 @@ func (i *instance) postOrders(c *gin.Context) {
 		LineItems:     args.LineItems,
 		Status:        storage.OrderStatusPending,
 	}
+	// nothing has been fulfilled or reserved yet no matter what the client sent
+	for idx := range order.LineItems {
+		order.LineItems[idx].FulfilledQuantity = 0
+		order.LineItems[idx].ReservedQuantity = 0
+	}
+	// fill in the line item IDs now so we can return them and so we can make
+	// sure any the client set are unique
+	order.FillLineItemIDs()
+	lineItemIDs := map[string]bool{}
+	for _, li := range order.LineItems {
+		if lineItemIDs[li.ID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duplicate line item id: %q", li.ID)})
+			return
+		}
+		lineItemIDs[li.ID] = true
+	}
 	if order.TotalCents() < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "an order's total cannot be less than 0"})
 	}
@@ -227,48 +527,96 @@ func (i *instance) postOrders(c *gin.Context) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// chargeServiceChargeArgs is the expected body for the POST /charge method of
-// the charge service
-// we could use a map[string]interface{}{} or something else but this makes it
-// easier to use in tests and makes the API contract clear
-// we could also be importing something from the charge service instead if that
-// actually existed
-type chargeServiceChargeArgs struct {
-	CardToken   string `json:"cardToken"`
-	AmountCents int64  `json:"amountCents"`
-}
-
-// innerChargeOrder actually does the charging or refunding (negative amount) by
-// making at POST request to the charge service
-func (i *instance) innerChargeOrder(ctx context.Context, args chargeServiceChargeArgs) error {
-	// encode the charge service's charge arguments as JSON so we can POST them to
-	// the /charge path on the charge service
-	// this method returns a byte slice that we can later pass to the Post message
-	// as the body of the POST request
-	// there's a package called "bytes" so we call the variable byts
-	byts, err := json.Marshal(args)
-	if err != nil {
-		return fmt.Errorf("error encoding charge body: %w", err)
+// chargeIdempotencyKey returns the idempotency key for a charge or refund of
+// the order. op is either "charge" or "refund" and attempt is the order's
+// PaymentAttempts after moving to charging or refunding. The key is the same
+// every time the same attempt is retried but different for every attempt so a
+// charge that failed can be tried again later.
+func chargeIdempotencyKey(orderID, op string, attempt int64) string {
+	return fmt.Sprintf("%s:%s:%d", orderID, op, attempt)
+}
+
+// refundIdempotencyKey returns the idempotency key for a partial refund of the
+// order. Every refund has its own ID so the key is unique per refund and the
+// recovery worker can look for it in the order's charges.
+func refundIdempotencyKey(orderID, refundID string) string {
+	return fmt.Sprintf("%s:refund:%s", orderID, refundID)
+}
+
+// voidIdempotencyKey returns the idempotency key for voiding the authorization
+// with the given ID. An authorization can only be voided once so the key is
+// the same no matter who voids it or how many times they try.
+func voidIdempotencyKey(orderID, authorizationID string) string {
+	return fmt.Sprintf("%s:void:%s", orderID, authorizationID)
+}
+
+// chargeErrorStatus returns the HTTP status code to respond with when the
+// charge service fails so callers can tell a declined card from an outage
+func chargeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, chargeclient.ErrDeclined):
+		return http.StatusPaymentRequired
+	case errors.Is(err, chargeclient.ErrInvalidToken):
+		return http.StatusBadRequest
+	case errors.Is(err, chargeclient.ErrUnavailable), errors.Is(err, chargeclient.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errAuthorizationExpired is returned when capturing an order whose
+// authorization has already expired
+var errAuthorizationExpired = errors.New("authorization expired")
+
+// paymentErrorStatus is like chargeErrorStatus but also handles the errors
+// returned by TransitionOrderStatus and errAuthorizationExpired, which is
+// what innerCaptureOrder and innerVoidOrder can return
+func paymentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrOrderNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrInvalidTransition), errors.Is(err, errAuthorizationExpired):
+		return http.StatusConflict
+	default:
+		return chargeErrorStatus(err)
 	}
+}
 
-	// make a POST request to the /charge endpoint on the charge service
-	// the body is JSON but this method accepts a io.Reader so we need to wrap the
-	// byte slice in bytes.NewReader which simply reads over the sent byte slice
-	resp, err := i.chargeService.Post("/charge", "application/json", bytes.NewReader(byts))
+// cardFingerprint returns a short hash of the card token so payments made with
+// the same card can be matched up without storing the token
+func cardFingerprint(cardToken string) string {
+	sum := sha256.Sum256([]byte(cardToken))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordPayment adds an attempt at moving money for the order, and how it went,
+// to the order's payments so support can trace it. The charge service was
+// already called so failing to store it is only logged rather than failing the
+// request.
+func (i *instance) recordPayment(ctx context.Context, orderID string, kind storage.PaymentKind, args chargeclient.ChargeArgs, res chargeclient.ChargeResult, err error) {
+	payment := storage.Payment{
+		Kind:            kind,
+		AmountCents:     args.AmountCents,
+		IdempotencyKey:  args.IdempotencyKey,
+		Outcome:         storage.PaymentOutcomeSucceeded,
+		ChargeReference: res.ID,
+	}
+	// captures and voids don't send a card token since the authorization
+	// already has it
+	if args.CardToken != "" {
+		payment.CardFingerprint = cardFingerprint(args.CardToken)
+	}
 	if err != nil {
-		return fmt.Errorf("error making charge request: %w", err)
+		payment.Outcome = storage.PaymentOutcomeFailed
+		if errors.Is(err, chargeclient.ErrUnavailable) {
+			payment.Outcome = storage.PaymentOutcomeUnknown
+		}
+		payment.Error = err.Error()
 	}
-	// we need to make sure we close the body otherwise this will leak memory
-	defer resp.Body.Close()
-	// /charge creates a new charge so we expect a 201 response, if we didn't get
-	// that then we must've errored
-	if resp.StatusCode != http.StatusCreated {
-		// we opportunistically try to read the body in case it contains an error but
-		// if it fails then that's not the end of the world so we ignore the error
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("error charging body: %d %s", resp.StatusCode, body)
+	if err := i.stor.AddPayment(ctx, orderID, payment); err != nil {
+		llog.Error("failed to record payment", llog.KV{"id": orderID, "idempotencyKey": args.IdempotencyKey}, llog.ErrKV(err))
 	}
-	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -285,10 +633,6 @@ type chargeOrderRes struct {
 
 // chargeOrder is called by incoming HTTP POST requests to /orders/:id/charge
 func (i *instance) chargeOrder(c *gin.Context) {
-	// I have not yet gotten much exposure to the various concurrency functionality with Go. I added this to atleast
-	// partial credit here. Definetly want and need to learn more about Go Concurrency
-	i.chargeMutex.Lock()
-	defer i.chargeMutex.Unlock()
 	// the context of the request we pass along to every downstream function so we
 	// can stop processing if the caller aborts the request and also to ensure that
 	// the tracing context is kept throughout the whole request
@@ -306,38 +650,58 @@ func (i *instance) chargeOrder(c *gin.Context) {
 	// the Param function
 	id := c.Param("id")
 
-	// make a call to the storage instance to get the current state of the order
-	// so we can make sure that its ready for charging and get the amount to charge
-	order, err := i.stor.GetOrder(c.Request.Context(), id)
+	// this is a two-phase change where we first move the order to charging before
+	// calling the charge service and only move it to charged once we know the
+	// charge succeeded
+	// moving to charging is atomic so if multiple requests (possibly to different
+	// replicas of this service) try to charge the same order only one of them
+	// will succeed and the rest will get an ErrInvalidTransition
+	// if this service crashes after this the order stays charging and the
+	// recovery worker asks the charge service whether the charge went through
+	// the returned order is how it looked before the transition which gives us
+	// the amount to charge
+	order, err := i.stor.TransitionOrderStatus(ctx, id, storage.PreviousStatuses(storage.OrderStatusCharging), storage.OrderStatusCharging, "charge requested")
 	if err != nil {
-		if errors.Is(err, storage.ErrOrderNotFound) {
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
 			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting order: %v", err)})
+		case errors.Is(err, storage.ErrInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for charging"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to charging: %v", err)})
 		}
 		return
 	}
-	if order.Status != storage.OrderStatusCharged {
-		c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for charging"})
-		return
-	}
 
-	err = i.innerChargeOrder(ctx, chargeServiceChargeArgs{
-		CardToken:   args.CardToken,
-		AmountCents: order.TotalCents(),
-	})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	// there's nothing to charge if discounts cover the whole order
+	if order.TotalCents() > 0 {
+		chargeArgs := chargeclient.ChargeArgs{
+			CardToken:   args.CardToken,
+			AmountCents: order.TotalCents(),
+			OrderID:     order.ID,
+			// the transition counted this attempt but order is from before it
+			IdempotencyKey: chargeIdempotencyKey(order.ID, "charge", order.PaymentAttempts+1),
+		}
+		res, err := i.charges.Charge(ctx, chargeArgs)
+		i.recordPayment(ctx, order.ID, storage.PaymentKindCharge, chargeArgs, res, err)
+		if err != nil {
+			// if the charge service was unavailable we don't know whether the
+			// charge went through so we leave the order charging for the recovery
+			// worker, otherwise the charge definitely failed and we move the order
+			// back to pending so it can be retried
+			// that includes ErrCircuitOpen since the charge was never sent, so the
+			// order doesn't sit in charging until the recovery worker gets to it
+			if !errors.Is(err, chargeclient.ErrUnavailable) {
+				if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, "charge failed: "+err.Error()); rerr != nil {
+					err = fmt.Errorf("%w (and error updating order to pending: %v)", err, rerr)
+				}
+			}
+			c.JSON(chargeErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// in a real-world scenario we would do a two-phase change where we set it to
-	// charging ahead of time and then mark it as charged after so we would be able
-	// to understand if this was retried that we already tried to charge
-	// as it's written if this service crashed before this line then we would've
-	// charged the customer and not reflected that on the order but for now we're
-	// ignoring this scenario
-	err = i.stor.SetOrderStatus(ctx, order.ID, storage.OrderStatusCharged)
+	_, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to charged: %v", err)})
 		return
@@ -379,8 +743,8 @@ func (i *instance) cancelOrder(c *gin.Context) {
 	id := c.Param("id")
 
 	// make a call to the storage instance to get the current state of the order
-	// so we can make sure that its ready to be cancelled
-	order, err := i.stor.GetOrder(c.Request.Context(), id)
+	// so we know whether it needs to be refunded before it can be cancelled
+	order, err := i.stor.GetOrder(ctx, id)
 	if err != nil {
 		if errors.Is(err, storage.ErrOrderNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
@@ -390,33 +754,431 @@ func (i *instance) cancelOrder(c *gin.Context) {
 		return
 	}
 
-	if order.Status == storage.OrderStatusFulfilled {
-		c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for refund since the order has been fulfilled already"})
+	var refundAmount int64
+	switch {
+	case storage.CanTransition(order.Status, storage.OrderStatusCancelled):
+		// orders that were never charged can be cancelled immediately
+		// this only succeeds if the order's status hasn't changed since we got it
+		_, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{order.Status}, storage.OrderStatusCancelled, "cancelled")
+	case storage.CanTransition(order.Status, storage.OrderStatusRefunding):
+		// charged orders need to be refunded first which is a two-phase change
+		// just like charging
+		var prev storage.Order
+		prev, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{order.Status}, storage.OrderStatusRefunding, "cancellation requested")
+		if err != nil {
+			break
+		}
+		// a partial refund that's still pending might yet fail, and then we'd
+		// refund less than what's left, so the cancellation has to wait for it
+		// prev is how the order looked right before it moved to refunding and no
+		// refunds can be added while it's refunding so this can't race
+		if prev.HasPendingRefund() {
+			if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCharged, "refund in progress"); rerr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to charged: %v", rerr)})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "order has a refund in progress"})
+			return
+		}
+		// only what's left after any partial refunds is refunded
+		refundAmount = prev.NetCents()
+		if refundAmount > 0 {
+			refundArgs := chargeclient.ChargeArgs{
+				CardToken:      args.CardToken,
+				AmountCents:    refundAmount,
+				OrderID:        order.ID,
+				IdempotencyKey: chargeIdempotencyKey(order.ID, "refund", prev.PaymentAttempts+1),
+			}
+			var res chargeclient.ChargeResult
+			res, err = i.charges.Refund(ctx, refundArgs)
+			i.recordPayment(ctx, order.ID, storage.PaymentKindRefund, refundArgs, res, err)
+			if err != nil {
+				// just like charging, if we don't know whether the refund went through
+				// we leave the order refunding for the recovery worker, otherwise,
+				// including when the circuit breaker is open, we move it back to
+				// charged since the customer is still charged and the cancellation can
+				// be retried
+				if !errors.Is(err, chargeclient.ErrUnavailable) {
+					if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCharged, "refund failed: "+err.Error()); rerr != nil {
+						err = fmt.Errorf("%w (and error updating order to charged: %v)", err, rerr)
+					}
+				}
+				c.JSON(chargeErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+		}
+		_, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "refund succeeded")
+	case storage.CanTransition(order.Status, storage.OrderStatusVoiding):
+		// authorized orders were never charged so releasing the hold on the card
+		// is enough
+		err = i.innerVoidOrder(ctx, order.ID)
+		if err != nil && !errors.Is(err, storage.ErrInvalidTransition) {
+			c.JSON(paymentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		err = storage.ErrInvalidTransition
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for cancellation"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error cancelling order: %v", err)})
+		}
+		return
+	}
+
+	// since we successfully refunded the order and updated the order status we
+	// can return a success to the caller
+	c.JSON(http.StatusOK, cancelOrderRes{
+		RefundAmount: refundAmount,
+		OrderID:      order.ID,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// refundOrderArgs is the expected body for the POST /orders/:id/refunds handler
+type refundOrderArgs struct {
+	CardToken string `json:"cardToken"`
+	// AmountCents is how much to refund. Either this or Items must be set.
+	AmountCents int64 `json:"amountCents"`
+	// Items refunds some quantity of each line item instead of an amount
+	Items  []storage.RefundLineItem `json:"items"`
+	Reason string                   `json:"reason"`
+}
+
+// refundOrderRes is the result of the POST /orders/:id/refunds handler
+type refundOrderRes struct {
+	OrderID       string         `json:"id"`
+	Refund        storage.Refund `json:"refund"`
+	TotalCents    int64          `json:"totalCents"`
+	RefundedCents int64          `json:"refundedCents"`
+	NetCents      int64          `json:"netCents"`
+}
+
+// refundOrder is called by incoming HTTP POST requests to /orders/:id/refunds
+// and refunds part of an order without cancelling it
+func (i *instance) refundOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	// parse the body as JSON into the refundOrderArgs struct
+	var args refundOrderArgs
+	err := c.BindJSON(&args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error decoding body: %v", err)})
+		return
+	}
+
+	id := c.Param("id")
+
+	// the refund is recorded as pending before calling the charge service, which
+	// also checks that it isn't for more than what's left of the order even if
+	// other refunds are being made at the same time
+	// if this service crashes after this the refund stays pending and the
+	// recovery worker asks the charge service whether it went through
+	order, err := i.stor.AddRefund(ctx, id, storage.Refund{
+		AmountCents: args.AmountCents,
+		LineItems:   args.Items,
+		Reason:      args.Reason,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, storage.ErrInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for refunds"})
+		case errors.Is(err, storage.ErrOrderContended):
+			c.JSON(http.StatusConflict, gin.H{"error": "order is being changed by another request"})
+		case errors.Is(err, storage.ErrInvalidRefund):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error adding refund: %v", err)})
+		}
+		return
+	}
+	// AddRefund always adds the new refund last
+	idx := len(order.Refunds) - 1
+	refund := order.Refunds[idx]
+
+	refundArgs := chargeclient.ChargeArgs{
+		CardToken:      args.CardToken,
+		AmountCents:    refund.AmountCents,
+		OrderID:        order.ID,
+		IdempotencyKey: refundIdempotencyKey(order.ID, refund.ID),
+	}
+	res, err := i.charges.Refund(ctx, refundArgs)
+	i.recordPayment(ctx, order.ID, storage.PaymentKindRefund, refundArgs, res, err)
+	if err != nil {
+		// just like charging, if we don't know whether the refund went through we
+		// leave it pending for the recovery worker, otherwise, including when the
+		// circuit breaker is open, it definitely failed and stops counting against
+		// what's left of the order
+		if !errors.Is(err, chargeclient.ErrUnavailable) {
+			if rerr := i.stor.SetRefundStatus(ctx, order.ID, refund.ID, storage.RefundStatusFailed, ""); rerr != nil {
+				err = fmt.Errorf("%w (and error updating refund to failed: %v)", err, rerr)
+			}
+		}
+		c.JSON(chargeErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	err = i.stor.SetRefundStatus(ctx, order.ID, refund.ID, storage.RefundStatusSucceeded, res.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating refund to succeeded: %v", err)})
+		return
+	}
+	refund.Status = storage.RefundStatusSucceeded
+	refund.ChargeReference = res.ID
+	order.Refunds[idx] = refund
+
+	c.JSON(http.StatusCreated, refundOrderRes{
+		OrderID:       order.ID,
+		Refund:        refund,
+		TotalCents:    order.TotalCents(),
+		RefundedCents: order.RefundedCents(),
+		NetCents:      order.NetCents(),
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// authorizeOrderRes is the result of the POST /orders/:id/authorize handler
+type authorizeOrderRes struct {
+	AuthorizedCents int64 `json:"authorizedCents"`
+	// AuthorizationID is empty if discounts cover the whole order
+	AuthorizationID string    `json:"authorizationId"`
+	ExpiresAt       time.Time `json:"expiresAt"`
+}
+
+// authorizeOrder is called by incoming HTTP POST requests to
+// /orders/:id/authorize and places a hold on the customer's card for the
+// order's total that's captured later, usually when the order ships
+func (i *instance) authorizeOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	// authorizing takes the same body as charging
+	var args chargeOrderArgs
+	err := c.BindJSON(&args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error decoding body: %v", err)})
 		return
 	}
 
-	refundAmount := order.TotalCents() * -1
+	id := c.Param("id")
 
-	err = i.innerChargeOrder(ctx, chargeServiceChargeArgs{
-		CardToken:   args.CardToken,
-		AmountCents: refundAmount,
+	// this is a two-phase change just like charging
+	order, err := i.stor.TransitionOrderStatus(ctx, id, storage.PreviousStatuses(storage.OrderStatusAuthorizing), storage.OrderStatusAuthorizing, "authorization requested")
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, storage.ErrInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for authorization"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to authorizing: %v", err)})
+		}
+		return
+	}
+
+	// the expiration is based on when we asked for the authorization so we never
+	// think it lasts longer than the charge service does
+	auth := storage.Authorization{
+		AmountCents: order.TotalCents(),
+		ExpiresAt:   time.Now().Add(i.authorizationTTL),
+	}
+	// there's nothing to authorize if discounts cover the whole order
+	if order.TotalCents() > 0 {
+		authArgs := chargeclient.ChargeArgs{
+			CardToken:      args.CardToken,
+			AmountCents:    order.TotalCents(),
+			OrderID:        order.ID,
+			IdempotencyKey: chargeIdempotencyKey(order.ID, "authorize", order.PaymentAttempts+1),
+		}
+		res, err := i.charges.Authorize(ctx, authArgs)
+		i.recordPayment(ctx, order.ID, storage.PaymentKindAuthorization, authArgs, res, err)
+		if err != nil {
+			// just like charging, if we don't know whether the authorization went
+			// through we leave the order authorizing for the recovery worker,
+			// otherwise, including when the circuit breaker is open, we move it
+			// back to pending so it can be retried
+			if !errors.Is(err, chargeclient.ErrUnavailable) {
+				if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorizing}, storage.OrderStatusPending, "authorization failed: "+err.Error()); rerr != nil {
+					err = fmt.Errorf("%w (and error updating order to pending: %v)", err, rerr)
+				}
+			}
+			c.JSON(chargeErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		auth.ID = res.ID
+	}
+
+	err = i.stor.AuthorizeOrder(ctx, order.ID, auth)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to authorized: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, authorizeOrderRes{
+		AuthorizedCents: auth.AmountCents,
+		AuthorizationID: auth.ID,
+		ExpiresAt:       auth.ExpiresAt,
 	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// innerCaptureOrder charges the customer for the authorized order with the
+// given ID by capturing its authorization. This is a two-phase change just
+// like charging. It returns the order as it was before it was captured. If the
+// authorization expired then errAuthorizationExpired is returned, otherwise
+// the errors are from TransitionOrderStatus or the charge service.
+func (i *instance) innerCaptureOrder(ctx context.Context, id string) (storage.Order, error) {
+	order, err := i.stor.TransitionOrderStatus(ctx, id, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return storage.Order{}, err
+	}
+
+	// an expired authorization can't be captured anymore so the order goes back
+	// to authorized until the recovery worker moves it to pending
+	if order.Authorization != nil && order.Authorization.Expired(time.Now()) {
+		err = errAuthorizationExpired
+		if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, "authorization expired"); rerr != nil {
+			err = fmt.Errorf("%w (and error updating order to authorized: %v)", err, rerr)
+		}
+		return storage.Order{}, err
+	}
+
+	// orders with nothing to authorize don't have anything to capture either
+	if order.TotalCents() > 0 && order.Authorization != nil && order.Authorization.ID != "" {
+		captureArgs := chargeclient.ChargeArgs{
+			AmountCents:    order.TotalCents(),
+			OrderID:        order.ID,
+			IdempotencyKey: chargeIdempotencyKey(order.ID, "capture", order.PaymentAttempts+1),
+		}
+		res, err := i.charges.Capture(ctx, order.Authorization.ID, captureArgs)
+		i.recordPayment(ctx, order.ID, storage.PaymentKindCapture, captureArgs, res, err)
+		if err != nil {
+			// captures show up in the order's charges so the recovery worker can
+			// find out whether one went through just like a charge, and a capture
+			// that definitely failed, including when the circuit breaker is open,
+			// moves the order back to authorized
+			if !errors.Is(err, chargeclient.ErrUnavailable) {
+				if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, "capture failed: "+err.Error()); rerr != nil {
+					err = fmt.Errorf("%w (and error updating order to authorized: %v)", err, rerr)
+				}
+			}
+			return storage.Order{}, err
+		}
+	}
+
+	// the charge service already captured it so this shouldn't be mistaken for
+	// the order being ineligible
+	_, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusCharged, "capture succeeded")
+	if err != nil {
+		return storage.Order{}, fmt.Errorf("error updating order to charged: %v", err)
+	}
+	return order, nil
+}
+
+// captureOrderRes is the result of the POST /orders/:id/capture handler
+type captureOrderRes struct {
+	CapturedCents int64 `json:"capturedCents"`
+}
+
+// captureOrder is called by incoming HTTP POST requests to /orders/:id/capture
+// and charges the customer for an authorized order
+func (i *instance) captureOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	order, err := i.innerCaptureOrder(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, storage.ErrInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for capture"})
+		default:
+			c.JSON(paymentErrorStatus(err), gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	err = i.stor.SetOrderStatus(ctx, order.ID, storage.OrderStatusCancelled)
+	c.JSON(http.StatusOK, captureOrderRes{
+		CapturedCents: order.TotalCents(),
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// innerVoidOrder releases the hold on the customer's card for the authorized
+// order with the given ID and cancels the order. This is a two-phase change
+// just like charging. The errors are from TransitionOrderStatus or the charge
+// service.
+func (i *instance) innerVoidOrder(ctx context.Context, id string) error {
+	order, err := i.stor.TransitionOrderStatus(ctx, id, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to cancelled: %v", err)})
+		return err
+	}
+
+	// there's no hold to release if there was nothing to authorize or if it
+	// already expired
+	auth := order.Authorization
+	if auth != nil && auth.ID != "" && !auth.Expired(time.Now()) {
+		voidArgs := chargeclient.ChargeArgs{
+			AmountCents:    auth.AmountCents,
+			OrderID:        order.ID,
+			IdempotencyKey: voidIdempotencyKey(order.ID, auth.ID),
+		}
+		res, err := i.charges.Void(ctx, auth.ID, voidArgs)
+		i.recordPayment(ctx, order.ID, storage.PaymentKindVoid, voidArgs, res, err)
+		if err != nil {
+			// if we don't know whether the void went through we leave the order
+			// voiding for the recovery worker, otherwise, including when the circuit breaker is
+			// open, the order is still authorized and the void can be retried
+			if !errors.Is(err, chargeclient.ErrUnavailable) {
+				if _, rerr := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusAuthorized, "void failed: "+err.Error()); rerr != nil {
+					err = fmt.Errorf("%w (and error updating order to authorized: %v)", err, rerr)
+				}
+			}
+			return err
+		}
+	}
+
+	_, err = i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "void succeeded")
+	if err != nil {
+		return fmt.Errorf("error updating order to cancelled: %v", err)
+	}
+	return nil
+}
+
+// voidOrderRes is the result of the POST /orders/:id/void handler
+type voidOrderRes struct {
+	OrderID string `json:"id"`
+}
+
+// voidOrder is called by incoming HTTP POST requests to /orders/:id/void and
+// cancels an authorized order by releasing the hold on the customer's card
+func (i *instance) voidOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	err := i.innerVoidOrder(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrOrderNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, storage.ErrInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "order ineligible for voiding"})
+		default:
+			c.JSON(paymentErrorStatus(err), gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	// since we successfully charged the order and updated the order status we can
-	// return a success to the caller
-	c.JSON(http.StatusOK, cancelOrderRes{
-		RefundAmount: order.TotalCents(),
-		OrderID:      order.ID,
+	c.JSON(http.StatusOK, voidOrderRes{
+		OrderID: id,
 	})
 }
 
@@ -428,19 +1190,150 @@ type fulfillmentServiceFulfillArgs struct {
 	Description string `json:"description"`
 	Quantity    int64  `json:"quantity"`
 	OrderID     string `json:"id"`
+	// LineItemID lets the fulfillment service tell apart line items with the
+	// same description
+	LineItemID string `json:"lineItemId"`
+}
+
+// maxConcurrentFulfillments limits how many requests we make to the
+// fulfillment service at once for a single order so a big order doesn't
+// overwhelm it
+const maxConcurrentFulfillments = 4
+
+// innerFulfillLineItem asks the fulfillment service to fulfill a single line
+// item by making a PUT request to it
+// the fulfillment service ignores line items it's already fulfilled for the
+// order so this is safe to call again if a previous attempt partially failed
+func (i *instance) innerFulfillLineItem(ctx context.Context, args fulfillmentServiceFulfillArgs) error {
+	byts, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("error encoding fulfill body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, i.fulfillmentURL+"/fulfill", bytes.NewReader(byts))
+	if err != nil {
+		return fmt.Errorf("error creating fulfill request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := i.fulfillmentService.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making fulfill request: %w", err)
+	}
+	// we need to make sure we close the body otherwise this will leak memory
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// we opportunistically try to read the body in case it contains an error
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error fulfilling line item: %d %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// fulfillLineItemRes is the result of fulfilling a single line item
+type fulfillLineItemRes struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// Quantity is how many were fulfilled by this request
+	Quantity  int64  `json:"quantity"`
+	Fulfilled bool   `json:"fulfilled"`
+	Error     string `json:"error,omitempty"`
+}
+
+// innerFulfillOrder fulfills the given quantity of each line item on the order
+// at the same time, although at most maxConcurrentFulfillments at once, and
+// returns the result of each one
+func (i *instance) innerFulfillOrder(ctx context.Context, order storage.Order, quantities map[string]int64) []fulfillLineItemRes {
+	// initialized as an empty slice so it's encoded as [] instead of null
+	results := []fulfillLineItemRes{}
+	for _, li := range order.LineItems {
+		if q, ok := quantities[li.ID]; ok {
+			results = append(results, fulfillLineItemRes{
+				ID:          li.ID,
+				Description: li.Description,
+				Quantity:    q,
+			})
+		}
+	}
+
+	// sem is a semaphore that holds a value for every request in progress so
+	// sending blocks once there are too many
+	sem := make(chan struct{}, maxConcurrentFulfillments)
+	var wg sync.WaitGroup
+	for idx := range results {
+		wg.Add(1)
+		sem <- struct{}{}
+		// each goroutine only writes to its own element so they don't need a lock
+		go func(res *fulfillLineItemRes) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := i.innerFulfillLineItem(ctx, fulfillmentServiceFulfillArgs{
+				Description: res.Description,
+				Quantity:    res.Quantity,
+				OrderID:     order.ID,
+				LineItemID:  res.ID,
+			})
+			if err != nil {
+				res.Error = err.Error()
+				return
+			}
+			res.Fulfilled = true
+		}(&results[idx])
+	}
+	wg.Wait()
+	return results
+}
+
+// fulfillmentRecordTimeout bounds how long recording what the fulfillment
+// service did can take once the caller has gone away
+const fulfillmentRecordTimeout = 5 * time.Second
+
+// releaseLineItem releases the reservation of the line item the fulfillment
+// service failed to fulfill so it can be fulfilled again, which also adds the
+// failure to the order's event log so support can see why it hasn't shipped.
+// The request is failing anyway so failing to release it is only logged,
+// although the line item then stays reserved until support releases it.
+func (i *instance) releaseLineItem(ctx context.Context, orderID string, item fulfillLineItemRes) {
+	_, err := i.stor.ReleaseLineItems(ctx, orderID, map[string]int64{item.ID: item.Quantity}, item.Error)
+	if err != nil {
+		llog.Error("failed to release line item", llog.KV{"id": orderID, "lineItemId": item.ID}, llog.ErrKV(err))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fulfillOrderItemArgs is how many of a line item to fulfill
+type fulfillOrderItemArgs struct {
+	ID       string `json:"id"`
+	Quantity int64  `json:"quantity"`
 }
 
-type fulfillmentServiceFulfillRes struct {
+// fulfillOrderArgs is the expected body for the PUT /fulfill handler
+type fulfillOrderArgs struct {
+	OrderID string `json:"id"`
+	// Items limits the fulfillment to some of the line items, like when only
+	// some of them fit in a box. If it's empty then everything that's left is
+	// fulfilled.
+	Items []fulfillOrderItemArgs `json:"items"`
+}
+
+// fulfillOrderRes is the result of the PUT /fulfill handler
+type fulfillOrderRes struct {
 	OrderID string              `json:"id"`
 	Status  storage.OrderStatus `json:"status"`
+	// Items holds the result of fulfilling each line item and is empty if the
+	// order was already fulfilled
+	Items []fulfillLineItemRes `json:"items"`
+	Error string               `json:"error,omitempty"`
 }
 
-// TODO: fulfill args, res, function
+// fulfillOrder is called by incoming HTTP PUT requests to /fulfill. It reserves
+// the requested line items on the order, asks the fulfillment service to
+// fulfill them and then records which ones it did.
 func (i *instance) fulfillOrder(c *gin.Context) {
 	ctx := c.Request.Context()
 
-	// parse the body as JSON into the chargeOrderArgs struct
-	var args fulfillmentServiceFulfillArgs
+	// parse the body as JSON into the fulfillOrderArgs struct
+	var args fulfillOrderArgs
 	err := c.BindJSON(&args)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error decoding body: %v", err)})
@@ -457,26 +1350,119 @@ func (i *instance) fulfillOrder(c *gin.Context) {
 		return
 	}
 
-	if order.Status != storage.OrderStatusCharged && order.Status != storage.OrderStatusFulfilled {
-		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Order cannot be fulfilled since the status is elibigle for fulfillment processing: %v", err)})
+	// this is idempotent so an order that's already fulfilled is a success
+	if order.Status == storage.OrderStatusFulfilled {
+		c.JSON(http.StatusOK, fulfillOrderRes{
+			OrderID: order.ID,
+			Status:  storage.OrderStatusFulfilled,
+			Items:   []fulfillLineItemRes{},
+		})
 		return
 	}
 
-	// makes sure we ignore statuses that have been fulfilled
-	if order.Status != storage.OrderStatusFulfilled {
+	quantities := map[string]int64{}
+	if len(args.Items) == 0 {
+		// what's reserved is already being fulfilled by another request
+		var reserved bool
+		for _, li := range order.LineItems {
+			if q := li.AvailableQuantity(); q > 0 {
+				quantities[li.ID] = q
+			}
+			if li.ReservedQuantity > 0 {
+				reserved = true
+			}
+		}
+		if len(quantities) == 0 && reserved {
+			c.JSON(http.StatusConflict, gin.H{"error": "order is already being fulfilled"})
+			return
+		}
+	} else {
+		for _, item := range args.Items {
+			quantities[item.ID] += item.Quantity
+		}
+	}
 
-		err = i.stor.SetOrderStatus(ctx, args.OrderID, storage.OrderStatusFulfilled)
+	// check that the fulfillment is valid before we call the fulfillment service
+	// authorized orders are checked as if they were already captured so we don't
+	// capture an order we then can't fulfill
+	check := order
+	if check.Status == storage.OrderStatusAuthorized {
+		check.Status = storage.OrderStatusCharged
+	}
+	if _, err := check.WithReserved(quantities); err != nil {
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order cannot be fulfilled since its status is %v", order.Status)})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order to fulfilled: %v", err)})
+	// we only ship orders we've been paid for so authorized orders are captured
+	// first
+	if order.Status == storage.OrderStatusAuthorized {
+		if _, err := i.innerCaptureOrder(ctx, order.ID); err != nil {
+			c.JSON(paymentErrorStatus(err), gin.H{"error": fmt.Sprintf("error capturing order: %v", err)})
 			return
 		}
+	}
+
+	// the line items are reserved before calling the fulfillment service so if
+	// multiple requests try to fulfill the same line items at once only one of
+	// them ships them and the rest get an ErrInvalidFulfillment
+	// the order could've changed since we got it above, like if it was
+	// cancelled, so this checks everything again
+	// if this service crashes before the reservation is fulfilled or released
+	// the line items stay reserved so they're never shipped twice
+	order, err = i.stor.ReserveLineItems(ctx, order.ID, quantities)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidTransition), errors.Is(err, storage.ErrInvalidFulfillment), errors.Is(err, storage.ErrOrderContended):
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is no longer eligible for fulfillment: %v", err)})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error reserving line items: %v", err)})
+		}
+		return
+	}
 
+	items := i.innerFulfillOrder(ctx, order, quantities)
+
+	// what the fulfillment service did has to be recorded even if the caller
+	// went away in the meantime, otherwise the line items would stay reserved
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fulfillmentRecordTimeout)
+	defer cancel()
+	// only the line items the fulfillment service actually fulfilled are
+	// recorded, the rest are released so they can be retried
+	fulfilled := map[string]int64{}
+	for _, item := range items {
+		if item.Fulfilled {
+			fulfilled[item.ID] = item.Quantity
+		} else {
+			i.releaseLineItem(recordCtx, order.ID, item)
+		}
+	}
+	if len(fulfilled) > 0 {
+		// the line items were shipped so they stay reserved if this fails rather
+		// than risk shipping them again
+		order, err = i.stor.FulfillLineItems(recordCtx, order.ID, fulfilled)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error updating order fulfillment: %v", err)})
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, fulfillmentServiceFulfillRes{
+	if len(fulfilled) < len(items) {
+		c.JSON(http.StatusBadGateway, fulfillOrderRes{
+			OrderID: order.ID,
+			Status:  order.Status,
+			Items:   items,
+			Error:   "error fulfilling line items",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, fulfillOrderRes{
 		OrderID: order.ID,
-		Status:  storage.OrderStatusFulfilled,
+		Status:  order.Status,
+		Items:   items,
 	})
-
 }
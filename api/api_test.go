@@ -5,18 +5,23 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/order-up/chargeclient"
 	"github.com/levenlabs/order-up/mocks"
 	"github.com/levenlabs/order-up/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,12 +32,31 @@ func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// newChargeClient wraps a mocked charge service in a charge client that doesn't
+// wait long between retries so the tests stay fast
+func newChargeClient(chgServ *http.Client) *chargeclient.Client {
+	return chargeclient.New(chgServ, chargeclient.Config{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	})
+}
+
+// paymentWithOutcome matches any storage.Payment of the given kind with the
+// given outcome, for when the rest of the payment isn't what's being tested
+func paymentWithOutcome(kind storage.PaymentKind, outcome storage.PaymentOutcome) interface{} {
+	return mock.MatchedBy(func(p storage.Payment) bool {
+		return p.Kind == kind && p.Outcome == outcome
+	})
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func TestGetOrders(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
-	ctx := context.Background()
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	// the page requested when the request doesn't have any paging parameters
+	defaultPage := storage.OrderPage{Limit: defaultOrdersLimit, Sort: storage.OrderSortCreatedAt}
 
 	// these braces form a new scope so we don't end up polluting the top-level
 	// function with our recorder, request, etc
@@ -46,7 +70,7 @@ func TestGetOrders(t *testing.T) {
 		// On queues up a new expected call with the provided arguments and returns
 		// the values sent to Return
 		// we also only expect this call to only happen Once
-		stor.On("GetOrders", ctx, storage.OrderStatus(-1)).Return([]storage.Order{}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, defaultPage).Return([]storage.Order{}, "", nil).Once()
 		// we know that this call doesn't make any external calls so we can just pass
 		// nil to simplify this code
 		h := Handler(stor, nil, nil)
@@ -86,7 +110,7 @@ func TestGetOrders(t *testing.T) {
 	// should return all orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatus(-1)).Return([]storage.Order{order1, order2}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, defaultPage).Return([]storage.Order{order1, order2}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
@@ -107,7 +131,7 @@ func TestGetOrders(t *testing.T) {
 	// should return charged orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatusCharged).Return([]storage.Order{order1}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharged}}, defaultPage).Return([]storage.Order{order1}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders?status=charged", nil).WithContext(ctx)
@@ -127,7 +151,7 @@ func TestGetOrders(t *testing.T) {
 	// should return pending orders
 	{
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrders", ctx, storage.OrderStatusPending).Return([]storage.Order{}, nil).Once()
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusPending}}, defaultPage).Return([]storage.Order{}, "", nil).Once()
 		h := Handler(stor, nil, nil)
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("GET", "/orders?status=pending", nil).WithContext(ctx)
@@ -152,6 +176,121 @@ func TestGetOrders(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 		stor.AssertExpectations(t)
 	}
+
+	// should pass the paging parameters along and return the next cursor
+	{
+		page := storage.OrderPage{Limit: 2, Cursor: "abc", Sort: storage.OrderSortTotal, Descending: true}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{Statuses: []storage.OrderStatus{storage.OrderStatusCharged}}, page).Return([]storage.Order{order1, order2}, "def", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?status=charged&limit=2&cursor=abc&sort=-total", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrdersRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Len(t, res.Orders, 2)
+			assert.Equal(t, "def", res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should return 400 for a cursor that storage doesn't accept
+	{
+		page := defaultPage
+		page.Cursor = "bad"
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, storage.OrderQuery{}, page).Return(nil, "", storage.ErrInvalidCursor).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?cursor=bad", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should pass every filter along
+	{
+		created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		updated := time.Date(2022, 2, 1, 12, 30, 0, 0, time.UTC)
+		min, max := int64(0), int64(5000)
+		query := storage.OrderQuery{
+			Statuses:      []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusCharged, storage.OrderStatusRefunding},
+			CustomerEmail: "martin+1@email.com",
+			CreatedSince:  created,
+			CreatedBefore: created.Add(24 * time.Hour),
+			UpdatedSince:  updated,
+			MinTotalCents: &min,
+			MaxTotalCents: &max,
+			Description:   "red shirt",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrders", ctx, query, defaultPage).Return([]storage.Order{order1}, "", nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		q := url.Values{}
+		q.Add("status", "pending,charged")
+		q.Add("status", "refunding")
+		q.Set("email", "martin+1@email.com")
+		q.Set("createdSince", "2022-01-01T00:00:00Z")
+		q.Set("createdBefore", "2022-01-02T00:00:00Z")
+		q.Set("updatedSince", "2022-02-01T13:30:00+01:00")
+		q.Set("minTotal", "0")
+		q.Set("maxTotal", "5000")
+		q.Set("description", "red shirt")
+		r := httptest.NewRequest("GET", "/orders?"+q.Encode(), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		stor.AssertExpectations(t)
+	}
+
+	// should list every invalid parameter at once
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		query := "status=pending,shipped&createdSince=yesterday&updatedSince=2022-01-02T00:00:00Z&updatedBefore=2022-01-01T00:00:00Z&minTotal=1.50&maxTotal=10&limit=0&sort=email"
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code) {
+			var res invalidParamsRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			var params []string
+			for _, p := range res.Params {
+				params = append(params, p.Param)
+				assert.NotEmpty(t, p.Error, p.Param)
+			}
+			assert.Equal(t, []string{"status", "createdSince", "minTotal", "updatedBefore", "limit", "sort"}, params)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should error on ranges that can't match anything
+	for _, query := range []string{
+		"createdSince=2022-01-01T00:00:00Z&createdBefore=2022-01-01T00:00:00Z",
+		"updatedSince=2022-01-02T00:00:00Z&updatedBefore=2022-01-01T00:00:00Z",
+		"minTotal=10&maxTotal=9",
+	} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		stor.AssertExpectations(t)
+	}
+
+	// should error on invalid limits and sorts
+	for _, query := range []string{"limit=0", "limit=abc", fmt.Sprintf("limit=%d", storage.MaxOrdersLimit+1), "sort=email", "sort=-", "sort=--total"} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		stor.AssertExpectations(t)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -159,7 +298,7 @@ func TestGetOrders(t *testing.T) {
 func TestGetOrder(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
-	ctx := context.Background()
+	ctx := storage.WithActor(context.Background(), defaultActor)
 
 	// these braces form a new scope so we don't end up polluting the top-level
 	// function with our recorder, request, etc
@@ -223,10 +362,164 @@ func TestGetOrder(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+func TestGetOrderTransitions(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	// should return 404 on not found
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, "notfound").Return(storage.Order{}, storage.ErrOrderNotFound).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/notfound/transitions", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should list the next statuses and actions for a charged order
+	{
+		order := storage.Order{
+			ID:     "test1",
+			Status: storage.OrderStatusCharged,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path.Join("/orders", order.ID, "transitions"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrderTransitionsRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, order.ID, res.OrderID)
+			assert.Equal(t, "charged", res.Status)
+			assert.ElementsMatch(t, []string{"fulfilled", "partiallyFulfilled", "refunding"}, res.NextStatuses)
+			assert.ElementsMatch(t, []string{"fulfill", "cancel"}, res.Actions)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// authorized orders can be captured, voided, fulfilled, which captures them
+	// first, or cancelled, which voids them
+	{
+		order := storage.Order{
+			ID:     "test1",
+			Status: storage.OrderStatusAuthorized,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path.Join("/orders", order.ID, "transitions"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrderTransitionsRes
+			err := json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"capturing", "voiding", "pending"}, res.NextStatuses)
+			assert.ElementsMatch(t, []string{"capture", "void", "fulfill", "cancel"}, res.Actions)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should return empty lists for a final status
+	{
+		order := storage.Order{
+			ID:     "test1",
+			Status: storage.OrderStatusCancelled,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path.Join("/orders", order.ID, "transitions"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.JSONEq(t, `{"id":"test1","status":"cancelled","nextStatuses":[],"actions":[]}`, w.Body.String())
+		}
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestGetOrderEvents(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	// should return 404 if the order has no events and doesn't exist
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrderEvents", ctx, "notfound", "", defaultOrderEventsLimit).Return(nil, nil).Once()
+		stor.On("GetOrder", ctx, "notfound").Return(storage.Order{}, storage.ErrOrderNotFound).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/notfound/events", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should return a cursor for the next page if the page is full
+	{
+		events := []storage.OrderEvent{
+			{ID: "ev-1", OrderID: "test1", Type: storage.OrderEventCreated},
+			{ID: "ev-2", OrderID: "test1", Type: storage.OrderEventStatusChanged},
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrderEvents", ctx, "test1", "", 2).Return(events, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test1/events?limit=2", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrderEventsRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, events, res.Events)
+			assert.Equal(t, "ev-2", res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should pass the cursor along and not return one after the last page
+	{
+		events := []storage.OrderEvent{
+			{ID: "ev-3", OrderID: "test1", Type: storage.OrderEventPaymentRecorded},
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrderEvents", ctx, "test1", "ev-2", 2).Return(events, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test1/events?limit=2&cursor=ev-2", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getOrderEventsRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, events, res.Events)
+			assert.Empty(t, res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should reject invalid limits
+	for _, limit := range []string{"0", "-1", "abc", fmt.Sprint(storage.MaxOrderEventsLimit + 1)} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/test1/events?limit="+limit, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, limit)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 func TestPostOrders(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
-	ctx := context.Background()
+	ctx := storage.WithActor(context.Background(), defaultActor)
 
 	// these braces form a new scope so we don't end up polluting the top-level
 	// function with our recorder, request, etc
@@ -239,6 +532,8 @@ func TestPostOrders(t *testing.T) {
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
+					// the line item IDs are filled in by the handler
+					ID:          "li-1",
 					Description: "item 1",
 					Quantity:    1,
 					PriceCents:  1000,
@@ -248,7 +543,13 @@ func TestPostOrders(t *testing.T) {
 		}
 		args := postOrderArgs{
 			CustomerEmail: expOrder.CustomerEmail,
-			LineItems:     expOrder.LineItems,
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  1000,
+				},
+			},
 		}
 		// make a pointer to a mocks.MockStorageInstance struct which is necessary
 		// for mocking the storage package
@@ -316,6 +617,34 @@ func TestPostOrders(t *testing.T) {
 		stor.AssertExpectations(t)
 	}
 
+	// should error on duplicate line item IDs
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(postOrderArgs{
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-2",
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  1000,
+				},
+				{
+					Description: "item 2",
+					Quantity:    1,
+					PriceCents:  1000,
+				},
+			},
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		stor.AssertExpectations(t)
+	}
+
 	// should error on no line items
 	{
 		stor := new(mocks.MockStorageInstance)
@@ -364,7 +693,7 @@ func TestPostOrders(t *testing.T) {
 func TestChargeOrder(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
-	ctx := context.Background()
+	ctx := storage.WithActor(context.Background(), defaultActor)
 
 	var chgServCalled int64
 	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -373,19 +702,22 @@ func TestChargeOrder(t *testing.T) {
 		require.Equal(t, "/charge", r.URL.Path)
 		require.Equal(t, http.MethodPost, r.Method)
 
-		// decode the body as a chargeServiceChargeArgs
-		var args chargeServiceChargeArgs
+		// decode the body as a chargeclient.ChargeArgs
+		var args chargeclient.ChargeArgs
 		err := json.NewDecoder(r.Body).Decode(&args)
 		require.NoError(t, err)
 
 		// make sure the args are sane
 		require.True(t, args.AmountCents > 0, "amountCents must be more than 0: %v", args.AmountCents)
 		require.NotEmpty(t, args.CardToken)
+		require.NotEmpty(t, args.IdempotencyKey)
+		require.Equal(t, args.IdempotencyKey, r.Header.Get("Idempotency-Key"))
 
 		// increment calls so we can test to make sure the charge service was ever
 		// called and that it was only called an expected number of times
 		atomic.AddInt64(&chgServCalled, 1)
 		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"ch_1"}`))
 	}))
 
 	// these braces form a new scope so we don't end up polluting the top-level
@@ -413,14 +745,22 @@ func TestChargeOrder(t *testing.T) {
 		// make a pointer to a mocks.MockStorageInstance struct which is necessary
 		// for mocking the storage package
 		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, storage.Payment{
+			Kind:            storage.PaymentKindCharge,
+			AmountCents:     100,
+			IdempotencyKey:  "test:charge:1",
+			CardFingerprint: cardFingerprint("amex"),
+			Outcome:         storage.PaymentOutcomeSucceeded,
+			ChargeReference: "ch_1",
+		}).Return(nil).Once()
 		// On queues up a new expected call with the provided arguments and returns
 		// the values sent to Return
 		// we also only expect this call to only happen Once
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded").Return(order, nil).Once()
 		// no need to pass along a fulfillment service since we know we're only
 		// calling storage and charge service
-		h := Handler(stor, nil, chgServ)
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		// httptest is a package to help with testing http servers
 		// NewRecorder returns an http.ResponseWriter that allows us to record the
 		// status and body set by the caller
@@ -477,8 +817,8 @@ func TestChargeOrder(t *testing.T) {
 			CardToken: "amex",
 		}
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		h := Handler(stor, nil, chgServ)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
@@ -508,8 +848,8 @@ func TestChargeOrder(t *testing.T) {
 			CardToken: "amex",
 		}
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		h := Handler(stor, nil, chgServ)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
@@ -544,9 +884,9 @@ func TestChargeOrder(t *testing.T) {
 			CardToken: "amex",
 		}
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Once()
-		h := Handler(stor, nil, chgServ)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
@@ -563,7 +903,7 @@ func TestChargeOrder(t *testing.T) {
 		stor.AssertExpectations(t)
 	}
 
-	// should not have more than 1 outstanding charge service request
+	// should only charge once if the same order is charged concurrently
 	{
 		chgServCalled = 0
 		order := storage.Order{
@@ -582,50 +922,25 @@ func TestChargeOrder(t *testing.T) {
 			CardToken: "amex",
 		}
 
-		// we make a new chgServ mock that tracks the concurrency using the atomic
-		// package
-		var concurrent int64
-		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			require.Equal(t, "/charge", r.URL.Path)
-			require.Equal(t, http.MethodPost, r.Method)
-
-			// ensure that only 1 call is happening concurrently by adding 1 to concurrent
-			// and checking to ensure it was 0 and is now 1
-			// the atomic package allows us to avoid locking and its a little simpler to
-			// work with in this situation
-			running := atomic.AddInt64(&concurrent, 1)
-			// defer decrementing the concurrent when this function is done running
-			defer atomic.AddInt64(&concurrent, -1)
-			require.EqualValues(t, 1, running, "detected more than 1 /charge happening concurrently")
-
-			// goroutines do not start immediately and we can't control how go schedules
-			// them so this sleep gives us a chance to try and see if another goroutine
-			// ends up calling this while we're sleeping to try and detect concurrency
-			// this isn't perfect but should be sufficient enough for this project
-			time.Sleep(time.Second)
-
-			// increment calls so we can test to make sure the charge service was ever
-			// called and that it was only called an expected number of times
-			atomic.AddInt64(&chgServCalled, 1)
-			w.WriteHeader(http.StatusCreated)
-		}))
-
 		times := 5
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Times(times)
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCharged).Return(nil).Times(times)
-		h := Handler(stor, nil, chgServ)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		// only the first transition out of pending succeeds and the rest see that
+		// the order was already claimed, just like the database would do
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(storage.Order{}, storage.ErrInvalidTransition).Times(times - 1)
+		h := Handler(stor, nil, newChargeClient(chgServ))
 
 		// sync.WaitGroup is a handy tool for waiting until a bunch of goroutines
 		// return
 		// whenever you spawn a new goroutine you increment and whenever a goroutine
 		// finishes you call done
 		var wg sync.WaitGroup
+		var succeeded, conflicted int64
 		for i := 0; i < times; i++ {
 			wg.Add(1)
 			// each of these goroutines will make the same charge call
-			// it's not important that they're all charging the same order for the
-			// purposes of testing concurrency
 			go func() {
 				defer wg.Done()
 				w := httptest.NewRecorder()
@@ -633,45 +948,29 @@ func TestChargeOrder(t *testing.T) {
 				require.NoError(t, err)
 				r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
 				h.ServeHTTP(w, r)
-				assert.Equal(t, http.StatusOK, w.Code)
+				switch w.Code {
+				case http.StatusOK:
+					atomic.AddInt64(&succeeded, 1)
+				case http.StatusConflict:
+					atomic.AddInt64(&conflicted, 1)
+				default:
+					t.Errorf("unexpected status code: %d", w.Code)
+				}
 			}()
 		}
 
 		// wait until all of the goroutines are done
 		wg.Wait()
-		assert.EqualValues(t, times, chgServCalled)
+		assert.EqualValues(t, 1, succeeded)
+		assert.EqualValues(t, times-1, conflicted)
+		assert.EqualValues(t, 1, chgServCalled)
 		stor.AssertExpectations(t)
 	}
-}
-
-////////////////////////////////////////////////////////////////////////////////
-
-func TestPostCancelOrder(t *testing.T) {
-	// TODO: add tests
-	ctx := context.Background()
-
-	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// make sure the URL is /charge and the method is POST since that's the only
-		// endpoint the charge service has
-		require.Equal(t, "/charge", r.URL.Path)
-		require.Equal(t, http.MethodPost, r.Method)
-
-		// decode the body as a chargeServiceChargeArgs
-		var args chargeServiceChargeArgs
-		err := json.NewDecoder(r.Body).Decode(&args)
-		require.NoError(t, err)
 
-		// make sure the args are sane
-		//require.True(t, args.AmountCents > 0, "amountCents must be more than 0: %v", args.AmountCents)
-		require.NotEmpty(t, args.CardToken)
-
-		w.WriteHeader(http.StatusCreated)
-	}))
-
-	// Customer with order-1234 has an eligible order for refund. Should refund the total amount of 100
+	// should put the order back to pending if charging fails
 	{
 		order := storage.Order{
-			ID:            "order-1234",
+			ID:            "test",
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
@@ -680,35 +979,30 @@ func TestPostCancelOrder(t *testing.T) {
 					PriceCents:  100,
 				},
 			},
-			Status: storage.OrderStatusCharged,
-		}
-		args := chargeOrderArgs{
-			CardToken: "amex",
+			Status: storage.OrderStatusPending,
 		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "card declined", http.StatusPaymentRequired)
+		}))
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusCancelled).Return(nil).Once()
-		h := Handler(stor, nil, chgServ)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		w := httptest.NewRecorder()
-		byts, err := json.Marshal(args)
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
 		require.NoError(t, err)
-		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
 		h.ServeHTTP(w, r)
-		if assert.Equal(t, http.StatusOK, w.Code) {
-			assert.Contains(t, w.HeaderMap.Get("Content-Type"), "application/json")
-			var res cancelOrderRes
-			err = json.Unmarshal(w.Body.Bytes(), &res)
-			require.NoError(t, err)
-			assert.EqualValues(t, 100, res.RefundAmount)
-			assert.EqualValues(t, "order-1234", res.OrderID)
-		}
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
 		stor.AssertExpectations(t)
 	}
 
-	// Customer with order-12345 does not have an eligible order for refund since the order has been fulfilled. Message should be returned saying a refund was unable to be made
+	// should leave the order charging if the charge service is unavailable since
+	// the charge might have gone through
 	{
 		order := storage.Order{
-			ID:            "order-1234",
+			ID:            "test",
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
@@ -717,23 +1011,926 @@ func TestPostCancelOrder(t *testing.T) {
 					PriceCents:  100,
 				},
 			},
-			Status: storage.OrderStatusFulfilled,
-		}
-		args := chargeOrderArgs{
-			CardToken: "amex",
+			Status: storage.OrderStatusPending,
 		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
 		stor := new(mocks.MockStorageInstance)
-		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		h := Handler(stor, nil, chgServ)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeUnknown)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should move the order back to pending right away if the circuit breaker is
+	// open since the charge was never sent
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		charges := chargeclient.New(chgServ, chargeclient.Config{MaxAttempts: 1, BreakerThreshold: 1})
+		// the first failure opens the breaker
+		_, err := charges.Charge(ctx, chargeclient.ChargeArgs{AmountCents: 100, OrderID: "other", IdempotencyKey: "other:charge:1"})
+		require.True(t, errors.Is(err, chargeclient.ErrUnavailable), "%v", err)
+
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, charges)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// should retry charge service errors with the same idempotency key
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:          storage.OrderStatusPending,
+			PaymentAttempts: 2,
+		}
+		var keys []string
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			if len(keys) < 3 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		// this is the order's third attempt since it already had 2
+		assert.Equal(t, []string{"test:charge:3", "test:charge:3", "test:charge:3"}, keys)
+		stor.AssertExpectations(t)
+	}
+
+	// should not retry errors that would fail the same way again
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			http.Error(w, "card declined", http.StatusPaymentRequired)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// should still charge the order if the payment can't be recorded since the
+	// charge already went through
+	{
+		order := storage.Order{
+			ID:            "test",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCharge, storage.PaymentOutcomeSucceeded)).Return(assert.AnError).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "charge"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostCancelOrder(t *testing.T) {
+	// TODO: add tests
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// make sure the URL is /charge and the method is POST since that's the only
+		// endpoint the charge service has
+		require.Equal(t, "/charge", r.URL.Path)
+		require.Equal(t, http.MethodPost, r.Method)
+
+		// decode the body as a chargeclient.ChargeArgs
+		var args chargeclient.ChargeArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		require.NoError(t, err)
+
+		// make sure the args are sane
+		//require.True(t, args.AmountCents > 0, "amountCents must be more than 0: %v", args.AmountCents)
+		require.NotEmpty(t, args.CardToken)
+		require.Equal(t, args.IdempotencyKey, r.Header.Get("Idempotency-Key"))
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	// Customer with order-1234 has an eligible order for refund. Should refund the total amount of 100
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "cancellation requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "refund succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
 		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
 		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Contains(t, w.HeaderMap.Get("Content-Type"), "application/json")
+			var res cancelOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 100, res.RefundAmount)
+			assert.EqualValues(t, "order-1234", res.OrderID)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// Customer with order-12345 does not have an eligible order for refund since the order has been fulfilled. Message should be returned saying a refund was unable to be made
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusFulfilled,
+		}
+		args := chargeOrderArgs{
+			CardToken: "amex",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// a pending order is cancelled without a refund
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusPending,
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCancelled, "cancelled").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 0, res.RefundAmount)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// a declined refund moves the order back to charged
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "declined", http.StatusPaymentRequired)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "cancellation requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCharged, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an unavailable charge service leaves the order refunding since the refund
+	// might have gone through
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeUnknown)).Return(nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "cancellation requested").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// only what's left after partial refunds is refunded
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+			Refunds: []storage.Refund{
+				{ID: "rf-1", AmountCents: 30, Status: storage.RefundStatusSucceeded},
+				{ID: "rf-2", AmountCents: 50, Status: storage.RefundStatusFailed},
+			},
+		}
+		var refunded int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var args chargeclient.ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			atomic.StoreInt64(&refunded, args.AmountCents)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "cancellation requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "refund succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res cancelOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 70, res.RefundAmount)
+			// refunds are sent as negative charges
+			assert.EqualValues(t, -70, atomic.LoadInt64(&refunded))
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// an order with a pending refund can't be cancelled until the refund finishes
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+			Refunds: []storage.Refund{
+				{ID: "rf-1", AmountCents: 30, Status: storage.RefundStatusPending},
+			},
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "cancellation requested").Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCharged, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an authorized order is cancelled by voiding its authorization instead of
+	// refunding it
+	{
+		order := storage.Order{
+			ID:            "order-1234",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:        storage.OrderStatusAuthorized,
+			Authorization: &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			require.Equal(t, "/authorizations/auth_1/void", r.URL.Path)
+			w.WriteHeader(http.StatusOK)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindVoid, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "void succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(chargeOrderArgs{CardToken: "amex"})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "cancel"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.JSONEq(t, `{"id":"order-1234","refundAmount":0}`, w.Body.String())
+		}
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostRefundOrder(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	order := storage.Order{
+		ID:            "order-1234",
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				ID:          "li-1",
+				Description: "item 1",
+				Quantity:    2,
+				PriceCents:  100,
+			},
+		},
+		Status: storage.OrderStatusFulfilled,
+	}
+	// withRefund returns the order as AddRefund would after adding refund
+	withRefund := func(refund storage.Refund) storage.Order {
+		updated, err := order.WithRefund(refund)
+		require.NoError(t, err)
+		return updated
+	}
+
+	// should record the refund, refund it through the charge service and mark it
+	// as succeeded
+	{
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			var args chargeclient.ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			require.EqualValues(t, -100, args.AmountCents)
+			require.Equal(t, "amex", args.CardToken)
+			require.Equal(t, "order-1234:refund:rf-1", args.IdempotencyKey)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"ch_1"}`))
+		}))
+		refund := storage.Refund{
+			LineItems: []storage.RefundLineItem{{ID: "li-1", Quantity: 1}},
+			Reason:    "damaged",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("AddRefund", ctx, order.ID, refund).Return(withRefund(refund), nil).Once()
+		stor.On("SetRefundStatus", ctx, order.ID, "rf-1", storage.RefundStatusSucceeded, "ch_1").Return(nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(refundOrderArgs{
+			CardToken: "amex",
+			Items:     refund.LineItems,
+			Reason:    refund.Reason,
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "refunds"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res refundOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.Equal(t, order.ID, res.OrderID)
+			assert.Equal(t, "rf-1", res.Refund.ID)
+			assert.EqualValues(t, 100, res.Refund.AmountCents)
+			assert.Equal(t, storage.RefundStatusSucceeded, res.Refund.Status)
+			assert.Equal(t, "ch_1", res.Refund.ChargeReference)
+			assert.EqualValues(t, 200, res.TotalCents)
+			assert.EqualValues(t, 100, res.RefundedCents)
+			assert.EqualValues(t, 100, res.NetCents)
+		}
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// a declined refund is marked as failed
+	{
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "declined", http.StatusPaymentRequired)
+		}))
+		refund := storage.Refund{AmountCents: 50}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("AddRefund", ctx, order.ID, refund).Return(withRefund(refund), nil).Once()
+		stor.On("SetRefundStatus", ctx, order.ID, "rf-1", storage.RefundStatusFailed, "").Return(nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(refundOrderArgs{CardToken: "amex", AmountCents: 50})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "refunds"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an unavailable charge service leaves the refund pending since it might
+	// have gone through
+	{
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		refund := storage.Refund{AmountCents: 50}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindRefund, storage.PaymentOutcomeUnknown)).Return(nil).Once()
+		stor.On("AddRefund", ctx, order.ID, refund).Return(withRefund(refund), nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(refundOrderArgs{CardToken: "amex", AmountCents: 50})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "refunds"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// storage errors are returned without calling the charge service
+	for expErr, code := range map[error]int{
+		storage.ErrOrderNotFound:     http.StatusNotFound,
+		storage.ErrInvalidTransition: http.StatusConflict,
+		storage.ErrOrderContended:    http.StatusConflict,
+		storage.ErrInvalidRefund:     http.StatusBadRequest,
+		assert.AnError:               http.StatusInternalServerError,
+	} {
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		}))
+		refund := storage.Refund{AmountCents: 500}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("AddRefund", ctx, order.ID, refund).Return(storage.Order{}, expErr).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(refundOrderArgs{CardToken: "amex", AmountCents: 500})
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "refunds"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, "%v", expErr)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostAuthorizeOrder(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	order := storage.Order{
+		ID:            "order-1234",
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				ID:          "li-1",
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  100,
+			},
+		},
+		Status: storage.OrderStatusPending,
+	}
+	args := chargeOrderArgs{
+		CardToken: "amex",
+	}
+
+	// should authorize the total and record the authorization with when it
+	// expires
+	{
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			require.Equal(t, "/authorizations", r.URL.Path)
+			var args chargeclient.ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			require.EqualValues(t, 100, args.AmountCents)
+			require.Equal(t, "amex", args.CardToken)
+			require.Equal(t, "order-1234:authorize:1", args.IdempotencyKey)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"auth_1"}`))
+		}))
+		start := time.Now()
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusAuthorizing, "authorization requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindAuthorization, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("AuthorizeOrder", ctx, order.ID, mock.MatchedBy(func(auth storage.Authorization) bool {
+			return auth.ID == "auth_1" && auth.AmountCents == 100 &&
+				!auth.ExpiresAt.Before(start.Add(time.Hour)) && !auth.ExpiresAt.After(time.Now().Add(time.Hour))
+		})).Return(nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ), WithAuthorizationTTL(time.Hour))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "authorize"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res authorizeOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, 100, res.AuthorizedCents)
+			assert.Equal(t, "auth_1", res.AuthorizationID)
+			assert.False(t, res.ExpiresAt.Before(start.Add(time.Hour)))
+		}
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// a declined authorization moves the order back to pending and an
+	// unavailable charge service leaves it authorizing for the recovery worker
+	for status, expected := range map[int]int{
+		http.StatusPaymentRequired:    http.StatusPaymentRequired,
+		http.StatusServiceUnavailable: http.StatusServiceUnavailable,
+	} {
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", status)
+		}))
+		outcome := storage.PaymentOutcomeFailed
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusAuthorizing, "authorization requested").Return(order, nil).Once()
+		if status == http.StatusPaymentRequired {
+			stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorizing}, storage.OrderStatusPending, mock.Anything).Return(order, nil).Once()
+		} else {
+			outcome = storage.PaymentOutcomeUnknown
+		}
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindAuthorization, outcome)).Return(nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "authorize"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, expected, w.Code, "%d", status)
+		stor.AssertExpectations(t)
+	}
+
+	// orders that can't be authorized are rejected without calling the charge
+	// service
+	for expErr, code := range map[error]int{
+		storage.ErrOrderNotFound:     http.StatusNotFound,
+		storage.ErrInvalidTransition: http.StatusConflict,
+	} {
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusAuthorizing, "authorization requested").Return(storage.Order{}, expErr).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "authorize"), bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, code, w.Code, "%v", expErr)
+		stor.AssertExpectations(t)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostCaptureOrder(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	order := storage.Order{
+		ID:            "order-1234",
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				ID:          "li-1",
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  100,
+			},
+		},
+		Status:        storage.OrderStatusAuthorized,
+		Authorization: &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	// should capture the total from the authorization and move the order to
+	// charged
+	{
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			require.Equal(t, "/authorizations/auth_1/capture", r.URL.Path)
+			var args chargeclient.ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			require.EqualValues(t, 100, args.AmountCents)
+			require.Empty(t, args.CardToken)
+			require.Equal(t, "order-1234:capture:1", args.IdempotencyKey)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"ch_1"}`))
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, storage.Payment{
+			Kind:            storage.PaymentKindCapture,
+			AmountCents:     100,
+			IdempotencyKey:  "order-1234:capture:1",
+			Outcome:         storage.PaymentOutcomeSucceeded,
+			ChargeReference: "ch_1",
+		}).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusCharged, "capture succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "capture"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.JSONEq(t, `{"capturedCents":100}`, w.Body.String())
+		}
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// a declined capture moves the order back to authorized
+	{
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "declined", http.StatusPaymentRequired)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCapture, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "capture"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an expired authorization can't be captured
+	{
+		expired := order
+		expired.Authorization = &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(-time.Minute)}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(expired, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, mock.Anything).Return(expired, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "capture"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "authorization expired")
+		stor.AssertExpectations(t)
+	}
+
+	// orders that aren't authorized can't be captured
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "capture"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
 		assert.Equal(t, http.StatusConflict, w.Code)
 		stor.AssertExpectations(t)
 	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestPostVoidOrder(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	order := storage.Order{
+		ID:            "order-1234",
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				ID:          "li-1",
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  100,
+			},
+		},
+		Status:        storage.OrderStatusAuthorized,
+		Authorization: &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	// should void the authorization and cancel the order
+	{
+		var calls int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			require.Equal(t, "/authorizations/auth_1/void", r.URL.Path)
+			require.Equal(t, voidIdempotencyKey(order.ID, "auth_1"), r.Header.Get("Idempotency-Key"))
+			w.WriteHeader(http.StatusOK)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindVoid, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "void succeeded").Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "void"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.JSONEq(t, `{"id":"order-1234"}`, w.Body.String())
+		}
+		assert.EqualValues(t, 1, calls)
+		stor.AssertExpectations(t)
+	}
+
+	// a void the charge service rejects leaves the order authorized
+	{
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "already captured", http.StatusConflict)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindVoid, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusAuthorized, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, nil, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "void"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// an expired authorization doesn't need to be voided
+	{
+		expired := order
+		expired.Authorization = &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(-time.Minute)}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested").Return(expired, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "void succeeded").Return(expired, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "void"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
 
+	// orders that aren't authorized can't be voided
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusVoiding, "void requested").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", path.Join("/orders", order.ID, "void"), nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -741,7 +1938,7 @@ func TestPostCancelOrder(t *testing.T) {
 func TestPostFulfillOrder(t *testing.T) {
 	// the context just needs to be something static so we can include it in the
 	// mocked arguments
-	ctx := context.Background()
+	ctx := storage.WithActor(context.Background(), defaultActor)
 
 	// keep track of which items have already been fulfilled so we can ignore ones
 	// that have already been requested
@@ -789,11 +1986,6 @@ func TestPostFulfillOrder(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
-	// these 2 lines are strictly to prevent Go from complaining that we didn't use
-	// these variables and you should delete these lines once you add the tests
-	_ = ctx
-	_ = fulfillServ
-
 	// Order has already been fulfilled we do not call SetOrderStatus, instead skip it and return a 200 ok status
 	{
 		order := storage.Order{
@@ -801,6 +1993,7 @@ func TestPostFulfillOrder(t *testing.T) {
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
+					ID:          "li-1",
 					Description: "item 1",
 					Quantity:    1,
 					PriceCents:  100,
@@ -816,13 +2009,13 @@ func TestPostFulfillOrder(t *testing.T) {
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
 
-		h := Handler(stor, nil, fulfillServ)
+		h := Handler(stor, fulfillServ, nil)
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
 		r := httptest.NewRequest("PUT", path.Join("/fulfill"), bytes.NewReader(byts)).WithContext(ctx)
 		h.ServeHTTP(w, r)
-		var res fulfillmentServiceFulfillRes
+		var res fulfillOrderRes
 		err = json.Unmarshal(w.Body.Bytes(), &res)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -836,6 +2029,7 @@ func TestPostFulfillOrder(t *testing.T) {
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
+					ID:          "li-1",
 					Description: "item 1",
 					Quantity:    1,
 					PriceCents:  100,
@@ -850,20 +2044,26 @@ func TestPostFulfillOrder(t *testing.T) {
 		}
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusFulfilled).Return(nil, nil).Once()
+		fulfilledOrder := order
+		fulfilledOrder.Status = storage.OrderStatusFulfilled
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 1}).Return(order, nil).Once()
+		// the fulfillment is recorded even if the caller hangs up
+		stor.On("FulfillLineItems", mock.Anything, order.ID, map[string]int64{"li-1": 1}).Return(fulfilledOrder, nil).Once()
 
-		h := Handler(stor, nil, fulfillServ)
+		h := Handler(stor, fulfillServ, nil)
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
 		r := httptest.NewRequest("PUT", path.Join("/fulfill"), bytes.NewReader(byts)).WithContext(ctx)
 		h.ServeHTTP(w, r)
-		var res fulfillmentServiceFulfillRes
+		var res fulfillOrderRes
 		err = json.Unmarshal(w.Body.Bytes(), &res)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
 		assert.EqualValues(t, "order-1234", res.OrderID)
 		assert.EqualValues(t, storage.OrderStatusFulfilled, res.Status)
+		assert.Equal(t, []fulfillLineItemRes{{ID: "li-1", Description: "item 1", Quantity: 1, Fulfilled: true}}, res.Items)
+		assert.EqualValues(t, 1, atomic.LoadInt64(&fulfillments))
 		stor.AssertExpectations(t)
 	}
 	// Order status is storage.OrderStatusPending, should return StatusConflict error
@@ -873,6 +2073,7 @@ func TestPostFulfillOrder(t *testing.T) {
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
+					ID:          "li-1",
 					Description: "item 1",
 					Quantity:    1,
 					PriceCents:  100,
@@ -888,7 +2089,7 @@ func TestPostFulfillOrder(t *testing.T) {
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
 
-		h := Handler(stor, nil, fulfillServ)
+		h := Handler(stor, fulfillServ, nil)
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
@@ -905,6 +2106,7 @@ func TestPostFulfillOrder(t *testing.T) {
 			CustomerEmail: "test@test",
 			LineItems: []storage.LineItem{
 				{
+					ID:          "li-1",
 					Description: "item 1",
 					Quantity:    1,
 					PriceCents:  100,
@@ -919,8 +2121,9 @@ func TestPostFulfillOrder(t *testing.T) {
 		}
 		stor := new(mocks.MockStorageInstance)
 		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
-		stor.On("SetOrderStatus", ctx, order.ID, storage.OrderStatusFulfilled).Return(errors.New("unable to change the change the order status"), nil).Once()
-		h := Handler(stor, nil, fulfillServ)
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 1}).Return(order, nil).Once()
+		stor.On("FulfillLineItems", mock.Anything, order.ID, map[string]int64{"li-1": 1}).Return(storage.Order{}, errors.New("unable to change the change the order status")).Once()
+		h := Handler(stor, fulfillServ, nil)
 		w := httptest.NewRecorder()
 		byts, err := json.Marshal(args)
 		require.NoError(t, err)
@@ -930,4 +2133,363 @@ func TestPostFulfillOrder(t *testing.T) {
 		stor.AssertExpectations(t)
 	}
 
+	// every line item except discounts is fulfilled, at most
+	// maxConcurrentFulfillments at a time
+	{
+		order := storage.Order{
+			ID:            "order-5678",
+			CustomerEmail: "test@test",
+			Status:        storage.OrderStatusCharged,
+		}
+		for i := 0; i < 10; i++ {
+			order.LineItems = append(order.LineItems, storage.LineItem{
+				ID:          fmt.Sprintf("li-%d", i+1),
+				Description: fmt.Sprintf("item %d", i),
+				Quantity:    2,
+				PriceCents:  100,
+			})
+		}
+		order.LineItems = append(order.LineItems, storage.LineItem{
+			ID:          "li-11",
+			Description: "discount",
+			Quantity:    1,
+			PriceCents:  -100,
+		})
+		var inFlight, maxInFlight int64
+		var mu sync.Mutex
+		var described []string
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt64(&inFlight, 1)
+			defer atomic.AddInt64(&inFlight, -1)
+			var args fulfillmentServiceFulfillArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			mu.Lock()
+			if n > maxInFlight {
+				maxInFlight = n
+			}
+			described = append(described, args.Description)
+			mu.Unlock()
+			// give the other requests a chance to start
+			time.Sleep(5 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		allItems := mock.MatchedBy(func(quantities map[string]int64) bool {
+			return len(quantities) == 10 && quantities["li-11"] == 0
+		})
+		stor.On("ReserveLineItems", ctx, order.ID, allItems).Return(order, nil).Once()
+		stor.On("FulfillLineItems", mock.Anything, order.ID, allItems).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res fulfillOrderRes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Len(t, res.Items, 10)
+		assert.Len(t, described, 10)
+		assert.NotContains(t, described, "discount")
+		assert.True(t, maxInFlight <= maxConcurrentFulfillments, "%d requests at once", maxInFlight)
+		stor.AssertExpectations(t)
+	}
+
+	// if any line item fails the order is only partially fulfilled and the
+	// failure is reported for that item
+	{
+		order := storage.Order{
+			ID:            "order-5678",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+				{
+					ID:          "li-2",
+					Description: "item 2",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var args fulfillmentServiceFulfillArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			if args.Description == "item 2" {
+				http.Error(w, "out of stock", http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		partialOrder := order
+		partialOrder.Status = storage.OrderStatusPartiallyFulfilled
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 1, "li-2": 1}).Return(order, nil).Once()
+		stor.On("FulfillLineItems", mock.Anything, order.ID, map[string]int64{"li-1": 1}).Return(partialOrder, nil).Once()
+		// the line item that failed is released with why so it can be retried
+		stor.On("ReleaseLineItems", mock.MatchedBy(func(ctx context.Context) bool {
+			return storage.ActorFromContext(ctx) == defaultActor
+		}), order.ID, map[string]int64{"li-2": 1}, mock.MatchedBy(func(reason string) bool {
+			return strings.Contains(reason, "out of stock")
+		})).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		var res fulfillOrderRes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.EqualValues(t, storage.OrderStatusPartiallyFulfilled, res.Status)
+		if assert.Len(t, res.Items, 2) {
+			assert.True(t, res.Items[0].Fulfilled)
+			assert.Empty(t, res.Items[0].Error)
+			assert.False(t, res.Items[1].Fulfilled)
+			assert.Contains(t, res.Items[1].Error, "out of stock")
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// only the requested line items and quantities are fulfilled
+	{
+		order := storage.Order{
+			ID:            "order-5678",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    3,
+					PriceCents:  100,
+				},
+				{
+					ID:          "li-2",
+					Description: "item 2",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		var got []fulfillmentServiceFulfillArgs
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var args fulfillmentServiceFulfillArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&args))
+			got = append(got, args)
+			w.WriteHeader(http.StatusOK)
+		}))
+		partialOrder := order
+		partialOrder.Status = storage.OrderStatusPartiallyFulfilled
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 2}).Return(order, nil).Once()
+		stor.On("FulfillLineItems", mock.Anything, order.ID, map[string]int64{"li-1": 2}).Return(partialOrder, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{
+			OrderID: order.ID,
+			Items:   []fulfillOrderItemArgs{{ID: "li-1", Quantity: 2}},
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res fulfillOrderRes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.EqualValues(t, storage.OrderStatusPartiallyFulfilled, res.Status)
+		assert.Equal(t, []fulfillmentServiceFulfillArgs{{Description: "item 1", Quantity: 2, OrderID: order.ID, LineItemID: "li-1"}}, got)
+		stor.AssertExpectations(t)
+	}
+
+	// line items that another request reserved in the meantime aren't shipped
+	// again
+	{
+		order := storage.Order{
+			ID:            "order-5678",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("fulfillment service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 1}).Return(storage.Order{}, storage.ErrInvalidFulfillment).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+
+		// and if everything that's left is already reserved there's nothing to do
+		order.LineItems[0].ReservedQuantity = 1
+		stor = new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h = Handler(stor, fulfillServ, nil)
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// fulfilling more than what's left or unknown line items is rejected without
+	// calling the fulfillment service
+	for _, items := range [][]fulfillOrderItemArgs{
+		{{ID: "li-1", Quantity: 4}},
+		{{ID: "li-1", Quantity: 2}, {ID: "li-1", Quantity: 2}},
+		{{ID: "li-3", Quantity: 1}},
+	} {
+		order := storage.Order{
+			ID:            "order-5678",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    3,
+					PriceCents:  100,
+				},
+			},
+			Status: storage.OrderStatusCharged,
+		}
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("fulfillment service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, nil)
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID, Items: items})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%v", items)
+		stor.AssertExpectations(t)
+	}
+
+	// authorized orders are captured before they're fulfilled
+	{
+		order := storage.Order{
+			ID:            "order-authorized",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:        storage.OrderStatusAuthorized,
+			Authorization: &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		var captures int64
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&captures, 1)
+			require.Equal(t, "/authorizations/auth_1/capture", r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		fulfilledOrder := order
+		fulfilledOrder.Status = storage.OrderStatusFulfilled
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCapture, storage.PaymentOutcomeSucceeded)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusCharged, "capture succeeded").Return(order, nil).Once()
+		chargedOrder := order
+		chargedOrder.Status = storage.OrderStatusCharged
+		stor.On("ReserveLineItems", ctx, order.ID, map[string]int64{"li-1": 1}).Return(chargedOrder, nil).Once()
+		stor.On("FulfillLineItems", mock.Anything, order.ID, map[string]int64{"li-1": 1}).Return(fulfilledOrder, nil).Once()
+		h := Handler(stor, fulfillServ, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res fulfillOrderRes
+			err = json.Unmarshal(w.Body.Bytes(), &res)
+			require.NoError(t, err)
+			assert.EqualValues(t, storage.OrderStatusFulfilled, res.Status)
+		}
+		assert.EqualValues(t, 1, captures)
+		stor.AssertExpectations(t)
+	}
+
+	// an authorized order that can't be captured isn't fulfilled
+	{
+		order := storage.Order{
+			ID:            "order-declined",
+			CustomerEmail: "test@test",
+			LineItems: []storage.LineItem{
+				{
+					ID:          "li-1",
+					Description: "item 1",
+					Quantity:    1,
+					PriceCents:  100,
+				},
+			},
+			Status:        storage.OrderStatusAuthorized,
+			Authorization: &storage.Authorization{ID: "auth_1", AmountCents: 100, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		chgServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "declined", http.StatusPaymentRequired)
+		}))
+		fulfillServ := mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("fulfillment service should not be called")
+		}))
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetOrder", ctx, order.ID).Return(order, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusCapturing, "capture requested").Return(order, nil).Once()
+		stor.On("AddPayment", ctx, order.ID, paymentWithOutcome(storage.PaymentKindCapture, storage.PaymentOutcomeFailed)).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, mock.Anything).Return(order, nil).Once()
+		h := Handler(stor, fulfillServ, newChargeClient(chgServ))
+		w := httptest.NewRecorder()
+		byts, err := json.Marshal(fulfillOrderArgs{OrderID: order.ID})
+		require.NoError(t, err)
+		r := httptest.NewRequest("PUT", "/fulfill", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestFulfillmentURL(t *testing.T) {
+	// a real fulfillment service is reached at the configured URL
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	inst := &instance{fulfillmentService: srv.Client()}
+	WithFulfillmentURL(srv.URL)(inst)
+	err := inst.innerFulfillLineItem(context.Background(), fulfillmentServiceFulfillArgs{
+		Description: "item 1",
+		Quantity:    1,
+		OrderID:     "order-1234",
+		LineItemID:  "li-1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /fulfill", got)
 }
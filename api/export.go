@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// exportFlushEvery is how many orders GET /orders/export writes between
+// flushes so the client sees progress even while the orders are small enough
+// to sit in the response's buffer
+const exportFlushEvery = 100
+
+// orderWriter writes exported orders to a response
+type orderWriter interface {
+	// writeOrder writes the order, which may be buffered until flush
+	writeOrder(order storage.Order) error
+	// flush sends everything written so far to the client
+	flush() error
+}
+
+// exportFormat is a format GET /orders/export can write orders in
+type exportFormat struct {
+	contentType string
+	newWriter   func(w gin.ResponseWriter) orderWriter
+}
+
+// exportFormats holds every exportFormat by the name passed as the format
+// parameter
+var exportFormats = map[string]exportFormat{
+	"ndjson": {contentType: "application/x-ndjson", newWriter: newNDJSONWriter},
+	"csv":    {contentType: "text/csv; charset=utf-8", newWriter: newCSVWriter},
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ndjsonWriter writes each order as a line of JSON, which is the same JSON
+// GET /orders returns for it
+type ndjsonWriter struct {
+	w   gin.ResponseWriter
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w gin.ResponseWriter) orderWriter {
+	return ndjsonWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (w ndjsonWriter) writeOrder(order storage.Order) error {
+	// Encode ends every value with a newline
+	return w.enc.Encode(order)
+}
+
+func (w ndjsonWriter) flush() error {
+	w.w.Flush()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// csvHeader is the first row of a CSV export
+var csvHeader = []string{
+	"orderId",
+	"customerEmail",
+	"status",
+	"createdAt",
+	"updatedAt",
+	"totalCents",
+	"refundedCents",
+	"netCents",
+	"lineItemId",
+	"description",
+	"priceCents",
+	"quantity",
+	"fulfilledQuantity",
+}
+
+// csvWriter writes a row for every line item of each order with the order's
+// fields repeated on each one, so the export can be opened as a single sheet.
+// Orders without any line items get a single row with the line item columns
+// left empty.
+type csvWriter struct {
+	w   gin.ResponseWriter
+	csv *csv.Writer
+}
+
+func newCSVWriter(w gin.ResponseWriter) orderWriter {
+	cw := csvWriter{w: w, csv: csv.NewWriter(w)}
+	// this is buffered so any error comes back from a later call
+	_ = cw.csv.Write(csvHeader)
+	return cw
+}
+
+func (w csvWriter) writeOrder(order storage.Order) error {
+	fields := []string{
+		csvText(order.ID),
+		csvText(order.CustomerEmail),
+		order.Status.String(),
+		csvTime(order.CreatedAt),
+		csvTime(order.UpdatedAt),
+		strconv.FormatInt(order.TotalCents(), 10),
+		strconv.FormatInt(order.RefundedCents(), 10),
+		strconv.FormatInt(order.NetCents(), 10),
+	}
+	if len(order.LineItems) == 0 {
+		return w.csv.Write(append(fields, "", "", "", "", ""))
+	}
+	for _, li := range order.LineItems {
+		row := append(append([]string{}, fields...),
+			csvText(li.ID),
+			csvText(li.Description),
+			strconv.FormatInt(li.PriceCents, 10),
+			strconv.FormatInt(li.Quantity, 10),
+			strconv.FormatInt(li.FulfilledQuantity, 10),
+		)
+		if err := w.csv.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w csvWriter) flush() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return nil
+}
+
+// csvText returns the text with a ' in front of it if a spreadsheet would
+// otherwise treat it as a formula, since emails and descriptions come from
+// customers
+func csvText(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+// csvTime returns the time the same way it's formatted in JSON but always in
+// UTC so every row of the export is comparable
+func csvTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// exportOrders is called by incoming HTTP GET requests to /orders/export
+func (i *instance) exportOrders(c *gin.Context) {
+	// the context of the request we pass along to every downstream function so we
+	// can stop processing if the caller aborts the request and also to ensure that
+	// the tracing context is kept throughout the whole request
+	// the export also stops once it's taken exportTimeout so a client reading
+	// slowly can't hold the database cursor open forever. The timeout is checked
+	// between orders, so a client that stops reading altogether holds it until
+	// its write fails, but the database drops cursors that sit idle long enough.
+	reqCtx := c.Request.Context()
+	ctx, cancel := context.WithTimeout(reqCtx, i.exportTimeout)
+	defer cancel()
+
+	// the export takes the same filters as GET /orders but isn't paged
+	p := newQueryParser(c)
+	query := p.orderQuery()
+	name := c.DefaultQuery("format", "ndjson")
+	format, ok := exportFormats[name]
+	if !ok {
+		p.fail("format", "must be ndjson or csv")
+	}
+	if !p.ok() {
+		return
+	}
+
+	// the response isn't started until there's an order to write so that an
+	// error from the query itself can still be responded to normally. There's
+	// no Content-Length so the orders are sent with chunked encoding as they're
+	// written instead of being held in memory.
+	var w orderWriter
+	start := func() {
+		c.Header("Content-Type", format.contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="orders.%s"`, name))
+		c.Status(http.StatusOK)
+		w = format.newWriter(c.Writer)
+	}
+	var n int
+	err := i.stor.IterOrders(ctx, query, func(order storage.Order) error {
+		if w == nil {
+			start()
+		}
+		if err := w.writeOrder(order); err != nil {
+			return err
+		}
+		n++
+		if n%exportFlushEvery == 0 {
+			return w.flush()
+		}
+		return nil
+	})
+	if err != nil && w == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error exporting orders: %v", err)})
+		return
+	}
+	if err == nil {
+		if w == nil {
+			start()
+		}
+		err = w.flush()
+	}
+	if err != nil {
+		// a client that went away doesn't need to be logged but one that hit the
+		// timeout does
+		if reqCtx.Err() == nil {
+			llog.Error("failed to export orders", llog.KV{"exported": n}, llog.ErrKV(err))
+		}
+		abortResponse(c)
+	}
+}
+
+// abortResponse closes the connection of a response that's already started so
+// the client gets an error instead of what looks like a complete response that
+// happens to be missing the rest of it. This can only be done for HTTP/1 since
+// HTTP/2 connections are shared between requests.
+func abortResponse(c *gin.Context) {
+	if c.Request.ProtoMajor != 1 {
+		return
+	}
+	// the chunk ending the response is never written so the client knows it's
+	// incomplete
+	if conn, _, err := c.Writer.Hijack(); err == nil {
+		conn.Close()
+	}
+}
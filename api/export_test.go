@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// iterOrders returns a mocked IterOrders that calls fn with each of the orders
+// and then returns err
+func iterOrders(err error, orders ...storage.Order) func(context.Context, storage.OrderQuery, func(storage.Order) error) error {
+	return func(_ context.Context, _ storage.OrderQuery, fn func(storage.Order) error) error {
+		for _, order := range orders {
+			if err := fn(order); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+}
+
+func TestExportOrders(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	at := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	order1 := storage.Order{
+		ID:            "test1",
+		CustomerEmail: "a@example.com",
+		LineItems: []storage.LineItem{
+			{ID: "li-1", Description: "Red shirt", PriceCents: 1000, Quantity: 2, FulfilledQuantity: 1},
+			{ID: "li-2", Description: "=discount", PriceCents: -500, Quantity: 1},
+		},
+		Status:    storage.OrderStatusPartiallyFulfilled,
+		CreatedAt: at,
+		UpdatedAt: at.Add(time.Hour),
+		Refunds: []storage.Refund{
+			{ID: "r-1", AmountCents: 300, Status: storage.RefundStatusSucceeded},
+		},
+	}
+	order2 := storage.Order{
+		ID:            "test2",
+		CustomerEmail: "b@example.com, c@example.com",
+		LineItems:     []storage.LineItem{},
+		Status:        storage.OrderStatusPending,
+		CreatedAt:     at,
+		UpdatedAt:     at,
+	}
+
+	// the export is given a deadline on top of the request's context
+	exportCtx := mock.MatchedBy(func(c context.Context) bool {
+		_, ok := c.Deadline()
+		return ok && storage.ActorFromContext(c) == defaultActor
+	})
+
+	// should write each order as a line of JSON by default
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("IterOrders", exportCtx, storage.OrderQuery{}, mock.Anything).Return(iterOrders(nil, order1, order2)).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Equal(t, "application/x-ndjson", w.HeaderMap.Get("Content-Type"))
+			assert.Equal(t, `attachment; filename="orders.ndjson"`, w.HeaderMap.Get("Content-Disposition"))
+			var got []storage.Order
+			scanner := bufio.NewScanner(w.Body)
+			for scanner.Scan() {
+				var order storage.Order
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &order))
+				got = append(got, order)
+			}
+			assert.Equal(t, []storage.Order{order1, order2}, got)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should write a row for every line item
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("IterOrders", exportCtx, storage.OrderQuery{}, mock.Anything).Return(iterOrders(nil, order1, order2)).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export?format=csv", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Equal(t, "text/csv; charset=utf-8", w.HeaderMap.Get("Content-Type"))
+			assert.Equal(t, `attachment; filename="orders.csv"`, w.HeaderMap.Get("Content-Disposition"))
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			require.NoError(t, err)
+			assert.Equal(t, [][]string{
+				csvHeader,
+				{"test1", "a@example.com", "partiallyFulfilled", "2022-01-02T03:04:05Z", "2022-01-02T04:04:05Z", "1500", "300", "1200", "li-1", "Red shirt", "1000", "2", "1"},
+				// descriptions are kept from being treated as formulas
+				{"test1", "a@example.com", "partiallyFulfilled", "2022-01-02T03:04:05Z", "2022-01-02T04:04:05Z", "1500", "300", "1200", "li-2", "'=discount", "-500", "1", "0"},
+				{"test2", "b@example.com, c@example.com", "pending", "2022-01-02T03:04:05Z", "2022-01-02T03:04:05Z", "0", "0", "0", "", "", "", "", ""},
+			}, rows)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should still write the header when there aren't any orders
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("IterOrders", exportCtx, storage.OrderQuery{}, mock.Anything).Return(iterOrders(nil)).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export?format=csv", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Equal(t, "text/csv; charset=utf-8", w.HeaderMap.Get("Content-Type"))
+			assert.Equal(t, strings.Join(csvHeader, ",")+"\n", w.Body.String())
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should pass along the same filters as GET /orders
+	{
+		since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		min := int64(100)
+		query := storage.OrderQuery{
+			Statuses:      []storage.OrderStatus{storage.OrderStatusCharged, storage.OrderStatusFulfilled},
+			CustomerEmail: "a@example.com",
+			CreatedSince:  since,
+			MinTotalCents: &min,
+			Description:   "shirt",
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("IterOrders", exportCtx, query, mock.Anything).Return(iterOrders(nil, order1)).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export?format=ndjson&status=charged,fulfilled&email=a@example.com&createdSince=2022-01-01T00:00:00Z&minTotal=100&description=shirt", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// should list every invalid parameter
+	{
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export?format=xml&status=bogus", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusBadRequest, w.Code) {
+			var res invalidParamsRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, []paramError{
+				{Param: "status", Error: `unknown status: "bogus"`},
+				{Param: "format", Error: "must be ndjson or csv"},
+			}, res.Params)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// should respond with an error if the export fails before any orders
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("IterOrders", exportCtx, storage.OrderQuery{}, mock.Anything).Return(errors.New("fail")).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orders/export?format=csv", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusInternalServerError, w.Code) {
+			assert.Contains(t, w.HeaderMap.Get("Content-Type"), "application/json")
+			assert.Empty(t, w.HeaderMap.Get("Content-Disposition"))
+			assert.Contains(t, w.Body.String(), "error exporting orders")
+		}
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestExportOrdersFailure(t *testing.T) {
+	// more orders than are written between flushes so the response has started
+	// by the time the export fails
+	var orders []storage.Order
+	for idx := 0; idx < exportFlushEvery+10; idx++ {
+		orders = append(orders, storage.Order{
+			ID:        fmt.Sprintf("test%d", idx),
+			LineItems: []storage.LineItem{{ID: "li-1", Description: "item", PriceCents: 100, Quantity: 1}},
+		})
+	}
+	stor := new(mocks.MockStorageInstance)
+	stor.On("IterOrders", mock.Anything, storage.OrderQuery{}, mock.Anything).Return(iterOrders(errors.New("fail"), orders...)).Once()
+	// a real server is needed since the connection is closed on the client
+	srv := httptest.NewServer(Handler(stor, nil, nil))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/orders/export?format=csv")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	// the client can tell the export is incomplete instead of it looking like
+	// the orders just ended early
+	body, err := io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.True(t, strings.HasPrefix(string(body), strings.Join(csvHeader, ",")+"\n"))
+	stor.AssertExpectations(t)
+}
+
+func TestExportOrdersTimeout(t *testing.T) {
+	var orders []storage.Order
+	for idx := 0; idx < exportFlushEvery+10; idx++ {
+		orders = append(orders, storage.Order{ID: fmt.Sprintf("test%d", idx)})
+	}
+	stor := new(mocks.MockStorageInstance)
+	// the export keeps going, like a slow client would make it, until it's cut
+	// off by the timeout
+	stor.On("IterOrders", mock.Anything, storage.OrderQuery{}, mock.Anything).Return(func(ctx context.Context, _ storage.OrderQuery, fn func(storage.Order) error) error {
+		for _, order := range orders {
+			if err := fn(order); err != nil {
+				return err
+			}
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}).Once()
+	srv := httptest.NewServer(Handler(stor, nil, nil, WithExportTimeout(50*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/orders/export")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	stor.AssertExpectations(t)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// idempotencyKeyHeader is the header clients set to a unique value per logical
+// request so that retrying the request doesn't do the work twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLen limits how big of a key we'll store
+const maxIdempotencyKeyLen = 255
+
+// idempotencyFinishTimeout is how long storing the response for a key, or
+// deleting the key, can take once the handler is done
+const idempotencyFinishTimeout = 5 * time.Second
+
+// idempotencyFingerprint returns a hash of everything that makes a request
+// unique so we can tell if a key is reused for a different request
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	// the newlines make sure a path can't run into the body and collide
+	fmt.Fprintf(h, "%s\n%s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder wraps the gin.ResponseWriter and keeps a copy of the
+// response body so it can be stored once the handler finishes
+type idempotencyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write implements the io.Writer interface and writes b to both the response
+// and the copy
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteString is used by some of gin's renderers instead of Write
+func (r *idempotencyRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// idempotency is a middleware for the POST and PUT routes that honors the
+// Idempotency-Key header. The first request with a key is handled normally and
+// its response is stored, any retries with the same key get the stored response
+// back without calling the handler again. Requests without the header are
+// handled normally.
+func (i *instance) idempotency(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen)})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// we need the body for the fingerprint but the handler needs to read it too
+	// so we put a copy back on the request
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading body: %v", err)})
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fingerprint := idempotencyFingerprint(c.Request, body)
+
+	// reserving the key is atomic so if the same request is sent twice at once
+	// only one of them is handled. The reservation only lasts for the lease so
+	// a request that never finishes doesn't hold the key until the TTL. The
+	// token makes sure that if the lease runs out and a retry takes over the key
+	// this request can't overwrite or delete the retry's record.
+	now := time.Now()
+	token := uuid.New().String()
+	err = i.stor.ReserveIdempotencyKey(ctx, storage.IdempotencyRecord{
+		Key:         key,
+		Token:       token,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(i.idempotencyLease),
+	})
+	if errors.Is(err, storage.ErrIdempotencyKeyExists) {
+		i.replayIdempotentResponse(c, key, fingerprint)
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error reserving idempotency key: %v", err)})
+		return
+	}
+
+	rec := &idempotencyRecorder{ResponseWriter: c.Writer}
+	c.Writer = rec
+	c.Next()
+
+	// a client that hung up is going to retry with the key, which only works
+	// if the key is finished, so this can't use the request's context since
+	// it's cancelled by then
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyFinishTimeout)
+	defer cancel()
+
+	// server errors are usually temporary so instead of storing them we delete
+	// the key to let the client retry with it
+	status := rec.Status()
+	if status >= http.StatusInternalServerError {
+		err = i.stor.DeleteIdempotencyKey(finishCtx, key, token)
+	} else {
+		expiresAt := time.Now().Add(i.idempotencyKeyTTL)
+		err = i.stor.CompleteIdempotencyKey(finishCtx, key, token, status, rec.Header().Get("Content-Type"), rec.body.Bytes(), expiresAt)
+	}
+	// the response was already sent so all we can do is log
+	if err != nil {
+		llog.Error("failed to store idempotent response", llog.KV{"key": key}, llog.ErrKV(err))
+	}
+}
+
+// replayIdempotentResponse responds to a request whose idempotency key was
+// already used with the stored response for that key
+func (i *instance) replayIdempotentResponse(c *gin.Context, key, fingerprint string) {
+	ctx := c.Request.Context()
+
+	existing, err := i.stor.GetIdempotencyKey(ctx, key)
+	if err != nil {
+		// the key could've expired or been deleted after a server error since we
+		// tried to reserve it so the client should just retry
+		if errors.Is(err, storage.ErrIdempotencyKeyNotFound) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "idempotency key changed while handling the request, please retry"})
+		} else {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting idempotency key: %v", err)})
+		}
+		return
+	}
+
+	if existing.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "idempotency key was already used for a different request"})
+		return
+	}
+	if !existing.Completed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this idempotency key is still in progress"})
+		return
+	}
+
+	// let the client know this isn't a new response
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(existing.StatusCode, existing.ContentType, existing.Body)
+	c.Abort()
+}
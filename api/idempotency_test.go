@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	args := postOrderArgs{
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  100,
+			},
+		},
+	}
+	byts, err := json.Marshal(args)
+	require.NoError(t, err)
+	newRequest := func(key string, body []byte) *http.Request {
+		r := httptest.NewRequest("POST", "/orders", bytes.NewReader(body)).WithContext(ctx)
+		if key != "" {
+			r.Header.Set(idempotencyKeyHeader, key)
+		}
+		return r
+	}
+	fingerprint := idempotencyFingerprint(newRequest("", byts), byts)
+
+	// the first request is handled and its response is stored
+	{
+		stor := new(mocks.MockStorageInstance)
+		var token string
+		stor.On("ReserveIdempotencyKey", ctx, mock.MatchedBy(func(rec storage.IdempotencyRecord) bool {
+			token = rec.Token
+			return rec.Key == "key-1" &&
+				rec.Token != "" &&
+				rec.Fingerprint == fingerprint &&
+				!rec.Completed &&
+				// the key is only held for the lease until the response is stored
+				rec.ExpiresAt.Sub(rec.CreatedAt) == time.Minute
+		})).Return(nil).Once()
+		stor.On("InsertOrder", ctx, mock.AnythingOfType("storage.Order")).Return("order-1234", nil).Once()
+		var stored []byte
+		var expiresAt time.Time
+		// only the reservation's token can complete it
+		stor.On("CompleteIdempotencyKey", mock.Anything, "key-1", mock.MatchedBy(func(got string) bool {
+			return got == token
+		}), http.StatusCreated, "application/json; charset=utf-8", mock.AnythingOfType("[]uint8"), mock.AnythingOfType("time.Time")).Run(func(args mock.Arguments) {
+			stored = args.Get(5).([]byte)
+			expiresAt = args.Get(6).(time.Time)
+		}).Return(nil).Once()
+		h := Handler(stor, nil, nil, WithIdempotencyKeyTTL(time.Hour), WithIdempotencyKeyLease(time.Minute))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, w.Body.Bytes(), stored)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+		stor.AssertExpectations(t)
+	}
+
+	// the key is still finished when the client hangs up before the response
+	{
+		reqCtx, cancel := context.WithCancel(ctx)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ReserveIdempotencyKey", reqCtx, mock.AnythingOfType("storage.IdempotencyRecord")).Return(nil).Once()
+		stor.On("InsertOrder", reqCtx, mock.AnythingOfType("storage.Order")).Run(func(mock.Arguments) {
+			cancel()
+		}).Return("order-1234", nil).Once()
+		stor.On("CompleteIdempotencyKey", mock.MatchedBy(func(ctx context.Context) bool {
+			return ctx.Err() == nil && storage.ActorFromContext(ctx) == defaultActor
+		}), "key-1", mock.AnythingOfType("string"), http.StatusCreated, "application/json; charset=utf-8", mock.AnythingOfType("[]uint8"), mock.AnythingOfType("time.Time")).Return(nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts).WithContext(reqCtx))
+		stor.AssertExpectations(t)
+	}
+
+	// a retry gets the stored response without the handler being called
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ReserveIdempotencyKey", ctx, mock.AnythingOfType("storage.IdempotencyRecord")).Return(storage.ErrIdempotencyKeyExists).Once()
+		stor.On("GetIdempotencyKey", ctx, "key-1").Return(storage.IdempotencyRecord{
+			Key:         "key-1",
+			Fingerprint: fingerprint,
+			Completed:   true,
+			StatusCode:  http.StatusCreated,
+			ContentType: "application/json; charset=utf-8",
+			Body:        []byte(`{"order":{"id":"order-1234"}}`),
+		}, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, `{"order":{"id":"order-1234"}}`, w.Body.String())
+		stor.AssertExpectations(t)
+	}
+
+	// reusing a key for a different request is rejected
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ReserveIdempotencyKey", ctx, mock.AnythingOfType("storage.IdempotencyRecord")).Return(storage.ErrIdempotencyKeyExists).Once()
+		stor.On("GetIdempotencyKey", ctx, "key-1").Return(storage.IdempotencyRecord{
+			Key:         "key-1",
+			Fingerprint: "something else",
+			Completed:   true,
+		}, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// a retry while the first request is still being handled is a conflict
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ReserveIdempotencyKey", ctx, mock.AnythingOfType("storage.IdempotencyRecord")).Return(storage.ErrIdempotencyKeyExists).Once()
+		stor.On("GetIdempotencyKey", ctx, "key-1").Return(storage.IdempotencyRecord{
+			Key:         "key-1",
+			Fingerprint: fingerprint,
+		}, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts))
+		assert.Equal(t, http.StatusConflict, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// server errors aren't stored so the request can be retried
+	{
+		stor := new(mocks.MockStorageInstance)
+		var token string
+		stor.On("ReserveIdempotencyKey", ctx, mock.MatchedBy(func(rec storage.IdempotencyRecord) bool {
+			token = rec.Token
+			return true
+		})).Return(nil).Once()
+		stor.On("InsertOrder", ctx, mock.AnythingOfType("storage.Order")).Return("", assert.AnError).Once()
+		stor.On("DeleteIdempotencyKey", mock.Anything, "key-1", mock.MatchedBy(func(got string) bool {
+			return got == token
+		})).Return(nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest("key-1", byts))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// requests without a key are handled normally
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("InsertOrder", ctx, mock.AnythingOfType("storage.Order")).Return("order-1234", nil).Twice()
+		h := Handler(stor, nil, nil)
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newRequest("", byts))
+			assert.Equal(t, http.StatusCreated, w.Code)
+		}
+		stor.AssertExpectations(t)
+	}
+}
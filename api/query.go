@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// paramError describes why a query parameter is invalid
+type paramError struct {
+	Param string `json:"param"`
+	Error string `json:"error"`
+}
+
+// invalidParamsRes is the result of a request with invalid query parameters
+type invalidParamsRes struct {
+	Error string `json:"error"`
+	// Params lists every invalid parameter in the order they were checked
+	Params []paramError `json:"params"`
+}
+
+// invalidParams returns the response for a request with the invalid
+// parameters
+func invalidParams(errs ...paramError) invalidParamsRes {
+	return invalidParamsRes{Error: "invalid query parameters", Params: errs}
+}
+
+// queryParser parses the query parameters of a request and collects why any of
+// them are invalid instead of stopping at the first, so the client can fix
+// them all at once
+type queryParser struct {
+	c    *gin.Context
+	errs []paramError
+}
+
+func newQueryParser(c *gin.Context) *queryParser {
+	return &queryParser{c: c}
+}
+
+// fail records that the parameter is invalid
+func (p *queryParser) fail(param, format string, args ...interface{}) {
+	p.errs = append(p.errs, paramError{Param: param, Error: fmt.Sprintf(format, args...)})
+}
+
+// ok returns true if every parameter parsed so far is valid. Otherwise it
+// responds with a 400 listing every invalid parameter and returns false.
+func (p *queryParser) ok() bool {
+	if len(p.errs) == 0 {
+		return true
+	}
+	p.c.JSON(http.StatusBadRequest, invalidParams(p.errs...))
+	return false
+}
+
+// time parses the parameter as an RFC 3339 time, like 2022-01-01T00:00:00Z,
+// and returns it in UTC. It returns the zero time if the parameter isn't set.
+func (p *queryParser) time(param string) time.Time {
+	v := p.c.Query(param)
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		p.fail(param, "must be an RFC 3339 time, like 2022-01-01T00:00:00Z")
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// cents parses the parameter as a whole number of cents. It returns nil if the
+// parameter isn't set.
+func (p *queryParser) cents(param string) *int64 {
+	v := p.c.Query(param)
+	if v == "" {
+		return nil
+	}
+	cents, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		p.fail(param, "must be a whole number of cents")
+		return nil
+	}
+	return &cents
+}
+
+// statuses parses the parameter as order status names, which can be repeated
+// or separated by commas, like status=pending,charged
+func (p *queryParser) statuses(param string) []storage.OrderStatus {
+	var statuses []storage.OrderStatus
+	for _, v := range p.c.QueryArray(param) {
+		for _, name := range strings.Split(v, ",") {
+			status, err := storage.ParseOrderStatus(strings.TrimSpace(name))
+			if err != nil {
+				p.fail(param, "unknown status: %q", name)
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// orderQuery parses the parameters that filter which orders are returned
+func (p *queryParser) orderQuery() storage.OrderQuery {
+	q := storage.OrderQuery{
+		Statuses:      p.statuses("status"),
+		CustomerEmail: p.c.Query("email"),
+		CreatedSince:  p.time("createdSince"),
+		CreatedBefore: p.time("createdBefore"),
+		UpdatedSince:  p.time("updatedSince"),
+		UpdatedBefore: p.time("updatedBefore"),
+		MinTotalCents: p.cents("minTotal"),
+		MaxTotalCents: p.cents("maxTotal"),
+		Description:   p.c.Query("description"),
+	}
+	// ranges that can't match anything are almost certainly a mistake
+	if !q.CreatedSince.IsZero() && !q.CreatedBefore.IsZero() && !q.CreatedSince.Before(q.CreatedBefore) {
+		p.fail("createdBefore", "must be after createdSince")
+	}
+	if !q.UpdatedSince.IsZero() && !q.UpdatedBefore.IsZero() && !q.UpdatedSince.Before(q.UpdatedBefore) {
+		p.fail("updatedBefore", "must be after updatedSince")
+	}
+	if q.MinTotalCents != nil && q.MaxTotalCents != nil && *q.MinTotalCents > *q.MaxTotalCents {
+		p.fail("maxTotal", "must be at least minTotal")
+	}
+	return q
+}
+
+// orderPage parses the parameters that page and sort the orders that are
+// returned. The sort is one of the storage.OrderSorts optionally prefixed with
+// a - to sort in reverse.
+func (p *queryParser) orderPage() storage.OrderPage {
+	page := storage.OrderPage{
+		Cursor: p.c.Query("cursor"),
+		Sort:   storage.OrderSortCreatedAt,
+	}
+	var err error
+	if page.Limit, err = parseLimit(p.c.Query("limit"), defaultOrdersLimit, storage.MaxOrdersLimit); err != nil {
+		p.fail("limit", err.Error())
+	}
+	if v := p.c.Query("sort"); v != "" {
+		page.Descending = strings.HasPrefix(v, "-")
+		page.Sort = storage.OrderSort(strings.TrimPrefix(v, "-"))
+		var known bool
+		for _, sort := range storage.OrderSorts {
+			known = known || sort == page.Sort
+		}
+		if !known {
+			p.fail("sort", "must be one of %v, optionally prefixed with -", storage.OrderSorts)
+		}
+	}
+	return page
+}
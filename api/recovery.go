@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/chargeclient"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// recoveryActor is who the changes RunRecovery makes are attributed to
+const recoveryActor = "recovery"
+
+// recoverableStatuses are the statuses an order can get stuck in if the
+// service crashes in the middle of a two-phase change
+var recoverableStatuses = []storage.OrderStatus{
+	storage.OrderStatusCharging,
+	storage.OrderStatusRefunding,
+	storage.OrderStatusAuthorizing,
+	storage.OrderStatusCapturing,
+	storage.OrderStatusVoiding,
+}
+
+// recoverOrder finishes the two-phase change of an order stuck in one of the
+// recoverableStatuses by asking the charge service whether the charge, refund,
+// authorization, capture or void actually went through and moving the order to
+// where it should be
+func (i *instance) recoverOrder(ctx context.Context, order storage.Order) error {
+	// authorizations aren't returned with the order's charges so they're
+	// looked up separately
+	switch order.Status {
+	case storage.OrderStatusAuthorizing:
+		return i.recoverAuthorization(ctx, order)
+	case storage.OrderStatusVoiding:
+		return i.recoverVoid(ctx, order)
+	}
+
+	charges, err := i.charges.Charges(ctx, order.ID)
+	if err != nil {
+		return fmt.Errorf("error getting charges: %w", err)
+	}
+	// failed charges aren't returned so adding everything up tells us how much
+	// the customer has been charged after refunds
+	var netCents int64
+	for _, charge := range charges {
+		netCents += charge.AmountCents
+	}
+
+	var to storage.OrderStatus
+	var reason string
+	switch order.Status {
+	case storage.OrderStatusCharging:
+		// orders with nothing to charge never call the charge service
+		if order.TotalCents() <= 0 || netCents >= order.TotalCents() {
+			to, reason = storage.OrderStatusCharged, "recovered stuck charge that succeeded"
+		} else {
+			to, reason = storage.OrderStatusPending, "recovered stuck charge that failed"
+		}
+	case storage.OrderStatusRefunding:
+		if netCents <= 0 {
+			to, reason = storage.OrderStatusCancelled, "recovered stuck refund that succeeded"
+		} else {
+			to, reason = storage.OrderStatusCharged, "recovered stuck refund that failed"
+		}
+	case storage.OrderStatusCapturing:
+		// captures are returned with the order's charges so this works just like
+		// charging except the order is still authorized if it wasn't captured
+		if order.TotalCents() <= 0 || netCents >= order.TotalCents() {
+			to, reason = storage.OrderStatusCharged, "recovered stuck capture that succeeded"
+		} else {
+			to, reason = storage.OrderStatusAuthorized, "recovered stuck capture that failed"
+		}
+	default:
+		return fmt.Errorf("order %s has unrecoverable status %v", order.ID, order.Status)
+	}
+	return i.finishRecovery(ctx, order, to, reason)
+}
+
+// recoverAuthorization finishes authorizing an order stuck authorizing if the
+// charge service has an authorization with the idempotency key it was made
+// with and moves it back to pending otherwise
+func (i *instance) recoverAuthorization(ctx context.Context, order storage.Order) error {
+	// the expiration is based on when the order moved to authorizing since that's
+	// right before the charge service was asked for the authorization
+	auth := storage.Authorization{
+		AmountCents: order.TotalCents(),
+		ExpiresAt:   order.StatusUpdatedAt.Add(i.authorizationTTL),
+	}
+	// orders with nothing to authorize never call the charge service
+	if order.TotalCents() > 0 {
+		auths, err := i.charges.Authorizations(ctx, order.ID)
+		if err != nil {
+			return fmt.Errorf("error getting authorizations: %w", err)
+		}
+		// PaymentAttempts was incremented when the order moved to authorizing so
+		// it's already the attempt the key was made with
+		key := chargeIdempotencyKey(order.ID, "authorize", order.PaymentAttempts)
+		var found bool
+		for _, a := range auths {
+			if a.IdempotencyKey == key && a.Status == chargeclient.AuthorizationStatusAuthorized {
+				auth.ID, auth.AmountCents, found = a.ID, a.AmountCents, true
+				break
+			}
+		}
+		// an authorization that failed, or that somebody already voided, leaves
+		// nothing to capture
+		if !found {
+			return i.finishRecovery(ctx, order, storage.OrderStatusPending, "recovered stuck authorization that failed")
+		}
+	}
+
+	// this only succeeds if the order is still authorizing so if the request
+	// finished it in the meantime we leave it alone
+	if err := i.stor.AuthorizeOrder(ctx, order.ID, auth); err != nil {
+		return fmt.Errorf("error updating order %s to authorized: %w", order.ID, err)
+	}
+	llog.Info("recovered stuck order", llog.KV{"id": order.ID, "from": order.Status.String(), "to": storage.OrderStatusAuthorized.String()})
+	return nil
+}
+
+// recoverVoid cancels an order stuck voiding if the charge service voided its
+// authorization and moves it back to authorized if the authorization is still
+// holding the money
+func (i *instance) recoverVoid(ctx context.Context, order storage.Order) error {
+	// just like voiding, there's no hold to release if there was nothing to
+	// authorize or if it already expired
+	auth := order.Authorization
+	if auth == nil || auth.ID == "" || auth.Expired(time.Now()) {
+		return i.finishRecovery(ctx, order, storage.OrderStatusCancelled, "recovered stuck void without a hold")
+	}
+
+	auths, err := i.charges.Authorizations(ctx, order.ID)
+	if err != nil {
+		return fmt.Errorf("error getting authorizations: %w", err)
+	}
+	for _, a := range auths {
+		if a.ID != auth.ID {
+			continue
+		}
+		switch a.Status {
+		case chargeclient.AuthorizationStatusVoided:
+			return i.finishRecovery(ctx, order, storage.OrderStatusCancelled, "recovered stuck void that succeeded")
+		case chargeclient.AuthorizationStatusAuthorized:
+			return i.finishRecovery(ctx, order, storage.OrderStatusAuthorized, "recovered stuck void that failed")
+		default:
+			return fmt.Errorf("authorization %s of order %s is %s", auth.ID, order.ID, a.Status)
+		}
+	}
+	return fmt.Errorf("authorization %s of order %s not found", auth.ID, order.ID)
+}
+
+// finishRecovery moves the stuck order to the to status, recording the reason
+// in its status history
+func (i *instance) finishRecovery(ctx context.Context, order storage.Order, to storage.OrderStatus, reason string) error {
+	// this only succeeds if the order is still stuck so if a request finished the
+	// change in the meantime we leave it alone
+	_, err := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{order.Status}, to, reason)
+	if err != nil {
+		return fmt.Errorf("error updating order %s to %v: %w", order.ID, to, err)
+	}
+	llog.Info("recovered stuck order", llog.KV{"id": order.ID, "from": order.Status.String(), "to": to.String()})
+	return nil
+}
+
+// recoverRefunds finishes every refund on the order that's been pending since
+// before by asking the charge service whether a refund with the refund's
+// idempotency key went through
+func (i *instance) recoverRefunds(ctx context.Context, order storage.Order, before time.Time) error {
+	charges, err := i.charges.Charges(ctx, order.ID)
+	if err != nil {
+		return fmt.Errorf("error getting charges: %w", err)
+	}
+	// failed refunds aren't returned so any refund whose key isn't here failed
+	refs := map[string]string{}
+	for _, charge := range charges {
+		if charge.IdempotencyKey != "" {
+			refs[charge.IdempotencyKey] = charge.ID
+		}
+	}
+
+	for _, refund := range order.Refunds {
+		if refund.Status != storage.RefundStatusPending || !refund.CreatedAt.Before(before) {
+			continue
+		}
+		status := storage.RefundStatusFailed
+		ref, ok := refs[refundIdempotencyKey(order.ID, refund.ID)]
+		if ok {
+			status = storage.RefundStatusSucceeded
+		}
+		// this only succeeds if the refund is still pending so if the request
+		// finished it in the meantime we leave it alone
+		err := i.stor.SetRefundStatus(ctx, order.ID, refund.ID, status, ref)
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error updating refund %s of order %s to %s: %w", refund.ID, order.ID, status, err)
+		}
+		llog.Info("recovered stuck refund", llog.KV{"id": order.ID, "refundId": refund.ID, "to": string(status)})
+	}
+	return nil
+}
+
+// expireAuthorizations moves every authorized order whose authorization
+// expired before now back to pending so it can be charged or authorized again.
+// The charge service is asked to void the authorization in case it holds it
+// for longer than we do, but since it's expired for us that's only logged if it
+// fails.
+func (i *instance) expireAuthorizations(ctx context.Context, now time.Time) error {
+	orders, err := i.stor.GetExpiredAuthorizations(ctx, now)
+	if err != nil {
+		return fmt.Errorf("error getting expired authorizations: %w", err)
+	}
+	for _, order := range orders {
+		// this only succeeds if the order is still authorized so an order that's
+		// being captured or voided is left alone
+		_, err := i.stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusPending, "authorization expired")
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			continue
+		} else if err != nil {
+			llog.Error("failed to expire authorization", llog.KV{"id": order.ID}, llog.ErrKV(err))
+			continue
+		}
+		llog.Info("expired authorization", llog.KV{"id": order.ID})
+
+		auth := order.Authorization
+		if auth == nil || auth.ID == "" {
+			continue
+		}
+		voidArgs := chargeclient.ChargeArgs{
+			AmountCents:    auth.AmountCents,
+			OrderID:        order.ID,
+			IdempotencyKey: voidIdempotencyKey(order.ID, auth.ID),
+		}
+		res, err := i.charges.Void(ctx, auth.ID, voidArgs)
+		i.recordPayment(ctx, order.ID, storage.PaymentKindVoid, voidArgs, res, err)
+		if err != nil {
+			llog.Warn("failed to void expired authorization", llog.KV{"id": order.ID, "authorizationId": auth.ID}, llog.ErrKV(err))
+		}
+	}
+	return nil
+}
+
+// recoverStaleOrders recovers every order that's been in one of the
+// recoverableStatuses since before and every refund that's been pending since
+// before
+func (i *instance) recoverStaleOrders(ctx context.Context, before time.Time) error {
+	orders, err := i.stor.GetStaleOrders(ctx, recoverableStatuses, before)
+	if err != nil {
+		return fmt.Errorf("error getting stale orders: %w", err)
+	}
+	for _, order := range orders {
+		// one order failing shouldn't stop the rest from being recovered and it'll
+		// be tried again next time
+		if err := i.recoverOrder(ctx, order); err != nil {
+			llog.Error("failed to recover stuck order", llog.KV{"id": order.ID}, llog.ErrKV(err))
+		}
+	}
+
+	orders, err = i.stor.GetStaleRefunds(ctx, before)
+	if err != nil {
+		return fmt.Errorf("error getting stale refunds: %w", err)
+	}
+	for _, order := range orders {
+		if err := i.recoverRefunds(ctx, order, before); err != nil {
+			llog.Error("failed to recover stuck refunds", llog.KV{"id": order.ID}, llog.ErrKV(err))
+		}
+	}
+	return nil
+}
+
+// RunRecovery looks for orders that have been stuck charging, refunding,
+// authorizing, capturing or voiding, and refunds that have been stuck pending,
+// for longer than timeout every interval and reconciles them with the charge
+// service. They get stuck if the service crashes in the middle of calling the
+// charge service. It also moves authorized orders whose authorization expired
+// back to pending. Recovered authorizations expire authorizationTTL after the
+// order started authorizing. This blocks until the context is cancelled. Every change it
+// makes is attributed to the recovery actor in the orders' status history.
+func RunRecovery(ctx context.Context, stor mocks.StorageInstance, charges *chargeclient.Client, interval, timeout, authorizationTTL time.Duration) {
+	ctx = storage.WithActor(ctx, recoveryActor)
+	inst := &instance{
+		stor:             stor,
+		charges:          charges,
+		authorizationTTL: authorizationTTL,
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := inst.recoverStaleOrders(ctx, time.Now().Add(-timeout)); err != nil {
+			llog.Error("failed to recover stale orders", llog.ErrKV(err))
+		}
+		if err := inst.expireAuthorizations(ctx, time.Now()); err != nil {
+			llog.Error("failed to expire authorizations", llog.ErrKV(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/chargeclient"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverStaleOrders(t *testing.T) {
+	ctx := context.Background()
+	lineItems := []storage.LineItem{
+		{
+			Description: "item 1",
+			Quantity:    1,
+			PriceCents:  100,
+		},
+	}
+	statuses := []storage.OrderStatus{
+		storage.OrderStatusCharging,
+		storage.OrderStatusRefunding,
+		storage.OrderStatusAuthorizing,
+		storage.OrderStatusCapturing,
+		storage.OrderStatusVoiding,
+	}
+	before := time.Now()
+
+	// a charging order that was charged should move to charged and one that wasn't
+	// should move back to pending
+	{
+		charged := storage.Order{ID: "order-charged", LineItems: lineItems, Status: storage.OrderStatusCharging}
+		notCharged := storage.Order{ID: "order-not-charged", LineItems: lineItems, Status: storage.OrderStatusCharging}
+		chgServ := mocks.NewFakeChargeService()
+		chgServ.AddCharge(charged.ID, 100)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{charged, notCharged}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, charged.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "recovered stuck charge that succeeded").Return(charged, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, notCharged.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, "recovered stuck charge that failed").Return(notCharged, nil).Once()
+		inst := &instance{stor: stor, charges: newChargeClient(mocks.NewMockedService(chgServ))}
+		err := inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// a refunding order that was refunded should move to cancelled and one that
+	// wasn't should move back to charged
+	{
+		refunded := storage.Order{ID: "order-refunded", LineItems: lineItems, Status: storage.OrderStatusRefunding}
+		notRefunded := storage.Order{ID: "order-not-refunded", LineItems: lineItems, Status: storage.OrderStatusRefunding}
+		chgServ := mocks.NewFakeChargeService()
+		chgServ.AddCharge(refunded.ID, 100)
+		chgServ.AddCharge(refunded.ID, -100)
+		chgServ.AddCharge(notRefunded.ID, 100)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{refunded, notRefunded}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, refunded.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "recovered stuck refund that succeeded").Return(refunded, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, notRefunded.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCharged, "recovered stuck refund that failed").Return(notRefunded, nil).Once()
+		inst := &instance{stor: stor, charges: newChargeClient(mocks.NewMockedService(chgServ))}
+		err := inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// a capturing order that was captured should move to charged and one that
+	// wasn't should move back to authorized
+	{
+		captured := storage.Order{ID: "order-captured", LineItems: lineItems, Status: storage.OrderStatusCapturing}
+		notCaptured := storage.Order{ID: "order-not-captured", LineItems: lineItems, Status: storage.OrderStatusCapturing}
+		chgServ := mocks.NewFakeChargeService()
+		chgServ.AddCharge(captured.ID, 100)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{captured, notCaptured}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, captured.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusCharged, "recovered stuck capture that succeeded").Return(captured, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, notCaptured.ID, []storage.OrderStatus{storage.OrderStatusCapturing}, storage.OrderStatusAuthorized, "recovered stuck capture that failed").Return(notCaptured, nil).Once()
+		inst := &instance{stor: stor, charges: newChargeClient(mocks.NewMockedService(chgServ))}
+		err := inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// an authorizing order the charge service authorized should be authorized
+	// with that authorization, expiring based on when it started authorizing,
+	// while one that wasn't authorized, or whose authorization was made for an
+	// earlier attempt or was already voided, should move back to pending
+	{
+		startedAt := before.Add(-time.Hour)
+		authorized := storage.Order{ID: "order-authorized", LineItems: lineItems, Status: storage.OrderStatusAuthorizing, StatusUpdatedAt: startedAt, PaymentAttempts: 2}
+		notAuthorized := storage.Order{ID: "order-not-authorized", LineItems: lineItems, Status: storage.OrderStatusAuthorizing, StatusUpdatedAt: startedAt, PaymentAttempts: 2}
+		voided := storage.Order{ID: "order-voided", LineItems: lineItems, Status: storage.OrderStatusAuthorizing, StatusUpdatedAt: startedAt, PaymentAttempts: 1}
+		chgServ := mocks.NewFakeChargeService()
+		chgs := newChargeClient(mocks.NewMockedService(chgServ))
+		auth, err := chgs.Authorize(ctx, chargeclient.ChargeArgs{
+			CardToken:      "amex",
+			AmountCents:    100,
+			OrderID:        authorized.ID,
+			IdempotencyKey: chargeIdempotencyKey(authorized.ID, "authorize", 2),
+		})
+		require.NoError(t, err)
+		_, err = chgs.Authorize(ctx, chargeclient.ChargeArgs{
+			CardToken:      "amex",
+			AmountCents:    100,
+			OrderID:        notAuthorized.ID,
+			IdempotencyKey: chargeIdempotencyKey(notAuthorized.ID, "authorize", 1),
+		})
+		require.NoError(t, err)
+		voidedAuth, err := chgs.Authorize(ctx, chargeclient.ChargeArgs{
+			CardToken:      "amex",
+			AmountCents:    100,
+			OrderID:        voided.ID,
+			IdempotencyKey: chargeIdempotencyKey(voided.ID, "authorize", 1),
+		})
+		require.NoError(t, err)
+		_, err = chgs.Void(ctx, voidedAuth.ID, chargeclient.ChargeArgs{OrderID: voided.ID, IdempotencyKey: voidIdempotencyKey(voided.ID, voidedAuth.ID)})
+		require.NoError(t, err)
+
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{authorized, notAuthorized, voided}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("AuthorizeOrder", ctx, authorized.ID, storage.Authorization{
+			ID:          auth.ID,
+			AmountCents: 100,
+			ExpiresAt:   startedAt.Add(24 * time.Hour),
+		}).Return(nil).Once()
+		stor.On("TransitionOrderStatus", ctx, notAuthorized.ID, []storage.OrderStatus{storage.OrderStatusAuthorizing}, storage.OrderStatusPending, "recovered stuck authorization that failed").Return(notAuthorized, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, voided.ID, []storage.OrderStatus{storage.OrderStatusAuthorizing}, storage.OrderStatusPending, "recovered stuck authorization that failed").Return(voided, nil).Once()
+		inst := &instance{stor: stor, charges: chgs, authorizationTTL: 24 * time.Hour}
+		err = inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// a voiding order whose authorization was voided should be cancelled and one
+	// whose authorization is still holding the money should move back to
+	// authorized, while one without a hold is cancelled without asking the charge
+	// service and one whose authorization the charge service doesn't know about
+	// is left alone
+	{
+		voided := storage.Order{ID: "order-voided", LineItems: lineItems, Status: storage.OrderStatusVoiding}
+		notVoided := storage.Order{ID: "order-not-voided", LineItems: lineItems, Status: storage.OrderStatusVoiding}
+		expired := storage.Order{ID: "order-expired", LineItems: lineItems, Status: storage.OrderStatusVoiding, Authorization: &storage.Authorization{ID: "auth_expired", AmountCents: 100, ExpiresAt: before.Add(-time.Hour)}}
+		unknown := storage.Order{ID: "order-unknown", LineItems: lineItems, Status: storage.OrderStatusVoiding, Authorization: &storage.Authorization{ID: "auth_unknown", AmountCents: 100, ExpiresAt: before.Add(time.Hour)}}
+		chgServ := mocks.NewFakeChargeService()
+		chgs := newChargeClient(mocks.NewMockedService(chgServ))
+		for _, order := range []*storage.Order{&voided, &notVoided} {
+			auth, err := chgs.Authorize(ctx, chargeclient.ChargeArgs{
+				CardToken:      "amex",
+				AmountCents:    100,
+				OrderID:        order.ID,
+				IdempotencyKey: chargeIdempotencyKey(order.ID, "authorize", 1),
+			})
+			require.NoError(t, err)
+			order.Authorization = &storage.Authorization{ID: auth.ID, AmountCents: 100, ExpiresAt: before.Add(time.Hour)}
+		}
+		_, err := chgs.Void(ctx, voided.Authorization.ID, chargeclient.ChargeArgs{OrderID: voided.ID, IdempotencyKey: voidIdempotencyKey(voided.ID, voided.Authorization.ID)})
+		require.NoError(t, err)
+
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{voided, notVoided, expired, unknown}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, voided.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "recovered stuck void that succeeded").Return(voided, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, notVoided.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusAuthorized, "recovered stuck void that failed").Return(notVoided, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, expired.ID, []storage.OrderStatus{storage.OrderStatusVoiding}, storage.OrderStatusCancelled, "recovered stuck void without a hold").Return(expired, nil).Once()
+		inst := &instance{stor: stor, charges: chgs}
+		err = inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// an order that was already moved by a request is left alone and doesn't stop
+	// the rest from being recovered
+	{
+		moved := storage.Order{ID: "order-moved", LineItems: lineItems, Status: storage.OrderStatusCharging}
+		stuck := storage.Order{ID: "order-stuck", LineItems: lineItems, Status: storage.OrderStatusCharging}
+		chgServ := mocks.NewFakeChargeService()
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return([]storage.Order{moved, stuck}, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return(nil, nil).Once()
+		stor.On("TransitionOrderStatus", ctx, moved.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, "recovered stuck charge that failed").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+		stor.On("TransitionOrderStatus", ctx, stuck.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusPending, "recovered stuck charge that failed").Return(stuck, nil).Once()
+		inst := &instance{stor: stor, charges: newChargeClient(mocks.NewMockedService(chgServ))}
+		err := inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// a pending refund that went through should succeed with the charge
+	// service's reference and one that didn't should fail, while refunds that
+	// aren't stale yet or aren't pending are left alone
+	{
+		order := storage.Order{
+			ID:        "order-refunds",
+			LineItems: lineItems,
+			Status:    storage.OrderStatusFulfilled,
+			Refunds: []storage.Refund{
+				{ID: "rf-1", AmountCents: 10, Status: storage.RefundStatusSucceeded, CreatedAt: before.Add(-time.Hour)},
+				{ID: "rf-2", AmountCents: 10, Status: storage.RefundStatusPending, CreatedAt: before.Add(-time.Hour)},
+				{ID: "rf-3", AmountCents: 10, Status: storage.RefundStatusPending, CreatedAt: before.Add(-time.Hour)},
+				{ID: "rf-4", AmountCents: 10, Status: storage.RefundStatusPending, CreatedAt: before.Add(time.Second)},
+			},
+		}
+		chgServ := mocks.NewFakeChargeService()
+		chgServ.AddCharge(order.ID, 100)
+		chgs := newChargeClient(mocks.NewMockedService(chgServ))
+		res, err := chgs.Refund(ctx, chargeclient.ChargeArgs{
+			CardToken:      "amex",
+			AmountCents:    10,
+			OrderID:        order.ID,
+			IdempotencyKey: refundIdempotencyKey(order.ID, "rf-2"),
+		})
+		require.NoError(t, err)
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return(nil, nil).Once()
+		stor.On("GetStaleRefunds", ctx, before).Return([]storage.Order{order}, nil).Once()
+		stor.On("SetRefundStatus", ctx, order.ID, "rf-2", storage.RefundStatusSucceeded, res.ID).Return(nil).Once()
+		stor.On("SetRefundStatus", ctx, order.ID, "rf-3", storage.RefundStatusFailed, "").Return(nil).Once()
+		inst := &instance{stor: stor, charges: chgs}
+		err = inst.recoverStaleOrders(ctx, before)
+		require.NoError(t, err)
+		stor.AssertExpectations(t)
+	}
+
+	// errors getting the stale orders are returned
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetStaleOrders", ctx, statuses, before).Return(nil, assert.AnError).Once()
+		inst := &instance{stor: stor, charges: newChargeClient(mocks.NewMockedService(mocks.NewFakeChargeService()))}
+		err := inst.recoverStaleOrders(ctx, before)
+		assert.ErrorIs(t, err, assert.AnError)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestExpireAuthorizations(t *testing.T) {
+	ctx := context.Background()
+	lineItems := []storage.LineItem{
+		{
+			Description: "item 1",
+			Quantity:    1,
+			PriceCents:  100,
+		},
+	}
+	now := time.Now()
+	chgServ := mocks.NewFakeChargeService()
+	chgs := newChargeClient(mocks.NewMockedService(chgServ))
+	res, err := chgs.Authorize(ctx, chargeclient.ChargeArgs{
+		CardToken:      "amex",
+		AmountCents:    100,
+		OrderID:        "order-expired",
+		IdempotencyKey: "order-expired:authorize:1",
+	})
+	require.NoError(t, err)
+
+	// expired orders move back to pending and their authorization is voided,
+	// unless there's nothing to void or the order was captured in the meantime
+	expired := storage.Order{
+		ID:            "order-expired",
+		LineItems:     lineItems,
+		Status:        storage.OrderStatusAuthorized,
+		Authorization: &storage.Authorization{ID: res.ID, AmountCents: 100, ExpiresAt: now.Add(-time.Minute)},
+	}
+	free := storage.Order{
+		ID:            "order-free",
+		Status:        storage.OrderStatusAuthorized,
+		Authorization: &storage.Authorization{ExpiresAt: now.Add(-time.Minute)},
+	}
+	captured := expired
+	captured.ID = "order-captured"
+
+	stor := new(mocks.MockStorageInstance)
+	stor.On("GetExpiredAuthorizations", ctx, now).Return([]storage.Order{expired, free, captured}, nil).Once()
+	stor.On("TransitionOrderStatus", ctx, expired.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusPending, "authorization expired").Return(expired, nil).Once()
+	stor.On("TransitionOrderStatus", ctx, free.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusPending, "authorization expired").Return(free, nil).Once()
+	stor.On("TransitionOrderStatus", ctx, captured.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusPending, "authorization expired").Return(storage.Order{}, storage.ErrInvalidTransition).Once()
+	stor.On("AddPayment", ctx, expired.ID, storage.Payment{
+		Kind:            storage.PaymentKindVoid,
+		AmountCents:     100,
+		IdempotencyKey:  voidIdempotencyKey(expired.ID, res.ID),
+		Outcome:         storage.PaymentOutcomeSucceeded,
+		ChargeReference: res.ID,
+	}).Return(nil).Once()
+	inst := &instance{stor: stor, charges: chgs}
+	err = inst.expireAuthorizations(ctx, now)
+	require.NoError(t, err)
+	stor.AssertExpectations(t)
+
+	// the authorization was voided so it can no longer be captured
+	_, err = chgs.Capture(ctx, res.ID, chargeclient.ChargeArgs{AmountCents: 100, OrderID: expired.ID, IdempotencyKey: "order-expired:capture:2"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// streamBufferSize is how many events can be waiting to be written to a
+// stream before it's considered too slow and closed
+const streamBufferSize = 256
+
+// streamKeepAlive is how often a comment is written to an idle stream so
+// proxies don't close the connection
+const streamKeepAlive = 15 * time.Second
+
+// streamable returns whether the event is sent to order streams, which only
+// care about orders being inserted or changing status
+func streamable(event storage.OrderEvent) bool {
+	return event.Type == storage.OrderEventCreated || event.StatusChange != nil
+}
+
+// streamSub is a single stream's subscription to the hub
+type streamSub struct {
+	// orderID is the only order the stream wants events for, or empty for every
+	// order
+	orderID string
+	events  chan storage.OrderEvent
+}
+
+// streamHub polls storage for new events and hands them to every open stream.
+// However many streams are open there's only one query every interval and none
+// at all while there aren't any streams.
+type streamHub struct {
+	stor     mocks.StorageInstance
+	interval time.Duration
+
+	mu   sync.Mutex
+	subs map[*streamSub]bool
+	// stop stops the poller, it's nil while the poller isn't running
+	stop context.CancelFunc
+}
+
+func newStreamHub(stor mocks.StorageInstance, interval time.Duration) *streamHub {
+	return &streamHub{
+		stor:     stor,
+		interval: interval,
+		subs:     map[*streamSub]bool{},
+	}
+}
+
+// subscribe returns a subscription to every streamable event recorded from now
+// on, starting the poller if it's the first one. The events channel is closed
+// if the stream falls too far behind.
+func (h *streamHub) subscribe(ctx context.Context, orderID string) (*streamSub, error) {
+	// the poller starts from whatever the newest event is now, anything older
+	// is read by the stream from storage
+	// that's read without holding the lock so a slow database doesn't hold up
+	// every other stream, which means the poller could start or stop in the
+	// meantime so this goes around once more to check again
+	var last int64
+	var haveLast bool
+	for {
+		h.mu.Lock()
+		if h.stop == nil && !haveLast {
+			h.mu.Unlock()
+			var err error
+			if last, err = h.stor.GetLastOrderEventSeq(ctx); err != nil {
+				return nil, fmt.Errorf("error getting last event: %w", err)
+			}
+			haveLast = true
+			continue
+		}
+		if h.stop == nil {
+			pollCtx, stop := context.WithCancel(context.Background())
+			h.stop = stop
+			go h.poll(pollCtx, last)
+		}
+		sub := &streamSub{
+			orderID: orderID,
+			events:  make(chan storage.OrderEvent, streamBufferSize),
+		}
+		h.subs[sub] = true
+		h.mu.Unlock()
+		return sub, nil
+	}
+}
+
+// unsubscribe removes the subscription, stopping the poller if it was the last
+// one
+func (h *streamHub) unsubscribe(sub *streamSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.subs[sub] {
+		return
+	}
+	delete(h.subs, sub)
+	close(sub.events)
+	if len(h.subs) == 0 && h.stop != nil {
+		h.stop()
+		h.stop = nil
+	}
+}
+
+// publish hands the event to every subscription that wants it. Subscriptions
+// that are full are dropped rather than holding up the others, their streams
+// end and the clients resume with Last-Event-ID.
+func (h *streamHub) publish(ctx context.Context, event storage.OrderEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// a poller that was stopped could still be finishing a poll and its events
+	// would be duplicates of the new poller's
+	if ctx.Err() != nil {
+		return
+	}
+	for sub := range h.subs {
+		if sub.orderID != "" && sub.orderID != event.OrderID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+	if len(h.subs) == 0 {
+		h.stop()
+		h.stop = nil
+	}
+}
+
+// poll publishes the streamable events with a Seq greater than after every
+// interval until the context is cancelled
+func (h *streamHub) poll(ctx context.Context, after int64) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// keep going until a page isn't full so a burst of events doesn't take
+		// more than one interval to catch up on
+		for {
+			events, err := h.stor.GetOrderEventsAfterSeq(ctx, "", after, storage.MaxOrderEventsLimit)
+			if err != nil {
+				if ctx.Err() == nil {
+					llog.Error("failed to get events for order streams", llog.ErrKV(err))
+				}
+				break
+			}
+			for _, event := range events {
+				after = event.Seq
+				if streamable(event) {
+					h.publish(ctx, event)
+				}
+			}
+			if len(events) < storage.MaxOrderEventsLimit {
+				break
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// writeStreamEvent writes the event to the stream with its Seq as the ID so
+// the client can resume after it
+func writeStreamEvent(c *gin.Context, event storage.OrderEvent) {
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatInt(event.Seq, 10),
+		Event: string(event.Type),
+		Data:  event,
+	})
+	c.Writer.Flush()
+}
+
+// stream writes the events of the order with the given ID, or of every order
+// if orderID is empty, to the response as server-sent events. Any events after
+// the Last-Event-ID header are read from storage first, then the new events
+// from the hub are written as they're recorded until the client goes away.
+func (i *instance) stream(c *gin.Context, orderID string) {
+	ctx := c.Request.Context()
+
+	// subscribing before reading the backlog means nothing recorded in between
+	// is missed, anything in both is skipped below by its Seq
+	sub, err := i.streams.subscribe(ctx, orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error subscribing to events: %v", err)})
+		return
+	}
+	defer i.streams.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// nginx buffers responses by default which would hold events back
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// an ID that isn't a Seq can't be resumed from so the stream just starts
+	// with the new events like it would without one
+	last, err := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+	if err == nil {
+		for {
+			events, err := i.stor.GetOrderEventsAfterSeq(ctx, orderID, last, storage.MaxOrderEventsLimit)
+			if err != nil {
+				// the headers were already sent so all that can be done is end the
+				// stream and let the client resume
+				llog.Error("failed to get events for order stream", llog.ErrKV(err))
+				return
+			}
+			for _, event := range events {
+				last = event.Seq
+				if streamable(event) {
+					writeStreamEvent(c, event)
+				}
+			}
+			if len(events) < storage.MaxOrderEventsLimit {
+				break
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		case event, ok := <-sub.events:
+			if !ok {
+				// the stream fell too far behind
+				return
+			}
+			if event.Seq <= last {
+				continue
+			}
+			last = event.Seq
+			writeStreamEvent(c, event)
+		}
+	}
+}
+
+// streamOrders is called by incoming HTTP GET requests to /orders/stream and
+// streams every order being inserted or changing status as server-sent events
+func (i *instance) streamOrders(c *gin.Context) {
+	i.stream(c, "")
+}
+
+// streamOrder is called by incoming HTTP GET requests to /orders/:id/stream and
+// streams the order changing status as server-sent events
+func (i *instance) streamOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if _, err := i.stor.GetOrder(ctx, id); err != nil {
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting order: %v", err)})
+		}
+		return
+	}
+	i.stream(c, id)
+}
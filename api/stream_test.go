@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamEvent is a single server-sent event read from a stream
+type streamEvent struct {
+	id    string
+	event string
+	data  storage.OrderEvent
+}
+
+// openStream connects to the stream at path, resuming after lastEventID if
+// it's set, and returns a channel of the events read from it. The stream is
+// closed when the test ends.
+func openStream(t *testing.T, srv *httptest.Server, path, lastEventID string) (*http.Response, <-chan streamEvent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan streamEvent, 16)
+	go func() {
+		defer close(events)
+		var ev streamEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev.id != "" {
+					events <- ev
+				}
+				ev = streamEvent{}
+			case strings.HasPrefix(line, "id:"):
+				ev.id = strings.TrimPrefix(line, "id:")
+			case strings.HasPrefix(line, "event:"):
+				ev.event = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev.data)
+			}
+		}
+	}()
+	return resp, events
+}
+
+// nextStreamEvent returns the next event from the stream or fails the test if
+// there isn't one soon
+func nextStreamEvent(t *testing.T, events <-chan streamEvent) streamEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		require.True(t, ok, "stream ended")
+		return ev
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for stream event")
+	}
+	return streamEvent{}
+}
+
+func TestStreamOrders(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	stor := memory.New()
+	srv := httptest.NewServer(Handler(stor, nil, nil, WithStreamInterval(10*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	// an order that exists before the stream is opened isn't sent
+	old, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "old@example.com"})
+	require.NoError(t, err)
+
+	resp, events := openStream(t, srv, "/orders/stream", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	id, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "new@example.com"})
+	require.NoError(t, err)
+	created := nextStreamEvent(t, events)
+	assert.Equal(t, string(storage.OrderEventCreated), created.event)
+	// the ID is the event's Seq so clients can resume from it
+	assert.Equal(t, strconv.FormatInt(created.data.Seq, 10), created.id)
+	assert.Equal(t, id, created.data.OrderID)
+	if assert.NotNil(t, created.data.Order) {
+		assert.Equal(t, "new@example.com", created.data.Order.CustomerEmail)
+	}
+
+	// events that aren't a status change aren't sent
+	require.NoError(t, stor.AddPayment(ctx, id, storage.Payment{Kind: storage.PaymentKindCharge, Outcome: storage.PaymentOutcomeFailed}))
+	require.NoError(t, stor.SetOrderStatus(ctx, old, storage.OrderStatusCancelled, "cancelled"))
+	changed := nextStreamEvent(t, events)
+	assert.Equal(t, string(storage.OrderEventStatusChanged), changed.event)
+	assert.Equal(t, old, changed.data.OrderID)
+	if assert.NotNil(t, changed.data.StatusChange) {
+		assert.Equal(t, storage.OrderStatusCancelled, changed.data.StatusChange.To)
+	}
+
+	// resuming sends everything after the last event from storage first and
+	// then keeps going
+	_, resumed := openStream(t, srv, "/orders/stream", created.id)
+	ev := nextStreamEvent(t, resumed)
+	assert.Equal(t, changed.id, ev.id)
+	require.NoError(t, stor.SetOrderStatus(ctx, id, storage.OrderStatusCancelled, "cancelled"))
+	ev = nextStreamEvent(t, resumed)
+	assert.Equal(t, id, ev.data.OrderID)
+	assert.Equal(t, string(storage.OrderEventStatusChanged), ev.event)
+	// the first stream gets it too and nothing is sent twice
+	ev = nextStreamEvent(t, events)
+	assert.Equal(t, id, ev.data.OrderID)
+	select {
+	case ev := <-resumed:
+		assert.Fail(t, "unexpected event", ev.id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamOrder(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	stor := memory.New()
+	srv := httptest.NewServer(Handler(stor, nil, nil, WithStreamInterval(10*time.Millisecond)))
+	t.Cleanup(srv.Close)
+
+	// an order that doesn't exist can't be streamed
+	resp, _ := openStream(t, srv, "/orders/notfound/stream", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	id, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "one@example.com"})
+	require.NoError(t, err)
+	other, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "two@example.com"})
+	require.NoError(t, err)
+	events, err := stor.GetOrderEvents(ctx, id, "", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// resuming from the created event only sends later events of the order
+	resp, stream := openStream(t, srv, "/orders/"+id+"/stream", strconv.FormatInt(events[0].Seq, 10))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, stor.SetOrderStatus(ctx, other, storage.OrderStatusCancelled, "cancelled"))
+	require.NoError(t, stor.SetOrderStatus(ctx, id, storage.OrderStatusCharged, "charged"))
+	ev := nextStreamEvent(t, stream)
+	assert.Equal(t, id, ev.data.OrderID)
+	if assert.NotNil(t, ev.data.StatusChange) {
+		assert.Equal(t, storage.OrderStatusCharged, ev.data.StatusChange.To)
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/webhook"
+)
+
+// minWebhookSecretLen is the shortest secret a webhook subscription can have
+// so signatures can't be guessed
+const minWebhookSecretLen = 16
+
+// defaultWebhookDeliveriesLimit is how many deliveries
+// GET /webhooks/:id/deliveries returns if the request doesn't have a limit
+const defaultWebhookDeliveriesLimit = 50
+
+// postWebhookArgs is the expected body for the POST /webhooks handler
+type postWebhookArgs struct {
+	URL        string                     `json:"url"`
+	EventTypes []storage.WebhookEventType `json:"eventTypes"`
+	Secret     string                     `json:"secret"`
+}
+
+// webhookRes is the result of the handlers that return a single webhook
+// subscription
+type webhookRes struct {
+	Webhook storage.WebhookSubscription `json:"webhook"`
+}
+
+// getWebhooksRes is the result of the GET /webhooks handler
+type getWebhooksRes struct {
+	Webhooks []storage.WebhookSubscription `json:"webhooks"`
+}
+
+// getWebhookDeliveriesRes is the result of the GET /webhooks/:id/deliveries
+// handler
+type getWebhookDeliveriesRes struct {
+	Deliveries []storage.WebhookDelivery `json:"deliveries"`
+	// NextCursor is passed as the cursor to get the next page of deliveries and
+	// is empty once there aren't any more
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// withoutSecret returns the subscription without its secret, which is never
+// returned once it's been set
+func withoutSecret(sub storage.WebhookSubscription) storage.WebhookSubscription {
+	sub.Secret = ""
+	return sub
+}
+
+// validateWebhookArgs returns why the args aren't a valid subscription, if
+// they aren't. The URL's host has to resolve to public addresses only so
+// partners can't have webhooks sent inside our own network.
+func (i *instance) validateWebhookArgs(ctx context.Context, args postWebhookArgs) error {
+	u, err := url.Parse(args.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(args.EventTypes) < 1 {
+		return fmt.Errorf("eventTypes must contain at least one of %v", storage.WebhookEventTypes)
+	}
+	seen := map[storage.WebhookEventType]bool{}
+	for _, typ := range args.EventTypes {
+		var known bool
+		for _, t := range storage.WebhookEventTypes {
+			known = known || t == typ
+		}
+		if !known {
+			return fmt.Errorf("unknown event type: %q", typ)
+		}
+		if seen[typ] {
+			return fmt.Errorf("duplicate event type: %q", typ)
+		}
+		seen[typ] = true
+	}
+	if len(args.Secret) < minWebhookSecretLen {
+		return fmt.Errorf("secret must be at least %d characters", minWebhookSecretLen)
+	}
+	// this is checked last since it has to look up the host
+	if err := webhook.CheckURL(ctx, i.webhookResolver, u); err != nil {
+		if errors.Is(err, webhook.ErrForbiddenAddress) {
+			return fmt.Errorf("url must only resolve to public addresses: %v", err)
+		}
+		return fmt.Errorf("url host must resolve: %v", err)
+	}
+	return nil
+}
+
+// postWebhook is called by incoming HTTP POST requests to /webhooks and
+// subscribes the URL to the event types
+func (i *instance) postWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var args postWebhookArgs
+	if err := c.BindJSON(&args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error decoding body: %v", err)})
+		return
+	}
+	if err := i.validateWebhookArgs(ctx, args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := storage.WebhookSubscription{
+		URL:        args.URL,
+		EventTypes: args.EventTypes,
+		Secret:     args.Secret,
+	}
+	id, err := i.stor.InsertWebhookSubscription(ctx, sub)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error inserting webhook: %v", err)})
+		return
+	}
+	// get it back so the response has the created time the storage filled in
+	sub, err = i.stor.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting webhook: %v", err)})
+		return
+	}
+	c.JSON(http.StatusCreated, webhookRes{Webhook: withoutSecret(sub)})
+}
+
+// getWebhooks is called by incoming HTTP GET requests to /webhooks
+func (i *instance) getWebhooks(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	subs, err := i.stor.GetWebhookSubscriptions(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting webhooks: %v", err)})
+		return
+	}
+	// this is initialized as an empty slice so it's encoded as [] instead of null
+	res := getWebhooksRes{Webhooks: []storage.WebhookSubscription{}}
+	for _, sub := range subs {
+		res.Webhooks = append(res.Webhooks, withoutSecret(sub))
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// getWebhook is called by incoming HTTP GET requests to /webhooks/:id
+func (i *instance) getWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	sub, err := i.stor.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrWebhookSubscriptionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting webhook: %v", err)})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, webhookRes{Webhook: withoutSecret(sub)})
+}
+
+// deleteWebhook is called by incoming HTTP DELETE requests to /webhooks/:id and
+// stops anything more from being sent to the subscription
+func (i *instance) deleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if err := i.stor.DeleteWebhookSubscription(ctx, id); err != nil {
+		if errors.Is(err, storage.ErrWebhookSubscriptionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error deleting webhook: %v", err)})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getWebhookDeliveries is called by incoming HTTP GET requests to
+// /webhooks/:id/deliveries and returns a page of the deliveries made to the
+// subscription, oldest first. Passing status=dead returns the dead-letter
+// list.
+func (i *instance) getWebhookDeliveries(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	var status storage.WebhookDeliveryStatus
+	switch v := storage.WebhookDeliveryStatus(c.Query("status")); v {
+	case "", storage.WebhookDeliveryStatusPending, storage.WebhookDeliveryStatusSucceeded, storage.WebhookDeliveryStatusDead:
+		status = v
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+	limit, ok := queryLimit(c, defaultWebhookDeliveriesLimit, storage.MaxWebhookDeliveriesLimit)
+	if !ok {
+		return
+	}
+	// just like the order events the cursor is the ID of the last delivery of
+	// the previous page
+	cursor := c.Query("cursor")
+
+	deliveries, err := i.stor.GetWebhookDeliveries(ctx, id, status, cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting webhook deliveries: %v", err)})
+		return
+	}
+	// deliveries are kept after their subscription is deleted so only a
+	// subscription without any needs to be checked
+	if len(deliveries) == 0 && cursor == "" {
+		if _, err := i.stor.GetWebhookSubscription(ctx, id); err != nil {
+			if errors.Is(err, storage.ErrWebhookSubscriptionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("error getting webhook: %v", err)})
+			}
+			return
+		}
+	}
+
+	// these are initialized as empty slices so they're encoded as [] instead of
+	// null
+	res := getWebhookDeliveriesRes{Deliveries: []storage.WebhookDelivery{}}
+	for _, d := range deliveries {
+		if d.Attempts == nil {
+			d.Attempts = []storage.WebhookAttempt{}
+		}
+		res.Deliveries = append(res.Deliveries, d)
+	}
+	if len(deliveries) == limit {
+		res.NextCursor = deliveries[len(deliveries)-1].ID
+	}
+	c.JSON(http.StatusOK, res)
+}
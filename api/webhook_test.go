@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves hosts from the map instead of looking them up
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestPostWebhook(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	args := postWebhookArgs{
+		URL:        "https://partner.example.com/hooks",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated, storage.WebhookEventOrderCharged},
+		Secret:     "0123456789abcdef",
+	}
+	resolver := fakeResolver{
+		"partner.example.com":  {netip.MustParseAddr("93.184.216.34")},
+		"internal.example.com": {netip.MustParseAddr("10.0.0.5")},
+		"rebind.example.com":   {netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")},
+	}
+	post := func(stor *mocks.MockStorageInstance, args postWebhookArgs) *httptest.ResponseRecorder {
+		byts, err := json.Marshal(args)
+		require.NoError(t, err)
+		h := Handler(stor, nil, nil, WithWebhookResolver(resolver))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/webhooks", bytes.NewReader(byts)).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// the subscription is stored and returned without its secret
+	{
+		stored := storage.WebhookSubscription{
+			ID:         "wh-1",
+			URL:        args.URL,
+			EventTypes: args.EventTypes,
+			Secret:     args.Secret,
+			CreatedAt:  time.Now().UTC(),
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("InsertWebhookSubscription", ctx, storage.WebhookSubscription{
+			URL:        args.URL,
+			EventTypes: args.EventTypes,
+			Secret:     args.Secret,
+		}).Return(stored.ID, nil).Once()
+		stor.On("GetWebhookSubscription", ctx, stored.ID).Return(stored, nil).Once()
+		w := post(stor, args)
+		if assert.Equal(t, http.StatusCreated, w.Code) {
+			var res webhookRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			stored.Secret = ""
+			assert.Equal(t, stored, res.Webhook)
+			assert.NotContains(t, w.Body.String(), args.Secret)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// invalid subscriptions are rejected
+	invalid := []func(a *postWebhookArgs){
+		func(a *postWebhookArgs) { a.URL = "" },
+		func(a *postWebhookArgs) { a.URL = "ftp://partner.example.com" },
+		func(a *postWebhookArgs) { a.URL = "/hooks" },
+		// URLs inside our own network can't be subscribed
+		func(a *postWebhookArgs) { a.URL = "http://127.0.0.1:8080/hooks" },
+		func(a *postWebhookArgs) { a.URL = "http://[::1]/hooks" },
+		func(a *postWebhookArgs) { a.URL = "http://169.254.169.254/latest/meta-data" },
+		func(a *postWebhookArgs) { a.URL = "http://100.100.100.200/latest/meta-data" },
+		func(a *postWebhookArgs) { a.URL = "http://[::ffff:10.0.0.1]/hooks" },
+		func(a *postWebhookArgs) { a.URL = "https://internal.example.com/hooks" },
+		func(a *postWebhookArgs) { a.URL = "https://rebind.example.com/hooks" },
+		func(a *postWebhookArgs) { a.URL = "https://unknown.example.com/hooks" },
+		func(a *postWebhookArgs) { a.EventTypes = nil },
+		func(a *postWebhookArgs) { a.EventTypes = []storage.WebhookEventType{"order.shipped"} },
+		func(a *postWebhookArgs) {
+			a.EventTypes = []storage.WebhookEventType{storage.WebhookEventOrderCreated, storage.WebhookEventOrderCreated}
+		},
+		func(a *postWebhookArgs) { a.Secret = "short" },
+	}
+	for idx, fn := range invalid {
+		bad := args
+		fn(&bad)
+		stor := new(mocks.MockStorageInstance)
+		w := post(stor, bad)
+		assert.Equal(t, http.StatusBadRequest, w.Code, idx)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestGetWebhooks(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	sub := storage.WebhookSubscription{
+		ID:         "wh-1",
+		URL:        "https://partner.example.com/hooks",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated},
+		Secret:     "0123456789abcdef",
+	}
+
+	// secrets are never returned
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookSubscriptions", ctx).Return([]storage.WebhookSubscription{sub}, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getWebhooksRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			if assert.Len(t, res.Webhooks, 1) {
+				assert.Equal(t, sub.ID, res.Webhooks[0].ID)
+				assert.Empty(t, res.Webhooks[0].Secret)
+			}
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// no subscriptions is an empty list
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookSubscriptions", ctx).Return(nil, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"webhooks":[]}`, w.Body.String())
+		stor.AssertExpectations(t)
+	}
+
+	// a single subscription can be looked up
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookSubscription", ctx, sub.ID).Return(sub, nil).Once()
+		stor.On("GetWebhookSubscription", ctx, "notfound").Return(storage.WebhookSubscription{}, storage.ErrWebhookSubscriptionNotFound).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/"+sub.ID, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res webhookRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, sub.URL, res.Webhook.URL)
+			assert.Empty(t, res.Webhook.Secret)
+		}
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/webhooks/notfound", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+	stor := new(mocks.MockStorageInstance)
+	stor.On("DeleteWebhookSubscription", ctx, "wh-1").Return(nil).Once()
+	stor.On("DeleteWebhookSubscription", ctx, "notfound").Return(storage.ErrWebhookSubscriptionNotFound).Once()
+	h := Handler(stor, nil, nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/webhooks/wh-1", nil).WithContext(ctx)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/webhooks/notfound", nil).WithContext(ctx)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	stor.AssertExpectations(t)
+}
+
+func TestGetWebhookDeliveries(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), defaultActor)
+
+	// the dead-letter list is a full page so it has a cursor
+	{
+		deliveries := []storage.WebhookDelivery{
+			{ID: "ev-1-wh-1", SubscriptionID: "wh-1", Status: storage.WebhookDeliveryStatusDead, Attempts: []storage.WebhookAttempt{{StatusCode: 500}}},
+			{ID: "ev-2-wh-1", SubscriptionID: "wh-1", Status: storage.WebhookDeliveryStatusDead, Attempts: []storage.WebhookAttempt{{Error: "timeout"}}},
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookDeliveries", ctx, "wh-1", storage.WebhookDeliveryStatusDead, "", 2).Return(deliveries, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/wh-1/deliveries?status=dead&limit=2", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getWebhookDeliveriesRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Len(t, res.Deliveries, 2)
+			assert.Equal(t, "ev-2-wh-1", res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// the cursor is passed along and the last page has no cursor
+	{
+		deliveries := []storage.WebhookDelivery{
+			{ID: "ev-3-wh-1", SubscriptionID: "wh-1", Status: storage.WebhookDeliveryStatusPending},
+		}
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookDeliveries", ctx, "wh-1", storage.WebhookDeliveryStatus(""), "ev-2-wh-1", defaultWebhookDeliveriesLimit).Return(deliveries, nil).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/wh-1/deliveries?cursor=ev-2-wh-1", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			var res getWebhookDeliveriesRes
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			if assert.Len(t, res.Deliveries, 1) {
+				// deliveries that haven't been tried yet have no attempts
+				assert.Equal(t, []storage.WebhookAttempt{}, res.Deliveries[0].Attempts)
+			}
+			assert.Empty(t, res.NextCursor)
+		}
+		stor.AssertExpectations(t)
+	}
+
+	// a subscription that doesn't exist is a 404
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("GetWebhookDeliveries", ctx, "notfound", storage.WebhookDeliveryStatus(""), "", defaultWebhookDeliveriesLimit).Return(nil, nil).Once()
+		stor.On("GetWebhookSubscription", ctx, "notfound").Return(storage.WebhookSubscription{}, storage.ErrWebhookSubscriptionNotFound).Once()
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/notfound/deliveries", nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		stor.AssertExpectations(t)
+	}
+
+	// invalid statuses and limits are rejected
+	for _, query := range []string{"status=failed", "limit=0", "limit=abc"} {
+		stor := new(mocks.MockStorageInstance)
+		h := Handler(stor, nil, nil)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/webhooks/wh-1/deliveries?"+query, nil).WithContext(ctx)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		stor.AssertExpectations(t)
+	}
+}
@@ -0,0 +1,75 @@
+package chargeclient
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker that opens after threshold failures in a row.
+// While it's open every request fails immediately so we don't pile more load
+// onto a charge service that's already struggling or make callers wait on
+// timeouts. Once cooldown passes a single request is let through and the
+// breaker closes again if it succeeds.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is set while the request let through after the cooldown hasn't
+	// finished yet
+	probing bool
+}
+
+// allow returns true if a request can be made
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// let this request through to test the charge service but keep the breaker
+	// open for everyone else until we know how it went
+	b.openUntil = now.Add(b.cooldown)
+	b.probing = true
+	return true
+}
+
+// success records that a request reached the charge service and closes the
+// breaker
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records that a request couldn't reach the charge service and opens
+// the breaker if that's happened too many times in a row
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.probing = false
+}
+
+// cancelled records that a request was given up on by the caller before we
+// knew whether the charge service is up, which doesn't count either way. If it
+// was the request testing the charge service the next one is let through
+// instead of waiting for another cooldown.
+func (b *breaker) cancelled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probing {
+		b.openUntil = time.Time{}
+		b.probing = false
+	}
+}
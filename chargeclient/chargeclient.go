@@ -0,0 +1,410 @@
+// Package chargeclient is a client for the charge service that charges and
+// refunds customers, or authorizes their card and captures the charge later.
+// It retries failures that are likely temporary and stops calling the charge
+// service for a while once it looks like it's down.
+package chargeclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrDeclined is returned when the charge service declined the charge, like
+	// when the card doesn't have enough funds
+	ErrDeclined = errors.New("charge declined")
+
+	// ErrInvalidToken is returned when the charge service doesn't accept the
+	// card token
+	ErrInvalidToken = errors.New("invalid card token")
+
+	// ErrUnavailable is returned when the charge service couldn't be reached or
+	// kept failing after every retry, or when the context was cancelled before it
+	// answered. The charge may or may not have gone through.
+	ErrUnavailable = errors.New("charge service unavailable")
+
+	// ErrCircuitOpen is returned instead of calling the charge service while the
+	// circuit breaker is open. Unlike ErrUnavailable nothing was sent so the
+	// charge definitely didn't go through.
+	ErrCircuitOpen = errors.New("charge service circuit breaker is open")
+)
+
+// Config describes how to talk to the charge service. The zero value of any
+// field falls back to the value from DefaultConfig.
+type Config struct {
+	// BaseURL is prepended to every path, like http://charges.internal. It can
+	// be empty if the http.Client's transport doesn't need a host, like in tests.
+	BaseURL string
+
+	// AttemptTimeout bounds how long a single request can take, on top of any
+	// deadline on the context passed in
+	AttemptTimeout time.Duration
+	// MaxAttempts is how many times a request is tried before giving up
+	MaxAttempts int
+	// MinBackoff is about how long to wait before the first retry, which doubles
+	// after every failure up to MaxBackoff. Each wait is randomized so that many
+	// clients don't retry at the same time.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// BreakerThreshold is how many requests in a row can fail to reach the
+	// charge service, or get a 5xx response from it, before the circuit breaker
+	// opens and requests fail with ErrCircuitOpen without calling it
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open before a
+	// request is allowed through to see if the charge service is back
+	BreakerCooldown time.Duration
+}
+
+// DefaultConfig returns the Config used when a field isn't set
+func DefaultConfig() Config {
+	return Config{
+		AttemptTimeout:   5 * time.Second,
+		MaxAttempts:      3,
+		MinBackoff:       100 * time.Millisecond,
+		MaxBackoff:       2 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// withDefaults returns a copy of the config with any unset fields set to their
+// values from DefaultConfig
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	if c.AttemptTimeout == 0 {
+		c.AttemptTimeout = def.AttemptTimeout
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = def.MaxAttempts
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = def.MinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = def.MaxBackoff
+	}
+	if c.BreakerThreshold == 0 {
+		c.BreakerThreshold = def.BreakerThreshold
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = def.BreakerCooldown
+	}
+	return c
+}
+
+// Client makes requests to the charge service. It's safe to use from many
+// goroutines at once and should be shared so they all use the same circuit
+// breaker.
+type Client struct {
+	cfg     Config
+	http    *http.Client
+	breaker *breaker
+}
+
+// New returns a Client that makes requests with httpClient, or
+// http.DefaultClient if it's nil
+func New(httpClient *http.Client, cfg Config) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	cfg = cfg.withDefaults()
+	return &Client{
+		cfg:  cfg,
+		http: httpClient,
+		breaker: &breaker{
+			threshold: cfg.BreakerThreshold,
+			cooldown:  cfg.BreakerCooldown,
+		},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ChargeArgs are the arguments to Charge, Refund, Authorize, Capture and Void
+type ChargeArgs struct {
+	// CardToken is left out when capturing or voiding since the authorization
+	// already knows the card
+	CardToken string `json:"cardToken,omitempty"`
+	// AmountCents is how much to charge, refund, authorize or capture and is
+	// always positive. It's ignored when voiding.
+	AmountCents int64 `json:"amountCents"`
+	// OrderID lets us ask the charge service for an order's charges later if we
+	// don't know whether a charge succeeded
+	OrderID string `json:"orderId"`
+	// IdempotencyKey is also sent as the Idempotency-Key header and tells the
+	// charge service that retries of the same request should only charge once.
+	// It's required since it's what makes retrying safe.
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+// ChargeResult is the charge service's response to a successful charge,
+// refund, authorization, capture or void
+type ChargeResult struct {
+	// ID is how the charge service refers to the charge, refund or
+	// authorization. It's empty if the charge service didn't return one.
+	ID string `json:"id"`
+}
+
+// Charge charges the customer's card AmountCents
+func (c *Client) Charge(ctx context.Context, args ChargeArgs) (ChargeResult, error) {
+	if args.AmountCents <= 0 {
+		return ChargeResult{}, fmt.Errorf("charge amount must be more than 0: %d", args.AmountCents)
+	}
+	return c.post(ctx, "/charge", args, http.StatusCreated)
+}
+
+// Refund refunds AmountCents to the customer's card
+func (c *Client) Refund(ctx context.Context, args ChargeArgs) (ChargeResult, error) {
+	if args.AmountCents <= 0 {
+		return ChargeResult{}, fmt.Errorf("refund amount must be more than 0: %d", args.AmountCents)
+	}
+	// the charge service treats negative charges as refunds
+	args.AmountCents *= -1
+	return c.post(ctx, "/charge", args, http.StatusCreated)
+}
+
+// Authorize places a hold for AmountCents on the customer's card without
+// charging it. The result's ID is what's passed to Capture or Void.
+func (c *Client) Authorize(ctx context.Context, args ChargeArgs) (ChargeResult, error) {
+	if args.AmountCents <= 0 {
+		return ChargeResult{}, fmt.Errorf("authorization amount must be more than 0: %d", args.AmountCents)
+	}
+	return c.post(ctx, "/authorizations", args, http.StatusCreated)
+}
+
+// Capture charges AmountCents, which can't be more than what was authorized,
+// from the authorization with the given ID. The capture is a charge like any
+// other so it's returned by Charges and can be refunded.
+func (c *Client) Capture(ctx context.Context, authorizationID string, args ChargeArgs) (ChargeResult, error) {
+	if authorizationID == "" {
+		return ChargeResult{}, errors.New("missing authorization id")
+	}
+	if args.AmountCents <= 0 {
+		return ChargeResult{}, fmt.Errorf("capture amount must be more than 0: %d", args.AmountCents)
+	}
+	return c.post(ctx, "/authorizations/"+url.PathEscape(authorizationID)+"/capture", args, http.StatusCreated)
+}
+
+// Void releases the hold of the authorization with the given ID so it can no
+// longer be captured
+func (c *Client) Void(ctx context.Context, authorizationID string, args ChargeArgs) (ChargeResult, error) {
+	if authorizationID == "" {
+		return ChargeResult{}, errors.New("missing authorization id")
+	}
+	args.AmountCents = 0
+	return c.post(ctx, "/authorizations/"+url.PathEscape(authorizationID)+"/void", args, http.StatusOK)
+}
+
+// post makes a POST request with the args to one of the charge service's
+// endpoints that moves money
+func (c *Client) post(ctx context.Context, path string, args ChargeArgs, expected int) (ChargeResult, error) {
+	if args.IdempotencyKey == "" {
+		return ChargeResult{}, errors.New("missing idempotency key")
+	}
+	byts, err := json.Marshal(args)
+	if err != nil {
+		return ChargeResult{}, fmt.Errorf("error encoding charge body: %w", err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Idempotency-Key", args.IdempotencyKey)
+
+	body, err := c.do(ctx, http.MethodPost, path, header, byts, expected)
+	if err != nil {
+		return ChargeResult{}, err
+	}
+	var res ChargeResult
+	// the request already went through so a body we can't decode isn't a reason
+	// to fail it, the result is just missing the ID
+	if len(body) > 0 {
+		_ = json.Unmarshal(body, &res)
+	}
+	return res, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ChargeRecord is a single successful charge, or refund if the amount is
+// negative, made by the charge service
+type ChargeRecord struct {
+	// ID is the same ID returned in the ChargeResult when the charge was made
+	ID          string `json:"id"`
+	AmountCents int64  `json:"amountCents"`
+	// IdempotencyKey is the key the charge was made with, if any
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+// chargesRes is the result of the GET /charges endpoint of the charge service
+type chargesRes struct {
+	Charges []ChargeRecord `json:"charges"`
+}
+
+// Charges returns every successful charge and refund the charge service has
+// made for the order
+func (c *Client) Charges(ctx context.Context, orderID string) ([]ChargeRecord, error) {
+	body, err := c.do(ctx, http.MethodGet, "/charges?orderId="+url.QueryEscape(orderID), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var res chargesRes
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("error decoding charges: %w", err)
+	}
+	return res.Charges, nil
+}
+
+// AuthorizationStatus is what happened to an authorization after it was made
+type AuthorizationStatus string
+
+// All of the possible AuthorizationStatus values
+const (
+	// AuthorizationStatusAuthorized is an authorization that still holds the
+	// money and can be captured or voided
+	AuthorizationStatusAuthorized AuthorizationStatus = "authorized"
+	AuthorizationStatusCaptured   AuthorizationStatus = "captured"
+	AuthorizationStatusVoided     AuthorizationStatus = "voided"
+)
+
+// AuthorizationRecord is a single successful authorization made by the charge
+// service
+type AuthorizationRecord struct {
+	// ID is the same ID returned in the ChargeResult when the authorization was
+	// made
+	ID          string `json:"id"`
+	AmountCents int64  `json:"amountCents"`
+	// IdempotencyKey is the key the authorization was made with, if any
+	IdempotencyKey string              `json:"idempotencyKey"`
+	Status         AuthorizationStatus `json:"status"`
+}
+
+// authorizationsRes is the result of the GET /authorizations endpoint of the
+// charge service
+type authorizationsRes struct {
+	Authorizations []AuthorizationRecord `json:"authorizations"`
+}
+
+// Authorizations returns every successful authorization the charge service has
+// made for the order, including ones that were since captured or voided
+func (c *Client) Authorizations(ctx context.Context, orderID string) ([]AuthorizationRecord, error) {
+	body, err := c.do(ctx, http.MethodGet, "/authorizations?orderId="+url.QueryEscape(orderID), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var res authorizationsRes
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("error decoding authorizations: %w", err)
+	}
+	return res.Authorizations, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// do makes the request, retrying it with backoff if it fails in a way that's
+// likely temporary, and returns the response body if the response had the
+// expected status code
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, expected int) ([]byte, error) {
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	backoff := c.cfg.MinBackoff
+	for attempt := 1; ; attempt++ {
+		res, retriable, down, err := c.attempt(ctx, method, path, header, body, expected)
+		if err == nil {
+			c.breaker.success()
+			return res, nil
+		}
+		if !retriable {
+			// the charge service answered so it's up even if it didn't like the
+			// request
+			c.breaker.success()
+			return nil, err
+		}
+		if attempt >= c.cfg.MaxAttempts || ctx.Err() != nil {
+			c.giveUp(ctx, down)
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+
+		// wait somewhere between half and all of the backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			c.giveUp(ctx, down)
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// giveUp tells the circuit breaker how a request that's out of retries went.
+// down is whether the last attempt couldn't reach the charge service or got a
+// 5xx response. The caller giving up, like a client hanging up, says nothing
+// about the charge service so it isn't counted either way.
+func (c *Client) giveUp(ctx context.Context, down bool) {
+	switch {
+	case ctx.Err() != nil:
+		c.breaker.cancelled()
+	case down:
+		c.breaker.failure()
+	default:
+		// the charge service answered, it's just asking us to slow down
+		c.breaker.success()
+	}
+}
+
+// attempt makes a single request. If it fails it also returns whether it's
+// worth trying again and whether the charge service looks down, which is when
+// it couldn't be reached or responded with a 5xx.
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte, expected int) ([]byte, bool, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.AttemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, false, fmt.Errorf("error creating request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// we don't know whether the charge service got the request but the
+		// idempotency key makes sure it's only charged once if it did
+		return nil, true, true, fmt.Errorf("error making request: %w", err)
+	}
+	// we need to make sure we close the body otherwise this will leak memory
+	defer resp.Body.Close()
+	// the body has to be read before the attempt's context is cancelled
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, true, fmt.Errorf("error reading response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == expected:
+		return res, false, false, nil
+	case resp.StatusCode == http.StatusPaymentRequired:
+		return nil, false, false, fmt.Errorf("%w: %s", ErrDeclined, res)
+	case resp.StatusCode == http.StatusBadRequest:
+		return nil, false, false, fmt.Errorf("%w: %s", ErrInvalidToken, res)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, true, true, fmt.Errorf("unexpected response: %d %s", resp.StatusCode, res)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, true, false, fmt.Errorf("unexpected response: %d %s", resp.StatusCode, res)
+	default:
+		return nil, false, false, fmt.Errorf("unexpected response: %d %s", resp.StatusCode, res)
+	}
+}
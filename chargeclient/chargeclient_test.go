@@ -0,0 +1,311 @@
+package chargeclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig doesn't wait long between retries so the tests stay fast
+var testConfig = Config{
+	AttemptTimeout:   100 * time.Millisecond,
+	MaxAttempts:      3,
+	MinBackoff:       time.Millisecond,
+	MaxBackoff:       time.Millisecond,
+	BreakerThreshold: 2,
+	BreakerCooldown:  time.Hour,
+}
+
+// transportFunc implements http.RoundTripper with a function
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestCharge(t *testing.T) {
+	ctx := context.Background()
+	args := ChargeArgs{
+		CardToken:      "amex",
+		AmountCents:    100,
+		OrderID:        "order-1234",
+		IdempotencyKey: "order-1234:charge:1",
+	}
+
+	// should POST the args with the idempotency key
+	{
+		var calls int64
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			require.Equal(t, "/charge", r.URL.Path)
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, args.IdempotencyKey, r.Header.Get("Idempotency-Key"))
+			var got ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+			require.Equal(t, args, got)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"ch_1"}`))
+		})), testConfig)
+		res, err := client.Charge(ctx, args)
+		require.NoError(t, err)
+		assert.Equal(t, "ch_1", res.ID)
+		assert.EqualValues(t, 1, calls)
+	}
+
+	// should send refunds as negative charges
+	{
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var got ChargeArgs
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+			require.EqualValues(t, -100, got.AmountCents)
+			w.WriteHeader(http.StatusCreated)
+		})), testConfig)
+		_, err := client.Refund(ctx, args)
+		require.NoError(t, err)
+	}
+
+	// should reject bad amounts and missing keys without calling the service
+	{
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("charge service should not be called")
+		})), testConfig)
+		bad := args
+		bad.AmountCents = 0
+		_, err := client.Charge(ctx, bad)
+		assert.Error(t, err)
+		_, err = client.Refund(ctx, bad)
+		assert.Error(t, err)
+		bad = args
+		bad.IdempotencyKey = ""
+		_, err = client.Charge(ctx, bad)
+		assert.Error(t, err)
+	}
+
+	// should return typed errors without retrying
+	for status, expected := range map[int]error{
+		http.StatusPaymentRequired: ErrDeclined,
+		http.StatusBadRequest:      ErrInvalidToken,
+	} {
+		var calls int64
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			http.Error(w, "nope", status)
+		})), testConfig)
+		_, err := client.Charge(ctx, args)
+		assert.True(t, errors.Is(err, expected), "%d: %v", status, err)
+		assert.EqualValues(t, 1, calls)
+	}
+
+	// should retry server errors and succeed if a retry does
+	{
+		var calls int64
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&calls, 1) < 3 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		})), testConfig)
+		_, err := client.Charge(ctx, args)
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, calls)
+	}
+
+	// should time out each attempt and return unavailable once they run out
+	{
+		var calls int64
+		// this acts like a real transport that never gets a response
+		client := New(&http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt64(&calls, 1)
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}),
+		}, testConfig)
+		_, err := client.Charge(ctx, args)
+		assert.True(t, errors.Is(err, ErrUnavailable), "%v", err)
+		assert.EqualValues(t, 3, calls)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	chgServ := mocks.NewFakeChargeService()
+	client := New(mocks.NewMockedService(chgServ), testConfig)
+	args := ChargeArgs{
+		CardToken:      "amex",
+		AmountCents:    100,
+		OrderID:        "order-1234",
+		IdempotencyKey: "order-1234:authorize:1",
+	}
+
+	// authorizing doesn't charge anything until it's captured
+	auth, err := client.Authorize(ctx, args)
+	require.NoError(t, err)
+	require.NotEmpty(t, auth.ID)
+	charges, err := client.Charges(ctx, args.OrderID)
+	require.NoError(t, err)
+	assert.Empty(t, charges)
+
+	// capturing charges the customer and retries with the same key don't charge
+	// them again
+	capture := ChargeArgs{AmountCents: 100, OrderID: args.OrderID, IdempotencyKey: "order-1234:capture:2"}
+	res, err := client.Capture(ctx, auth.ID, capture)
+	require.NoError(t, err)
+	again, err := client.Capture(ctx, auth.ID, capture)
+	require.NoError(t, err)
+	assert.Equal(t, res.ID, again.ID)
+	charges, err = client.Charges(ctx, args.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, []ChargeRecord{{ID: res.ID, AmountCents: 100, IdempotencyKey: capture.IdempotencyKey}}, charges)
+
+	// a captured authorization can't be voided
+	_, err = client.Void(ctx, auth.ID, ChargeArgs{OrderID: args.OrderID, IdempotencyKey: "order-1234:void:" + auth.ID})
+	assert.Error(t, err)
+
+	// a voided authorization can't be captured
+	captured := auth
+	auth, err = client.Authorize(ctx, ChargeArgs{CardToken: "amex", AmountCents: 100, OrderID: args.OrderID, IdempotencyKey: "order-1234:authorize:3"})
+	require.NoError(t, err)
+	_, err = client.Void(ctx, auth.ID, ChargeArgs{OrderID: args.OrderID, IdempotencyKey: "order-1234:void:" + auth.ID})
+	require.NoError(t, err)
+	_, err = client.Capture(ctx, auth.ID, ChargeArgs{AmountCents: 100, OrderID: args.OrderID, IdempotencyKey: "order-1234:capture:4"})
+	assert.Error(t, err)
+
+	// both authorizations are listed with what happened to them
+	auths, err := client.Authorizations(ctx, args.OrderID)
+	require.NoError(t, err)
+	assert.Equal(t, []AuthorizationRecord{
+		{ID: captured.ID, AmountCents: 100, IdempotencyKey: args.IdempotencyKey, Status: AuthorizationStatusCaptured},
+		{ID: auth.ID, AmountCents: 100, IdempotencyKey: "order-1234:authorize:3", Status: AuthorizationStatusVoided},
+	}, auths)
+	auths, err = client.Authorizations(ctx, "order-other")
+	require.NoError(t, err)
+	assert.Empty(t, auths)
+
+	// bad amounts and missing authorization IDs are rejected without calling the
+	// charge service
+	_, err = client.Authorize(ctx, ChargeArgs{CardToken: "amex", OrderID: args.OrderID, IdempotencyKey: "key"})
+	assert.Error(t, err)
+	_, err = client.Capture(ctx, "", capture)
+	assert.Error(t, err)
+	_, err = client.Void(ctx, "", capture)
+	assert.Error(t, err)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	args := ChargeArgs{
+		CardToken:      "amex",
+		AmountCents:    100,
+		OrderID:        "order-1234",
+		IdempotencyKey: "order-1234:charge:1",
+	}
+
+	var calls, healthy int64
+	client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if atomic.LoadInt64(&healthy) == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})), testConfig)
+
+	// after 2 failed charges the breaker opens and the service isn't called
+	for i := 0; i < 2; i++ {
+		_, err := client.Charge(ctx, args)
+		assert.True(t, errors.Is(err, ErrUnavailable))
+	}
+	assert.EqualValues(t, 6, calls)
+	_, err := client.Charge(ctx, args)
+	assert.True(t, errors.Is(err, ErrCircuitOpen), "%v", err)
+	assert.False(t, errors.Is(err, ErrUnavailable))
+	assert.EqualValues(t, 6, calls)
+
+	// once the cooldown passes a single request is let through and closes the
+	// breaker if it succeeds
+	atomic.StoreInt64(&healthy, 1)
+	client.breaker.mu.Lock()
+	client.breaker.openUntil = time.Now()
+	client.breaker.mu.Unlock()
+	_, err = client.Charge(ctx, args)
+	require.NoError(t, err)
+	_, err = client.Charge(ctx, args)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, calls)
+}
+
+func TestCircuitBreakerIgnores(t *testing.T) {
+	args := ChargeArgs{
+		CardToken:      "amex",
+		AmountCents:    100,
+		OrderID:        "order-1234",
+		IdempotencyKey: "order-1234:charge:1",
+	}
+
+	// callers hanging up shouldn't open the breaker since the charge service
+	// might be fine
+	{
+		var calls int64
+		client := New(&http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt64(&calls, 1)
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}),
+		}, testConfig)
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			_, err := client.Charge(ctx, args)
+			cancel()
+			assert.True(t, errors.Is(err, ErrUnavailable), "%v", err)
+		}
+		assert.EqualValues(t, 3, calls)
+	}
+
+	// neither should being rate limited since the charge service answered
+	{
+		var calls int64
+		client := New(mocks.NewMockedService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&calls, 1)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		})), testConfig)
+		for i := 0; i < 3; i++ {
+			_, err := client.Charge(context.Background(), args)
+			assert.True(t, errors.Is(err, ErrUnavailable), "%v", err)
+		}
+		assert.EqualValues(t, 9, calls)
+	}
+
+	// a cancelled request testing the charge service after the cooldown lets
+	// the next one through instead of waiting another cooldown
+	{
+		client := New(&http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				if err := r.Context().Err(); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: http.StatusCreated, Body: http.NoBody}, nil
+			}),
+		}, testConfig)
+		client.breaker.mu.Lock()
+		client.breaker.failures = testConfig.BreakerThreshold
+		client.breaker.mu.Unlock()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.Charge(ctx, args)
+		assert.True(t, errors.Is(err, ErrUnavailable), "%v", err)
+		_, err = client.Charge(context.Background(), args)
+		require.NoError(t, err)
+	}
+}
@@ -8,17 +8,166 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/order-up/api"
+	"github.com/levenlabs/order-up/chargeclient"
 	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/outbox"
 	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/storage/memory"
+	"github.com/levenlabs/order-up/webhook"
 )
 
 func main() {
 	// flag.String returns a pointer to a string value that is set after
 	// flag.Parse() is called
 	addr := flag.String("listen-addr", "localhost:8888", "the address to listen on for API requests")
+	storageBackend := flag.String("storage", "mongo", "the storage backend to use, either mongo or memory")
+
+	// the database flags write directly into the config and default to the
+	// values for local development
+	storageCfg := storage.DefaultConfig()
+	flag.StringVar(&storageCfg.URI, "mongo-uri", storageCfg.URI, "the MongoDB connection string")
+	flag.StringVar(&storageCfg.Database, "mongo-database", storageCfg.Database, "the database to store orders in")
+	flag.StringVar(&storageCfg.Collection, "mongo-collection", storageCfg.Collection, "the collection to store orders in")
+	flag.StringVar(&storageCfg.IdempotencyCollection, "mongo-idempotency-collection", storageCfg.IdempotencyCollection, "the collection to store idempotency keys in")
+	flag.StringVar(&storageCfg.EventCollection, "mongo-event-collection", storageCfg.EventCollection, "the collection to store the event log of every order in")
+	flag.StringVar(&storageCfg.CounterCollection, "mongo-counter-collection", storageCfg.CounterCollection, "the collection to store the counter numbering order events in")
+	flag.StringVar(&storageCfg.OutboxCollection, "mongo-outbox-collection", storageCfg.OutboxCollection, "the collection to store how far order events were delivered to each outbox sink in")
+	flag.StringVar(&storageCfg.WebhookCollection, "mongo-webhook-collection", storageCfg.WebhookCollection, "the collection to store webhook subscriptions in")
+	flag.StringVar(&storageCfg.WebhookDeliveryCollection, "mongo-webhook-delivery-collection", storageCfg.WebhookDeliveryCollection, "the collection to store webhook deliveries in")
+	flag.StringVar(&storageCfg.Username, "mongo-username", "", "the username to authenticate to MongoDB with")
+	flag.StringVar(&storageCfg.Password, "mongo-password", "", "the password to authenticate to MongoDB with")
+	flag.StringVar(&storageCfg.AuthSource, "mongo-auth-source", storageCfg.AuthSource, "the database the MongoDB credentials are defined in")
+	flag.BoolVar(&storageCfg.TLS, "mongo-tls", false, "connect to MongoDB over TLS")
+	flag.StringVar(&storageCfg.TLSCAFile, "mongo-tls-ca-file", "", "a PEM file of certificate authorities to trust for MongoDB")
+	flag.BoolVar(&storageCfg.TLSInsecureSkipVerify, "mongo-tls-insecure", false, "skip verifying MongoDB's TLS certificate (local testing only)")
+	flag.DurationVar(&storageCfg.ConnectTimeout, "mongo-connect-timeout", storageCfg.ConnectTimeout, "how long to wait when connecting to MongoDB")
+	flag.DurationVar(&storageCfg.ServerSelectionTimeout, "mongo-server-selection-timeout", storageCfg.ServerSelectionTimeout, "how long an operation waits for an available MongoDB server")
+	flag.Uint64Var(&storageCfg.MaxPoolSize, "mongo-max-pool-size", storageCfg.MaxPoolSize, "the maximum number of connections to each MongoDB server")
+	flag.Uint64Var(&storageCfg.MinPoolSize, "mongo-min-pool-size", storageCfg.MinPoolSize, "the minimum number of connections to each MongoDB server")
+	storageConnectWait := flag.Duration("storage-connect-wait", time.Minute, "how long to keep retrying to connect to the database on startup before giving up")
+	// the charge service flags work the same way as the database flags
+	chargeCfg := chargeclient.DefaultConfig()
+	flag.StringVar(&chargeCfg.BaseURL, "charge-service-url", "", "the base URL of the charge service, like http://charges.internal")
+	flag.DurationVar(&chargeCfg.AttemptTimeout, "charge-attempt-timeout", chargeCfg.AttemptTimeout, "how long a single request to the charge service can take")
+	flag.IntVar(&chargeCfg.MaxAttempts, "charge-max-attempts", chargeCfg.MaxAttempts, "how many times a request to the charge service is tried before giving up")
+	flag.IntVar(&chargeCfg.BreakerThreshold, "charge-breaker-threshold", chargeCfg.BreakerThreshold, "how many charge service requests in a row can fail before failing fast")
+	flag.DurationVar(&chargeCfg.BreakerCooldown, "charge-breaker-cooldown", chargeCfg.BreakerCooldown, "how long to fail fast before trying the charge service again")
+	fulfillmentURL := flag.String("fulfillment-service-url", "", "the base URL of the fulfillment service, like http://fulfillment.internal")
+	fulfillmentTimeout := flag.Duration("fulfillment-service-timeout", 10*time.Second, "how long a single request to the fulfillment service can take")
+	fakeChargeService := flag.Bool("fake-charge-service", false, "use an in-memory fake charge service that accepts every charge, for local runs")
+	recoveryInterval := flag.Duration("recovery-interval", time.Minute, "how often to look for orders stuck calling the charge service and expired authorizations")
+	recoveryTimeout := flag.Duration("recovery-timeout", 5*time.Minute, "how long an order can be calling the charge service, like charging, before it's considered stuck")
+	idempotencyKeyTTL := flag.Duration("idempotency-key-ttl", 24*time.Hour, "how long responses to requests with an Idempotency-Key header are kept for retries")
+	idempotencyKeyLease := flag.Duration("idempotency-key-lease", 2*time.Minute, "how long a request with an Idempotency-Key header holds the key while it's handled, should be longer than any request takes")
+	authorizationTTL := flag.Duration("authorization-ttl", 7*24*time.Hour, "how long an authorized order can be captured for before it moves back to pending")
+	exportTimeout := flag.Duration("export-timeout", 10*time.Minute, "the longest exporting orders can take before the download is cut off")
+	streamInterval := flag.Duration("stream-interval", time.Second, "how often to look for new order events while clients are connected to an order stream")
+	outboxInterval := flag.Duration("outbox-interval", time.Second, "how often to deliver pending order events to the outbox sinks")
+	outboxSinkURLs := flag.String("outbox-sink-urls", "", "a comma-separated list of URLs to POST every order event to")
+	outboxSinkTimeout := flag.Duration("outbox-sink-timeout", 10*time.Second, "how long POSTing an order event to an outbox sink URL can take")
+	outboxLog := flag.Bool("outbox-log", false, "log every order event, for local runs")
+	// the webhook flags work the same way as the database flags
+	webhookCfg := webhook.DefaultConfig()
+	flag.DurationVar(&webhookCfg.AttemptTimeout, "webhook-attempt-timeout", webhookCfg.AttemptTimeout, "how long a single webhook request can take")
+	flag.IntVar(&webhookCfg.Concurrency, "webhook-concurrency", webhookCfg.Concurrency, "how many webhook requests can be in flight at once, with at most one per subscription")
+	flag.IntVar(&webhookCfg.MaxAttempts, "webhook-max-attempts", webhookCfg.MaxAttempts, "how many times a webhook delivery is tried before it's put on the dead-letter list")
+	flag.DurationVar(&webhookCfg.MinBackoff, "webhook-min-backoff", webhookCfg.MinBackoff, "about how long to wait before retrying a failed webhook delivery the first time")
+	flag.DurationVar(&webhookCfg.MaxBackoff, "webhook-max-backoff", webhookCfg.MaxBackoff, "the longest to wait before retrying a failed webhook delivery")
+	webhookInterval := flag.Duration("webhook-interval", time.Second, "how often to send webhook deliveries that are due")
 	flag.Parse()
+	parseEnv()
+
+	// the memory backend lets you run the whole service without a database but
+	// everything is lost once the process stops
+	var stor mocks.StorageInstance
+	switch *storageBackend {
+	case "mongo":
+		inst, err := connectStorage(storageCfg, *storageConnectWait)
+		if err != nil {
+			llog.Fatal("failed to connect to database", llog.ErrKV(err))
+		}
+		// this is deferred before the server's shutdown below so it runs after the
+		// server stops handling requests
+		defer inst.Close(context.Background())
+		stor = inst
+	case "memory":
+		stor = memory.New()
+	default:
+		llog.Fatal("unknown storage backend", llog.KV{"storage": *storageBackend})
+	}
+
+	// without a URL for a service every request to it fails, which is fine for
+	// local runs that don't need it
+	fulfillmentService := mocks.NewMockedService(unimplementedHandler)
+	if *fulfillmentURL != "" {
+		fulfillmentService = &http.Client{Timeout: *fulfillmentTimeout}
+	}
+	chargeService := mocks.NewMockedService(unimplementedHandler)
+	switch {
+	case *fakeChargeService:
+		chargeService = mocks.NewMockedService(mocks.NewFakeChargeService())
+	case chargeCfg.BaseURL != "":
+		// the client applies its own timeout to every attempt
+		chargeService = new(http.Client)
+	}
+	// the recovery worker and the handler share a client so they share the
+	// circuit breaker too
+	charges := chargeclient.New(chargeService, chargeCfg)
+
+	// the background workers run until main returns and cancels the context,
+	// and main waits for them to stop before the database is closed so the
+	// outbox can release its cursors and nothing is cut off mid-write
+	// deferred functions run in reverse so this waits after cancelling and
+	// before the inst.Close deferred above
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// goBackground runs fn in its own goroutine that main waits for
+	goBackground := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+
+	// the recovery worker looks for orders stuck calling the charge service
+	goBackground(func() {
+		api.RunRecovery(ctx, stor, charges, *recoveryInterval, *recoveryTimeout, *authorizationTTL)
+	})
+
+	// webhook deliveries are added by the outbox and sent in the background with
+	// their own client since the timeout is applied to every attempt and only
+	// public addresses can be connected to
+	webhooks := webhook.New(stor, webhook.NewClient(), webhookCfg)
+	goBackground(func() {
+		webhooks.Run(ctx, *webhookInterval)
+	})
+
+	// the outbox dispatcher also runs in the background and delivers the events
+	// the storage methods record to every sink
+	// the sinks are named after what they are, and HTTP sinks after their URL,
+	// since each one's progress is stored under its name
+	sinks := map[string]outbox.Sink{"webhooks": webhooks}
+	if *outboxLog {
+		sinks["log"] = outbox.LogSink
+	}
+	sinkClient := &http.Client{Timeout: *outboxSinkTimeout}
+	for _, url := range strings.Split(*outboxSinkURLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			sinks[url] = outbox.NewHTTPSink(sinkClient, url)
+		}
+	}
+	goBackground(func() {
+		outbox.Run(ctx, stor, sinks, *outboxInterval)
+	})
 
 	server := new(http.Server)
 	// we dereference the address flag and set it on the server so the
@@ -27,13 +176,7 @@ func main() {
 	// here we're calling the api package's Handler() function to get an instance of
 	// an http.Handler that we can set as the server's Handler
 	// on every HTTP request the server will call the handler's ServeHTTP function
-	server.Handler = api.Handler(
-		storage.New(""),
-		// we would replace these with actual clients that talk to the underlying services
-		// but for this contrived service we just iuggno
-		mocks.NewMockedService(unimplementedHandler),
-		mocks.NewMockedService(unimplementedHandler),
-	)
+	server.Handler = api.Handler(stor, fulfillmentService, charges, api.WithFulfillmentURL(*fulfillmentURL), api.WithIdempotencyKeyTTL(*idempotencyKeyTTL), api.WithIdempotencyKeyLease(*idempotencyKeyLease), api.WithAuthorizationTTL(*authorizationTTL), api.WithStreamInterval(*streamInterval), api.WithExportTimeout(*exportTimeout))
 
 	// if we just called ListenAndServe directly then we would never return since
 	// ListenAndServe starts listening for HTTP requests and blocks until the
@@ -48,13 +191,68 @@ func main() {
 	// if main returns then the process stops running so we instead wait for an
 	// interrupt signal (Ctrl+C) by creating a channel, passing it to the signal
 	// package and then waiting to receive something from the channel
-	ch := make(chan os.Signal)
+	// the channel needs a buffer of 1 so the signal isn't dropped if we're not
+	// ready to receive it yet
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	// once we receive something over this channel we will continue the function
 	// and end up returning, causing the process to stop
 	<-ch
 }
 
+// connectStorage tries to connect to the database until it succeeds or until
+// wait has passed, backing off between attempts, so the service can start
+// alongside the database instead of failing immediately
+func connectStorage(cfg storage.Config, wait time.Duration) (*storage.Instance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	backoff := 500 * time.Millisecond
+	for {
+		inst, err := storage.New(ctx, cfg)
+		if err == nil {
+			return inst, nil
+		}
+		llog.Warn("failed to connect to database, retrying", llog.KV{"backoff": backoff.String()}, llog.ErrKV(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		// double the backoff every attempt up to 10 seconds so we don't hammer a
+		// database that's still starting
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// parseEnv sets any flag that wasn't passed on the command line from its
+// environment variable, which is the flag's name uppercased with dashes
+// replaced by underscores and prefixed with ORDER_UP_, so -mongo-uri can also
+// be set with ORDER_UP_MONGO_URI
+// flags passed on the command line always take precedence
+func parseEnv() {
+	passed := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		if passed[f.Name] {
+			return
+		}
+		name := "ORDER_UP_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(val); err != nil {
+			llog.Fatal("invalid environment variable", llog.KV{"name": name}, llog.ErrKV(err))
+		}
+	})
+}
+
 var unimplementedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "not implemented", http.StatusNotImplemented)
 })
@@ -0,0 +1,260 @@
+package mocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// fakeCharge is a single charge, or refund if the amount is negative, recorded
+// by FakeChargeService
+type fakeCharge struct {
+	ID          string `json:"id"`
+	CardToken   string `json:"cardToken"`
+	AmountCents int64  `json:"amountCents"`
+	OrderID     string `json:"orderId"`
+	// IdempotencyKey is omitted from GET /charges when it's empty, like for
+	// charges added with AddCharge
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// fakeAuthorization is a hold on a card recorded by FakeChargeService
+type fakeAuthorization struct {
+	fakeCharge
+	// captured and voided are mutually exclusive since an authorization can only
+	// be used once
+	captured bool
+	voided   bool
+}
+
+// fakeAuthorizationRecord is how an authorization is returned from GET
+// /authorizations
+type fakeAuthorizationRecord struct {
+	fakeCharge
+	Status string `json:"status"`
+}
+
+// record returns the authorization as it's returned from GET /authorizations.
+// The lock must be held.
+func (a *fakeAuthorization) record() fakeAuthorizationRecord {
+	rec := fakeAuthorizationRecord{fakeCharge: a.fakeCharge, Status: "authorized"}
+	switch {
+	case a.captured:
+		rec.Status = "captured"
+	case a.voided:
+		rec.Status = "voided"
+	}
+	return rec
+}
+
+// FakeChargeService is an http.Handler that behaves like the charge service by
+// accepting every charge and authorization and remembering it in memory. Like
+// the real charge service, a request with an Idempotency-Key header it's
+// already seen succeeds without being made again and returns the same ID. It's
+// useful for running the service locally and for testing recovery.
+type FakeChargeService struct {
+	mu      sync.Mutex
+	charges map[string][]fakeCharge
+	// authorizations maps the ID of every authorization to it
+	authorizations map[string]*fakeAuthorization
+	// orderAuthorizations lists every order's authorizations in the order they
+	// were made
+	orderAuthorizations map[string][]*fakeAuthorization
+	// keys maps every idempotency key seen to the ID of its charge or
+	// authorization
+	keys map[string]string
+	// lastID is used to give every charge and authorization a unique ID
+	lastID int64
+}
+
+// NewFakeChargeService returns a FakeChargeService without any charges
+func NewFakeChargeService() *FakeChargeService {
+	return &FakeChargeService{
+		charges:             map[string][]fakeCharge{},
+		authorizations:      map[string]*fakeAuthorization{},
+		orderAuthorizations: map[string][]*fakeAuthorization{},
+		keys:                map[string]string{},
+	}
+}
+
+// ServeHTTP implements the http.Handler interface and handles POST /charge to
+// make a charge, GET /charges?orderId= to list an order's charges, POST
+// /authorizations, /authorizations/:id/capture and /authorizations/:id/void to
+// authorize a card and then capture or void the authorization and GET
+// /authorizations?orderId= to list an order's authorizations
+func (f *FakeChargeService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/charge":
+		var charge fakeCharge
+		if err := json.NewDecoder(r.Body).Decode(&charge); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if charge.CardToken == "" {
+			http.Error(w, "missing cardToken", http.StatusBadRequest)
+			return
+		}
+		charge.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		f.mu.Lock()
+		// retries of a charge that already went through aren't charged again
+		id, ok := f.keys[charge.IdempotencyKey]
+		if !ok {
+			id = f.nextID()
+			charge.ID = id
+			f.charges[charge.OrderID] = append(f.charges[charge.OrderID], charge)
+			if charge.IdempotencyKey != "" {
+				f.keys[charge.IdempotencyKey] = id
+			}
+		}
+		f.mu.Unlock()
+		writeFakeResult(w, http.StatusCreated, id)
+	case r.Method == http.MethodGet && r.URL.Path == "/charges":
+		f.mu.Lock()
+		// initialize as an empty slice so it's encoded as [] instead of null
+		charges := append([]fakeCharge{}, f.charges[r.URL.Query().Get("orderId")]...)
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"charges": charges,
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/authorizations":
+		var auth fakeAuthorization
+		if err := json.NewDecoder(r.Body).Decode(&auth.fakeCharge); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if auth.CardToken == "" {
+			http.Error(w, "missing cardToken", http.StatusBadRequest)
+			return
+		}
+		auth.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		f.mu.Lock()
+		id, ok := f.keys[auth.IdempotencyKey]
+		if !ok {
+			id = f.nextAuthorizationID()
+			auth.ID = id
+			f.authorizations[id] = &auth
+			f.orderAuthorizations[auth.OrderID] = append(f.orderAuthorizations[auth.OrderID], &auth)
+			if auth.IdempotencyKey != "" {
+				f.keys[auth.IdempotencyKey] = id
+			}
+		}
+		f.mu.Unlock()
+		writeFakeResult(w, http.StatusCreated, id)
+	case r.Method == http.MethodGet && r.URL.Path == "/authorizations":
+		f.mu.Lock()
+		auths := []fakeAuthorizationRecord{}
+		for _, auth := range f.orderAuthorizations[r.URL.Query().Get("orderId")] {
+			auths = append(auths, auth.record())
+		}
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"authorizations": auths,
+		})
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/authorizations/"):
+		f.serveAuthorization(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveAuthorization handles POST /authorizations/:id/capture, which records a
+// charge for the authorization, and POST /authorizations/:id/void
+func (f *FakeChargeService) serveAuthorization(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/authorizations/"), "/")
+	if len(parts) != 2 || (parts[1] != "capture" && parts[1] != "void") {
+		http.NotFound(w, r)
+		return
+	}
+	var args fakeCharge
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	auth, ok := f.authorizations[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// retries of a capture or void that already went through succeed again
+	if id, ok := f.keys[key]; ok {
+		status := http.StatusCreated
+		if parts[1] == "void" {
+			status = http.StatusOK
+		}
+		writeFakeResult(w, status, id)
+		return
+	}
+	if auth.captured || auth.voided {
+		http.Error(w, "authorization already used", http.StatusConflict)
+		return
+	}
+
+	if parts[1] == "void" {
+		auth.voided = true
+		if key != "" {
+			f.keys[key] = auth.ID
+		}
+		writeFakeResult(w, http.StatusOK, auth.ID)
+		return
+	}
+	if args.AmountCents <= 0 || args.AmountCents > auth.AmountCents {
+		http.Error(w, "invalid capture amount", http.StatusConflict)
+		return
+	}
+	auth.captured = true
+	charge := fakeCharge{
+		ID:             f.nextID(),
+		CardToken:      auth.CardToken,
+		AmountCents:    args.AmountCents,
+		OrderID:        auth.OrderID,
+		IdempotencyKey: key,
+	}
+	f.charges[charge.OrderID] = append(f.charges[charge.OrderID], charge)
+	if key != "" {
+		f.keys[key] = charge.ID
+	}
+	writeFakeResult(w, http.StatusCreated, charge.ID)
+}
+
+// writeFakeResult responds with the ID of a charge or authorization like the
+// charge service
+func writeFakeResult(w http.ResponseWriter, status int, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id": id,
+	})
+}
+
+// AddCharge records a charge for the order as if it was made through POST
+// /charge, like when the service crashed before it could record the result
+func (f *FakeChargeService) AddCharge(orderID string, amountCents int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.charges[orderID] = append(f.charges[orderID], fakeCharge{
+		ID:          f.nextID(),
+		AmountCents: amountCents,
+		OrderID:     orderID,
+	})
+}
+
+// nextID returns a new unique charge ID. The lock must be held.
+func (f *FakeChargeService) nextID() string {
+	f.lastID++
+	return fmt.Sprintf("ch_%d", f.lastID)
+}
+
+// nextAuthorizationID returns a new unique authorization ID. The lock must be
+// held.
+func (f *FakeChargeService) nextAuthorizationID() string {
+	f.lastID++
+	return fmt.Sprintf("auth_%d", f.lastID)
+}
@@ -7,6 +7,8 @@ import (
 
 	storage "github.com/levenlabs/order-up/storage"
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // MockStorageInstance is an autogenerated mock type for the StorageInstance type
@@ -14,6 +16,239 @@ type MockStorageInstance struct {
 	mock.Mock
 }
 
+// AddPayment provides a mock function with given fields: ctx, id, payment
+func (_m *MockStorageInstance) AddPayment(ctx context.Context, id string, payment storage.Payment) error {
+	ret := _m.Called(ctx, id, payment)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.Payment) error); ok {
+		r0 = rf(ctx, id, payment)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddRefund provides a mock function with given fields: ctx, id, refund
+func (_m *MockStorageInstance) AddRefund(ctx context.Context, id string, refund storage.Refund) (storage.Order, error) {
+	ret := _m.Called(ctx, id, refund)
+
+	var r0 storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.Refund) storage.Order); ok {
+		r0 = rf(ctx, id, refund)
+	} else {
+		r0 = ret.Get(0).(storage.Order)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, storage.Refund) error); ok {
+		r1 = rf(ctx, id, refund)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// AddWebhookDeliveries provides a mock function with given fields: ctx, deliveries
+func (_m *MockStorageInstance) AddWebhookDeliveries(ctx context.Context, deliveries []storage.WebhookDelivery) error {
+	ret := _m.Called(ctx, deliveries)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []storage.WebhookDelivery) error); ok {
+		r0 = rf(ctx, deliveries)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AuthorizeOrder provides a mock function with given fields: ctx, id, auth
+func (_m *MockStorageInstance) AuthorizeOrder(ctx context.Context, id string, auth storage.Authorization) error {
+	ret := _m.Called(ctx, id, auth)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.Authorization) error); ok {
+		r0 = rf(ctx, id, auth)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ClaimDueWebhookDelivery provides a mock function with given fields: ctx, now, leaseExpiresAt, exclude, skip
+func (_m *MockStorageInstance) ClaimDueWebhookDelivery(ctx context.Context, now time.Time, leaseExpiresAt time.Time, exclude []string, skip []string) (storage.WebhookDelivery, error) {
+	ret := _m.Called(ctx, now, leaseExpiresAt, exclude, skip)
+
+	var r0 storage.WebhookDelivery
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, time.Time, []string, []string) storage.WebhookDelivery); ok {
+		r0 = rf(ctx, now, leaseExpiresAt, exclude, skip)
+	} else {
+		r0 = ret.Get(0).(storage.WebhookDelivery)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, time.Time, []string, []string) error); ok {
+		r1 = rf(ctx, now, leaseExpiresAt, exclude, skip)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ClaimOutboxCursor provides a mock function with given fields: ctx, sink, owner, now, leaseExpiresAt
+func (_m *MockStorageInstance) ClaimOutboxCursor(ctx context.Context, sink string, owner string, now time.Time, leaseExpiresAt time.Time) (storage.OutboxCursor, error) {
+	ret := _m.Called(ctx, sink, owner, now, leaseExpiresAt)
+
+	var r0 storage.OutboxCursor
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time, time.Time) storage.OutboxCursor); ok {
+		r0 = rf(ctx, sink, owner, now, leaseExpiresAt)
+	} else {
+		r0 = ret.Get(0).(storage.OutboxCursor)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, time.Time, time.Time) error); ok {
+		r1 = rf(ctx, sink, owner, now, leaseExpiresAt)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CompleteIdempotencyKey provides a mock function with given fields: ctx, key, token, statusCode, contentType, body, expiresAt
+func (_m *MockStorageInstance) CompleteIdempotencyKey(ctx context.Context, key string, token string, statusCode int, contentType string, body []byte, expiresAt time.Time) error {
+	ret := _m.Called(ctx, key, token, statusCode, contentType, body, expiresAt)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int, string, []byte, time.Time) error); ok {
+		r0 = rf(ctx, key, token, statusCode, contentType, body, expiresAt)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteIdempotencyKey provides a mock function with given fields: ctx, key, token
+func (_m *MockStorageInstance) DeleteIdempotencyKey(ctx context.Context, key string, token string) error {
+	ret := _m.Called(ctx, key, token)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, key, token)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteWebhookSubscription provides a mock function with given fields: ctx, id
+func (_m *MockStorageInstance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// FulfillLineItems provides a mock function with given fields: ctx, id, quantities
+func (_m *MockStorageInstance) FulfillLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error) {
+	ret := _m.Called(ctx, id, quantities)
+
+	var r0 storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]int64) storage.Order); ok {
+		r0 = rf(ctx, id, quantities)
+	} else {
+		r0 = ret.Get(0).(storage.Order)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, map[string]int64) error); ok {
+		r1 = rf(ctx, id, quantities)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetExpiredAuthorizations provides a mock function with given fields: ctx, before
+func (_m *MockStorageInstance) GetExpiredAuthorizations(ctx context.Context, before time.Time) ([]storage.Order, error) {
+	ret := _m.Called(ctx, before)
+
+	var r0 []storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) []storage.Order); ok {
+		r0 = rf(ctx, before)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.Order)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetIdempotencyKey provides a mock function with given fields: ctx, key
+func (_m *MockStorageInstance) GetIdempotencyKey(ctx context.Context, key string) (storage.IdempotencyRecord, error) {
+	ret := _m.Called(ctx, key)
+
+	var r0 storage.IdempotencyRecord
+	if rf, ok := ret.Get(0).(func(context.Context, string) storage.IdempotencyRecord); ok {
+		r0 = rf(ctx, key)
+	} else {
+		r0 = ret.Get(0).(storage.IdempotencyRecord)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetLastOrderEventSeq provides a mock function with given fields: ctx
+func (_m *MockStorageInstance) GetLastOrderEventSeq(ctx context.Context) (int64, error) {
+	ret := _m.Called(ctx)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context) int64); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetOrder provides a mock function with given fields: ctx, id
 func (_m *MockStorageInstance) GetOrder(ctx context.Context, id string) (storage.Order, error) {
 	ret := _m.Called(ctx, id)
@@ -35,13 +270,89 @@ func (_m *MockStorageInstance) GetOrder(ctx context.Context, id string) (storage
 	return r0, r1
 }
 
-// GetOrders provides a mock function with given fields: ctx, status
-func (_m *MockStorageInstance) GetOrders(ctx context.Context, status storage.OrderStatus) ([]storage.Order, error) {
-	ret := _m.Called(ctx, status)
+// GetOrderEvents provides a mock function with given fields: ctx, orderID, after, limit
+func (_m *MockStorageInstance) GetOrderEvents(ctx context.Context, orderID string, after string, limit int) ([]storage.OrderEvent, error) {
+	ret := _m.Called(ctx, orderID, after, limit)
+
+	var r0 []storage.OrderEvent
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int) []storage.OrderEvent); ok {
+		r0 = rf(ctx, orderID, after, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.OrderEvent)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int) error); ok {
+		r1 = rf(ctx, orderID, after, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOrderEventsAfterSeq provides a mock function with given fields: ctx, orderID, after, limit
+func (_m *MockStorageInstance) GetOrderEventsAfterSeq(ctx context.Context, orderID string, after int64, limit int) ([]storage.OrderEvent, error) {
+	ret := _m.Called(ctx, orderID, after, limit)
+
+	var r0 []storage.OrderEvent
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, int) []storage.OrderEvent); ok {
+		r0 = rf(ctx, orderID, after, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.OrderEvent)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64, int) error); ok {
+		r1 = rf(ctx, orderID, after, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOrders provides a mock function with given fields: ctx, query, page
+func (_m *MockStorageInstance) GetOrders(ctx context.Context, query storage.OrderQuery, page storage.OrderPage) ([]storage.Order, string, error) {
+	ret := _m.Called(ctx, query, page)
 
 	var r0 []storage.Order
-	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderStatus) []storage.Order); ok {
-		r0 = rf(ctx, status)
+	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderQuery, storage.OrderPage) []storage.Order); ok {
+		r0 = rf(ctx, query, page)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.Order)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, storage.OrderQuery, storage.OrderPage) string); ok {
+		r1 = rf(ctx, query, page)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, storage.OrderQuery, storage.OrderPage) error); ok {
+		r2 = rf(ctx, query, page)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// GetStaleOrders provides a mock function with given fields: ctx, statuses, before
+func (_m *MockStorageInstance) GetStaleOrders(ctx context.Context, statuses []storage.OrderStatus, before time.Time) ([]storage.Order, error) {
+	ret := _m.Called(ctx, statuses, before)
+
+	var r0 []storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, []storage.OrderStatus, time.Time) []storage.Order); ok {
+		r0 = rf(ctx, statuses, before)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]storage.Order)
@@ -49,8 +360,98 @@ func (_m *MockStorageInstance) GetOrders(ctx context.Context, status storage.Ord
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, storage.OrderStatus) error); ok {
-		r1 = rf(ctx, status)
+	if rf, ok := ret.Get(1).(func(context.Context, []storage.OrderStatus, time.Time) error); ok {
+		r1 = rf(ctx, statuses, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetStaleRefunds provides a mock function with given fields: ctx, before
+func (_m *MockStorageInstance) GetStaleRefunds(ctx context.Context, before time.Time) ([]storage.Order, error) {
+	ret := _m.Called(ctx, before)
+
+	var r0 []storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) []storage.Order); ok {
+		r0 = rf(ctx, before)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.Order)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetWebhookDeliveries provides a mock function with given fields: ctx, subscriptionID, status, after, limit
+func (_m *MockStorageInstance) GetWebhookDeliveries(ctx context.Context, subscriptionID string, status storage.WebhookDeliveryStatus, after string, limit int) ([]storage.WebhookDelivery, error) {
+	ret := _m.Called(ctx, subscriptionID, status, after, limit)
+
+	var r0 []storage.WebhookDelivery
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.WebhookDeliveryStatus, string, int) []storage.WebhookDelivery); ok {
+		r0 = rf(ctx, subscriptionID, status, after, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.WebhookDelivery)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, storage.WebhookDeliveryStatus, string, int) error); ok {
+		r1 = rf(ctx, subscriptionID, status, after, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetWebhookSubscription provides a mock function with given fields: ctx, id
+func (_m *MockStorageInstance) GetWebhookSubscription(ctx context.Context, id string) (storage.WebhookSubscription, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 storage.WebhookSubscription
+	if rf, ok := ret.Get(0).(func(context.Context, string) storage.WebhookSubscription); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Get(0).(storage.WebhookSubscription)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetWebhookSubscriptions provides a mock function with given fields: ctx
+func (_m *MockStorageInstance) GetWebhookSubscriptions(ctx context.Context) ([]storage.WebhookSubscription, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []storage.WebhookSubscription
+	if rf, ok := ret.Get(0).(func(context.Context) []storage.WebhookSubscription); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]storage.WebhookSubscription)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -79,13 +480,167 @@ func (_m *MockStorageInstance) InsertOrder(ctx context.Context, order storage.Or
 	return r0, r1
 }
 
-// SetOrderStatus provides a mock function with given fields: ctx, id, status
-func (_m *MockStorageInstance) SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus) error {
-	ret := _m.Called(ctx, id, status)
+// InsertWebhookSubscription provides a mock function with given fields: ctx, sub
+func (_m *MockStorageInstance) InsertWebhookSubscription(ctx context.Context, sub storage.WebhookSubscription) (string, error) {
+	ret := _m.Called(ctx, sub)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, storage.WebhookSubscription) string); ok {
+		r0 = rf(ctx, sub)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, storage.WebhookSubscription) error); ok {
+		r1 = rf(ctx, sub)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// IterOrders provides a mock function with given fields: ctx, query, fn
+func (_m *MockStorageInstance) IterOrders(ctx context.Context, query storage.OrderQuery, fn func(storage.Order) error) error {
+	ret := _m.Called(ctx, query, fn)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, storage.OrderQuery, func(storage.Order) error) error); ok {
+		r0 = rf(ctx, query, fn)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RecordWebhookAttempt provides a mock function with given fields: ctx, id, attempt, status, nextAttemptAt
+func (_m *MockStorageInstance) RecordWebhookAttempt(ctx context.Context, id string, attempt storage.WebhookAttempt, status storage.WebhookDeliveryStatus, nextAttemptAt time.Time) error {
+	ret := _m.Called(ctx, id, attempt, status, nextAttemptAt)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.WebhookAttempt, storage.WebhookDeliveryStatus, time.Time) error); ok {
+		r0 = rf(ctx, id, attempt, status, nextAttemptAt)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReleaseLineItems provides a mock function with given fields: ctx, id, quantities, reason
+func (_m *MockStorageInstance) ReleaseLineItems(ctx context.Context, id string, quantities map[string]int64, reason string) (storage.Order, error) {
+	ret := _m.Called(ctx, id, quantities, reason)
+
+	var r0 storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]int64, string) storage.Order); ok {
+		r0 = rf(ctx, id, quantities, reason)
+	} else {
+		r0 = ret.Get(0).(storage.Order)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, map[string]int64, string) error); ok {
+		r1 = rf(ctx, id, quantities, reason)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReserveIdempotencyKey provides a mock function with given fields: ctx, rec
+func (_m *MockStorageInstance) ReserveIdempotencyKey(ctx context.Context, rec storage.IdempotencyRecord) error {
+	ret := _m.Called(ctx, rec)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, storage.IdempotencyRecord) error); ok {
+		r0 = rf(ctx, rec)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ReserveLineItems provides a mock function with given fields: ctx, id, quantities
+func (_m *MockStorageInstance) ReserveLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error) {
+	ret := _m.Called(ctx, id, quantities)
+
+	var r0 storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, string, map[string]int64) storage.Order); ok {
+		r0 = rf(ctx, id, quantities)
+	} else {
+		r0 = ret.Get(0).(storage.Order)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, map[string]int64) error); ok {
+		r1 = rf(ctx, id, quantities)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetOrderStatus provides a mock function with given fields: ctx, id, status, reason
+func (_m *MockStorageInstance) SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus, reason string) error {
+	ret := _m.Called(ctx, id, status, reason)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, storage.OrderStatus, string) error); ok {
+		r0 = rf(ctx, id, status, reason)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetRefundStatus provides a mock function with given fields: ctx, id, refundID, status, chargeReference
+func (_m *MockStorageInstance) SetRefundStatus(ctx context.Context, id string, refundID string, status storage.RefundStatus, chargeReference string) error {
+	ret := _m.Called(ctx, id, refundID, status, chargeReference)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, storage.RefundStatus, string) error); ok {
+		r0 = rf(ctx, id, refundID, status, chargeReference)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TransitionOrderStatus provides a mock function with given fields: ctx, id, from, to, reason
+func (_m *MockStorageInstance) TransitionOrderStatus(ctx context.Context, id string, from []storage.OrderStatus, to storage.OrderStatus, reason string) (storage.Order, error) {
+	ret := _m.Called(ctx, id, from, to, reason)
+
+	var r0 storage.Order
+	if rf, ok := ret.Get(0).(func(context.Context, string, []storage.OrderStatus, storage.OrderStatus, string) storage.Order); ok {
+		r0 = rf(ctx, id, from, to, reason)
+	} else {
+		r0 = ret.Get(0).(storage.Order)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, []storage.OrderStatus, storage.OrderStatus, string) error); ok {
+		r1 = rf(ctx, id, from, to, reason)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateOutboxCursor provides a mock function with given fields: ctx, cursor
+func (_m *MockStorageInstance) UpdateOutboxCursor(ctx context.Context, cursor storage.OutboxCursor) error {
+	ret := _m.Called(ctx, cursor)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, storage.OrderStatus) error); ok {
-		r0 = rf(ctx, id, status)
+	if rf, ok := ret.Get(0).(func(context.Context, storage.OutboxCursor) error); ok {
+		r0 = rf(ctx, cursor)
 	} else {
 		r0 = ret.Error(0)
 	}
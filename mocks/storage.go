@@ -4,6 +4,7 @@ package mocks
 
 import (
 	"context"
+	"time"
 
 	"github.com/levenlabs/order-up/storage"
 )
@@ -13,15 +14,167 @@ type StorageInstance interface {
 	// GetOrder should return the order with the given ID. If that ID isn't found then
 	// the special ErrOrderNotFound error should be returned.
 	GetOrder(ctx context.Context, id string) (storage.Order, error)
-	// GetOrders should return all orders with the given status. If status is the
-	// special -1 value then it should return all orders regardless of their status.
-	GetOrders(ctx context.Context, status storage.OrderStatus) ([]storage.Order, error)
-	// SetOrderStatus should update the order with the given ID and set the status
-	// field. If that ID isn't found then the special ErrOrderNotFound error should
+	// GetOrders should return a page of the orders matching the query. If the
+	// page is full then the cursor of the next page should be returned too. If
+	// the page's cursor is invalid then the special ErrInvalidCursor error should
 	// be returned.
-	SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus) error
+	GetOrders(ctx context.Context, query storage.OrderQuery, page storage.OrderPage) ([]storage.Order, string, error)
+	// IterOrders should call fn with every order matching the query, sorted the
+	// same as GetOrders' default sort, without holding them all in memory. If fn
+	// returns an error then the iteration should stop and return that error.
+	IterOrders(ctx context.Context, query storage.OrderQuery, fn func(storage.Order) error) error
+	// GetStaleOrders returns all orders whose status is one of statuses and hasn't
+	// changed since before.
+	GetStaleOrders(ctx context.Context, statuses []storage.OrderStatus, before time.Time) ([]storage.Order, error)
+	// SetOrderStatus should update the order with the given ID and set the status
+	// field. The change is added to the order's StatusHistory with the reason. If
+	// that ID isn't found then the special ErrOrderNotFound error should be
+	// returned.
+	SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus, reason string) error
+	// TransitionOrderStatus atomically sets the status of the order with the given
+	// ID to the to status but only if its current status is one of the from
+	// statuses. It returns the order as it was right before the change. If that ID
+	// isn't found then ErrOrderNotFound is returned and if the order's status isn't
+	// in from, or the to status is BlockedByReservations and some of its line
+	// items are reserved, then ErrInvalidTransition is returned. Moving to a
+	// status that starts a payment attempt also increments PaymentAttempts. The
+	// change is added to the order's StatusHistory with the reason.
+	TransitionOrderStatus(ctx context.Context, id string, from []storage.OrderStatus, to storage.OrderStatus, reason string) (storage.Order, error)
+	// ReserveLineItems adds quantities, which maps line item IDs to how many of
+	// them are about to be fulfilled, to the reserved quantities of the line
+	// items of the order with the given ID, which should happen before asking
+	// the fulfillment service to ship them. It returns the order after the
+	// change. If that ID isn't found then ErrOrderNotFound is returned, if the
+	// order isn't charged or partially fulfilled then ErrInvalidTransition is
+	// returned and if the quantities are more than what's available then
+	// ErrInvalidFulfillment is returned. If the order keeps changing while trying
+	// to update it then ErrOrderContended is returned.
+	ReserveLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error)
+	// ReleaseLineItems takes quantities, which maps line item IDs to how many of
+	// them the fulfillment service failed to ship, out of the reserved quantities
+	// of the line items of the order with the given ID so they can be fulfilled
+	// again, and records reason as why. It returns the order after the change.
+	// It returns the same errors as ReserveLineItems other than
+	// ErrInvalidTransition since reservations can be released in any status.
+	ReleaseLineItems(ctx context.Context, id string, quantities map[string]int64, reason string) (storage.Order, error)
+	// FulfillLineItems moves quantities, which maps line item IDs to how many
+	// more of them were fulfilled, from the reserved to the fulfilled quantities
+	// of the line items of the order with the given ID and updates its status to
+	// fulfilled or partially fulfilled. It returns the order after the change.
+	// It returns the same errors as ReserveLineItems, with
+	// ErrInvalidFulfillment also returned if the quantities weren't reserved.
+	FulfillLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error)
+	// AddRefund adds the refund to the order with the given ID as pending, which
+	// should happen before asking the charge service to make the refund. It
+	// returns the order after the change with the new refund last. If that ID
+	// isn't found then ErrOrderNotFound is returned, if the order can't be
+	// refunded then ErrInvalidTransition is returned and if the refund is invalid
+	// then ErrInvalidRefund is returned. If the order keeps changing while this
+	// tries to update it then ErrOrderContended is returned.
+	AddRefund(ctx context.Context, id string, refund storage.Refund) (storage.Order, error)
+	// SetRefundStatus moves the pending refund with the given ID on the order with
+	// the given ID to status and records the charge service's reference for it. If
+	// the order isn't found then ErrOrderNotFound is returned, if the refund isn't
+	// found then ErrRefundNotFound is returned and if the refund isn't pending
+	// anymore then ErrInvalidTransition is returned.
+	SetRefundStatus(ctx context.Context, id, refundID string, status storage.RefundStatus, chargeReference string) error
+	// GetStaleRefunds returns all orders with a refund that's been pending since
+	// before.
+	GetStaleRefunds(ctx context.Context, before time.Time) ([]storage.Order, error)
+	// AddPayment adds the payment to the end of the payments of the order with the
+	// given ID. CreatedAt is set to the current time if it's not already set. If
+	// that ID isn't found then ErrOrderNotFound is returned.
+	AddPayment(ctx context.Context, id string, payment storage.Payment) error
+	// AuthorizeOrder atomically moves the order with the given ID from
+	// authorizing to authorized and records the authorization on it. If that ID
+	// isn't found then ErrOrderNotFound is returned and if the order isn't
+	// authorizing then ErrInvalidTransition is returned.
+	AuthorizeOrder(ctx context.Context, id string, auth storage.Authorization) error
+	// GetExpiredAuthorizations returns all authorized orders whose authorization
+	// expired before before.
+	GetExpiredAuthorizations(ctx context.Context, before time.Time) ([]storage.Order, error)
 	// InsertOrder should fill in the order's ID with a unique identifier if it's not
 	// already set and then insert it into the database. It should return the order's
 	// ID. If the order already exists then ErrOrderExists should be returned.
+	// StatusUpdatedAt, CreatedAt and UpdatedAt are set to the current time if
+	// they're not already set, the order's initial status is added to its
+	// StatusHistory if it's empty and line items without an ID get one.
 	InsertOrder(ctx context.Context, order storage.Order) (string, error)
+
+	// Every method above that changes an order also adds an event describing the
+	// change to the order's event log, atomically with the change. Events aren't
+	// changed once they're added, each outbox sink has its own cursor holding
+	// the Seq of the last event it got and reads the events after it.
+
+	// GetOrderEvents returns at most limit events of the order with the given ID,
+	// oldest first, starting after the event with the ID after, or from the
+	// beginning if after is empty. limit is capped at MaxOrderEventsLimit.
+	GetOrderEvents(ctx context.Context, orderID, after string, limit int) ([]storage.OrderEvent, error)
+	// GetOrderEventsAfterSeq returns at most limit events with a Seq greater
+	// than after, in order of their Seq, of the order with the given ID or of
+	// every order if orderID is empty. limit is capped at MaxOrderEventsLimit.
+	GetOrderEventsAfterSeq(ctx context.Context, orderID string, after int64, limit int) ([]storage.OrderEvent, error)
+	// GetLastOrderEventSeq returns the Seq of the newest event across every
+	// order, or 0 if there aren't any events yet.
+	GetLastOrderEventSeq(ctx context.Context) (int64, error)
+	// ClaimOutboxCursor gives owner the lease on the cursor of the named sink
+	// until leaseExpiresAt and returns the cursor. The owner can renew a lease it
+	// already holds but if another owner's lease hasn't expired by now then
+	// ErrOutboxCursorClaimed is returned. A sink that doesn't have a cursor yet
+	// gets one starting after the newest event.
+	ClaimOutboxCursor(ctx context.Context, sink, owner string, now, leaseExpiresAt time.Time) (storage.OutboxCursor, error)
+	// UpdateOutboxCursor stores the cursor's Seq and LeaseExpiresAt, which moves
+	// the cursor and renews or, with a zero LeaseExpiresAt, releases the lease.
+	// If the cursor's Owner no longer holds the lease then
+	// ErrOutboxCursorClaimed is returned.
+	UpdateOutboxCursor(ctx context.Context, cursor storage.OutboxCursor) error
+
+	// ReserveIdempotencyKey stores a new, uncompleted record for the key. If an
+	// unexpired record for the key already exists then ErrIdempotencyKeyExists is
+	// returned.
+	ReserveIdempotencyKey(ctx context.Context, rec storage.IdempotencyRecord) error
+	// GetIdempotencyKey returns the record for the key. If the key isn't found or
+	// has expired then ErrIdempotencyKeyNotFound is returned.
+	GetIdempotencyKey(ctx context.Context, key string) (storage.IdempotencyRecord, error)
+	// CompleteIdempotencyKey stores the response for the key's request, marks the
+	// record as completed and keeps it until expiresAt. If the key isn't found,
+	// or isn't reserved with token anymore, then ErrIdempotencyKeyNotFound is
+	// returned.
+	CompleteIdempotencyKey(ctx context.Context, key, token string, statusCode int, contentType string, body []byte, expiresAt time.Time) error
+	// DeleteIdempotencyKey deletes the record for the key, if it's still
+	// reserved with token, so it can be used again.
+	DeleteIdempotencyKey(ctx context.Context, key, token string) error
+
+	// InsertWebhookSubscription fills in the subscription's ID if it's not
+	// already set and its CreatedAt, then inserts it and returns its ID. If a
+	// subscription with the same ID already exists then
+	// ErrWebhookSubscriptionExists is returned.
+	InsertWebhookSubscription(ctx context.Context, sub storage.WebhookSubscription) (string, error)
+	// GetWebhookSubscription returns the subscription with the given ID. If that
+	// ID isn't found then ErrWebhookSubscriptionNotFound is returned.
+	GetWebhookSubscription(ctx context.Context, id string) (storage.WebhookSubscription, error)
+	// GetWebhookSubscriptions returns every subscription, oldest first.
+	GetWebhookSubscriptions(ctx context.Context) ([]storage.WebhookSubscription, error)
+	// DeleteWebhookSubscription deletes the subscription with the given ID. Its
+	// deliveries are kept. If that ID isn't found then
+	// ErrWebhookSubscriptionNotFound is returned.
+	DeleteWebhookSubscription(ctx context.Context, id string) error
+	// AddWebhookDeliveries inserts the deliveries, skipping any whose ID already
+	// exists.
+	AddWebhookDeliveries(ctx context.Context, deliveries []storage.WebhookDelivery) error
+	// ClaimDueWebhookDelivery claims the oldest pending delivery whose
+	// NextAttemptAt is at or before now, skipping deliveries to the
+	// subscriptions with the IDs in exclude and the deliveries with the IDs in
+	// skip, by moving its NextAttemptAt to leaseExpiresAt and returns it. If no
+	// delivery is due then ErrWebhookDeliveryNotFound is returned.
+	ClaimDueWebhookDelivery(ctx context.Context, now, leaseExpiresAt time.Time, exclude, skip []string) (storage.WebhookDelivery, error)
+	// RecordWebhookAttempt adds the attempt to the delivery with the given ID and
+	// moves it to status. A pending delivery is tried again at nextAttemptAt. If
+	// that ID isn't found then ErrWebhookDeliveryNotFound is returned.
+	RecordWebhookAttempt(ctx context.Context, id string, attempt storage.WebhookAttempt, status storage.WebhookDeliveryStatus, nextAttemptAt time.Time) error
+	// GetWebhookDeliveries returns at most limit deliveries to the subscription
+	// with the given ID, oldest first, starting after the delivery with the ID
+	// after. Only deliveries with the given status are returned unless status is
+	// empty.
+	GetWebhookDeliveries(ctx context.Context, subscriptionID string, status storage.WebhookDeliveryStatus, after string, limit int) ([]storage.WebhookDelivery, error)
 }
@@ -0,0 +1,229 @@
+// Package outbox delivers order events to the other services that react to
+// them, like sending emails or updating inventory. The storage methods add an
+// event to the event log in the same transaction as every change they make to
+// an order, and the dispatchers started by Run read the log in order and send
+// every event to each sink. Every sink has its own cursor in storage that's
+// moved once the sink accepts an event, so a failing sink only holds up its own
+// events, and a lease on the cursor so only one replica delivers to a sink at a
+// time. Sinks get every event at least once but can get the same event more
+// than once if the service stops before moving the cursor or a lease expires
+// while an event is being sent.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// batchSize is how many events are read from the event log at once
+const batchSize = 100
+
+// leaseDuration is how long a dispatcher holds a sink's cursor before another
+// replica can take over delivering to the sink. It's renewed after every event
+// so it only has to be longer than a single Send takes.
+const leaseDuration = time.Minute
+
+// releaseTimeout is how long releasing a sink's cursor can take once Run is
+// stopping
+const releaseTimeout = 5 * time.Second
+
+// Sink is somewhere order events are delivered to. Send can be called more
+// than once with the same event, which has the same ID every time, so sinks
+// that can't handle duplicates should skip IDs they've already seen.
+type Sink interface {
+	Send(ctx context.Context, event storage.OrderEvent) error
+}
+
+// SinkFunc is a function implementing the Sink interface
+type SinkFunc func(ctx context.Context, event storage.OrderEvent) error
+
+// Send implements the Sink interface by calling the underlying function
+func (fn SinkFunc) Send(ctx context.Context, event storage.OrderEvent) error {
+	return fn(ctx, event)
+}
+
+// LogSink is a Sink that logs every event, which is useful for seeing the
+// events during local development
+var LogSink = SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+	llog.Info("order event", llog.KV{"id": event.ID, "orderID": event.OrderID, "type": string(event.Type), "actor": event.Actor})
+	return nil
+})
+
+////////////////////////////////////////////////////////////////////////////////
+
+// HTTPSink is a Sink that POSTs every event as JSON to a URL. Any response
+// other than a 2xx is treated as a failure and the event is sent again later.
+type HTTPSink struct {
+	client *http.Client
+	url    string
+}
+
+// NewHTTPSink returns an HTTPSink that POSTs events to url with client. The
+// client should have a timeout shorter than the lease on the sink's cursor so
+// a slow receiver can't hold up its events forever or have another replica take
+// over while an event is still being sent.
+func NewHTTPSink(client *http.Client, url string) *HTTPSink {
+	return &HTTPSink{
+		client: client,
+		url:    url,
+	}
+}
+
+// Send implements the Sink interface
+func (s *HTTPSink) Send(ctx context.Context, event storage.OrderEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending event: %w", err)
+	}
+	// the body has to be read to the end for the connection to be reused
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d from %s", resp.StatusCode, s.url)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// dispatcher delivers events to a single sink
+type dispatcher struct {
+	stor mocks.StorageInstance
+	// name is what the sink's cursor is stored under
+	name string
+	sink Sink
+	// owner identifies the process when claiming the sink's cursor
+	owner string
+
+	// cursor is the sink's cursor, which is only up to date while held is true
+	cursor storage.OutboxCursor
+	held   bool
+}
+
+// dispatch claims the sink's cursor and delivers the next batch of events after
+// it, in order. It stops at the first event the sink fails on so events are
+// always delivered in the order they happened, and that event is tried again
+// the next time. The cursor is moved after every event the sink accepts.
+// Nothing is delivered while another replica holds the cursor. It returns how
+// many events were delivered.
+func (d *dispatcher) dispatch(ctx context.Context) (int, error) {
+	now := time.Now()
+	cursor, err := d.stor.ClaimOutboxCursor(ctx, d.name, d.owner, now, now.Add(leaseDuration))
+	if errors.Is(err, storage.ErrOutboxCursorClaimed) {
+		d.held = false
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("error claiming cursor: %w", err)
+	}
+	d.cursor, d.held = cursor, true
+
+	events, err := d.stor.GetOrderEventsAfterSeq(ctx, "", d.cursor.Seq, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("error getting events: %w", err)
+	}
+	for n, event := range events {
+		if err := d.sink.Send(ctx, event); err != nil {
+			return n, fmt.Errorf("error sending event %s: %w", event.ID, err)
+		}
+		d.cursor.Seq = event.Seq
+		d.cursor.LeaseExpiresAt = time.Now().Add(leaseDuration)
+		if err := d.stor.UpdateOutboxCursor(ctx, d.cursor); err != nil {
+			// the lease expired and another replica took over, which will send
+			// this event again
+			if errors.Is(err, storage.ErrOutboxCursorClaimed) {
+				d.held = false
+				return n + 1, nil
+			}
+			return n + 1, fmt.Errorf("error updating cursor: %w", err)
+		}
+	}
+	return len(events), nil
+}
+
+// release gives up the lease on the sink's cursor, if it's held, so another
+// replica can take over straight away instead of waiting for it to expire
+func (d *dispatcher) release(ctx context.Context) error {
+	if !d.held {
+		return nil
+	}
+	d.held = false
+	d.cursor.LeaseExpiresAt = time.Time{}
+	err := d.stor.UpdateOutboxCursor(ctx, d.cursor)
+	if err != nil && !errors.Is(err, storage.ErrOutboxCursorClaimed) {
+		return fmt.Errorf("error releasing cursor: %w", err)
+	}
+	return nil
+}
+
+// run delivers events to the sink every interval until the context is
+// cancelled. Whenever a full batch is delivered it keeps going without waiting
+// so a backlog clears as fast as the sink accepts it.
+func (d *dispatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := d.dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			llog.Error("failed to dispatch order events", llog.KV{"sink": d.name}, llog.ErrKV(err))
+		}
+		if err == nil && n == batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+			defer cancel()
+			if err := d.release(releaseCtx); err != nil {
+				llog.Error("failed to release outbox cursor", llog.KV{"sink": d.name}, llog.ErrKV(err))
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run delivers events to every sink, each with its own dispatcher, every
+// interval until the context is cancelled. sinks are keyed by the name their
+// cursor is stored under, which has to stay the same across restarts and
+// replicas, and a sink that's new or renamed only gets the events recorded
+// from then on.
+func Run(ctx context.Context, stor mocks.StorageInstance, sinks map[string]Sink, interval time.Duration) {
+	owner := uuid.New().String()
+	var wg sync.WaitGroup
+	for name, sink := range sinks {
+		d := &dispatcher{
+			stor:  stor,
+			name:  name,
+			sink:  sink,
+			owner: owner,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.run(ctx, interval)
+		}()
+	}
+	wg.Wait()
+}
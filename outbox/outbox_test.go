@@ -0,0 +1,225 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	events := []storage.OrderEvent{
+		{ID: "ev-1", Seq: 11, OrderID: "order-1", Type: storage.OrderEventCreated},
+		{ID: "ev-2", Seq: 12, OrderID: "order-1", Type: storage.OrderEventStatusChanged},
+		{ID: "ev-3", Seq: 13, OrderID: "order-2", Type: storage.OrderEventCreated},
+	}
+	cursor := storage.OutboxCursor{Sink: "sink", Seq: 10, Owner: "owner"}
+	// atSeq matches the cursor once it's been moved to seq
+	atSeq := func(seq int64) interface{} {
+		return mock.MatchedBy(func(c storage.OutboxCursor) bool {
+			return c.Sink == "sink" && c.Owner == "owner" && c.Seq == seq && c.LeaseExpiresAt.After(time.Now())
+		})
+	}
+
+	// every event after the cursor is sent to the sink and the cursor is moved
+	// after each one
+	{
+		var got []string
+		sink := SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+			got = append(got, event.ID)
+			return nil
+		})
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ClaimOutboxCursor", ctx, "sink", "owner", mock.Anything, mock.Anything).Return(cursor, nil).Once()
+		stor.On("GetOrderEventsAfterSeq", ctx, "", int64(10), batchSize).Return(events, nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, atSeq(11)).Return(nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, atSeq(12)).Return(nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, atSeq(13)).Return(nil).Once()
+		d := &dispatcher{stor: stor, name: "sink", sink: sink, owner: "owner"}
+		n, err := d.dispatch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, []string{"ev-1", "ev-2", "ev-3"}, got)
+		stor.AssertExpectations(t)
+	}
+
+	// delivery stops at the first event the sink fails on and the cursor is
+	// left after the events before it
+	{
+		var got []string
+		sink := SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+			got = append(got, event.ID)
+			if event.ID == "ev-2" {
+				return assert.AnError
+			}
+			return nil
+		})
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ClaimOutboxCursor", ctx, "sink", "owner", mock.Anything, mock.Anything).Return(cursor, nil).Once()
+		stor.On("GetOrderEventsAfterSeq", ctx, "", int64(10), batchSize).Return(events, nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, atSeq(11)).Return(nil).Once()
+		d := &dispatcher{stor: stor, name: "sink", sink: sink, owner: "owner"}
+		n, err := d.dispatch(ctx)
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []string{"ev-1", "ev-2"}, got)
+		stor.AssertExpectations(t)
+	}
+
+	// nothing is delivered while another replica holds the cursor
+	{
+		sink := SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+			assert.Fail(t, "unexpected event", event.ID)
+			return nil
+		})
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ClaimOutboxCursor", ctx, "sink", "owner", mock.Anything, mock.Anything).Return(storage.OutboxCursor{}, storage.ErrOutboxCursorClaimed).Once()
+		d := &dispatcher{stor: stor, name: "sink", sink: sink, owner: "owner"}
+		n, err := d.dispatch(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		// there's nothing to release either
+		require.NoError(t, d.release(ctx))
+		stor.AssertExpectations(t)
+	}
+
+	// delivery stops once another replica took over the cursor
+	{
+		var got []string
+		sink := SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+			got = append(got, event.ID)
+			return nil
+		})
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ClaimOutboxCursor", ctx, "sink", "owner", mock.Anything, mock.Anything).Return(cursor, nil).Once()
+		stor.On("GetOrderEventsAfterSeq", ctx, "", int64(10), batchSize).Return(events, nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, atSeq(11)).Return(storage.ErrOutboxCursorClaimed).Once()
+		d := &dispatcher{stor: stor, name: "sink", sink: sink, owner: "owner"}
+		n, err := d.dispatch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []string{"ev-1"}, got)
+		require.NoError(t, d.release(ctx))
+		stor.AssertExpectations(t)
+	}
+
+	// releasing clears the lease but keeps the cursor where it was
+	{
+		stor := new(mocks.MockStorageInstance)
+		stor.On("ClaimOutboxCursor", ctx, "sink", "owner", mock.Anything, mock.Anything).Return(cursor, nil).Once()
+		stor.On("GetOrderEventsAfterSeq", ctx, "", int64(10), batchSize).Return(nil, nil).Once()
+		stor.On("UpdateOutboxCursor", ctx, storage.OutboxCursor{Sink: "sink", Seq: 10, Owner: "owner"}).Return(nil).Once()
+		d := &dispatcher{stor: stor, name: "sink", owner: "owner"}
+		n, err := d.dispatch(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		require.NoError(t, d.release(ctx))
+		stor.AssertExpectations(t)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := storage.WithActor(context.Background(), "test")
+	stor := memory.New()
+
+	var mu sync.Mutex
+	got := map[string][]string{}
+	record := func(name string) Sink {
+		return SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got[name] = append(got[name], event.ID)
+			return nil
+		})
+	}
+	failing := SinkFunc(func(ctx context.Context, event storage.OrderEvent) error {
+		return assert.AnError
+	})
+
+	// two replicas delivering to the same sinks, one of which always fails
+	runCtx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, name := range []string{"replica1", "replica2"} {
+		sinks := map[string]Sink{"healthy": record(name), "failing": failing}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Run(runCtx, stor, sinks, 10*time.Millisecond)
+		}()
+	}
+	// give both replicas a chance to create the cursors before there are events
+	time.Sleep(50 * time.Millisecond)
+
+	var ids []string
+	for n := 0; n < 5; n++ {
+		id, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "test@example.com"})
+		require.NoError(t, err)
+		events, err := stor.GetOrderEvents(ctx, id, "", 0)
+		require.NoError(t, err)
+		ids = append(ids, events[0].ID)
+	}
+
+	// the healthy sink gets every event exactly once, from one replica, even
+	// though the other sink never accepts any
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got["replica1"])+len(got["replica2"]) >= len(ids)
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	// the replicas have stopped so got isn't changing anymore
+	if len(got["replica1"]) > 0 {
+		assert.Equal(t, ids, got["replica1"])
+		assert.Empty(t, got["replica2"])
+	} else {
+		assert.Equal(t, ids, got["replica2"])
+	}
+
+	// stopping released the cursors so a new replica takes over straight away
+	// and picks up where the others left off
+	id, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "test@example.com"})
+	require.NoError(t, err)
+	events, err := stor.GetOrderEvents(ctx, id, "", 0)
+	require.NoError(t, err)
+	d := &dispatcher{stor: stor, name: "healthy", sink: record("replica3"), owner: "replica3"}
+	n, err := d.dispatch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{events[0].ID}, got["replica3"])
+}
+
+func TestHTTPSink(t *testing.T) {
+	ctx := context.Background()
+	event := storage.OrderEvent{ID: "ev-1", OrderID: "order-1", Type: storage.OrderEventCreated, Actor: "api"}
+
+	var got storage.OrderEvent
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	sink := NewHTTPSink(srv.Client(), srv.URL)
+
+	require.NoError(t, sink.Send(ctx, event))
+	assert.Equal(t, event, got)
+
+	// anything other than a 2xx is a failure
+	status = http.StatusServiceUnavailable
+	assert.Error(t, sink.Send(ctx, event))
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Authorization is a hold the charge service placed on the customer's card for
+// an order. The money isn't moved until the authorization is captured and the
+// hold is released if it's voided or expires.
+type Authorization struct {
+	// ID is how the charge service refers to the authorization. It's empty if
+	// there was nothing to authorize because discounts covered the whole order.
+	ID          string `json:"id"`
+	AmountCents int64  `json:"amountCents"`
+	// ExpiresAt is when the authorization can no longer be captured and the
+	// order moves back to pending
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired returns true if the authorization can no longer be captured at the
+// given time
+func (a Authorization) Expired(now time.Time) bool {
+	return !now.Before(a.ExpiresAt)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AuthorizeOrder atomically moves the order with the given ID from authorizing
+// to authorized and records the authorization on it. The change is added to
+// the order's StatusHistory and an OrderEventAuthorized event to its event
+// log in the same transaction. If that ID isn't found then ErrOrderNotFound is returned and if the
+// order isn't authorizing then ErrInvalidTransition is returned.
+func (i *Instance) AuthorizeOrder(ctx context.Context, id string, auth Authorization) error {
+	// just like TransitionOrderStatus, matching on the status makes this atomic
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "status", Value: OrderStatusAuthorizing},
+	}
+	now := time.Now()
+	change := NewStatusChange(ctx, OrderStatusAuthorizing, OrderStatusAuthorized, now, "authorization succeeded")
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "status", Value: OrderStatusAuthorized},
+			{Key: "statusupdatedat", Value: now},
+			{Key: "updatedat", Value: now},
+			{Key: "authorization", Value: auth},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "statushistory", Value: change}}},
+	}
+	event := NewOrderEvent(ctx, id, OrderEventAuthorized, now)
+	event.StatusChange = &change
+	event.Authorization = &auth
+	var matched bool
+	err := i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		result, err := i.collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if matched = result.MatchedCount > 0; !matched {
+			return nil
+		}
+		return i.insertEvent(ctx, event)
+	})
+	if err != nil {
+		return err
+	}
+	if matched {
+		return nil
+	}
+
+	// nothing matched so figure out why to return the right error
+	n, err := i.collection.CountDocuments(ctx, bson.D{{Key: "id", Value: id}}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrOrderNotFound
+	}
+	return ErrInvalidTransition
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetExpiredAuthorizations returns all authorized orders whose authorization
+// expired before before. This is used to move orders that were never captured
+// back to pending.
+func (i *Instance) GetExpiredAuthorizations(ctx context.Context, before time.Time) ([]Order, error) {
+	filter := bson.D{
+		{Key: "status", Value: OrderStatusAuthorized},
+		{Key: "authorization.expiresat", Value: bson.D{{Key: "$lt", Value: before}}},
+	}
+	cursor, err := i.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return orders, nil
+}
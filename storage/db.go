@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
+
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -16,6 +19,16 @@ var (
 	// ErrOrderExists is returned when a new order is being inserted but an order
 	// with the same ID already exists
 	ErrOrderExists = errors.New("order already exists")
+
+	// ErrInvalidTransition is returned when an order's status is being changed
+	// but the order isn't currently in one of the expected statuses, or it has
+	// line items reserved and the new status is BlockedByReservations
+	ErrInvalidTransition = errors.New("invalid order status transition")
+
+	// ErrOrderContended is returned when an order kept being changed by others
+	// while trying to change it, so the change was given up on and can be tried
+	// again
+	ErrOrderContended = errors.New("order kept changing while being updated")
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -38,56 +51,432 @@ func (i *Instance) GetOrder(ctx context.Context, id string) (Order, error) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// GetOrders should return all orders with the given status. If status is the
-// special -1 value then it should return all orders regardless of their status.
-func (i *Instance) GetOrders(ctx context.Context, status OrderStatus) ([]Order, error) {
-	// TODO: get orders from DB based based on the status sent, unless status is -1
-	var orders []Order
-	var filter bson.M
-	if status == -1 {
-		filter = bson.M{}
-	} else {
-		filter = bson.M{"status": status}
+// orderDocument is how an order is stored. It has the fields GetOrders sorts
+// by that aren't kept on Order itself.
+type orderDocument struct {
+	Order `bson:",inline"`
+	// Total is the order's TotalCents, which never changes since line items
+	// can't be changed once the order is inserted
+	Total int64 `bson:"totalcents"`
+}
+
+// orderSortFields holds the document field each OrderSort sorts by
+var orderSortFields = map[OrderSort]string{
+	OrderSortCreatedAt: "createdat",
+	OrderSortTotal:     "totalcents",
+	OrderSortStatus:    "status",
+}
+
+// orderSortValue converts a cursor's value back to how the field it's for is
+// stored so it can be compared in a filter
+func orderSortValue(sort OrderSort, v int64) interface{} {
+	switch sort {
+	case OrderSortCreatedAt:
+		return time.UnixMilli(v)
+	case OrderSortStatus:
+		return OrderStatus(v)
+	default:
+		return v
 	}
-	cursor, err := i.collection.Find(ctx, filter)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return orders, ErrOrderNotFound
+}
+
+// GetOrders returns a page of the orders matching the query. If the page is
+// full then the cursor of the next page is returned too, otherwise the cursor
+// is empty. If the page's cursor is invalid then ErrInvalidCursor is returned.
+func (i *Instance) GetOrders(ctx context.Context, query OrderQuery, page OrderPage) ([]Order, string, error) {
+	page = page.WithDefaults()
+	field, ok := orderSortFields[page.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown sort: %q", page.Sort)
+	}
+	filter := query.filter()
+	if page.Cursor != "" {
+		c, err := page.ParseCursor()
+		if err != nil {
+			return nil, "", err
+		}
+		// the orders after the cursor either sort after its value or have the
+		// same value and sort after its ID
+		op := "$gt"
+		if page.Descending {
+			op = "$lt"
 		}
-		return orders, err
+		value := orderSortValue(page.Sort, c.Value)
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: field, Value: bson.D{{Key: op, Value: value}}}},
+			bson.D{{Key: field, Value: value}, {Key: "id", Value: bson.D{{Key: op, Value: c.ID}}}},
+		}})
+	}
+	dir := 1
+	if page.Descending {
+		dir = -1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: dir}, {Key: "id", Value: dir}}).
+		SetLimit(int64(page.Limit))
+	cursor, err := i.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, "", fmt.Errorf("error decoding documents: %w", err)
+	}
+	var next string
+	if len(orders) == page.Limit {
+		next = page.NextCursor(orders[len(orders)-1])
 	}
+	return orders, next, nil
+}
 
-	// Iterate over the cursor and decode each document into an Order
+// iterOrdersBatchSize is how many orders IterOrders asks the database for at a
+// time, which bounds how many are held in memory at once
+const iterOrdersBatchSize = 200
+
+// IterOrders calls fn with every order matching the query, sorted the same as
+// GetOrders' default sort, without holding more than a batch of them in
+// memory. This is meant for exports and background jobs that need to go
+// through more orders than a page holds. If fn returns an error then the
+// iteration stops and that error is returned as-is. Orders changed while the
+// iteration is running may or may not be seen in their new state. The database
+// cursor is held until the iteration ends, which can be a while if fn is slow,
+// so callers should give ctx a deadline, which is checked before every order.
+func (i *Instance) IterOrders(ctx context.Context, query OrderQuery, fn func(Order) error) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: orderSortFields[OrderSortCreatedAt], Value: 1}, {Key: "id", Value: 1}}).
+		SetBatchSize(iterOrdersBatchSize)
+	cursor, err := i.collection.Find(ctx, query.filter(), opts)
+	if err != nil {
+		return err
+	}
+	// the cursor has to be closed even if ctx was cancelled, otherwise the server
+	// keeps it open until it times out
+	defer cursor.Close(context.Background())
 	for cursor.Next(ctx) {
+		// Next only checks ctx when it gets the next batch
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var order Order
 		if err := cursor.Decode(&order); err != nil {
-			return nil, fmt.Errorf("error decoding document: %w", err)
+			return fmt.Errorf("error decoding document: %w", err)
+		}
+		if err := fn(order); err != nil {
+			return err
 		}
-		orders = append(orders, order)
 	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("error iterating documents: %w", err)
+	}
+	return nil
+}
 
+////////////////////////////////////////////////////////////////////////////////
+
+// GetStaleOrders returns all orders whose status is one of statuses and hasn't
+// changed since before. This is used to find orders that got stuck in the
+// middle of a multi-step change, like charging.
+func (i *Instance) GetStaleOrders(ctx context.Context, statuses []OrderStatus, before time.Time) ([]Order, error) {
+	filter := bson.D{
+		{Key: "status", Value: bson.D{{Key: "$in", Value: statuses}}},
+		{Key: "statusupdatedat", Value: bson.D{{Key: "$lt", Value: before}}},
+	}
+	cursor, err := i.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
 	return orders, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// statusChangeSet returns the fields an update pipeline sets to move an order
+// to the to status at now, including adding the change to its statushistory.
+// The change's from is whatever status the order is in when the update is
+// applied so it's right even if the filter matches more than one status.
+func statusChangeSet(ctx context.Context, to OrderStatus, now time.Time, reason string) bson.D {
+	// $literal stops the actor and reason from being treated as field paths if
+	// they start with a $
+	change := bson.D{
+		{Key: "from", Value: "$status"},
+		{Key: "to", Value: to},
+		{Key: "at", Value: now},
+		{Key: "actor", Value: bson.D{{Key: "$literal", Value: ActorFromContext(ctx)}}},
+		{Key: "reason", Value: bson.D{{Key: "$literal", Value: reason}}},
+	}
+	return bson.D{
+		{Key: "status", Value: to},
+		{Key: "statusupdatedat", Value: now},
+		{Key: "updatedat", Value: now},
+		{Key: "statushistory", Value: appendToArray("statushistory", change)},
+	}
+}
+
+// appendToArray returns the update pipeline expression that adds value to the
+// end of the array in field. Orders inserted before the field existed have it
+// missing or null, which $push refuses to append to, so those are treated as
+// an empty array.
+func appendToArray(field string, value interface{}) bson.D {
+	return bson.D{{Key: "$concatArrays", Value: bson.A{
+		bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, bson.A{}}}},
+		bson.A{value},
+	}}}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // SetOrderStatus should update the order with the given ID and set the status
-// field. If that ID isn't found then the special ErrOrderNotFound error should
-// be returned.
-func (i *Instance) SetOrderStatus(ctx context.Context, id string, status OrderStatus) error {
-	// TODO: update the order's status field to status for the id
+// field. The change is added to the order's StatusHistory with the reason and
+// to its event log in the same transaction. If that ID isn't found then the
+// special ErrOrderNotFound error should be returned.
+func (i *Instance) SetOrderStatus(ctx context.Context, id string, status OrderStatus, reason string) error {
+	now := time.Now()
 	filter := bson.D{{Key: "id", Value: id}}
+	update := mongo.Pipeline{{{Key: "$set", Value: statusChangeSet(ctx, status, now, reason)}}}
+	// the order from before the update tells us what status it changed from
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		var order Order
+		if err := i.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order); err != nil {
+			return err
+		}
+		return i.insertStatusChange(ctx, id, NewStatusChange(ctx, order.Status, status, now, reason))
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrOrderNotFound
+	}
+	return err
+}
+
+// insertStatusChange adds an OrderEventStatusChanged event for the change to
+// the event log of the order with the given ID
+func (i *Instance) insertStatusChange(ctx context.Context, id string, change StatusChange) error {
+	event := NewOrderEvent(ctx, id, OrderEventStatusChanged, change.At)
+	event.StatusChange = &change
+	return i.insertEvent(ctx, event)
+}
+
+////////////////////////////////////////////////////////////////////////////////
 
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}}}}
-	result, err := i.collection.UpdateOne(ctx, filter, update)
+// TransitionOrderStatus atomically sets the status of the order with the given
+// ID to the to status but only if its current status is one of the from
+// statuses. It returns the order as it was right before the change so callers
+// can tell which of the from statuses it was in. If that ID isn't found then
+// ErrOrderNotFound is returned and if the order's status isn't in from, or the
+// to status is BlockedByReservations and some of its line items are reserved,
+// then ErrInvalidTransition is returned. Moving to a status that starts a
+// payment attempt also increments PaymentAttempts. The change is added to the
+// order's StatusHistory with the reason in the same update and to its event
+// log in the same transaction.
+func (i *Instance) TransitionOrderStatus(ctx context.Context, id string, from []OrderStatus, to OrderStatus, reason string) (Order, error) {
+	// matching on the status in the filter is what makes this atomic since the
+	// database only applies the update if the status hasn't changed since
+	// anyone last looked at it, even across multiple replicas of this service
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "status", Value: bson.D{{Key: "$in", Value: from}}},
+	}
+	if BlockedByReservations(to) {
+		// a line item matches $gt on its own so this only matches if none of
+		// them are reserved, including ones stored without the field
+		filter = append(filter, bson.E{Key: "lineitems.reservedquantity", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: 0}}}}})
+	}
+	now := time.Now()
+	set := statusChangeSet(ctx, to, now, reason)
+	if StartsPaymentAttempt(to) {
+		set = append(set, bson.E{Key: "paymentattempts", Value: bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$paymentattempts", 0}}},
+			1,
+		}}}})
+	}
+	update := mongo.Pipeline{{{Key: "$set", Value: set}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var order Order
+	err := i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		if err := i.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order); err != nil {
+			return err
+		}
+		return i.insertStatusChange(ctx, id, NewStatusChange(ctx, order.Status, to, now, reason))
+	})
+	if err == nil {
+		return order, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return Order{}, err
+	}
+
+	// nothing matched so either the order doesn't exist or it's in a different
+	// status, or has line items reserved, and we need to check which to return
+	// the right error
+	n, err := i.collection.CountDocuments(ctx, bson.D{{Key: "id", Value: id}}, options.Count().SetLimit(1))
 	if err != nil {
-		return err
+		return Order{}, err
 	}
-	if result.MatchedCount == 0 {
-		return ErrOrderNotFound
+	if n == 0 {
+		return Order{}, ErrOrderNotFound
 	}
+	return Order{}, ErrInvalidTransition
+}
 
-	return nil
+////////////////////////////////////////////////////////////////////////////////
+
+// maxCASAttempts is how many times a compare-and-swap update of an order is
+// tried before giving up with ErrOrderContended
+const maxCASAttempts = 25
+
+// lineItemsUnchanged returns the filter conditions that only match if the
+// order's line items are fulfilled and reserved as much as they are in order.
+// Each line item is compared on its own by position rather than comparing the
+// whole array, which would never match a document whose line items are missing
+// fields, like the ones stored before line items had an ID or
+// FulfilledQuantity, or that stores the numbers as a different type.
+func lineItemsUnchanged(order Order) bson.D {
+	filter := bson.D{{Key: "lineitems", Value: bson.D{{Key: "$size", Value: len(order.LineItems)}}}}
+	for idx, li := range order.LineItems {
+		filter = append(filter,
+			bson.E{Key: fmt.Sprintf("lineitems.%d.fulfilledquantity", idx), Value: quantityEquals(li.FulfilledQuantity)},
+			bson.E{Key: fmt.Sprintf("lineitems.%d.reservedquantity", idx), Value: quantityEquals(li.ReservedQuantity)},
+		)
+	}
+	return filter
+}
+
+// quantityEquals returns the filter value matching a line item quantity field
+// equal to q, where 0 also matches the field being missing
+func quantityEquals(q int64) interface{} {
+	if q == 0 {
+		// null also matches the field being missing
+		return bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+	}
+	return q
+}
+
+// updateLineItems sets the line items, and status if it changed, of the order
+// with the given ID to what change returns for the order and adds event, with
+// its StatusChange filled in if the status changed, to the order's event log in
+// the same transaction. It returns the order after the change. This is a
+// compare-and-swap that only updates the order if its status and line items
+// haven't changed since change was called, otherwise two warehouses fulfilling
+// at the same time could overwrite each other's progress. If the order keeps
+// changing ErrOrderContended is returned.
+func (i *Instance) updateLineItems(ctx context.Context, id string, event OrderEvent, reason string, change func(Order) (Order, error)) (Order, error) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return Order{}, err
+		}
+		order, err := i.GetOrder(ctx, id)
+		if err != nil {
+			return Order{}, err
+		}
+		// orders inserted before line items had IDs don't have them stored, and
+		// this is also what fills them in on the document
+		order.FillLineItemIDs()
+		updated, err := change(order)
+		if err != nil {
+			return Order{}, err
+		}
+
+		filter := append(bson.D{
+			{Key: "id", Value: id},
+			{Key: "status", Value: order.Status},
+		}, lineItemsUnchanged(order)...)
+		now := time.Now()
+		updated.UpdatedAt = now
+		event.At = now
+		event.StatusChange = nil
+		set := bson.D{{Key: "updatedat", Value: now}}
+		if updated.Status != order.Status {
+			// the filter pins the status so the change's from that
+			// statusChangeSet stores is the same as this one's
+			change := NewStatusChange(ctx, order.Status, updated.Status, now, reason)
+			updated = updated.WithStatusChange(change)
+			set = statusChangeSet(ctx, updated.Status, now, reason)
+			event.StatusChange = &change
+		}
+		// $literal stops the line items from being treated as an expression, like
+		// a description that starts with a $
+		set = append(set, bson.E{Key: "lineitems", Value: bson.D{{Key: "$literal", Value: updated.LineItems}}})
+		update := mongo.Pipeline{{{Key: "$set", Value: set}}}
+		var matched bool
+		err = i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+			result, err := i.collection.UpdateOne(ctx, filter, update)
+			if err != nil {
+				return err
+			}
+			if matched = result.MatchedCount > 0; !matched {
+				return nil
+			}
+			return i.insertEvent(ctx, event)
+		})
+		if err != nil {
+			return Order{}, err
+		}
+		if matched {
+			return updated, nil
+		}
+		// the order changed in the meantime so try again with the latest version
+	}
+	return Order{}, ErrOrderContended
+}
+
+// ReserveLineItems adds quantities, which maps line item IDs to how many of
+// them are about to be fulfilled, to the reserved quantities of the line items
+// of the order with the given ID. This should happen before asking the
+// fulfillment service to ship them. It returns the order after the change. If
+// that ID isn't found then ErrOrderNotFound is returned, if the order isn't
+// charged or partially fulfilled then ErrInvalidTransition is returned and if
+// the quantities are more than what's available then ErrInvalidFulfillment is
+// returned. If the order keeps changing while this tries to update it then
+// ErrOrderContended is returned. An OrderEventLineItemsReserved event is added
+// to the order's event log in the same transaction.
+func (i *Instance) ReserveLineItems(ctx context.Context, id string, quantities map[string]int64) (Order, error) {
+	event := NewOrderEvent(ctx, id, OrderEventLineItemsReserved, time.Time{})
+	event.Quantities = quantities
+	return i.updateLineItems(ctx, id, event, "", func(order Order) (Order, error) {
+		return order.WithReserved(quantities)
+	})
+}
+
+// ReleaseLineItems takes quantities, which maps line item IDs to how many of
+// them the fulfillment service failed to ship, out of the reserved quantities
+// of the line items of the order with the given ID so they can be fulfilled
+// again. It returns the order after the change. If that ID isn't found then
+// ErrOrderNotFound is returned and if the quantities are more than what's
+// reserved then ErrInvalidFulfillment is returned. If the order keeps changing
+// while this tries to update it then ErrOrderContended is returned. An
+// OrderEventFulfillmentFailed event with reason as its Error is added to the
+// order's event log in the same transaction.
+func (i *Instance) ReleaseLineItems(ctx context.Context, id string, quantities map[string]int64, reason string) (Order, error) {
+	event := NewOrderEvent(ctx, id, OrderEventFulfillmentFailed, time.Time{})
+	event.Quantities = quantities
+	event.Error = reason
+	return i.updateLineItems(ctx, id, event, "", func(order Order) (Order, error) {
+		return order.WithReleased(quantities)
+	})
+}
+
+// FulfillLineItems moves quantities, which maps line item IDs to how many more
+// of them were fulfilled, from the reserved to the fulfilled quantities of the
+// line items of the order with the given ID and updates its status to
+// fulfilled or partially fulfilled. It returns the order after the change. If
+// that ID isn't found then ErrOrderNotFound is returned, if the order isn't
+// charged or partially fulfilled then ErrInvalidTransition is returned and if
+// the quantities are invalid, including when they weren't reserved with
+// ReserveLineItems first, then ErrInvalidFulfillment is returned. If the order
+// keeps changing while this tries to update it then ErrOrderContended is
+// returned. An OrderEventLineItemsFulfilled event is added to the order's event
+// log in the same transaction.
+func (i *Instance) FulfillLineItems(ctx context.Context, id string, quantities map[string]int64) (Order, error) {
+	event := NewOrderEvent(ctx, id, OrderEventLineItemsFulfilled, time.Time{})
+	event.Quantities = quantities
+	return i.updateLineItems(ctx, id, event, "line items fulfilled", func(order Order) (Order, error) {
+		return order.WithFulfilled(quantities)
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -95,32 +484,38 @@ func (i *Instance) SetOrderStatus(ctx context.Context, id string, status OrderSt
 // InsertOrder should fill in the order's ID with a unique identifier if it's not
 // already set and then insert it into the database. It should return the order's
 // ID. If the order already exists then ErrOrderExists should be returned.
+// StatusUpdatedAt, CreatedAt and UpdatedAt are set to the current time if
+// they're not already set, the order's initial status is added to its
+// StatusHistory if it's empty and line items without an ID get one. An
+// OrderEventCreated event is added to the order's event log in the same
+// transaction.
 func (i *Instance) InsertOrder(ctx context.Context, order Order) (string, error) {
-	// TODO: if the order's ID field is empty, generate a random ID, then insert
 	if order.ID == "" {
 		id := uuid.New()
 		order.ID = id.String()
-	} else {
-		// Check if document with the same ID already exists
-		filter := bson.D{{Key: "id", Value: order.ID}}
-		//filter := bson.M{"id": order.ID}
-		err := i.collection.FindOne(ctx, filter).Decode(&Order{})
-		if err == nil {
-			return "", ErrOrderExists
-		}
 	}
+	// copy the line items so filling in their IDs doesn't modify the caller's
+	order.LineItems = append([]LineItem(nil), order.LineItems...)
+	order.FillLineItemIDs()
+	order.FillTimestamps(ctx, time.Now())
 
-	// If no document with the same ID exists, insert the new document
-	_, err := i.collection.InsertOne(ctx, order)
+	// the unique index on id created by ensureSchema rejects the insert if an
+	// order with the same ID already exists, which unlike checking first can't
+	// race with another insert
+	event := NewOrderEvent(ctx, order.ID, OrderEventCreated, order.CreatedAt)
+	event.Order = &order
+	err := i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		doc := orderDocument{Order: order, Total: order.TotalCents()}
+		if _, err := i.collection.InsertOne(ctx, doc); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrOrderExists
+			}
+			return fmt.Errorf("error inserting document: %w", err)
+		}
+		return i.insertEvent(ctx, event)
+	})
 	if err != nil {
-		return "", fmt.Errorf("error inserting document: %e", err)
+		return "", err
 	}
-
-	//originally added this type assertion and conversion but now I think this is overkill
-	//insertedID, ok := result.InsertedID.(primitive.ObjectID)
-	//if !ok {
-	//	return "", errors.New("was not able to type assert the returned ID from mongo")
-	//}
-
 	return order.ID, nil
 }
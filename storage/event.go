@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrderEventType describes what happened to an order in an OrderEvent
+type OrderEventType string
+
+const (
+	// OrderEventCreated means the order was inserted. The event's Order is the
+	// order as it was inserted.
+	OrderEventCreated OrderEventType = "created"
+
+	// OrderEventStatusChanged means the order's status changed
+	OrderEventStatusChanged OrderEventType = "statusChanged"
+
+	// OrderEventLineItemsFulfilled means some of the order's line items were
+	// fulfilled. The event's Quantities are how many more of each were
+	// fulfilled and its StatusChange is set if the order's status changed.
+	OrderEventLineItemsFulfilled OrderEventType = "lineItemsFulfilled"
+
+	// OrderEventLineItemsReserved means some of the order's line items are
+	// about to be fulfilled. The event's Quantities are how many of each were
+	// reserved.
+	OrderEventLineItemsReserved OrderEventType = "lineItemsReserved"
+
+	// OrderEventFulfillmentFailed means the fulfillment service failed to
+	// fulfill the event's Quantities, with the reason in its Error, and they
+	// were released so they can be fulfilled again
+	OrderEventFulfillmentFailed OrderEventType = "fulfillmentFailed"
+
+	// OrderEventRefundAdded means a partial refund was added to the order
+	OrderEventRefundAdded OrderEventType = "refundAdded"
+
+	// OrderEventRefundStatusChanged means a pending partial refund succeeded or
+	// failed. The event's Refund only has the ID, Status and ChargeReference
+	// set.
+	OrderEventRefundStatusChanged OrderEventType = "refundStatusChanged"
+
+	// OrderEventPaymentRecorded means the charge service was called to charge,
+	// refund, authorize, capture or void the order
+	OrderEventPaymentRecorded OrderEventType = "paymentRecorded"
+
+	// OrderEventAuthorized means the order was authorized. The event's
+	// StatusChange is the change from authorizing to authorized.
+	OrderEventAuthorized OrderEventType = "authorized"
+)
+
+// MaxOrderEventsLimit is the most events GetOrderEvents returns at once
+const MaxOrderEventsLimit = 1000
+
+// OrderEvent is a single entry in an order's event log. Events are never changed
+// once they're recorded so the log can be used to reconstruct what happened to
+// an order regardless of what the order looks like now. The outbox doesn't
+// mark events either, it keeps a cursor per sink with the Seq of the last
+// event that sink got.
+type OrderEvent struct {
+	// ID uniquely identifies the event and the IDs of an order's events sort in
+	// the order they were recorded
+	ID string `json:"id"`
+	// Seq is the event's position in the log of every order's events. It's
+	// assigned in the same transaction that records the event, so events become
+	// visible in the order of their Seq and reading forward from a Seq never
+	// skips an event that's committed later. Events recorded before Seq existed
+	// don't have one.
+	Seq     int64          `json:"seq,omitempty"`
+	OrderID string         `json:"orderId"`
+	Type    OrderEventType `json:"type"`
+	At      time.Time      `json:"at"`
+	// Actor is who caused the event, from the context passed to the storage
+	// method that recorded it
+	Actor string `json:"actor,omitempty"`
+
+	// only the fields relevant to the Type are set
+	Order         *Order           `json:"order,omitempty"`
+	StatusChange  *StatusChange    `json:"statusChange,omitempty"`
+	Quantities    map[string]int64 `json:"quantities,omitempty"`
+	Refund        *Refund          `json:"refund,omitempty"`
+	Payment       *Payment         `json:"payment,omitempty"`
+	Authorization *Authorization   `json:"authorization,omitempty"`
+	Error         string           `json:"error,omitempty"`
+}
+
+// NewOrderEvent returns an event of the given type for the order with the
+// given ID that happened at the given time, attributed to the actor set on ctx
+func NewOrderEvent(ctx context.Context, orderID string, typ OrderEventType, at time.Time) OrderEvent {
+	return OrderEvent{
+		OrderID: orderID,
+		Type:    typ,
+		At:      at,
+		Actor:   ActorFromContext(ctx),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// withTransaction calls fn within a transaction so either everything fn
+// writes is committed or none of it is. This is what lets the storage methods
+// change an order and add the event for the change to the outbox at the same
+// time. fn can be called more than once if the transaction has to be retried,
+// and it must use the context it's given for every operation so they're part
+// of the transaction. Transactions need MongoDB to be running as a replica
+// set, although a replica set with a single member is fine.
+func (i *Instance) withTransaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error {
+	sess, err := i.db.StartSession()
+	if err != nil {
+		return fmt.Errorf("error starting session: %w", err)
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// eventSeqCounterID is the ID of the document in the counters collection
+// holding the last Seq given to an event
+const eventSeqCounterID = "orderevents"
+
+// nextEventSeq increments the event Seq counter and returns the new value. It
+// must be called within a transaction. The counter document stays locked until
+// the transaction commits, so another transaction can't take the next Seq
+// until then and Seqs become visible in order.
+//
+// This means every write that records an event, to any order, takes turns on
+// the one counter document and a transaction that finds it locked gets a
+// WriteConflict, which withTransaction retries. That's on purpose: it's what
+// lets the outbox and order streams read forward from a Seq without ever
+// skipping an event, which anything handed out outside the transaction, like
+// an ObjectID or a timestamp, can't promise since those can commit out of
+// order. To keep the turns short, insertEvent is always the last write in a
+// transaction so the counter is only locked while it commits. One document
+// takes thousands of increments a second, far more orders than this service
+// sees, and the OrderEventsAfterSeq conformance test checks that writes to
+// different orders at once all succeed without gaps in their Seqs. If that
+// ever becomes the bottleneck the counter could be split per shard of orders,
+// with readers merging the shards.
+func (i *Instance) nextEventSeq(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	filter := bson.D{{Key: "_id", Value: eventSeqCounterID}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: int64(1)}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := i.counters.FindOneAndUpdate(ctx, filter, update, opts).Decode(&counter); err != nil {
+		return 0, fmt.Errorf("error incrementing event seq: %w", err)
+	}
+	return counter.Seq, nil
+}
+
+// insertEvent adds the event to the event log, filling in its ID and Seq and
+// setting its At to the current time if it's not already set. It must be called
+// within a transaction.
+func (i *Instance) insertEvent(ctx context.Context, event OrderEvent) error {
+	// object IDs start with the time they were created so an order's events,
+	// whose changes can't overlap, sort in the order they were recorded
+	event.ID = primitive.NewObjectID().Hex()
+	seq, err := i.nextEventSeq(ctx)
+	if err != nil {
+		return err
+	}
+	event.Seq = seq
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	if _, err := i.events.InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("error inserting event: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetOrderEvents returns at most limit events of the order with the given ID,
+// oldest first, starting after the event with the ID after, or from the
+// beginning if after is empty. limit is capped at MaxOrderEventsLimit. An order
+// that doesn't exist has no events.
+func (i *Instance) GetOrderEvents(ctx context.Context, orderID, after string, limit int) ([]OrderEvent, error) {
+	if limit <= 0 || limit > MaxOrderEventsLimit {
+		limit = MaxOrderEventsLimit
+	}
+	filter := bson.D{{Key: "orderid", Value: orderID}}
+	if after != "" {
+		filter = append(filter, bson.E{Key: "id", Value: bson.D{{Key: "$gt", Value: after}}})
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := i.events.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []OrderEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return events, nil
+}
+
+// GetOrderEventsAfterSeq returns at most limit events with a Seq greater than
+// after, in order of their Seq, of the order with the given ID or of every
+// order if orderID is empty. limit is capped at MaxOrderEventsLimit. This is
+// what order streams read new events with.
+func (i *Instance) GetOrderEventsAfterSeq(ctx context.Context, orderID string, after int64, limit int) ([]OrderEvent, error) {
+	if limit <= 0 || limit > MaxOrderEventsLimit {
+		limit = MaxOrderEventsLimit
+	}
+	filter := bson.D{}
+	if orderID != "" {
+		filter = append(filter, bson.E{Key: "orderid", Value: orderID})
+	}
+	filter = append(filter, bson.E{Key: "seq", Value: bson.D{{Key: "$gt", Value: after}}})
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := i.events.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []OrderEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return events, nil
+}
+
+// GetLastOrderEventSeq returns the Seq of the newest committed event across
+// every order, or 0 if there aren't any events yet
+func (i *Instance) GetLastOrderEventSeq(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	// the counter only changes when a transaction recording an event commits so
+	// it's never ahead of the events that can be read
+	err := i.counters.FindOne(ctx, bson.D{{Key: "_id", Value: eventSeqCounterID}}).Decode(&counter)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error getting event seq: %w", err)
+	}
+	return counter.Seq, nil
+}
@@ -0,0 +1,11 @@
+package storage
+
+import (
+	"context"
+)
+
+// DropDatabase drops the Instance's whole database. It's only exported to the
+// tests so they can remove the random databases they make.
+func (i *Instance) DropDatabase(ctx context.Context) error {
+	return i.db.Database(i.cfg.Database).Drop(ctx)
+}
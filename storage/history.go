@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// actorKey is the context key WithActor stores the actor under
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that attributes any changes the storage
+// methods make with it to actor, like the client making a request or the
+// recovery worker
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set on ctx with WithActor or an empty
+// string if there isn't one
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// StatusChange is a single change of an order's status. The storage methods
+// append one to the order's StatusHistory whenever they change its status.
+type StatusChange struct {
+	// From is the status the order was in before the change. It's nil for the
+	// first change, which is when the order was created.
+	From *OrderStatus `json:"from,omitempty"`
+	To   OrderStatus  `json:"to"`
+	At   time.Time    `json:"at"`
+	// Actor is who made the change, from the context passed to the storage
+	// method that made it
+	Actor string `json:"actor,omitempty"`
+	// Reason is why the status changed, like a declined charge
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewStatusChange returns the change of an order from the from status to the
+// to status at the given time, attributed to the actor set on ctx
+func NewStatusChange(ctx context.Context, from, to OrderStatus, at time.Time, reason string) StatusChange {
+	return StatusChange{
+		From:   &from,
+		To:     to,
+		At:     at,
+		Actor:  ActorFromContext(ctx),
+		Reason: reason,
+	}
+}
+
+// WithStatusChange returns a copy of the order moved to the change's status
+// with the change added to the end of its StatusHistory. StatusUpdatedAt and
+// UpdatedAt are set to when the change happened.
+func (o Order) WithStatusChange(change StatusChange) Order {
+	o.Status = change.To
+	o.StatusUpdatedAt = change.At
+	o.UpdatedAt = change.At
+	// copy the history so we don't modify the caller's order
+	o.StatusHistory = append(append([]StatusChange{}, o.StatusHistory...), change)
+	return o
+}
+
+// EnteredStatusAt returns when the order last moved to the status, which is
+// useful for measuring how long orders take to get from one status to
+// another. It returns false if the order was never in the status.
+func (o Order) EnteredStatusAt(status OrderStatus) (time.Time, bool) {
+	for idx := len(o.StatusHistory) - 1; idx >= 0; idx-- {
+		if o.StatusHistory[idx].To == status {
+			return o.StatusHistory[idx].At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// FillTimestamps sets StatusUpdatedAt, CreatedAt and UpdatedAt to now if
+// they're not already set and starts the StatusHistory with the order's
+// initial status if it's empty. The storage methods call this when inserting
+// an order.
+func (o *Order) FillTimestamps(ctx context.Context, now time.Time) {
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = now
+	}
+	if o.UpdatedAt.IsZero() {
+		o.UpdatedAt = o.CreatedAt
+	}
+	if o.StatusUpdatedAt.IsZero() {
+		o.StatusUpdatedAt = o.CreatedAt
+	}
+	if len(o.StatusHistory) == 0 {
+		o.StatusHistory = []StatusChange{{
+			To:    o.Status,
+			At:    o.StatusUpdatedAt,
+			Actor: ActorFromContext(ctx),
+		}}
+	}
+}
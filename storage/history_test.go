@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFillTimestamps(t *testing.T) {
+	ctx := WithActor(context.Background(), "test")
+	now := time.Now()
+
+	// everything is filled in from now
+	var order Order
+	order.FillTimestamps(ctx, now)
+	assert.Equal(t, now, order.CreatedAt)
+	assert.Equal(t, now, order.UpdatedAt)
+	assert.Equal(t, now, order.StatusUpdatedAt)
+	assert.Equal(t, []StatusChange{{To: OrderStatusPending, At: now, Actor: "test"}}, order.StatusHistory)
+
+	// anything already set is kept
+	created := now.Add(-time.Hour)
+	order = Order{Status: OrderStatusCharged, CreatedAt: created}
+	order.FillTimestamps(ctx, now)
+	assert.Equal(t, created, order.UpdatedAt)
+	assert.Equal(t, created, order.StatusUpdatedAt)
+	assert.Equal(t, []StatusChange{{To: OrderStatusCharged, At: created, Actor: "test"}}, order.StatusHistory)
+}
+
+func TestWithStatusChange(t *testing.T) {
+	ctx := WithActor(context.Background(), "test")
+	created := time.Now().Add(-time.Hour)
+	order := Order{Status: OrderStatusPending}
+	order.FillTimestamps(ctx, created)
+
+	charging := created.Add(time.Minute)
+	got := order.WithStatusChange(NewStatusChange(ctx, OrderStatusPending, OrderStatusCharging, charging, "charge requested"))
+	charged := created.Add(2 * time.Minute)
+	got = got.WithStatusChange(NewStatusChange(ctx, OrderStatusCharging, OrderStatusCharged, charged, "charge succeeded"))
+	assert.Equal(t, OrderStatusCharged, got.Status)
+	assert.Equal(t, charged, got.StatusUpdatedAt)
+	assert.Equal(t, charged, got.UpdatedAt)
+	if assert.Len(t, got.StatusHistory, 3) {
+		change := got.StatusHistory[2]
+		assert.Equal(t, OrderStatusCharging, *change.From)
+		assert.Equal(t, "test", change.Actor)
+		assert.Equal(t, "charge succeeded", change.Reason)
+	}
+	// the original isn't modified
+	assert.Len(t, order.StatusHistory, 1)
+
+	// how long the order took to get charged can be found from the history
+	at, ok := got.EnteredStatusAt(OrderStatusPending)
+	assert.True(t, ok)
+	assert.Equal(t, created, at)
+	at, ok = got.EnteredStatusAt(OrderStatusCharged)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, at.Sub(created))
+	_, ok = got.EnteredStatusAt(OrderStatusFulfilled)
+	assert.False(t, ok)
+}
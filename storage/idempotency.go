@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrIdempotencyKeyExists is returned when an idempotency key is being
+	// reserved but an unexpired record with the same key already exists
+	ErrIdempotencyKeyExists = errors.New("idempotency key already exists")
+
+	// ErrIdempotencyKeyNotFound is returned when the specified idempotency key
+	// cannot be found or has expired
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+)
+
+// IdempotencyRecord remembers a request made with an Idempotency-Key header so
+// that retries of the same request get the same response instead of doing the
+// work again
+type IdempotencyRecord struct {
+	// Key is the value of the Idempotency-Key header sent by the client
+	Key string
+	// Token is a unique value for every reservation of the key. Only the request
+	// that reserved the key knows it, so once its lease runs out and another
+	// request takes over the key the first one can't complete or delete it.
+	Token string
+	// Fingerprint identifies the request the key was first used with so we can
+	// reject the same key being reused for a different request
+	Fingerprint string
+	// Completed is false while the first request is still being handled and the
+	// response fields below aren't set yet
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	// CreatedAt is when the key was reserved
+	CreatedAt time.Time
+	// ExpiresAt is when the record is deleted and the key can be used again.
+	// While the record isn't completed this is a short lease so an abandoned
+	// request doesn't hold the key for long.
+	ExpiresAt time.Time
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReserveIdempotencyKey stores a new, uncompleted record for the key. If an
+// unexpired record for the key already exists then ErrIdempotencyKeyExists is
+// returned.
+func (i *Instance) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) error {
+	// the TTL index only deletes expired records every minute or so, which means
+	// an expired record might still be around, so this replaces the record if
+	// it's expired and otherwise inserts a new one
+	// if an unexpired record exists the filter doesn't match, the upsert tries to
+	// insert and the unique index on key rejects it
+	filter := bson.D{
+		{Key: "key", Value: rec.Key},
+		{Key: "expiresat", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+	}
+	_, err := i.idempotencyKeys.ReplaceOne(ctx, filter, rec, options.Replace().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrIdempotencyKeyExists
+		}
+		return fmt.Errorf("error reserving idempotency key: %w", err)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetIdempotencyKey returns the record for the key. If the key isn't found or
+// has expired then ErrIdempotencyKeyNotFound is returned.
+func (i *Instance) GetIdempotencyKey(ctx context.Context, key string) (IdempotencyRecord, error) {
+	var rec IdempotencyRecord
+	filter := bson.D{
+		{Key: "key", Value: key},
+		{Key: "expiresat", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	err := i.idempotencyKeys.FindOne(ctx, filter).Decode(&rec)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return IdempotencyRecord{}, ErrIdempotencyKeyNotFound
+		}
+		return IdempotencyRecord{}, err
+	}
+	return rec, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// idempotencyReservation returns the filter that only matches the record for
+// the key while it's still reserved with token, which stops a request whose
+// lease ran out from touching the record of the request that took over
+func idempotencyReservation(key, token string) bson.D {
+	return bson.D{
+		{Key: "key", Value: key},
+		{Key: "token", Value: token},
+		{Key: "completed", Value: false},
+	}
+}
+
+// CompleteIdempotencyKey stores the response for the key's request, marks the
+// record as completed and keeps it until expiresAt. If the key isn't found, or
+// isn't reserved with token anymore, then ErrIdempotencyKeyNotFound is
+// returned.
+func (i *Instance) CompleteIdempotencyKey(ctx context.Context, key, token string, statusCode int, contentType string, body []byte, expiresAt time.Time) error {
+	filter := idempotencyReservation(key, token)
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "completed", Value: true},
+		{Key: "statuscode", Value: statusCode},
+		{Key: "contenttype", Value: contentType},
+		{Key: "body", Value: body},
+		{Key: "expiresat", Value: expiresAt},
+	}}}
+	result, err := i.idempotencyKeys.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DeleteIdempotencyKey deletes the record for the key, if it's still reserved
+// with token, so it can be used again. Deleting a key that doesn't exist or
+// isn't reserved with token anymore isn't an error.
+func (i *Instance) DeleteIdempotencyKey(ctx context.Context, key, token string) error {
+	_, err := i.idempotencyKeys.DeleteOne(ctx, idempotencyReservation(key, token))
+	return err
+}
@@ -0,0 +1,922 @@
+// Package memory contains an in-memory implementation of the storage methods
+// so the service and its tests can run without a database
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/levenlabs/order-up/storage"
+)
+
+// Instance holds all of the orders in memory and mirrors the behavior of
+// *storage.Instance, including the errors it returns
+type Instance struct {
+	// mu guards orders and ids since the HTTP server calls the storage methods
+	// from many goroutines at once
+	mu     sync.RWMutex
+	orders map[string]storage.Order
+	// ids holds the order IDs in the order they were inserted so GetOrders returns
+	// a stable ordering instead of a random map ordering
+	ids []string
+	// idempotencyKeys holds the idempotency records by key, expired records are
+	// ignored and overwritten rather than deleted
+	idempotencyKeys map[string]storage.IdempotencyRecord
+	// events holds the event log of every order by order ID, oldest first
+	events map[string][]storage.OrderEvent
+	// lastEventID is incremented for every event to give it an ID and Seq that
+	// sort after every event before it
+	lastEventID int64
+	// outboxCursors holds the outbox cursor of every sink by the sink's name
+	outboxCursors map[string]storage.OutboxCursor
+	// webhooks holds the webhook subscriptions by ID and webhookIDs holds their
+	// IDs in the order they were inserted
+	webhooks   map[string]storage.WebhookSubscription
+	webhookIDs []string
+	// webhookDeliveries holds every webhook delivery by ID
+	webhookDeliveries map[string]storage.WebhookDelivery
+}
+
+// New returns an empty Instance that's ready to use
+func New() *Instance {
+	return &Instance{
+		orders:            map[string]storage.Order{},
+		idempotencyKeys:   map[string]storage.IdempotencyRecord{},
+		events:            map[string][]storage.OrderEvent{},
+		outboxCursors:     map[string]storage.OutboxCursor{},
+		webhooks:          map[string]storage.WebhookSubscription{},
+		webhookDeliveries: map[string]storage.WebhookDelivery{},
+	}
+}
+
+// now returns the current time rounded to the same precision as the database
+// so orders look the same regardless of the backend
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// copyOrder returns a copy of the order that doesn't share the line items,
+// refunds, payments or status history backing arrays, or the authorization, so
+// callers can't modify the stored order by accident
+func copyOrder(order storage.Order) storage.Order {
+	if order.LineItems != nil {
+		order.LineItems = append([]storage.LineItem{}, order.LineItems...)
+	}
+	if order.Refunds != nil {
+		order.Refunds = append([]storage.Refund{}, order.Refunds...)
+		for idx, r := range order.Refunds {
+			if r.LineItems != nil {
+				order.Refunds[idx].LineItems = append([]storage.RefundLineItem{}, r.LineItems...)
+			}
+		}
+	}
+	if order.Payments != nil {
+		order.Payments = append([]storage.Payment{}, order.Payments...)
+	}
+	if order.Authorization != nil {
+		auth := *order.Authorization
+		order.Authorization = &auth
+	}
+	if order.StatusHistory != nil {
+		order.StatusHistory = append([]storage.StatusChange{}, order.StatusHistory...)
+	}
+	return order
+}
+
+// copyEvent returns a copy of the event that doesn't share anything it points
+// to so events can't be modified after they're recorded
+func copyEvent(event storage.OrderEvent) storage.OrderEvent {
+	if event.Order != nil {
+		order := copyOrder(*event.Order)
+		event.Order = &order
+	}
+	if event.StatusChange != nil {
+		change := *event.StatusChange
+		event.StatusChange = &change
+	}
+	if event.Quantities != nil {
+		quantities := make(map[string]int64, len(event.Quantities))
+		for id, q := range event.Quantities {
+			quantities[id] = q
+		}
+		event.Quantities = quantities
+	}
+	if event.Refund != nil {
+		refund := *event.Refund
+		refund.LineItems = append([]storage.RefundLineItem(nil), refund.LineItems...)
+		event.Refund = &refund
+	}
+	if event.Payment != nil {
+		payment := *event.Payment
+		event.Payment = &payment
+	}
+	if event.Authorization != nil {
+		auth := *event.Authorization
+		event.Authorization = &auth
+	}
+	return event
+}
+
+// copyWebhookSubscription returns a copy of the subscription that doesn't
+// share its event types
+func copyWebhookSubscription(sub storage.WebhookSubscription) storage.WebhookSubscription {
+	if sub.EventTypes != nil {
+		sub.EventTypes = append([]storage.WebhookEventType{}, sub.EventTypes...)
+	}
+	return sub
+}
+
+// copyWebhookDelivery returns a copy of the delivery that doesn't share its
+// payload or attempts
+func copyWebhookDelivery(d storage.WebhookDelivery) storage.WebhookDelivery {
+	if d.Payload != nil {
+		d.Payload = append([]byte{}, d.Payload...)
+	}
+	if d.Attempts != nil {
+		d.Attempts = append([]storage.WebhookAttempt{}, d.Attempts...)
+	}
+	return d
+}
+
+// recordEvent adds a copy of the event to the event log of its order. The
+// caller must hold the write lock, which makes recording the event atomic with
+// the change it describes.
+func (i *Instance) recordEvent(event storage.OrderEvent) {
+	i.lastEventID++
+	event.ID = fmt.Sprintf("%016x", i.lastEventID)
+	event.Seq = i.lastEventID
+	if event.At.IsZero() {
+		event.At = now()
+	}
+	i.events[event.OrderID] = append(i.events[event.OrderID], copyEvent(event))
+}
+
+// recordStatusChange adds a storage.OrderEventStatusChanged event for the
+// change to the event log of the order with the given ID. The caller must hold
+// the write lock.
+func (i *Instance) recordStatusChange(ctx context.Context, id string, change storage.StatusChange) {
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventStatusChanged, change.At)
+	event.StatusChange = &change
+	i.recordEvent(event)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetOrder returns the order with the given ID. If that ID isn't found then
+// the special storage.ErrOrderNotFound error is returned.
+func (i *Instance) GetOrder(ctx context.Context, id string) (storage.Order, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.Order{}, storage.ErrOrderNotFound
+	}
+	return copyOrder(order), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetOrders returns a page of the orders matching the query. If the page is
+// full then the cursor of the next page is returned too, otherwise the cursor
+// is empty. If the page's cursor is invalid then storage.ErrInvalidCursor is
+// returned.
+func (i *Instance) GetOrders(ctx context.Context, query storage.OrderQuery, page storage.OrderPage) ([]storage.Order, string, error) {
+	page = page.WithDefaults()
+	var cursor *storage.OrderCursor
+	if page.Cursor != "" {
+		c, err := page.ParseCursor()
+		if err != nil {
+			return nil, "", err
+		}
+		cursor = &c
+	}
+
+	i.mu.RLock()
+	var orders []storage.Order
+	for _, id := range i.ids {
+		order := i.orders[id]
+		if !query.Matches(order) {
+			continue
+		}
+		if cursor != nil && !page.After(*cursor, order) {
+			continue
+		}
+		orders = append(orders, copyOrder(order))
+	}
+	i.mu.RUnlock()
+
+	sort.Slice(orders, func(a, b int) bool { return page.Compare(orders[a], orders[b]) < 0 })
+	if len(orders) < page.Limit {
+		return orders, "", nil
+	}
+	orders = orders[:page.Limit]
+	return orders, page.NextCursor(orders[len(orders)-1]), nil
+}
+
+// iterOrdersPageSize is how many orders IterOrders copies at a time
+const iterOrdersPageSize = 200
+
+// IterOrders calls fn with every order matching the query, sorted the same as
+// GetOrders' default sort. If fn returns an error then the iteration stops and
+// that error is returned as-is.
+func (i *Instance) IterOrders(ctx context.Context, query storage.OrderQuery, fn func(storage.Order) error) error {
+	// going page by page means fn is never called with the lock held, so it can
+	// call the other methods, and like the database it sees orders inserted
+	// after the iteration started
+	page := storage.OrderPage{Limit: iterOrdersPageSize}
+	for {
+		// the database stops when ctx is cancelled so this does too
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		orders, next, err := i.GetOrders(ctx, query, page)
+		if err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(order); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		page.Cursor = next
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetStaleOrders returns all orders whose status is one of statuses and hasn't
+// changed since before
+func (i *Instance) GetStaleOrders(ctx context.Context, statuses []storage.OrderStatus, before time.Time) ([]storage.Order, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var orders []storage.Order
+	for _, id := range i.ids {
+		order := i.orders[id]
+		if !order.StatusUpdatedAt.Before(before) {
+			continue
+		}
+		for _, status := range statuses {
+			if order.Status == status {
+				orders = append(orders, copyOrder(order))
+				break
+			}
+		}
+	}
+	return orders, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetOrderStatus updates the order with the given ID and sets the status
+// field. The change is added to the order's StatusHistory with the reason and
+// to its event log. If that ID isn't found then the special
+// storage.ErrOrderNotFound error is returned.
+func (i *Instance) SetOrderStatus(ctx context.Context, id string, status storage.OrderStatus, reason string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.ErrOrderNotFound
+	}
+	change := storage.NewStatusChange(ctx, order.Status, status, now(), reason)
+	i.orders[id] = order.WithStatusChange(change)
+	i.recordStatusChange(ctx, id, change)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// TransitionOrderStatus atomically sets the status of the order with the given
+// ID to the to status but only if its current status is one of the from
+// statuses. It returns the order as it was right before the change. If that ID
+// isn't found then storage.ErrOrderNotFound is returned and if the order's
+// status isn't in from, or the to status is storage.BlockedByReservations and
+// some of its line items are reserved, then storage.ErrInvalidTransition is
+// returned. Moving to a status that starts a payment attempt also increments
+// PaymentAttempts. The change is added to the order's StatusHistory with the
+// reason and to its event log.
+func (i *Instance) TransitionOrderStatus(ctx context.Context, id string, from []storage.OrderStatus, to storage.OrderStatus, reason string) (storage.Order, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.Order{}, storage.ErrOrderNotFound
+	}
+	if storage.BlockedByReservations(to) && order.Reserved() {
+		return storage.Order{}, storage.ErrInvalidTransition
+	}
+	for _, status := range from {
+		if order.Status == status {
+			change := storage.NewStatusChange(ctx, order.Status, to, now(), reason)
+			updated := order.WithStatusChange(change)
+			if storage.StartsPaymentAttempt(to) {
+				updated.PaymentAttempts++
+			}
+			i.orders[id] = updated
+			i.recordStatusChange(ctx, id, change)
+			return copyOrder(order), nil
+		}
+	}
+	return storage.Order{}, storage.ErrInvalidTransition
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// updateLineItems sets the order with the given ID to what change returns for
+// it and adds event, with its StatusChange filled in if the status changed, to
+// its event log. reason is the reason for the status change, if there is one.
+func (i *Instance) updateLineItems(ctx context.Context, id string, event storage.OrderEvent, reason string, change func(storage.Order) (storage.Order, error)) (storage.Order, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.Order{}, storage.ErrOrderNotFound
+	}
+	updated, err := change(order)
+	if err != nil {
+		return storage.Order{}, err
+	}
+	at := now()
+	event.At = at
+	if updated.Status != order.Status {
+		change := storage.NewStatusChange(ctx, order.Status, updated.Status, at, reason)
+		updated = updated.WithStatusChange(change)
+		event.StatusChange = &change
+	} else {
+		updated.UpdatedAt = at
+	}
+	i.orders[id] = updated
+	i.recordEvent(event)
+	return copyOrder(updated), nil
+}
+
+// ReserveLineItems adds quantities, which maps line item IDs to how many of
+// them are about to be fulfilled, to the reserved quantities of the line items
+// of the order with the given ID. It returns the order after the change and
+// adds a storage.OrderEventLineItemsReserved event to its event log. It returns
+// the same errors as *storage.Instance.
+func (i *Instance) ReserveLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error) {
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventLineItemsReserved, time.Time{})
+	event.Quantities = quantities
+	return i.updateLineItems(ctx, id, event, "", func(order storage.Order) (storage.Order, error) {
+		return order.WithReserved(quantities)
+	})
+}
+
+// ReleaseLineItems takes quantities, which maps line item IDs to how many of
+// them the fulfillment service failed to ship, out of the reserved quantities
+// of the line items of the order with the given ID. It returns the order after
+// the change and adds a storage.OrderEventFulfillmentFailed event with reason
+// as its Error to its event log. It returns the same errors as
+// *storage.Instance.
+func (i *Instance) ReleaseLineItems(ctx context.Context, id string, quantities map[string]int64, reason string) (storage.Order, error) {
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventFulfillmentFailed, time.Time{})
+	event.Quantities = quantities
+	event.Error = reason
+	return i.updateLineItems(ctx, id, event, "", func(order storage.Order) (storage.Order, error) {
+		return order.WithReleased(quantities)
+	})
+}
+
+// FulfillLineItems moves quantities, which maps line item IDs to how many more
+// of them were fulfilled, from the reserved to the fulfilled quantities of the
+// line items of the order with the given ID and updates its status to
+// fulfilled or partially fulfilled. It returns the order after the change and
+// adds a storage.OrderEventLineItemsFulfilled event to its event log. It
+// returns the same errors as *storage.Instance.
+func (i *Instance) FulfillLineItems(ctx context.Context, id string, quantities map[string]int64) (storage.Order, error) {
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventLineItemsFulfilled, time.Time{})
+	event.Quantities = quantities
+	return i.updateLineItems(ctx, id, event, "line items fulfilled", func(order storage.Order) (storage.Order, error) {
+		return order.WithFulfilled(quantities)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddRefund adds the refund to the order with the given ID as pending. It
+// returns the order after the change with the new refund last and adds a
+// storage.OrderEventRefundAdded event to its event log. It returns the same
+// errors as *storage.Instance.
+func (i *Instance) AddRefund(ctx context.Context, id string, refund storage.Refund) (storage.Order, error) {
+	if refund.CreatedAt.IsZero() {
+		refund.CreatedAt = now()
+	}
+	// the database gives up once ctx is cancelled so this does too
+	if err := ctx.Err(); err != nil {
+		return storage.Order{}, err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.Order{}, storage.ErrOrderNotFound
+	}
+	updated, err := order.WithRefund(refund)
+	if err != nil {
+		return storage.Order{}, err
+	}
+	updated.UpdatedAt = now()
+	i.orders[id] = updated
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventRefundAdded, updated.UpdatedAt)
+	event.Refund = &updated.Refunds[len(updated.Refunds)-1]
+	i.recordEvent(event)
+	return copyOrder(updated), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetRefundStatus moves the pending refund with the given ID on the order with
+// the given ID to status and records the charge service's reference for it. A
+// storage.OrderEventRefundStatusChanged event is added to the order's event
+// log. It returns the same errors as *storage.Instance.
+func (i *Instance) SetRefundStatus(ctx context.Context, id, refundID string, status storage.RefundStatus, chargeReference string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.ErrOrderNotFound
+	}
+	// copy so we don't modify a slice a caller might still have
+	order = copyOrder(order)
+	for idx := range order.Refunds {
+		r := &order.Refunds[idx]
+		if r.ID != refundID {
+			continue
+		}
+		if r.Status != storage.RefundStatusPending {
+			return storage.ErrInvalidTransition
+		}
+		r.Status = status
+		r.ChargeReference = chargeReference
+		order.UpdatedAt = now()
+		i.orders[id] = order
+		event := storage.NewOrderEvent(ctx, id, storage.OrderEventRefundStatusChanged, order.UpdatedAt)
+		event.Refund = &storage.Refund{ID: refundID, Status: status, ChargeReference: chargeReference}
+		i.recordEvent(event)
+		return nil
+	}
+	return storage.ErrRefundNotFound
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetStaleRefunds returns all orders with a refund that's been pending since
+// before
+func (i *Instance) GetStaleRefunds(ctx context.Context, before time.Time) ([]storage.Order, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var orders []storage.Order
+	for _, id := range i.ids {
+		order := i.orders[id]
+		for _, r := range order.Refunds {
+			if r.Status == storage.RefundStatusPending && r.CreatedAt.Before(before) {
+				orders = append(orders, copyOrder(order))
+				break
+			}
+		}
+	}
+	return orders, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddPayment adds the payment to the end of the payments of the order with the
+// given ID. CreatedAt is set to the current time if it's not already set. A
+// storage.OrderEventPaymentRecorded event is added to the order's event log. If
+// that ID isn't found then storage.ErrOrderNotFound is returned.
+func (i *Instance) AddPayment(ctx context.Context, id string, payment storage.Payment) error {
+	if payment.CreatedAt.IsZero() {
+		payment.CreatedAt = now()
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.ErrOrderNotFound
+	}
+	// copy so we don't append to a slice a caller might still have
+	order = copyOrder(order)
+	order.Payments = append(order.Payments, payment)
+	order.UpdatedAt = now()
+	i.orders[id] = order
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventPaymentRecorded, order.UpdatedAt)
+	event.Payment = &payment
+	i.recordEvent(event)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AuthorizeOrder atomically moves the order with the given ID from authorizing
+// to authorized and records the authorization on it. A
+// storage.OrderEventAuthorized event is added to the order's event log. It
+// returns the same errors as *storage.Instance.
+func (i *Instance) AuthorizeOrder(ctx context.Context, id string, auth storage.Authorization) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	order, ok := i.orders[id]
+	if !ok {
+		return storage.ErrOrderNotFound
+	}
+	if order.Status != storage.OrderStatusAuthorizing {
+		return storage.ErrInvalidTransition
+	}
+	change := storage.NewStatusChange(ctx, order.Status, storage.OrderStatusAuthorized, now(), "authorization succeeded")
+	order = order.WithStatusChange(change)
+	order.Authorization = &auth
+	i.orders[id] = order
+	event := storage.NewOrderEvent(ctx, id, storage.OrderEventAuthorized, change.At)
+	event.StatusChange = &change
+	event.Authorization = &auth
+	i.recordEvent(event)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetExpiredAuthorizations returns all authorized orders whose authorization
+// expired before before
+func (i *Instance) GetExpiredAuthorizations(ctx context.Context, before time.Time) ([]storage.Order, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var orders []storage.Order
+	for _, id := range i.ids {
+		order := i.orders[id]
+		if order.Status == storage.OrderStatusAuthorized && order.Authorization != nil && order.Authorization.ExpiresAt.Before(before) {
+			orders = append(orders, copyOrder(order))
+		}
+	}
+	return orders, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// InsertOrder fills in the order's ID with a unique identifier if it's not
+// already set and then stores it. It returns the order's ID. If the order
+// already exists then storage.ErrOrderExists is returned. StatusUpdatedAt,
+// CreatedAt and UpdatedAt are set to the current time if they're not already
+// set, the order's initial status is added to its StatusHistory if it's empty
+// and line items without an ID get one. A storage.OrderEventCreated event is
+// added to the order's event log.
+func (i *Instance) InsertOrder(ctx context.Context, order storage.Order) (string, error) {
+	if order.ID == "" {
+		order.ID = uuid.New().String()
+	}
+	// copy first so filling in the line item IDs doesn't modify the caller's
+	order = copyOrder(order)
+	order.FillLineItemIDs()
+	order.FillTimestamps(ctx, now())
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.orders[order.ID]; ok {
+		return "", storage.ErrOrderExists
+	}
+	i.orders[order.ID] = order
+	i.ids = append(i.ids, order.ID)
+	event := storage.NewOrderEvent(ctx, order.ID, storage.OrderEventCreated, order.CreatedAt)
+	event.Order = &order
+	i.recordEvent(event)
+	return order.ID, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetOrderEvents returns at most limit events of the order with the given ID,
+// oldest first, starting after the event with the ID after, or from the
+// beginning if after is empty. limit is capped at storage.MaxOrderEventsLimit.
+func (i *Instance) GetOrderEvents(ctx context.Context, orderID, after string, limit int) ([]storage.OrderEvent, error) {
+	if limit <= 0 || limit > storage.MaxOrderEventsLimit {
+		limit = storage.MaxOrderEventsLimit
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var events []storage.OrderEvent
+	for _, event := range i.events[orderID] {
+		if event.ID <= after {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		events = append(events, copyEvent(event))
+	}
+	return events, nil
+}
+
+// GetOrderEventsAfterSeq returns at most limit events with a Seq greater than
+// after, in order of their Seq, of the order with the given ID or of every
+// order if orderID is empty. limit is capped at storage.MaxOrderEventsLimit.
+func (i *Instance) GetOrderEventsAfterSeq(ctx context.Context, orderID string, after int64, limit int) ([]storage.OrderEvent, error) {
+	if limit <= 0 || limit > storage.MaxOrderEventsLimit {
+		limit = storage.MaxOrderEventsLimit
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	logs := i.events
+	if orderID != "" {
+		logs = map[string][]storage.OrderEvent{orderID: i.events[orderID]}
+	}
+	// every order's log is already sorted by Seq so only the events after the
+	// cursor need to be merged together
+	var events []storage.OrderEvent
+	for _, log := range logs {
+		j := sort.Search(len(log), func(j int) bool { return log[j].Seq > after })
+		for _, event := range log[j:] {
+			events = append(events, copyEvent(event))
+		}
+	}
+	sort.Slice(events, func(a, b int) bool { return events[a].Seq < events[b].Seq })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// GetLastOrderEventSeq returns the Seq of the newest event across every order,
+// or 0 if there aren't any events yet
+func (i *Instance) GetLastOrderEventSeq(ctx context.Context) (int64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.lastEventID, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ClaimOutboxCursor gives owner the lease on the cursor of the named sink until
+// leaseExpiresAt and returns the cursor. The owner can renew a lease it already
+// holds but if another owner's lease hasn't expired by now then
+// storage.ErrOutboxCursorClaimed is returned. A sink that doesn't have a cursor
+// yet gets one starting after the newest event.
+func (i *Instance) ClaimOutboxCursor(ctx context.Context, sink, owner string, now, leaseExpiresAt time.Time) (storage.OutboxCursor, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	cursor, ok := i.outboxCursors[sink]
+	if !ok {
+		cursor = storage.OutboxCursor{Sink: sink, Seq: i.lastEventID}
+	} else if cursor.Owner != owner && cursor.LeaseExpiresAt.After(now) {
+		return storage.OutboxCursor{}, storage.ErrOutboxCursorClaimed
+	}
+	cursor.Owner = owner
+	cursor.LeaseExpiresAt = leaseExpiresAt
+	i.outboxCursors[sink] = cursor
+	return cursor, nil
+}
+
+// UpdateOutboxCursor stores the cursor's Seq and LeaseExpiresAt. If the
+// cursor's Owner no longer holds the lease then storage.ErrOutboxCursorClaimed
+// is returned and nothing is changed.
+func (i *Instance) UpdateOutboxCursor(ctx context.Context, cursor storage.OutboxCursor) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	existing, ok := i.outboxCursors[cursor.Sink]
+	if !ok || existing.Owner != cursor.Owner {
+		return storage.ErrOutboxCursorClaimed
+	}
+	existing.Seq = cursor.Seq
+	existing.LeaseExpiresAt = cursor.LeaseExpiresAt
+	i.outboxCursors[cursor.Sink] = existing
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ReserveIdempotencyKey stores a new, uncompleted record for the key. If an
+// unexpired record for the key already exists then
+// storage.ErrIdempotencyKeyExists is returned.
+func (i *Instance) ReserveIdempotencyKey(ctx context.Context, rec storage.IdempotencyRecord) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if existing, ok := i.idempotencyKeys[rec.Key]; ok && existing.ExpiresAt.After(time.Now()) {
+		return storage.ErrIdempotencyKeyExists
+	}
+	rec.Body = append([]byte(nil), rec.Body...)
+	i.idempotencyKeys[rec.Key] = rec
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetIdempotencyKey returns the record for the key. If the key isn't found or
+// has expired then storage.ErrIdempotencyKeyNotFound is returned.
+func (i *Instance) GetIdempotencyKey(ctx context.Context, key string) (storage.IdempotencyRecord, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	rec, ok := i.idempotencyKeys[key]
+	if !ok || !rec.ExpiresAt.After(time.Now()) {
+		return storage.IdempotencyRecord{}, storage.ErrIdempotencyKeyNotFound
+	}
+	rec.Body = append([]byte(nil), rec.Body...)
+	return rec, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// CompleteIdempotencyKey stores the response for the key's request, marks the
+// record as completed and keeps it until expiresAt. If the key isn't found, or
+// isn't reserved with token anymore, then storage.ErrIdempotencyKeyNotFound is
+// returned.
+func (i *Instance) CompleteIdempotencyKey(ctx context.Context, key, token string, statusCode int, contentType string, body []byte, expiresAt time.Time) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	rec, ok := i.idempotencyKeys[key]
+	if !ok || rec.Token != token || rec.Completed {
+		return storage.ErrIdempotencyKeyNotFound
+	}
+	rec.Completed = true
+	rec.StatusCode = statusCode
+	rec.ContentType = contentType
+	rec.Body = append([]byte(nil), body...)
+	rec.ExpiresAt = expiresAt
+	i.idempotencyKeys[key] = rec
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DeleteIdempotencyKey deletes the record for the key, if it's still reserved
+// with token, so it can be used again. Deleting a key that doesn't exist or
+// isn't reserved with token anymore isn't an error.
+func (i *Instance) DeleteIdempotencyKey(ctx context.Context, key, token string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if rec, ok := i.idempotencyKeys[key]; ok && rec.Token == token && !rec.Completed {
+		delete(i.idempotencyKeys, key)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// InsertWebhookSubscription fills in the subscription's ID if it's not already
+// set and its CreatedAt, then stores it and returns its ID. If a subscription
+// with the same ID already exists then storage.ErrWebhookSubscriptionExists is
+// returned.
+func (i *Instance) InsertWebhookSubscription(ctx context.Context, sub storage.WebhookSubscription) (string, error) {
+	if sub.ID == "" {
+		sub.ID = uuid.New().String()
+	}
+	if sub.CreatedAt.IsZero() {
+		sub.CreatedAt = now()
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.webhooks[sub.ID]; ok {
+		return "", storage.ErrWebhookSubscriptionExists
+	}
+	i.webhooks[sub.ID] = copyWebhookSubscription(sub)
+	i.webhookIDs = append(i.webhookIDs, sub.ID)
+	return sub.ID, nil
+}
+
+// GetWebhookSubscription returns the subscription with the given ID. If that
+// ID isn't found then storage.ErrWebhookSubscriptionNotFound is returned.
+func (i *Instance) GetWebhookSubscription(ctx context.Context, id string) (storage.WebhookSubscription, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	sub, ok := i.webhooks[id]
+	if !ok {
+		return storage.WebhookSubscription{}, storage.ErrWebhookSubscriptionNotFound
+	}
+	return copyWebhookSubscription(sub), nil
+}
+
+// GetWebhookSubscriptions returns every subscription, oldest first
+func (i *Instance) GetWebhookSubscriptions(ctx context.Context) ([]storage.WebhookSubscription, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var subs []storage.WebhookSubscription
+	for _, id := range i.webhookIDs {
+		subs = append(subs, copyWebhookSubscription(i.webhooks[id]))
+	}
+	return subs, nil
+}
+
+// DeleteWebhookSubscription deletes the subscription with the given ID. Its
+// deliveries are kept. If that ID isn't found then
+// storage.ErrWebhookSubscriptionNotFound is returned.
+func (i *Instance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.webhooks[id]; !ok {
+		return storage.ErrWebhookSubscriptionNotFound
+	}
+	delete(i.webhooks, id)
+	for idx, existing := range i.webhookIDs {
+		if existing == id {
+			i.webhookIDs = append(i.webhookIDs[:idx], i.webhookIDs[idx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddWebhookDeliveries stores the deliveries, skipping any whose ID already
+// exists
+func (i *Instance) AddWebhookDeliveries(ctx context.Context, deliveries []storage.WebhookDelivery) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, d := range deliveries {
+		if _, ok := i.webhookDeliveries[d.ID]; ok {
+			continue
+		}
+		i.webhookDeliveries[d.ID] = copyWebhookDelivery(d)
+	}
+	return nil
+}
+
+// webhookDeliveriesWhere returns copies of at most limit deliveries that match
+// fn, ordered by their ID. The caller must hold the lock.
+func (i *Instance) webhookDeliveriesWhere(limit int, fn func(storage.WebhookDelivery) bool) []storage.WebhookDelivery {
+	if limit <= 0 || limit > storage.MaxWebhookDeliveriesLimit {
+		limit = storage.MaxWebhookDeliveriesLimit
+	}
+	var deliveries []storage.WebhookDelivery
+	for _, d := range i.webhookDeliveries {
+		if fn(d) {
+			deliveries = append(deliveries, copyWebhookDelivery(d))
+		}
+	}
+	sort.Slice(deliveries, func(a, b int) bool {
+		return deliveries[a].ID < deliveries[b].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
+
+// ClaimDueWebhookDelivery claims the oldest pending delivery whose
+// NextAttemptAt is at or before now, skipping deliveries to the subscriptions
+// with the IDs in exclude and the deliveries with the IDs in skip, by moving
+// its NextAttemptAt to leaseExpiresAt and returns it. If no delivery is due
+// then storage.ErrWebhookDeliveryNotFound is returned.
+func (i *Instance) ClaimDueWebhookDelivery(ctx context.Context, now, leaseExpiresAt time.Time, exclude, skip []string) (storage.WebhookDelivery, error) {
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	skipped := make(map[string]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	due := i.webhookDeliveriesWhere(1, func(d storage.WebhookDelivery) bool {
+		return d.Status == storage.WebhookDeliveryStatusPending && !d.NextAttemptAt.After(now) && !excluded[d.SubscriptionID] && !skipped[d.ID]
+	})
+	if len(due) == 0 {
+		return storage.WebhookDelivery{}, storage.ErrWebhookDeliveryNotFound
+	}
+	d := due[0]
+	d.NextAttemptAt = leaseExpiresAt
+	i.webhookDeliveries[d.ID] = copyWebhookDelivery(d)
+	return d, nil
+}
+
+// RecordWebhookAttempt adds the attempt to the delivery with the given ID and
+// moves it to status. If that ID isn't found then
+// storage.ErrWebhookDeliveryNotFound is returned.
+func (i *Instance) RecordWebhookAttempt(ctx context.Context, id string, attempt storage.WebhookAttempt, status storage.WebhookDeliveryStatus, nextAttemptAt time.Time) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	d, ok := i.webhookDeliveries[id]
+	if !ok {
+		return storage.ErrWebhookDeliveryNotFound
+	}
+	d = copyWebhookDelivery(d)
+	d.Attempts = append(d.Attempts, attempt)
+	d.Status = status
+	d.NextAttemptAt = nextAttemptAt
+	d.UpdatedAt = now()
+	i.webhookDeliveries[id] = d
+	return nil
+}
+
+// GetWebhookDeliveries returns at most limit deliveries to the subscription
+// with the given ID, oldest first, starting after the delivery with the ID
+// after, or from the beginning if after is empty. Only deliveries with the
+// given status are returned unless status is empty. limit is capped at
+// storage.MaxWebhookDeliveriesLimit.
+func (i *Instance) GetWebhookDeliveries(ctx context.Context, subscriptionID string, status storage.WebhookDeliveryStatus, after string, limit int) ([]storage.WebhookDelivery, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.webhookDeliveriesWhere(limit, func(d storage.WebhookDelivery) bool {
+		return d.SubscriptionID == subscriptionID &&
+			(status == "" || d.Status == status) &&
+			d.ID > after
+	}), nil
+}
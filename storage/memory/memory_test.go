@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage/storagetest"
+)
+
+func TestInstance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) mocks.StorageInstance {
+		return New()
+	})
+}
@@ -1,5 +1,16 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidFulfillment is returned when line items are being fulfilled but
+// one of them doesn't exist, can't be fulfilled or would be fulfilled more
+// than its quantity
+var ErrInvalidFulfillment = errors.New("invalid line item fulfillment")
+
 // OrderStatus describes the current status of the order
 type OrderStatus int64
 
@@ -16,11 +27,46 @@ const (
 
 	//	Order Status Cancelled means we've successfully cancelled the order
 	OrderStatusCancelled OrderStatus = 3
+
+	// OrderStatusCharging means we're in the middle of charging the customer and
+	// don't know yet if the charge succeeded. Orders stuck in this status are
+	// reconciled with the charge service.
+	OrderStatusCharging OrderStatus = 4
+
+	// OrderStatusRefunding means we're in the middle of refunding the customer
+	// and don't know yet if the refund succeeded. Orders stuck in this status
+	// are reconciled with the charge service.
+	OrderStatusRefunding OrderStatus = 5
+
+	// OrderStatusPartiallyFulfilled means we've fulfilled some but not all of
+	// the line items, like when the order ships in multiple boxes
+	OrderStatusPartiallyFulfilled OrderStatus = 6
+
+	// OrderStatusAuthorizing means we're in the middle of placing a hold on the
+	// customer's card and don't know yet if it succeeded. Orders stuck in this
+	// status are moved back to pending since an unused hold expires on its own.
+	OrderStatusAuthorizing OrderStatus = 7
+
+	// OrderStatusAuthorized means there's a hold on the customer's card for the
+	// order's total that still needs to be captured before the order ships
+	OrderStatusAuthorized OrderStatus = 8
+
+	// OrderStatusCapturing means we're in the middle of capturing the order's
+	// authorization and don't know yet if the capture succeeded. Orders stuck in
+	// this status are reconciled with the charge service.
+	OrderStatusCapturing OrderStatus = 9
+
+	// OrderStatusVoiding means we're in the middle of releasing the hold on the
+	// customer's card to cancel the order
+	OrderStatusVoiding OrderStatus = 10
 )
 
 // LineItem is a single charge on an order. The product of the PriceCents and
 // Quantity is the total price of the line item.
 type LineItem struct {
+	// ID uniquely identifies the line item within the order and never changes.
+	// It's filled in when the order is inserted if it's not already set.
+	ID string `json:"id"`
 	// Description is a product ID or a discount ID
 	Description string `json:"description"`
 	// PriceCents is the individual price that should be multiplied against
@@ -28,6 +74,33 @@ type LineItem struct {
 	PriceCents int64 `json:"priceCents"`
 	// Quantity is how many descriptions this line item represents
 	Quantity int64 `json:"quantity"`
+	// FulfilledQuantity is how many of Quantity have been fulfilled so far
+	FulfilledQuantity int64 `json:"fulfilledQuantity"`
+	// ReservedQuantity is how many of Quantity are being fulfilled right now.
+	// They're reserved before asking the fulfillment service to ship them so
+	// two requests can't both ship the same items.
+	ReservedQuantity int64 `json:"reservedQuantity"`
+}
+
+// Fulfillable returns true if the line item is something that's shipped, as
+// opposed to a discount
+func (li LineItem) Fulfillable() bool {
+	return li.PriceCents >= 0 && li.Quantity > 0
+}
+
+// RemainingQuantity returns how many of the line item still need to be
+// fulfilled
+func (li LineItem) RemainingQuantity() int64 {
+	if !li.Fulfillable() {
+		return 0
+	}
+	return li.Quantity - li.FulfilledQuantity
+}
+
+// AvailableQuantity returns how many of the line item still need to be
+// fulfilled and aren't already reserved by a fulfillment in progress
+func (li LineItem) AvailableQuantity() int64 {
+	return li.RemainingQuantity() - li.ReservedQuantity
 }
 
 // Order represents a single order for one or more products
@@ -42,6 +115,31 @@ type Order struct {
 	// Status represents the current state of the order throughout the
 	// pending->charged->fulfilled lifecycle
 	Status OrderStatus `json:"status"`
+	// StatusUpdatedAt is when Status last changed. The storage methods set this
+	// whenever they change the status.
+	StatusUpdatedAt time.Time `json:"statusUpdatedAt"`
+	// CreatedAt is when the order was inserted
+	CreatedAt time.Time `json:"createdAt"`
+	// UpdatedAt is when anything about the order last changed. The storage
+	// methods set this on every change.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// StatusHistory holds every change of Status, oldest first, starting with
+	// the status the order was created in
+	StatusHistory []StatusChange `json:"statusHistory"`
+	// PaymentAttempts counts how many times the order was moved to a status that
+	// calls the charge service, like charging. TransitionOrderStatus increments
+	// it so every attempt at calling the charge service gets a unique number for
+	// its idempotency key.
+	PaymentAttempts int64 `json:"paymentAttempts"`
+	// Refunds holds every partial refund made for the order, in the order they
+	// were made, including the ones that failed
+	Refunds []Refund `json:"refunds"`
+	// Payments holds every attempt at charging, refunding or authorizing the
+	// order through the charge service, in the order they were made
+	Payments []Payment `json:"payments"`
+	// Authorization is the latest hold placed on the customer's card, if the
+	// order was authorized instead of charged
+	Authorization *Authorization `json:"authorization,omitempty"`
 }
 
 // TotalCents is a helper function that loops over each line item and totals up
@@ -53,3 +151,127 @@ func (o Order) TotalCents() int64 {
 	}
 	return total
 }
+
+// Reserved returns true if any of the order's line items are reserved by a
+// fulfillment in progress
+func (o Order) Reserved() bool {
+	for _, li := range o.LineItems {
+		if li.ReservedQuantity > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// FillLineItemIDs sets the ID of every line item without one based on its
+// position in the order, like li-1 for the first line item. The storage
+// methods call this when inserting an order.
+func (o *Order) FillLineItemIDs() {
+	for idx := range o.LineItems {
+		if o.LineItems[idx].ID == "" {
+			o.LineItems[idx].ID = fmt.Sprintf("li-%d", idx+1)
+		}
+	}
+}
+
+// withLineItems returns a copy of the order with fn called on each line item
+// in quantities, which maps line item IDs to a quantity. fn returns an error
+// if the quantity is invalid for the line item. ErrInvalidFulfillment is
+// returned if quantities is empty or has a line item the order doesn't.
+func (o Order) withLineItems(quantities map[string]int64, fn func(li *LineItem, q int64) error) (Order, error) {
+	if len(quantities) == 0 {
+		return Order{}, fmt.Errorf("%w: no line items", ErrInvalidFulfillment)
+	}
+	// copy the line items so we don't modify the caller's order
+	o.LineItems = append([]LineItem{}, o.LineItems...)
+	found := 0
+	for idx := range o.LineItems {
+		li := &o.LineItems[idx]
+		if q, ok := quantities[li.ID]; ok {
+			found++
+			if err := fn(li, q); err != nil {
+				return Order{}, err
+			}
+		}
+	}
+	if found != len(quantities) {
+		return Order{}, fmt.Errorf("%w: unknown line item", ErrInvalidFulfillment)
+	}
+	return o, nil
+}
+
+// canFulfill returns ErrInvalidTransition if the order's status doesn't allow
+// fulfilling its line items, which is only when it's charged or partially
+// fulfilled
+func (o Order) canFulfill() error {
+	if o.Status != OrderStatusPartiallyFulfilled && !CanTransition(o.Status, OrderStatusPartiallyFulfilled) {
+		return ErrInvalidTransition
+	}
+	return nil
+}
+
+// WithReserved returns a copy of the order with quantities, which maps line
+// item IDs to how many of them are about to be fulfilled, added to each line
+// item's ReservedQuantity. If the order isn't charged or partially fulfilled
+// then ErrInvalidTransition is returned and if any of the quantities are more
+// than what's available then ErrInvalidFulfillment is returned.
+func (o Order) WithReserved(quantities map[string]int64) (Order, error) {
+	if err := o.canFulfill(); err != nil {
+		return Order{}, err
+	}
+	return o.withLineItems(quantities, func(li *LineItem, q int64) error {
+		if q <= 0 || q > li.AvailableQuantity() {
+			return fmt.Errorf("%w: can't fulfill %d of line item %q with %d available", ErrInvalidFulfillment, q, li.ID, li.AvailableQuantity())
+		}
+		li.ReservedQuantity += q
+		return nil
+	})
+}
+
+// WithReleased returns a copy of the order with quantities, which maps line
+// item IDs to how many of them weren't fulfilled after all, taken out of each
+// line item's ReservedQuantity so they can be fulfilled again. This works no
+// matter the order's status. If any of the quantities are more than what's
+// reserved then ErrInvalidFulfillment is returned.
+func (o Order) WithReleased(quantities map[string]int64) (Order, error) {
+	return o.withLineItems(quantities, func(li *LineItem, q int64) error {
+		if q <= 0 || q > li.ReservedQuantity {
+			return fmt.Errorf("%w: can't release %d of line item %q with %d reserved", ErrInvalidFulfillment, q, li.ID, li.ReservedQuantity)
+		}
+		li.ReservedQuantity -= q
+		return nil
+	})
+}
+
+// WithFulfilled returns a copy of the order with quantities, which maps line
+// item IDs to how many more of them were fulfilled, moved from each line item's
+// ReservedQuantity to its FulfilledQuantity. The status is changed to fulfilled
+// if nothing is left to fulfill or to partially fulfilled otherwise. If the
+// order isn't charged or partially fulfilled then ErrInvalidTransition is
+// returned and if any of the quantities are invalid, including when they
+// weren't reserved first, then ErrInvalidFulfillment is returned.
+func (o Order) WithFulfilled(quantities map[string]int64) (Order, error) {
+	if err := o.canFulfill(); err != nil {
+		return Order{}, err
+	}
+	o, err := o.withLineItems(quantities, func(li *LineItem, q int64) error {
+		if q <= 0 || q > li.ReservedQuantity {
+			return fmt.Errorf("%w: can't fulfill %d of line item %q with %d reserved", ErrInvalidFulfillment, q, li.ID, li.ReservedQuantity)
+		}
+		li.ReservedQuantity -= q
+		li.FulfilledQuantity += q
+		return nil
+	})
+	if err != nil {
+		return Order{}, err
+	}
+
+	o.Status = OrderStatusFulfilled
+	for _, li := range o.LineItems {
+		if li.RemainingQuantity() > 0 {
+			o.Status = OrderStatusPartiallyFulfilled
+			break
+		}
+	}
+	return o, nil
+}
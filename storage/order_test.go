@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillLineItemIDs(t *testing.T) {
+	order := Order{
+		LineItems: []LineItem{
+			{Description: "item 1"},
+			{ID: "custom", Description: "item 2"},
+			{Description: "item 3"},
+		},
+	}
+	order.FillLineItemIDs()
+	assert.Equal(t, "li-1", order.LineItems[0].ID)
+	assert.Equal(t, "custom", order.LineItems[1].ID)
+	assert.Equal(t, "li-3", order.LineItems[2].ID)
+}
+
+func TestWithFulfilled(t *testing.T) {
+	order := Order{
+		LineItems: []LineItem{
+			{ID: "li-1", Description: "item 1", Quantity: 2, PriceCents: 100},
+			{ID: "li-2", Description: "item 2", Quantity: 1, PriceCents: 100},
+			{ID: "li-3", Description: "discount", Quantity: 1, PriceCents: -50},
+		},
+		Status: OrderStatusCharged,
+	}
+
+	// reserving doesn't change the status
+	reserved, err := order.WithReserved(map[string]int64{"li-1": 2, "li-2": 1})
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusCharged, reserved.Status)
+	assert.EqualValues(t, 2, reserved.LineItems[0].ReservedQuantity)
+	assert.EqualValues(t, 0, reserved.LineItems[0].AvailableQuantity())
+	// the original isn't modified
+	assert.EqualValues(t, 0, order.LineItems[0].ReservedQuantity)
+
+	// fulfilling some of the items is a partial fulfillment
+	got, err := reserved.WithFulfilled(map[string]int64{"li-1": 1})
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusPartiallyFulfilled, got.Status)
+	assert.EqualValues(t, 1, got.LineItems[0].FulfilledQuantity)
+	assert.EqualValues(t, 1, got.LineItems[0].ReservedQuantity)
+	// the original isn't modified
+	assert.EqualValues(t, 0, reserved.LineItems[0].FulfilledQuantity)
+
+	// releasing makes them available again
+	released, err := got.WithReleased(map[string]int64{"li-1": 1})
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, released.LineItems[0].ReservedQuantity)
+	assert.EqualValues(t, 1, released.LineItems[0].AvailableQuantity())
+	_, err = released.WithReleased(map[string]int64{"li-1": 1})
+	assert.True(t, errors.Is(err, ErrInvalidFulfillment), "%v", err)
+
+	// fulfilling the rest completes it and discounts don't need fulfilling
+	got, err = got.WithFulfilled(map[string]int64{"li-1": 1, "li-2": 1})
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusFulfilled, got.Status)
+
+	// reserving too many, unknown items, discounts or nothing is invalid
+	for _, quantities := range []map[string]int64{
+		{"li-1": 3},
+		{"li-1": 0},
+		{"li-4": 1},
+		{"li-3": 1},
+		{},
+	} {
+		_, err = order.WithReserved(quantities)
+		assert.True(t, errors.Is(err, ErrInvalidFulfillment), "%v: %v", quantities, err)
+	}
+	// as is reserving what's already reserved
+	_, err = reserved.WithReserved(map[string]int64{"li-1": 1})
+	assert.True(t, errors.Is(err, ErrInvalidFulfillment), "%v", err)
+	// or fulfilling what wasn't reserved
+	_, err = order.WithFulfilled(map[string]int64{"li-1": 1})
+	assert.True(t, errors.Is(err, ErrInvalidFulfillment), "%v", err)
+
+	// the order must be charged or partially fulfilled
+	order.Status = OrderStatusPending
+	_, err = order.WithReserved(map[string]int64{"li-1": 1})
+	assert.True(t, errors.Is(err, ErrInvalidTransition), "%v", err)
+	reserved.Status = OrderStatusCancelled
+	_, err = reserved.WithFulfilled(map[string]int64{"li-1": 1})
+	assert.True(t, errors.Is(err, ErrInvalidTransition), "%v", err)
+}
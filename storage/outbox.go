@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrOutboxCursorClaimed is returned when an outbox cursor is being claimed or
+// updated but another dispatcher holds an unexpired lease on it
+var ErrOutboxCursorClaimed = errors.New("outbox cursor is claimed by another dispatcher")
+
+// OutboxCursor is how far through the event log the outbox has delivered to a
+// single sink. Every sink has its own cursor so a sink that's failing only
+// holds up its own events, and only the dispatcher holding the cursor's lease
+// delivers to the sink so replicas don't all send the same events.
+type OutboxCursor struct {
+	// Sink is the name of the sink the cursor belongs to
+	Sink string
+	// Seq is the Seq of the last event delivered to the sink
+	Seq int64
+	// Owner identifies the dispatcher delivering to the sink and
+	// LeaseExpiresAt is when another dispatcher can take over if the owner
+	// hasn't renewed it by then
+	Owner          string
+	LeaseExpiresAt time.Time
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ClaimOutboxCursor gives owner the lease on the cursor of the named sink until
+// leaseExpiresAt and returns the cursor. The owner can renew a lease it already
+// holds but if another owner's lease hasn't expired by now then
+// ErrOutboxCursorClaimed is returned. A sink that doesn't have a cursor yet gets
+// one starting after the newest event, so a new sink only gets events recorded
+// from then on.
+func (i *Instance) ClaimOutboxCursor(ctx context.Context, sink, owner string, now, leaseExpiresAt time.Time) (OutboxCursor, error) {
+	last, err := i.GetLastOrderEventSeq(ctx)
+	if err != nil {
+		return OutboxCursor{}, err
+	}
+	// if another owner holds an unexpired lease the filter doesn't match, the
+	// upsert tries to insert and the unique index on sink rejects it
+	filter := bson.D{
+		{Key: "sink", Value: sink},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "owner", Value: owner}},
+			bson.D{{Key: "leaseexpiresat", Value: bson.D{{Key: "$lte", Value: now}}}},
+		}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "owner", Value: owner},
+			{Key: "leaseexpiresat", Value: leaseExpiresAt},
+		}},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "seq", Value: last}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var cursor OutboxCursor
+	if err := i.outboxCursors.FindOneAndUpdate(ctx, filter, update, opts).Decode(&cursor); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return OutboxCursor{}, ErrOutboxCursorClaimed
+		}
+		return OutboxCursor{}, fmt.Errorf("error claiming outbox cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// UpdateOutboxCursor stores the cursor's Seq and LeaseExpiresAt, which moves
+// the cursor and renews or, with a zero LeaseExpiresAt, releases the lease. If
+// the cursor's Owner no longer holds the lease then ErrOutboxCursorClaimed is
+// returned and nothing is changed.
+func (i *Instance) UpdateOutboxCursor(ctx context.Context, cursor OutboxCursor) error {
+	filter := bson.D{
+		{Key: "sink", Value: cursor.Sink},
+		{Key: "owner", Value: cursor.Owner},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "seq", Value: cursor.Seq},
+		{Key: "leaseexpiresat", Value: cursor.LeaseExpiresAt},
+	}}}
+	res, err := i.outboxCursors.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error updating outbox cursor: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrOutboxCursorClaimed
+	}
+	return nil
+}
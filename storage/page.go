@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCursor is returned by GetOrders when the page's cursor wasn't
+// returned by GetOrders or was returned for a different sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MaxOrdersLimit is the most orders GetOrders returns at once
+const MaxOrdersLimit = 1000
+
+// OrderSort is what GetOrders sorts orders by. Orders that sort the same are
+// sorted by their ID so every order has a stable place in the results.
+type OrderSort string
+
+const (
+	// OrderSortCreatedAt sorts orders by when they were inserted
+	OrderSortCreatedAt OrderSort = "createdAt"
+
+	// OrderSortTotal sorts orders by their TotalCents
+	OrderSortTotal OrderSort = "total"
+
+	// OrderSortStatus sorts orders by the numeric value of their status
+	OrderSortStatus OrderSort = "status"
+)
+
+// OrderSorts is every OrderSort
+var OrderSorts = []OrderSort{OrderSortCreatedAt, OrderSortTotal, OrderSortStatus}
+
+// OrderPage describes which orders GetOrders returns and in what order
+type OrderPage struct {
+	// Limit is the most orders to return, it's capped at MaxOrdersLimit and
+	// anything less than 1 means MaxOrdersLimit
+	Limit int
+	// Cursor is the next cursor returned with the previous page, or empty for
+	// the first page
+	Cursor string
+	// Sort defaults to OrderSortCreatedAt
+	Sort OrderSort
+	// Descending sorts the orders in reverse, including by their ID
+	Descending bool
+}
+
+// WithDefaults returns a copy of the page with its limit capped and its sort
+// filled in
+func (p OrderPage) WithDefaults() OrderPage {
+	if p.Limit <= 0 || p.Limit > MaxOrdersLimit {
+		p.Limit = MaxOrdersLimit
+	}
+	if p.Sort == "" {
+		p.Sort = OrderSortCreatedAt
+	}
+	return p
+}
+
+// SortValue returns the value of the order that the page sorts it by
+func (p OrderPage) SortValue(o Order) int64 {
+	switch p.Sort {
+	case OrderSortTotal:
+		return o.TotalCents()
+	case OrderSortStatus:
+		return int64(o.Status)
+	default:
+		// the database only keeps milliseconds so anything finer can't be used
+		// to compare orders
+		return o.CreatedAt.UnixMilli()
+	}
+}
+
+// Compare returns a negative number if a sorts before b in the page, a
+// positive number if it sorts after and 0 if they're the same order
+func (p OrderPage) Compare(a, b Order) int {
+	return p.compareKeys(p.SortValue(a), a.ID, p.SortValue(b), b.ID)
+}
+
+func (p OrderPage) compareKeys(aValue int64, aID string, bValue int64, bID string) int {
+	cmp := 0
+	switch {
+	case aValue < bValue:
+		cmp = -1
+	case aValue > bValue:
+		cmp = 1
+	default:
+		cmp = strings.Compare(aID, bID)
+	}
+	if p.Descending {
+		return -cmp
+	}
+	return cmp
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// OrderCursor is the position of an order within a sort, a page starting
+// from it has every order that sorts after it
+type OrderCursor struct {
+	Sort       OrderSort `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	// Value is the OrderPage.SortValue of the order
+	Value int64  `json:"v"`
+	ID    string `json:"i"`
+}
+
+// NextCursor returns the cursor of the page after the one ending with last
+func (p OrderPage) NextCursor(last Order) string {
+	p = p.WithDefaults()
+	byts, _ := json.Marshal(OrderCursor{
+		Sort:       p.Sort,
+		Descending: p.Descending,
+		Value:      p.SortValue(last),
+		ID:         last.ID,
+	})
+	// it's encoded so clients don't start depending on what's in it
+	return base64.RawURLEncoding.EncodeToString(byts)
+}
+
+// ParseCursor returns the page's decoded Cursor. If the cursor can't be
+// decoded or was made for a different sort then ErrInvalidCursor is returned.
+func (p OrderPage) ParseCursor() (OrderCursor, error) {
+	p = p.WithDefaults()
+	byts, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return OrderCursor{}, ErrInvalidCursor
+	}
+	var c OrderCursor
+	if err := json.Unmarshal(byts, &c); err != nil || c.ID == "" {
+		return OrderCursor{}, ErrInvalidCursor
+	}
+	if c.Sort != p.Sort || c.Descending != p.Descending {
+		return OrderCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// After returns true if the order sorts after the cursor in the page
+func (p OrderPage) After(c OrderCursor, o Order) bool {
+	return p.compareKeys(p.SortValue(o), o.ID, c.Value, c.ID) > 0
+}
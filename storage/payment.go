@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PaymentKind describes what a payment attempt was for
+type PaymentKind string
+
+const (
+	// PaymentKindCharge is an attempt at charging the customer
+	PaymentKindCharge PaymentKind = "charge"
+
+	// PaymentKindRefund is an attempt at refunding the customer, either when
+	// the order is cancelled or for a partial refund
+	PaymentKindRefund PaymentKind = "refund"
+
+	// PaymentKindAuthorization is an attempt at placing a hold on the
+	// customer's card
+	PaymentKindAuthorization PaymentKind = "authorization"
+
+	// PaymentKindCapture is an attempt at charging the customer by capturing an
+	// authorization
+	PaymentKindCapture PaymentKind = "capture"
+
+	// PaymentKindVoid is an attempt at releasing the hold of an authorization.
+	// Its AmountCents is how much the authorization was for.
+	PaymentKindVoid PaymentKind = "void"
+)
+
+// PaymentOutcome describes how a payment attempt ended
+type PaymentOutcome string
+
+const (
+	// PaymentOutcomeSucceeded means the charge service made the charge or refund
+	PaymentOutcomeSucceeded PaymentOutcome = "succeeded"
+
+	// PaymentOutcomeFailed means the charge service rejected the charge or
+	// refund, like when the card was declined
+	PaymentOutcomeFailed PaymentOutcome = "failed"
+
+	// PaymentOutcomeUnknown means the charge service couldn't be reached so the
+	// charge or refund may or may not have gone through. The recovery worker
+	// finds out which and updates the order.
+	PaymentOutcomeUnknown PaymentOutcome = "unknown"
+)
+
+// Payment is a single attempt at charging, refunding or authorizing the
+// customer through the charge service. It's kept so support can trace what
+// happened to a payment.
+type Payment struct {
+	Kind PaymentKind `json:"kind"`
+	// AmountCents is how much was charged, refunded or authorized and is always
+	// positive
+	AmountCents int64 `json:"amountCents"`
+	// IdempotencyKey is the key sent to the charge service, which it also
+	// returns from GET /charges
+	IdempotencyKey string `json:"idempotencyKey"`
+	// CardFingerprint identifies the card token that was used without storing
+	// the token itself. It's empty for captures and voids, which don't send one.
+	CardFingerprint string         `json:"cardFingerprint"`
+	Outcome         PaymentOutcome `json:"outcome"`
+	// ChargeReference is the ID the charge service gave the charge, refund or
+	// authorization, if it succeeded
+	ChargeReference string `json:"chargeReference,omitempty"`
+	// Error is why the attempt failed, if it did
+	Error string `json:"error,omitempty"`
+	// CreatedAt is when the attempt finished
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddPayment adds the payment to the end of the payments of the order with the
+// given ID. CreatedAt is set to the current time if it's not already set. An
+// OrderEventPaymentRecorded event is added to the order's event log in the same
+// transaction. If that ID isn't found then ErrOrderNotFound is returned.
+func (i *Instance) AddPayment(ctx context.Context, id string, payment Payment) error {
+	if payment.CreatedAt.IsZero() {
+		payment.CreatedAt = time.Now()
+	}
+	// orders are inserted with a null payments field which $push refuses to
+	// append to so this uses an update pipeline that treats null as an empty
+	// array
+	// $literal stops any strings in the payment, like the error, from being
+	// treated as field paths if they start with a $
+	now := time.Now()
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "payments", Value: appendToArray("payments", bson.D{{Key: "$literal", Value: payment}})},
+			{Key: "updatedat", Value: now},
+		}}},
+	}
+	event := NewOrderEvent(ctx, id, OrderEventPaymentRecorded, now)
+	event.Payment = &payment
+	return i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		result, err := i.collection.UpdateOne(ctx, bson.D{{Key: "id", Value: id}}, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return ErrOrderNotFound
+		}
+		return i.insertEvent(ctx, event)
+	})
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OrderQuery describes which orders GetOrders returns. Only the fields that are
+// set are used and an order has to match all of them, so the zero value
+// matches every order.
+type OrderQuery struct {
+	// Statuses matches orders in any of the statuses
+	Statuses []OrderStatus
+	// CustomerEmail matches orders placed with exactly this email address
+	CustomerEmail string
+	// CreatedSince and CreatedBefore match orders created at or after
+	// CreatedSince and before CreatedBefore
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	// UpdatedSince and UpdatedBefore match orders last changed at or after
+	// UpdatedSince and before UpdatedBefore
+	UpdatedSince  time.Time
+	UpdatedBefore time.Time
+	// MinTotalCents and MaxTotalCents match orders whose TotalCents is at least
+	// MinTotalCents and at most MaxTotalCents
+	MinTotalCents *int64
+	MaxTotalCents *int64
+	// Description matches orders with a line item whose description contains
+	// it, ignoring case
+	Description string
+}
+
+// Matches returns true if the order matches every field of the query that's
+// set
+func (q OrderQuery) Matches(o Order) bool {
+	if len(q.Statuses) > 0 {
+		var found bool
+		for _, status := range q.Statuses {
+			found = found || o.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.CustomerEmail != "" && o.CustomerEmail != q.CustomerEmail {
+		return false
+	}
+	if !inTimeRange(o.CreatedAt, q.CreatedSince, q.CreatedBefore) || !inTimeRange(o.UpdatedAt, q.UpdatedSince, q.UpdatedBefore) {
+		return false
+	}
+	total := o.TotalCents()
+	if (q.MinTotalCents != nil && total < *q.MinTotalCents) || (q.MaxTotalCents != nil && total > *q.MaxTotalCents) {
+		return false
+	}
+	if q.Description != "" {
+		desc := strings.ToLower(q.Description)
+		for _, li := range o.LineItems {
+			if strings.Contains(strings.ToLower(li.Description), desc) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// inTimeRange returns true if t is at or after since and before before, either
+// of which can be zero to leave that end of the range open
+func inTimeRange(t, since, before time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// filter returns the MongoDB filter matching the same orders as Matches
+func (q OrderQuery) filter() bson.D {
+	filter := bson.D{}
+	switch len(q.Statuses) {
+	case 0:
+	case 1:
+		filter = append(filter, bson.E{Key: "status", Value: q.Statuses[0]})
+	default:
+		filter = append(filter, bson.E{Key: "status", Value: bson.D{{Key: "$in", Value: q.Statuses}}})
+	}
+	if q.CustomerEmail != "" {
+		filter = append(filter, bson.E{Key: "customeremail", Value: q.CustomerEmail})
+	}
+	filter = appendRange(filter, "createdat", "$gte", q.CreatedSince, "$lt", q.CreatedBefore)
+	filter = appendRange(filter, "updatedat", "$gte", q.UpdatedSince, "$lt", q.UpdatedBefore)
+	var min, max interface{}
+	if q.MinTotalCents != nil {
+		min = *q.MinTotalCents
+	}
+	if q.MaxTotalCents != nil {
+		max = *q.MaxTotalCents
+	}
+	filter = appendRange(filter, "totalcents", "$gte", min, "$lte", max)
+	if q.Description != "" {
+		// this can't use an index but it's only run against the orders the rest
+		// of the filter matched
+		filter = append(filter, bson.E{Key: "lineitems.description", Value: containsRegex(q.Description)})
+	}
+	return filter
+}
+
+// appendRange appends a filter on the field for the range, leaving out either
+// end that's nil or a zero time
+func appendRange(filter bson.D, field, lowerOp string, lower interface{}, upperOp string, upper interface{}) bson.D {
+	var cond bson.D
+	for _, bound := range []struct {
+		op    string
+		value interface{}
+	}{{lowerOp, lower}, {upperOp, upper}} {
+		if t, ok := bound.value.(time.Time); (ok && t.IsZero()) || bound.value == nil {
+			continue
+		}
+		cond = append(cond, bson.E{Key: bound.op, Value: bound.value})
+	}
+	if len(cond) == 0 {
+		return filter
+	}
+	return append(filter, bson.E{Key: field, Value: cond})
+}
+
+// containsRegex returns a case-insensitive regex matching strings containing
+// s
+func containsRegex(s string) bson.D {
+	return bson.D{
+		{Key: "$regex", Value: regexp.QuoteMeta(s)},
+		{Key: "$options", Value: "i"},
+	}
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOrderQueryFilter(t *testing.T) {
+	// the zero query matches everything
+	assert.Equal(t, bson.D{}, OrderQuery{}.filter())
+
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	min := int64(100)
+	filter := OrderQuery{
+		Statuses:      []OrderStatus{OrderStatusPending},
+		CreatedSince:  since,
+		MinTotalCents: &min,
+		Description:   "a.b",
+	}.filter()
+	assert.Equal(t, bson.D{
+		{Key: "status", Value: OrderStatusPending},
+		{Key: "createdat", Value: bson.D{{Key: "$gte", Value: since}}},
+		{Key: "totalcents", Value: bson.D{{Key: "$gte", Value: min}}},
+		{Key: "lineitems.description", Value: bson.D{{Key: "$regex", Value: `a\.b`}, {Key: "$options", Value: "i"}}},
+	}, filter)
+
+	// zero is a real bound for totals
+	zero := int64(0)
+	filter = OrderQuery{
+		Statuses:      []OrderStatus{OrderStatusPending, OrderStatusCharged},
+		UpdatedBefore: since,
+		MaxTotalCents: &zero,
+	}.filter()
+	assert.Equal(t, bson.D{
+		{Key: "status", Value: bson.D{{Key: "$in", Value: []OrderStatus{OrderStatusPending, OrderStatusCharged}}}},
+		{Key: "updatedat", Value: bson.D{{Key: "$lt", Value: since}}},
+		{Key: "totalcents", Value: bson.D{{Key: "$lte", Value: zero}}},
+	}, filter)
+}
+
+func TestOrderQueryMatches(t *testing.T) {
+	at := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	order := Order{
+		CustomerEmail: "a@example.com",
+		Status:        OrderStatusCharged,
+		LineItems:     []LineItem{{Description: "Red Shirt", Quantity: 1, PriceCents: 100}},
+		CreatedAt:     at,
+		UpdatedAt:     at,
+	}
+	zero, hundred := int64(0), int64(100)
+
+	assert.True(t, OrderQuery{}.Matches(order))
+	// ranges include their start and total ranges include their end
+	assert.True(t, OrderQuery{CreatedSince: at, UpdatedSince: at}.Matches(order))
+	assert.False(t, OrderQuery{CreatedBefore: at}.Matches(order))
+	assert.False(t, OrderQuery{UpdatedBefore: at}.Matches(order))
+	assert.True(t, OrderQuery{MinTotalCents: &hundred, MaxTotalCents: &hundred}.Matches(order))
+	assert.False(t, OrderQuery{MaxTotalCents: &zero}.Matches(order))
+	assert.True(t, OrderQuery{Description: "d sh"}.Matches(order))
+	assert.False(t, OrderQuery{Description: "blue"}.Matches(order))
+	assert.False(t, OrderQuery{Statuses: []OrderStatus{OrderStatusPending}}.Matches(order))
+	assert.False(t, OrderQuery{CustomerEmail: "b@example.com"}.Matches(order))
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrInvalidRefund is returned when a refund is being added but its amount
+	// or line items are invalid, including when it's for more than what's left
+	// of the order
+	ErrInvalidRefund = errors.New("invalid refund")
+
+	// ErrRefundNotFound is returned when the specified refund cannot be found on
+	// the order
+	ErrRefundNotFound = errors.New("refund not found")
+)
+
+// RefundStatus describes whether a refund went through
+type RefundStatus string
+
+const (
+	// RefundStatusPending means the refund was recorded but we don't know yet if
+	// the charge service refunded it. Refunds stuck in this status are
+	// reconciled with the charge service.
+	RefundStatusPending RefundStatus = "pending"
+
+	// RefundStatusSucceeded means the charge service refunded the customer
+	RefundStatusSucceeded RefundStatus = "succeeded"
+
+	// RefundStatusFailed means the charge service didn't refund the customer and
+	// the refund doesn't count towards the order's refunded amount
+	RefundStatusFailed RefundStatus = "failed"
+)
+
+// RefundLineItem is how many of a line item a refund is for
+type RefundLineItem struct {
+	ID       string `json:"id"`
+	Quantity int64  `json:"quantity"`
+}
+
+// Refund is a single refund of some or all of an order
+type Refund struct {
+	// ID uniquely identifies the refund within the order and is filled in when
+	// the refund is added, like rf-1 for the first refund
+	ID string `json:"id"`
+	// AmountCents is how much was refunded. If LineItems is set then this is
+	// filled in with their total when the refund is added.
+	AmountCents int64 `json:"amountCents"`
+	// LineItems optionally holds the line items the refund is for so they can't
+	// be refunded more than once
+	LineItems []RefundLineItem `json:"lineItems,omitempty"`
+	// Reason is why the customer was refunded, like a damaged item
+	Reason string       `json:"reason"`
+	Status RefundStatus `json:"status"`
+	// ChargeReference is the ID the charge service gave the refund, once it
+	// succeeded
+	ChargeReference string `json:"chargeReference,omitempty"`
+	// CreatedAt is when the refund was added
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CanRefund returns true if an order in the status has been charged and can be
+// partially refunded without being cancelled
+func CanRefund(status OrderStatus) bool {
+	switch status {
+	case OrderStatusCharged, OrderStatusPartiallyFulfilled, OrderStatusFulfilled:
+		return true
+	default:
+		return false
+	}
+}
+
+// RefundedCents totals up the amount of every refund that succeeded or might
+// still succeed. Pending refunds are included so that two refunds made at once
+// can't add up to more than the order's total.
+func (o Order) RefundedCents() int64 {
+	var total int64
+	for _, r := range o.Refunds {
+		if r.Status != RefundStatusFailed {
+			total += r.AmountCents
+		}
+	}
+	return total
+}
+
+// NetCents is what's left of the order's total after refunds, which is the
+// most that can still be refunded
+func (o Order) NetCents() int64 {
+	return o.TotalCents() - o.RefundedCents()
+}
+
+// HasPendingRefund returns true if any of the order's refunds are pending
+func (o Order) HasPendingRefund() bool {
+	for _, r := range o.Refunds {
+		if r.Status == RefundStatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// refundedQuantity returns how many of the line item were refunded by refunds
+// that didn't fail
+func (o Order) refundedQuantity(lineItemID string) int64 {
+	var total int64
+	for _, r := range o.Refunds {
+		if r.Status == RefundStatusFailed {
+			continue
+		}
+		for _, li := range r.LineItems {
+			if li.ID == lineItemID {
+				total += li.Quantity
+			}
+		}
+	}
+	return total
+}
+
+// WithRefund returns a copy of the order with the refund added to the end of
+// its Refunds as pending. The refund's ID is filled in and, if it's for line
+// items, so is its AmountCents. If the order can't be refunded then
+// ErrInvalidTransition is returned and if the refund is invalid or is for more
+// than NetCents then ErrInvalidRefund is returned.
+func (o Order) WithRefund(refund Refund) (Order, error) {
+	if !CanRefund(o.Status) {
+		return Order{}, ErrInvalidTransition
+	}
+
+	if len(refund.LineItems) > 0 {
+		if refund.AmountCents != 0 {
+			return Order{}, fmt.Errorf("%w: can't set both an amount and line items", ErrInvalidRefund)
+		}
+		seen := map[string]bool{}
+		for _, item := range refund.LineItems {
+			if seen[item.ID] {
+				return Order{}, fmt.Errorf("%w: duplicate line item %q", ErrInvalidRefund, item.ID)
+			}
+			seen[item.ID] = true
+			li, ok := o.lineItem(item.ID)
+			if !ok || !li.Fulfillable() {
+				return Order{}, fmt.Errorf("%w: unknown line item %q", ErrInvalidRefund, item.ID)
+			}
+			left := li.Quantity - o.refundedQuantity(li.ID)
+			if item.Quantity <= 0 || item.Quantity > left {
+				return Order{}, fmt.Errorf("%w: can't refund %d of line item %q with %d left", ErrInvalidRefund, item.Quantity, li.ID, left)
+			}
+			refund.AmountCents += li.PriceCents * item.Quantity
+		}
+		// copy the line items so we don't keep the caller's slice
+		refund.LineItems = append([]RefundLineItem{}, refund.LineItems...)
+	}
+	if refund.AmountCents <= 0 {
+		return Order{}, fmt.Errorf("%w: amount must be more than 0", ErrInvalidRefund)
+	}
+	if refund.AmountCents > o.NetCents() {
+		return Order{}, fmt.Errorf("%w: can't refund %d with %d left", ErrInvalidRefund, refund.AmountCents, o.NetCents())
+	}
+
+	// refunds are never removed so numbering them by position keeps them unique
+	refund.ID = fmt.Sprintf("rf-%d", len(o.Refunds)+1)
+	refund.Status = RefundStatusPending
+	refund.ChargeReference = ""
+	// copy the refunds so we don't modify the caller's order
+	o.Refunds = append(append([]Refund{}, o.Refunds...), refund)
+	return o, nil
+}
+
+// lineItem returns the order's line item with the given ID
+func (o Order) lineItem(id string) (LineItem, bool) {
+	for _, li := range o.LineItems {
+		if li.ID == id {
+			return li, true
+		}
+	}
+	return LineItem{}, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// refundCountIs returns the filter conditions that only match if the order has
+// exactly n refunds. Refunds are only ever added to the end and a refund
+// changing status can only make more of the order refundable, so the count is
+// all that needs to stay the same for a refund to still fit. This checks which
+// positions exist rather than using $size since orders inserted before refunds
+// existed have the field missing or null.
+func refundCountIs(n int) bson.D {
+	filter := bson.D{{Key: fmt.Sprintf("refunds.%d", n), Value: bson.D{{Key: "$exists", Value: false}}}}
+	if n > 0 {
+		filter = append(filter, bson.E{Key: fmt.Sprintf("refunds.%d", n-1), Value: bson.D{{Key: "$exists", Value: true}}})
+	}
+	return filter
+}
+
+// AddRefund adds the refund to the order with the given ID as pending, which
+// should happen before asking the charge service to make the refund. It
+// returns the order after the change with the new refund last. If that ID
+// isn't found then ErrOrderNotFound is returned, if the order can't be refunded
+// then ErrInvalidTransition is returned and if the refund is invalid then
+// ErrInvalidRefund is returned. If the order keeps changing while this tries to
+// update it then ErrOrderContended is returned. An OrderEventRefundAdded event
+// is added to the order's event log in the same transaction.
+func (i *Instance) AddRefund(ctx context.Context, id string, refund Refund) (Order, error) {
+	if refund.CreatedAt.IsZero() {
+		refund.CreatedAt = time.Now()
+	}
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return Order{}, err
+		}
+		order, err := i.GetOrder(ctx, id)
+		if err != nil {
+			return Order{}, err
+		}
+		updated, err := order.WithRefund(refund)
+		if err != nil {
+			return Order{}, err
+		}
+		added := updated.Refunds[len(updated.Refunds)-1]
+
+		// just like FulfillLineItems this only updates the order if its status and
+		// number of refunds haven't changed since we got it so two refunds at once
+		// can't refund more than the order's total
+		filter := append(bson.D{
+			{Key: "id", Value: id},
+			{Key: "status", Value: order.Status},
+		}, refundCountIs(len(order.Refunds))...)
+		// the refund is appended rather than setting the whole array so a refund
+		// that finished in the meantime keeps its new status
+		updated.UpdatedAt = time.Now()
+		update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+			{Key: "refunds", Value: appendToArray("refunds", bson.D{{Key: "$literal", Value: added}})},
+			{Key: "updatedat", Value: updated.UpdatedAt},
+		}}}}
+		event := NewOrderEvent(ctx, id, OrderEventRefundAdded, updated.UpdatedAt)
+		event.Refund = &added
+		var matched bool
+		err = i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+			result, err := i.collection.UpdateOne(ctx, filter, update)
+			if err != nil {
+				return err
+			}
+			if matched = result.MatchedCount > 0; !matched {
+				return nil
+			}
+			return i.insertEvent(ctx, event)
+		})
+		if err != nil {
+			return Order{}, err
+		}
+		if matched {
+			return updated, nil
+		}
+		// the order changed in the meantime so try again with the latest version
+	}
+	return Order{}, ErrOrderContended
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// SetRefundStatus moves the pending refund with the given ID on the order with
+// the given ID to status, which is either succeeded or failed, and records the
+// charge service's reference for it. If the order isn't found then
+// ErrOrderNotFound is returned, if the refund isn't found then
+// ErrRefundNotFound is returned and if the refund isn't pending anymore then
+// ErrInvalidTransition is returned. An OrderEventRefundStatusChanged event is
+// added to the order's event log in the same transaction.
+func (i *Instance) SetRefundStatus(ctx context.Context, id, refundID string, status RefundStatus, chargeReference string) error {
+	// only matching pending refunds means the recovery worker and the request that
+	// made the refund can't both change it
+	filter := bson.D{
+		{Key: "id", Value: id},
+		{Key: "refunds", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+			{Key: "id", Value: refundID},
+			{Key: "status", Value: RefundStatusPending},
+		}}}},
+	}
+	// the $ is replaced with the position of the refund matched by the filter
+	now := time.Now()
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "refunds.$.status", Value: status},
+		{Key: "refunds.$.chargereference", Value: chargeReference},
+		{Key: "updatedat", Value: now},
+	}}}
+	event := NewOrderEvent(ctx, id, OrderEventRefundStatusChanged, now)
+	event.Refund = &Refund{ID: refundID, Status: status, ChargeReference: chargeReference}
+	var matched bool
+	err := i.withTransaction(ctx, func(ctx mongo.SessionContext) error {
+		result, err := i.collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if matched = result.MatchedCount > 0; !matched {
+			return nil
+		}
+		return i.insertEvent(ctx, event)
+	})
+	if err != nil {
+		return err
+	}
+	if matched {
+		return nil
+	}
+
+	// nothing matched so figure out why to return the right error
+	order, err := i.GetOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, r := range order.Refunds {
+		if r.ID == refundID {
+			return ErrInvalidTransition
+		}
+	}
+	return ErrRefundNotFound
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// GetStaleRefunds returns all orders with a refund that's been pending since
+// before. This is used to find refunds that were interrupted before we found
+// out whether the charge service made them.
+func (i *Instance) GetStaleRefunds(ctx context.Context, before time.Time) ([]Order, error) {
+	filter := bson.D{
+		{Key: "refunds", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+			{Key: "status", Value: RefundStatusPending},
+			{Key: "createdat", Value: bson.D{{Key: "$lt", Value: before}}},
+		}}}},
+	}
+	cursor, err := i.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return orders, nil
+}
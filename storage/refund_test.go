@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRefund(t *testing.T) {
+	order := Order{
+		LineItems: []LineItem{
+			{ID: "li-1", Description: "item 1", Quantity: 2, PriceCents: 100},
+			{ID: "li-2", Description: "discount", Quantity: 1, PriceCents: -50},
+		},
+		Status: OrderStatusFulfilled,
+	}
+	assert.EqualValues(t, 150, order.NetCents())
+
+	// refunding a line item fills in the amount, ID and status
+	got, err := order.WithRefund(Refund{LineItems: []RefundLineItem{{ID: "li-1", Quantity: 1}}})
+	require.NoError(t, err)
+	require.Len(t, got.Refunds, 1)
+	assert.Equal(t, "rf-1", got.Refunds[0].ID)
+	assert.EqualValues(t, 100, got.Refunds[0].AmountCents)
+	assert.Equal(t, RefundStatusPending, got.Refunds[0].Status)
+	assert.True(t, got.HasPendingRefund())
+	assert.EqualValues(t, 100, got.RefundedCents())
+	assert.EqualValues(t, 50, got.NetCents())
+	// the original isn't modified
+	assert.Empty(t, order.Refunds)
+
+	// refunding more than what's left, too many of a line item, unknown line
+	// items, discounts, nothing or both an amount and line items is invalid
+	for _, refund := range []Refund{
+		{AmountCents: 51},
+		{LineItems: []RefundLineItem{{ID: "li-1", Quantity: 2}}},
+		{LineItems: []RefundLineItem{{ID: "li-3", Quantity: 1}}},
+		{LineItems: []RefundLineItem{{ID: "li-2", Quantity: 1}}},
+		{AmountCents: 0},
+		{AmountCents: 10, LineItems: []RefundLineItem{{ID: "li-1", Quantity: 1}}},
+	} {
+		_, err = got.WithRefund(refund)
+		assert.True(t, errors.Is(err, ErrInvalidRefund), "%+v: %v", refund, err)
+	}
+
+	// failed refunds don't count towards what's been refunded
+	got.Refunds[0].Status = RefundStatusFailed
+	assert.False(t, got.HasPendingRefund())
+	assert.EqualValues(t, 150, got.NetCents())
+	got, err = got.WithRefund(Refund{LineItems: []RefundLineItem{{ID: "li-1", Quantity: 1}}})
+	require.NoError(t, err)
+	assert.Equal(t, "rf-2", got.Refunds[1].ID)
+
+	// the order must have been charged
+	order.Status = OrderStatusPending
+	_, err = order.WithRefund(Refund{AmountCents: 10})
+	assert.True(t, errors.Is(err, ErrInvalidTransition), "%v", err)
+}
@@ -4,99 +4,439 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"io/ioutil"
 	"time"
 
 	"github.com/levenlabs/go-llog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Config describes how to connect to the database. The zero value of any field
+// falls back to the value from DefaultConfig.
+type Config struct {
+	// URI is the MongoDB connection string, like mongodb://localhost:27017
+	URI string
+	// Database is the name of the database within the storage engine and being
+	// a variable we'll randomize this in tests so we don't need to wipe the
+	// database between every test run
+	Database string
+	// Collection is the name of the collection holding the orders
+	Collection string
+	// IdempotencyCollection is the name of the collection holding the
+	// responses to requests made with an Idempotency-Key header
+	IdempotencyCollection string
+	// EventCollection is the name of the collection holding the event log of
+	// every order and CounterCollection is the name of the one holding the
+	// counter that numbers the events
+	EventCollection   string
+	CounterCollection string
+	// OutboxCollection is the name of the collection holding how far the outbox
+	// has delivered to each sink
+	OutboxCollection string
+	// WebhookCollection is the name of the collection holding the webhook
+	// subscriptions and WebhookDeliveryCollection is the name of the one
+	// holding every delivery made to them
+	WebhookCollection         string
+	WebhookDeliveryCollection string
+
+	// Username and Password are the credentials to authenticate with, if any.
+	// These override any credentials in the URI.
+	Username string
+	Password string
+	// AuthSource is the database the credentials are defined in, which is
+	// typically admin
+	AuthSource string
+
+	// TLS enables TLS for every connection to the database
+	TLS bool
+	// TLSCAFile is an optional path to a PEM file of certificate authorities to
+	// trust instead of the system's
+	TLSCAFile string
+	// TLSInsecureSkipVerify disables verifying the server's certificate and
+	// should only ever be used for local testing
+	TLSInsecureSkipVerify bool
+
+	// ConnectTimeout is how long to wait when opening a new connection
+	ConnectTimeout time.Duration
+	// ServerSelectionTimeout is how long an operation waits for a suitable
+	// server to become available before failing
+	ServerSelectionTimeout time.Duration
+
+	// MaxPoolSize and MinPoolSize bound the number of connections kept open to
+	// each server
+	MaxPoolSize uint64
+	MinPoolSize uint64
+}
+
+// DefaultConfig returns the Config used for local development, which connects
+// to an unauthenticated MongoDB on localhost
+func DefaultConfig() Config {
+	return Config{
+		URI:                       "mongodb://localhost:27017",
+		Database:                  "order_up",
+		Collection:                "orders",
+		IdempotencyCollection:     "idempotency_keys",
+		EventCollection:           "order_events",
+		CounterCollection:         "counters",
+		OutboxCollection:          "outbox_cursors",
+		WebhookCollection:         "webhooks",
+		WebhookDeliveryCollection: "webhook_deliveries",
+		AuthSource:                "admin",
+		ConnectTimeout:            10 * time.Second,
+		ServerSelectionTimeout:    10 * time.Second,
+		MaxPoolSize:               100,
+	}
+}
+
+// withDefaults returns a copy of the config with any unset fields set to their
+// values from DefaultConfig
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	if c.URI == "" {
+		c.URI = def.URI
+	}
+	if c.Database == "" {
+		c.Database = def.Database
+	}
+	if c.Collection == "" {
+		c.Collection = def.Collection
+	}
+	if c.IdempotencyCollection == "" {
+		c.IdempotencyCollection = def.IdempotencyCollection
+	}
+	if c.EventCollection == "" {
+		c.EventCollection = def.EventCollection
+	}
+	if c.CounterCollection == "" {
+		c.CounterCollection = def.CounterCollection
+	}
+	if c.OutboxCollection == "" {
+		c.OutboxCollection = def.OutboxCollection
+	}
+	if c.WebhookCollection == "" {
+		c.WebhookCollection = def.WebhookCollection
+	}
+	if c.WebhookDeliveryCollection == "" {
+		c.WebhookDeliveryCollection = def.WebhookDeliveryCollection
+	}
+	if c.AuthSource == "" {
+		c.AuthSource = def.AuthSource
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = def.ConnectTimeout
+	}
+	if c.ServerSelectionTimeout == 0 {
+		c.ServerSelectionTimeout = def.ServerSelectionTimeout
+	}
+	if c.MaxPoolSize == 0 {
+		c.MaxPoolSize = def.MaxPoolSize
+	}
+	return c
+}
+
+// clientOptions converts the config into the options the mongo driver expects
+func (c Config) clientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().
+		ApplyURI(c.URI).
+		SetConnectTimeout(c.ConnectTimeout).
+		SetServerSelectionTimeout(c.ServerSelectionTimeout).
+		SetMaxPoolSize(c.MaxPoolSize).
+		SetMinPoolSize(c.MinPoolSize)
+
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			AuthSource: c.AuthSource,
+			Username:   c.Username,
+			Password:   c.Password,
+		})
+	}
+
+	if c.TLS {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: c.TLSInsecureSkipVerify,
+		}
+		if c.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading TLS CA file: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificates found in TLS CA file")
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// ApplyURI stores any parsing errors on the options and Validate returns
+	// them so we can fail before trying to connect
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid database config: %w", err)
+	}
+	return opts, nil
+}
+
 // Instance holds a database connection for use in the storage methods
 type Instance struct {
-	// database is the name of the database within the storage engine and being a
-	// variable we'll randomize this in tests so we don't need to wipe the database
-	// between every test run
-	// you should use this as the database name for all of your methods to simplify
-	// testing
-	database   string
-	db         *mongo.Client
-	collection *mongo.Collection
-
-	// this is where you'd store any database connections like a *mongo.Client or
-	// *sql.DB
-
+	cfg               Config
+	db                *mongo.Client
+	collection        *mongo.Collection
+	idempotencyKeys   *mongo.Collection
+	events            *mongo.Collection
+	counters          *mongo.Collection
+	outboxCursors     *mongo.Collection
+	webhooks          *mongo.Collection
+	webhookDeliveries *mongo.Collection
 }
 
-func New(overrideDatabase string) *Instance {
+// New connects to the database described by cfg and returns an Instance that's
+// ready to use. The context bounds how long connecting and setting up the
+// schema can take. Call Close once the Instance is no longer needed.
+func New(ctx context.Context, cfg Config) (*Instance, error) {
 	// create a pointer to an Instance that we will return after initialization
-	inst := &Instance{}
-	// if they sent overrideDatabase then use that, like for tests, otherwise
-	// fallback to a static name for production, staging, etc
-	// you might have some environmental variables or flags instead to do this but
-	// for this project this is sufficient
-	if overrideDatabase != "" {
-		inst.database = overrideDatabase
-	} else {
-		inst.database = "order_up"
-	}
-
-	// TODO: code for connecting to the database and storing the connected driver
-	db, err := inst.openDB()
+	inst := &Instance{
+		cfg: cfg.withDefaults(),
+	}
+
+	db, err := inst.openDB(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	inst.db = db
-	inst.collection = db.Database("test").Collection("Order")
-	// normally I would include a disconnect somewhere in the main, since we do not
-	// want to open/close the connection for each connection. I will leave it out because IDK where to put it here
+	inst.collection = db.Database(inst.cfg.Database).Collection(inst.cfg.Collection)
+	inst.idempotencyKeys = db.Database(inst.cfg.Database).Collection(inst.cfg.IdempotencyCollection)
+	inst.events = db.Database(inst.cfg.Database).Collection(inst.cfg.EventCollection)
+	inst.counters = db.Database(inst.cfg.Database).Collection(inst.cfg.CounterCollection)
+	inst.outboxCursors = db.Database(inst.cfg.Database).Collection(inst.cfg.OutboxCollection)
+	inst.webhooks = db.Database(inst.cfg.Database).Collection(inst.cfg.WebhookCollection)
+	inst.webhookDeliveries = db.Database(inst.cfg.Database).Collection(inst.cfg.WebhookDeliveryCollection)
 
-	// instance on inst
-
-	// give the ensureSchema function only 15 seconds to complete
+	// give the ensureSchema function at most 15 seconds to complete
 	// after 15 seconds the context will return DeadlineExceeded errors which should
 	// cause any functions downstream to error out
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	// if we don't call cancel then the ctx will leak so we make sure that cancel
 	// is called no matter what when we're done
 	defer cancel()
 	// we want to make sure the database is ready to accept requests and if that
-	// fails we need to fatal
+	// fails we disconnect since the caller won't get an Instance to Close
 	if err := inst.ensureSchema(ctx); err != nil {
-		llog.Fatal("failed to ensure schema", llog.ErrKV(err))
+		db.Disconnect(context.Background())
+		return nil, fmt.Errorf("error ensuring schema: %w", err)
 	}
-	return inst
+	return inst, nil
 }
 
-func (i *Instance) ensureSchema(ctx context.Context) error {
-	// TODO: this is where you'll do any schema setup (CREATE DATABASE or CREATE
-	// TABLE), if necessary, and since this will be called every time the service
-	// starts or every time you run tests, it should not fail if the schema is
-	// already setup
-	// for example you might need to add a unique index on the order's ID field ;)
-	return nil
+// Close disconnects from the database. The Instance must not be used after
+// calling Close.
+func (i *Instance) Close(ctx context.Context) error {
+	return i.db.Disconnect(ctx)
 }
 
-func (i *Instance) openDB() (*mongo.Client, error) {
+// ensureSchema creates the indexes the storage methods rely on and fills in
+// any fields they rely on that older orders are missing. It's called every
+// time the service starts so it must not fail if they already exist, which
+// CreateMany guarantees as long as an index's options haven't changed.
+func (i *Instance) ensureSchema(ctx context.Context) error {
+	_, err := i.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// every lookup and update is by id and the unique constraint is what
+			// makes InsertOrder's duplicate detection atomic
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetName("id_unique").SetUnique(true),
+		},
+		{
+			// GetOrders filters by status
+			Keys:    bson.D{{Key: "status", Value: 1}},
+			Options: options.Index().SetName("status"),
+		},
+		{
+			// GetStaleOrders looks for orders in a status since before a time
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "statusupdatedat", Value: 1}},
+			Options: options.Index().SetName("status_statusupdatedat"),
+		},
+		{
+			// GetStaleRefunds looks for pending refunds created before a time
+			Keys:    bson.D{{Key: "refunds.status", Value: 1}, {Key: "refunds.createdat", Value: 1}},
+			Options: options.Index().SetName("refunds_status_createdat"),
+		},
+		{
+			// GetExpiredAuthorizations looks for authorized orders that expired
+			// before a time
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "authorization.expiresat", Value: 1}},
+			Options: options.Index().SetName("status_authorization_expiresat"),
+		},
+		{
+			// orders are filtered and reported on by when they were created or
+			// last changed
+			Keys:    bson.D{{Key: "createdat", Value: 1}},
+			Options: options.Index().SetName("createdat"),
+		},
+		{
+			Keys:    bson.D{{Key: "updatedat", Value: 1}},
+			Options: options.Index().SetName("updatedat"),
+		},
+		{
+			// support and customers look up orders by email
+			Keys:    bson.D{{Key: "customeremail", Value: 1}},
+			Options: options.Index().SetName("customeremail"),
+		},
+		{
+			// GetOrders pages through orders sorted by one of these fields and
+			// then by id, optionally filtered by status
+			Keys:    bson.D{{Key: "createdat", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("createdat_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "totalcents", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("totalcents_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("status_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "createdat", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("status_createdat_id"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating order indexes: %w", err)
+	}
 
-	// Set connection options
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
+	// orders inserted before totalcents was stored don't have it so it's
+	// computed from their line items, which is a no-op once they all have it
+	lineItemTotals := bson.D{{Key: "$map", Value: bson.D{
+		{Key: "input", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$lineitems", bson.A{}}}}},
+		{Key: "as", Value: "li"},
+		{Key: "in", Value: bson.D{{Key: "$multiply", Value: bson.A{"$$li.pricecents", "$$li.quantity"}}}},
+	}}}
+	_, err = i.collection.UpdateMany(ctx,
+		bson.D{{Key: "totalcents", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "totalcents", Value: bson.D{{Key: "$sum", Value: lineItemTotals}}}}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error filling in order totals: %w", err)
+	}
 
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	_, err = i.idempotencyKeys.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// the unique constraint is what makes ReserveIdempotencyKey atomic
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetName("key_unique").SetUnique(true),
+		},
+		{
+			// the database deletes records once they're past expiresat, although
+			// it only checks every minute so the methods still filter by it
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetName("expiresat_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating idempotency key indexes: %w", err)
+	}
 
+	_, err = i.events.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// GetOrderEvents pages through an order's events in order of their ID
+			Keys:    bson.D{{Key: "orderid", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("orderid_id_unique").SetUnique(true),
+		},
+		{
+			// GetOrderEventsAfterSeq reads every order's events in order of their
+			// Seq. Events recorded before Seq existed are left out of the index.
+			Keys: bson.D{{Key: "seq", Value: 1}},
+			Options: options.Index().SetName("seq_unique").SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "seq", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{
+			// GetOrderEventsAfterSeq reads an order's events in order of their Seq
+			Keys:    bson.D{{Key: "orderid", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetName("orderid_seq"),
+		},
+	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error creating event indexes: %w", err)
 	}
 
-	// Check the connection
-	err = client.Ping(context.TODO(), nil)
+	_, err = i.outboxCursors.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// every sink has a single cursor, which ClaimOutboxCursor relies on
+			// to reject claims on a cursor with an unexpired lease
+			Keys:    bson.D{{Key: "sink", Value: 1}},
+			Options: options.Index().SetName("sink_unique").SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating outbox cursor indexes: %w", err)
+	}
+
+	_, err = i.webhooks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// the unique constraint is what makes InsertWebhookSubscription's
+			// duplicate detection atomic
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetName("id_unique").SetUnique(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating webhook indexes: %w", err)
+	}
+
+	_, err = i.webhookDeliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// the unique constraint is what stops AddWebhookDeliveries from adding
+			// the same delivery twice
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetName("id_unique").SetUnique(true),
+		},
+		{
+			// ClaimDueWebhookDelivery looks for pending deliveries due before a
+			// time
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}},
+			Options: options.Index().SetName("status_nextattemptat"),
+		},
+		{
+			// GetWebhookDeliveries pages through a subscription's deliveries in order
+			// of their ID
+			Keys:    bson.D{{Key: "subscriptionid", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("subscriptionid_id"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating webhook delivery indexes: %w", err)
+	}
+	return nil
+}
+
+func (i *Instance) openDB(ctx context.Context) (*mongo.Client, error) {
+	clientOptions, err := i.cfg.clientOptions()
 	if err != nil {
 		return nil, err
 	}
 
-	client.Database("edmEvents").Collection("lasVegasEdmEventsCollection")
+	// bound connecting and the initial ping by the connect timeout so a bad URI
+	// doesn't hang forever
+	ctx, cancel := context.WithTimeout(ctx, i.cfg.ConnectTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+
+	// Check the connection
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("error pinging database: %w", err)
+	}
 
-	fmt.Println("Connected to MongoDB!")
+	llog.Info("connected to database", llog.KV{"database": i.cfg.Database})
 	return client, nil
 }
@@ -0,0 +1,1762 @@
+// Package storagetest contains a conformance suite that every storage backend
+// runs in its own tests so they all behave the same way
+package storagetest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new storage instance for a single test. Every call must
+// return an instance that's isolated from every other instance, like by using
+// a random database name, so tests can't see each other's orders.
+type Factory func(t *testing.T) mocks.StorageInstance
+
+// Run runs every conformance test against instances returned by newInstance
+func Run(t *testing.T, newInstance Factory) {
+	t.Run("GetOrder", func(t *testing.T) {
+		testGetOrder(t, newInstance(t))
+	})
+	t.Run("GetOrders", func(t *testing.T) {
+		testGetOrders(t, newInstance(t))
+	})
+	t.Run("GetOrdersPages", func(t *testing.T) {
+		testGetOrdersPages(t, newInstance(t))
+	})
+	t.Run("GetOrdersQuery", func(t *testing.T) {
+		testGetOrdersQuery(t, newInstance(t))
+	})
+	t.Run("IterOrders", func(t *testing.T) {
+		testIterOrders(t, newInstance(t))
+	})
+	t.Run("GetStaleOrders", func(t *testing.T) {
+		testGetStaleOrders(t, newInstance(t))
+	})
+	t.Run("SetOrderStatus", func(t *testing.T) {
+		testSetOrderStatus(t, newInstance(t))
+	})
+	t.Run("TransitionOrderStatus", func(t *testing.T) {
+		testTransitionOrderStatus(t, newInstance(t))
+	})
+	t.Run("FulfillLineItems", func(t *testing.T) {
+		testFulfillLineItems(t, newInstance(t))
+	})
+	t.Run("Refunds", func(t *testing.T) {
+		testRefunds(t, newInstance(t))
+	})
+	t.Run("Payments", func(t *testing.T) {
+		testPayments(t, newInstance(t))
+	})
+	t.Run("Authorizations", func(t *testing.T) {
+		testAuthorizations(t, newInstance(t))
+	})
+	t.Run("Timestamps", func(t *testing.T) {
+		testTimestamps(t, newInstance(t))
+	})
+	t.Run("OrderEvents", func(t *testing.T) {
+		testOrderEvents(t, newInstance(t))
+	})
+	t.Run("OutboxCursors", func(t *testing.T) {
+		testOutboxCursors(t, newInstance(t))
+	})
+	t.Run("OrderEventsAfterSeq", func(t *testing.T) {
+		testOrderEventsAfterSeq(t, newInstance(t))
+	})
+	t.Run("Webhooks", func(t *testing.T) {
+		testWebhooks(t, newInstance(t))
+	})
+	t.Run("InsertOrder", func(t *testing.T) {
+		testInsertOrder(t, newInstance(t))
+	})
+	t.Run("IdempotencyKeys", func(t *testing.T) {
+		testIdempotencyKeys(t, newInstance(t))
+	})
+	t.Run("ConcurrentWrites", func(t *testing.T) {
+		testConcurrentWrites(t, newInstance(t))
+	})
+}
+
+// randomID returns a random order ID prefixed with prefix so that even if a
+// backend doesn't isolate its instances perfectly the tests won't collide
+func randomID(prefix string) string {
+	b := make([]byte, 8)
+	// rand.Read should never error unless we run out of entropy and since this
+	// is just in tests anyways it's easier to just panic
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s_%x", prefix, b)
+}
+
+// now returns the current time with the precision every backend is expected
+// to store, which is milliseconds like MongoDB
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// newOrder returns a valid order with a random ID and the given status
+func newOrder(status storage.OrderStatus) storage.Order {
+	created := now()
+	return storage.Order{
+		ID:            randomID("order"),
+		CustomerEmail: "test@test",
+		LineItems: []storage.LineItem{
+			{
+				ID:          "li-1",
+				Description: "item 1",
+				Quantity:    1,
+				PriceCents:  1000,
+			},
+			{
+				ID:          "li-2",
+				Description: "item 2",
+				Quantity:    10,
+				PriceCents:  5000,
+			},
+		},
+		Status:          status,
+		StatusUpdatedAt: created,
+		CreatedAt:       created,
+		UpdatedAt:       created,
+		StatusHistory:   []storage.StatusChange{{To: status, At: created}},
+	}
+}
+
+// statusQuery returns a query for the orders in any of the statuses
+func statusQuery(statuses ...storage.OrderStatus) storage.OrderQuery {
+	return storage.OrderQuery{Statuses: statuses}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testGetOrder(t *testing.T, inst mocks.StorageInstance) {
+	// the context isn't meaningful for these tests so we just use a new one
+	ctx := context.Background()
+	order := newOrder(storage.OrderStatusCharged)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// returns expected order
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	// returns not found
+	_, err = inst.GetOrder(ctx, randomID("notfound"))
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testGetOrders(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+
+	// returns none and no error if there are no orders at all
+	got, _, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	order1 := newOrder(storage.OrderStatusCharged)
+	_, err = inst.InsertOrder(ctx, order1)
+	require.NoError(t, err)
+	order2 := newOrder(storage.OrderStatusFulfilled)
+	_, err = inst.InsertOrder(ctx, order2)
+	require.NoError(t, err)
+
+	// returns all if -1 is sent
+	got, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Contains(t, got, order1)
+		assert.Contains(t, got, order2)
+	}
+
+	// only returns the matching status
+	got, _, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusCharged), storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Order{order1}, got)
+
+	got, _, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusFulfilled), storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Order{order2}, got)
+
+	// returns none and no error if none match
+	got, _, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusPending), storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// the filter follows status changes
+	err = inst.SetOrderStatus(ctx, order1.ID, storage.OrderStatusFulfilled, "test")
+	require.NoError(t, err)
+	// get the order again since changing the status also changes StatusUpdatedAt
+	order1, err = inst.GetOrder(ctx, order1.ID)
+	require.NoError(t, err)
+	got, _, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusCharged), storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	got, _, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusFulfilled), storage.OrderPage{})
+	require.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Contains(t, got, order1)
+		assert.Contains(t, got, order2)
+	}
+}
+
+func testGetOrdersQuery(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	base := now().Add(-time.Hour)
+	newQueryOrder := func(status storage.OrderStatus, email, desc string, price int64, created, updated time.Duration) storage.Order {
+		order := newOrder(status)
+		order.CustomerEmail = email
+		order.LineItems = []storage.LineItem{
+			{ID: "li-1", Description: "Shipping", Quantity: 1, PriceCents: 0},
+			{ID: "li-2", Description: desc, Quantity: 2, PriceCents: price},
+		}
+		order.CreatedAt = base.Add(created)
+		order.UpdatedAt = base.Add(updated)
+		order.StatusUpdatedAt = order.CreatedAt
+		order.StatusHistory[0].At = order.CreatedAt
+		return order
+	}
+	orders := []storage.Order{
+		newQueryOrder(storage.OrderStatusPending, "a@example.com", "Red Shirt", 500, 0, 10*time.Minute),
+		newQueryOrder(storage.OrderStatusCharged, "b@example.com", "Blue shirt", 1000, time.Minute, 2*time.Minute),
+		newQueryOrder(storage.OrderStatusFulfilled, "a@example.com", "Red hat", 1500, 2*time.Minute, 3*time.Minute),
+		newQueryOrder(storage.OrderStatusCancelled, "c@example.com", "Socks (3.pack)", 2000, 3*time.Minute, 4*time.Minute),
+	}
+	for _, order := range orders {
+		_, err := inst.InsertOrder(ctx, order)
+		require.NoError(t, err)
+	}
+
+	total := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name     string
+		query    storage.OrderQuery
+		expected []int
+	}{
+		{"everything", storage.OrderQuery{}, []int{0, 1, 2, 3}},
+		{"one status", statusQuery(storage.OrderStatusCharged), []int{1}},
+		{"many statuses", statusQuery(storage.OrderStatusPending, storage.OrderStatusFulfilled, storage.OrderStatusRefunding), []int{0, 2}},
+		{"email", storage.OrderQuery{CustomerEmail: "a@example.com"}, []int{0, 2}},
+		{"unknown email", storage.OrderQuery{CustomerEmail: "A@example.com"}, nil},
+		{"created since", storage.OrderQuery{CreatedSince: base.Add(time.Minute)}, []int{1, 2, 3}},
+		{"created before", storage.OrderQuery{CreatedBefore: base.Add(time.Minute)}, []int{0}},
+		{"created range", storage.OrderQuery{CreatedSince: base.Add(time.Minute), CreatedBefore: base.Add(3 * time.Minute)}, []int{1, 2}},
+		{"updated range", storage.OrderQuery{UpdatedSince: base.Add(3 * time.Minute), UpdatedBefore: base.Add(10 * time.Minute)}, []int{2, 3}},
+		{"min total", storage.OrderQuery{MinTotalCents: total(2000)}, []int{1, 2, 3}},
+		{"max total", storage.OrderQuery{MaxTotalCents: total(2000)}, []int{0, 1}},
+		{"total range", storage.OrderQuery{MinTotalCents: total(2001), MaxTotalCents: total(3000)}, []int{2}},
+		{"description ignores case", storage.OrderQuery{Description: "SHIRT"}, []int{0, 1}},
+		{"description isn't a pattern", storage.OrderQuery{Description: "(3.pack)"}, []int{3}},
+		{"description on any line item", storage.OrderQuery{Description: "shipping"}, []int{0, 1, 2, 3}},
+		{"everything at once", storage.OrderQuery{
+			Statuses:      []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusFulfilled},
+			CustomerEmail: "a@example.com",
+			CreatedSince:  base.Add(time.Minute),
+			MinTotalCents: total(1),
+			Description:   "red",
+		}, []int{2}},
+	}
+	for _, test := range tests {
+		got, next, err := inst.GetOrders(ctx, test.query, storage.OrderPage{})
+		require.NoError(t, err, test.name)
+		assert.Empty(t, next, test.name)
+		var ids []string
+		for _, order := range got {
+			ids = append(ids, order.ID)
+		}
+		var expected []string
+		for _, idx := range test.expected {
+			expected = append(expected, orders[idx].ID)
+			// the memory backend filters with Matches so it has to agree
+			assert.True(t, test.query.Matches(orders[idx]), test.name)
+		}
+		assert.Equal(t, expected, ids, test.name)
+	}
+
+	// the query applies to every page
+	query := storage.OrderQuery{CustomerEmail: "a@example.com"}
+	got, next, err := inst.GetOrders(ctx, query, storage.OrderPage{Limit: 1, Sort: storage.OrderSortTotal, Descending: true})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, orders[2].ID, got[0].ID)
+	}
+	got, _, err = inst.GetOrders(ctx, query, storage.OrderPage{Limit: 1, Cursor: next, Sort: storage.OrderSortTotal, Descending: true})
+	require.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, orders[0].ID, got[0].ID)
+	}
+}
+
+func testIterOrders(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+
+	// more orders than fit in one batch so the iteration has to go get more
+	var orders []storage.Order
+	base := now().Add(-time.Hour)
+	for idx := 0; idx < 450; idx++ {
+		status := storage.OrderStatusCharged
+		if idx%3 == 0 {
+			status = storage.OrderStatusPending
+		}
+		order := newOrder(status)
+		// every few orders share a creation time so those fall back to the ID
+		order.CreatedAt = base.Add(time.Duration(idx/4) * time.Second)
+		_, err := inst.InsertOrder(ctx, order)
+		require.NoError(t, err)
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(a, b int) bool {
+		return storage.OrderPage{}.Compare(orders[a], orders[b]) < 0
+	})
+	collect := func(query storage.OrderQuery) []string {
+		var ids []string
+		err := inst.IterOrders(ctx, query, func(order storage.Order) error {
+			ids = append(ids, order.ID)
+			return nil
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	var all, pending []string
+	for _, order := range orders {
+		all = append(all, order.ID)
+		if order.Status == storage.OrderStatusPending {
+			pending = append(pending, order.ID)
+		}
+	}
+	assert.Equal(t, all, collect(storage.OrderQuery{}))
+	assert.Equal(t, pending, collect(statusQuery(storage.OrderStatusPending)))
+	assert.Empty(t, collect(statusQuery(storage.OrderStatusRefunding)))
+
+	// the error from fn stops the iteration and is returned as-is
+	errStop := errors.New("stop")
+	var n int
+	err := inst.IterOrders(ctx, storage.OrderQuery{}, func(storage.Order) error {
+		n++
+		if n == 3 {
+			return errStop
+		}
+		return nil
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 3, n)
+
+	// fn can change the orders as it goes, which is what background jobs do
+	err = inst.IterOrders(ctx, statusQuery(storage.OrderStatusPending), func(order storage.Order) error {
+		return inst.SetOrderStatus(ctx, order.ID, storage.OrderStatusCancelled, "test")
+	})
+	require.NoError(t, err)
+	assert.Empty(t, collect(statusQuery(storage.OrderStatusPending)))
+	assert.Equal(t, pending, collect(statusQuery(storage.OrderStatusCancelled)))
+
+	// a cancelled context stops the iteration with an error
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	n = 0
+	err = inst.IterOrders(cctx, storage.OrderQuery{}, func(storage.Order) error {
+		n++
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Less(t, n, len(orders))
+}
+
+func testGetOrdersPages(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+
+	// each order has a different creation time but some have the same total and
+	// status so those sorts fall back to the ID
+	var orders []storage.Order
+	base := now().Add(-time.Hour)
+	for idx, status := range []storage.OrderStatus{
+		storage.OrderStatusCharged,
+		storage.OrderStatusPending,
+		storage.OrderStatusFulfilled,
+		storage.OrderStatusPending,
+		storage.OrderStatusCharged,
+	} {
+		order := newOrder(status)
+		order.LineItems = []storage.LineItem{{ID: "li-1", Description: "item", Quantity: 1, PriceCents: int64(idx%3) * 100}}
+		order.CreatedAt = base.Add(time.Duration(len(orders)) * time.Minute)
+		_, err := inst.InsertOrder(ctx, order)
+		require.NoError(t, err)
+		order, err = inst.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		orders = append(orders, order)
+	}
+
+	// pageThrough gets every page and checks that together they're in the
+	// expected order
+	pageThrough := func(query storage.OrderQuery, page storage.OrderPage, expected []storage.Order) {
+		t.Helper()
+		var got []storage.Order
+		for i := 0; i < len(orders)+1; i++ {
+			batch, next, err := inst.GetOrders(ctx, query, page)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(batch), page.Limit)
+			got = append(got, batch...)
+			if next == "" {
+				break
+			}
+			assert.Len(t, batch, page.Limit)
+			page.Cursor = next
+		}
+		if assert.Len(t, got, len(expected)) {
+			for i := range expected {
+				assert.Equal(t, expected[i].ID, got[i].ID, "index %d", i)
+			}
+		}
+	}
+	sorted := func(page storage.OrderPage, orders []storage.Order) []storage.Order {
+		orders = append([]storage.Order(nil), orders...)
+		sort.Slice(orders, func(a, b int) bool { return page.Compare(orders[a], orders[b]) < 0 })
+		return orders
+	}
+
+	for _, sortBy := range storage.OrderSorts {
+		for _, desc := range []bool{false, true} {
+			page := storage.OrderPage{Limit: 2, Sort: sortBy, Descending: desc}
+			pageThrough(storage.OrderQuery{}, page, sorted(page, orders))
+		}
+	}
+
+	// created time is the default sort and it's oldest first
+	pageThrough(storage.OrderQuery{}, storage.OrderPage{Limit: 3}, orders)
+	got, next, err := inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Len(t, got, len(orders))
+	assert.Empty(t, next)
+
+	// the status filter applies to every page
+	page := storage.OrderPage{Limit: 1, Sort: storage.OrderSortTotal, Descending: true}
+	pageThrough(statusQuery(storage.OrderStatusPending), page, sorted(page, []storage.Order{orders[1], orders[3]}))
+
+	// a page that's exactly full has a cursor to an empty page
+	got, next, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusFulfilled), storage.OrderPage{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+	require.NotEmpty(t, next)
+	got, next, err = inst.GetOrders(ctx, statusQuery(storage.OrderStatusFulfilled), storage.OrderPage{Limit: 1, Cursor: next})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	assert.Empty(t, next)
+
+	// cursors only work with the sort they were made for
+	_, next, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{Limit: 1})
+	require.NoError(t, err)
+	_, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{Limit: 1, Cursor: next, Sort: storage.OrderSortTotal})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "%v", err)
+	_, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{Limit: 1, Cursor: next, Descending: true})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "%v", err)
+	_, _, err = inst.GetOrders(ctx, storage.OrderQuery{}, storage.OrderPage{Cursor: "not a cursor"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), "%v", err)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testGetStaleOrders(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	stuck := []storage.OrderStatus{storage.OrderStatusCharging, storage.OrderStatusRefunding}
+	cutoff := now().Add(-time.Minute)
+
+	// charging for an hour so it's stale
+	order1 := newOrder(storage.OrderStatusCharging)
+	order1.StatusUpdatedAt = now().Add(-time.Hour)
+	_, err := inst.InsertOrder(ctx, order1)
+	require.NoError(t, err)
+
+	// refunding for an hour so it's stale
+	order2 := newOrder(storage.OrderStatusRefunding)
+	order2.StatusUpdatedAt = now().Add(-time.Hour)
+	_, err = inst.InsertOrder(ctx, order2)
+	require.NoError(t, err)
+
+	// charging but only just now so it's not stale
+	order3 := newOrder(storage.OrderStatusCharging)
+	_, err = inst.InsertOrder(ctx, order3)
+	require.NoError(t, err)
+
+	// charged for an hour but that's not one of the statuses
+	order4 := newOrder(storage.OrderStatusCharged)
+	order4.StatusUpdatedAt = now().Add(-time.Hour)
+	_, err = inst.InsertOrder(ctx, order4)
+	require.NoError(t, err)
+
+	got, err := inst.GetStaleOrders(ctx, stuck, cutoff)
+	require.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Contains(t, got, order1)
+		assert.Contains(t, got, order2)
+	}
+
+	// changing the status makes it no longer stale
+	_, err = inst.TransitionOrderStatus(ctx, order1.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "test")
+	require.NoError(t, err)
+	got, err = inst.GetStaleOrders(ctx, stuck, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Order{order2}, got)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testSetOrderStatus(t *testing.T, inst mocks.StorageInstance) {
+	ctx := storage.WithActor(context.Background(), "test-actor")
+	order := newOrder(storage.OrderStatusCharged)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	err = inst.SetOrderStatus(ctx, order.ID, storage.OrderStatusFulfilled, "test")
+	require.NoError(t, err)
+
+	// only the status, when it was updated and its history changed
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.False(t, got.StatusUpdatedAt.Before(order.StatusUpdatedAt))
+	change := storage.NewStatusChange(ctx, storage.OrderStatusCharged, storage.OrderStatusFulfilled, got.StatusUpdatedAt, "test")
+	assert.Equal(t, order.WithStatusChange(change), got)
+
+	// setting the same status again isn't an error
+	err = inst.SetOrderStatus(ctx, order.ID, storage.OrderStatusFulfilled, "test")
+	require.NoError(t, err)
+
+	// returns not found
+	err = inst.SetOrderStatus(ctx, randomID("notfound"), storage.OrderStatusFulfilled, "test")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testTransitionOrderStatus(t *testing.T, inst mocks.StorageInstance) {
+	ctx := storage.WithActor(context.Background(), "test-actor")
+	order := newOrder(storage.OrderStatusCharged)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// returns the order as it was before the transition
+	got, err := inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending, storage.OrderStatusCharged}, storage.OrderStatusFulfilled, "test")
+	require.NoError(t, err)
+	assert.Equal(t, order, got)
+
+	// the change is added to the history with who made it and why
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+	assert.False(t, got.StatusUpdatedAt.Before(order.StatusUpdatedAt))
+	change := storage.NewStatusChange(ctx, storage.OrderStatusCharged, storage.OrderStatusFulfilled, got.StatusUpdatedAt, "test")
+	assert.Equal(t, order.WithStatusChange(change), got)
+
+	// returns invalid transition and leaves the status alone if the current
+	// status isn't one of the from statuses
+	_, err = inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusCancelled, "test")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+	assert.Len(t, got.StatusHistory, 2)
+
+	// moving to charging or refunding counts as a payment attempt
+	order2 := newOrder(storage.OrderStatusPending)
+	_, err = inst.InsertOrder(ctx, order2)
+	require.NoError(t, err)
+	got, err = inst.TransitionOrderStatus(ctx, order2.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "test")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, got.PaymentAttempts)
+	got, err = inst.TransitionOrderStatus(ctx, order2.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "test")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, got.PaymentAttempts)
+	_, err = inst.TransitionOrderStatus(ctx, order2.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "test")
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order2.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, got.PaymentAttempts)
+
+	// an order with line items being shipped can't be refunded or cancelled
+	// until they're released
+	order3 := newOrder(storage.OrderStatusCharged)
+	_, err = inst.InsertOrder(ctx, order3)
+	require.NoError(t, err)
+	_, err = inst.ReserveLineItems(ctx, order3.ID, map[string]int64{"li-2": 1})
+	require.NoError(t, err)
+	_, err = inst.TransitionOrderStatus(ctx, order3.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "test")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, order3.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusCharged, got.Status)
+	assert.EqualValues(t, 0, got.PaymentAttempts)
+	order4 := newOrder(storage.OrderStatusRefunding)
+	order4.LineItems[0].ReservedQuantity = 1
+	_, err = inst.InsertOrder(ctx, order4)
+	require.NoError(t, err)
+	_, err = inst.TransitionOrderStatus(ctx, order4.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "test")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	_, err = inst.ReleaseLineItems(ctx, order3.ID, map[string]int64{"li-2": 1}, "out of stock")
+	require.NoError(t, err)
+	_, err = inst.TransitionOrderStatus(ctx, order3.ID, []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusRefunding, "test")
+	require.NoError(t, err)
+	_, err = inst.TransitionOrderStatus(ctx, order3.ID, []storage.OrderStatus{storage.OrderStatusRefunding}, storage.OrderStatusCancelled, "test")
+	require.NoError(t, err)
+
+	// returns not found
+	_, err = inst.TransitionOrderStatus(ctx, randomID("notfound"), []storage.OrderStatus{storage.OrderStatusCharged}, storage.OrderStatusFulfilled, "test")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// fulfill reserves the quantities of the order's line items and then fulfills
+// them, like the api does around calling the fulfillment service
+func fulfill(ctx context.Context, inst mocks.StorageInstance, id string, quantities map[string]int64) (storage.Order, error) {
+	if _, err := inst.ReserveLineItems(ctx, id, quantities); err != nil {
+		return storage.Order{}, err
+	}
+	return inst.FulfillLineItems(ctx, id, quantities)
+}
+
+func testFulfillLineItems(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	order := newOrder(storage.OrderStatusCharged)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// reserving line items doesn't change the status
+	got, err := inst.ReserveLineItems(ctx, order.ID, map[string]int64{"li-1": 1, "li-2": 4})
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusCharged, got.Status)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, got.LineItems[0].ReservedQuantity)
+	assert.EqualValues(t, 4, got.LineItems[1].ReservedQuantity)
+
+	// returns invalid fulfillment and leaves the order alone if reserving more
+	// than what's available, which doesn't include what's reserved
+	_, err = inst.ReserveLineItems(ctx, order.ID, map[string]int64{"li-2": 7})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidFulfillment), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, got.LineItems[1].ReservedQuantity)
+
+	// fulfilling some of the reserved line items partially fulfills the order
+	got, err = inst.FulfillLineItems(ctx, order.ID, map[string]int64{"li-1": 1, "li-2": 3})
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusPartiallyFulfilled, got.Status)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusPartiallyFulfilled, got.Status)
+	assert.EqualValues(t, 1, got.LineItems[0].FulfilledQuantity)
+	assert.EqualValues(t, 0, got.LineItems[0].ReservedQuantity)
+	assert.EqualValues(t, 3, got.LineItems[1].FulfilledQuantity)
+	assert.EqualValues(t, 1, got.LineItems[1].ReservedQuantity)
+
+	// returns invalid fulfillment if fulfilling more than what's reserved
+	_, err = inst.FulfillLineItems(ctx, order.ID, map[string]int64{"li-2": 2})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidFulfillment), "%#v", err)
+	}
+
+	// releasing makes the line items available again
+	got, err = inst.ReleaseLineItems(ctx, order.ID, map[string]int64{"li-2": 1}, "out of stock")
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, got.LineItems[1].ReservedQuantity)
+	_, err = inst.ReleaseLineItems(ctx, order.ID, map[string]int64{"li-2": 1}, "out of stock")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidFulfillment), "%#v", err)
+	}
+
+	// fulfilling the rest fulfills the order
+	got, err = fulfill(ctx, inst, order.ID, map[string]int64{"li-2": 7})
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusFulfilled, got.Status)
+
+	// returns invalid transition for orders that aren't charged
+	pending := newOrder(storage.OrderStatusPending)
+	_, err = inst.InsertOrder(ctx, pending)
+	require.NoError(t, err)
+	_, err = inst.ReserveLineItems(ctx, pending.ID, map[string]int64{"li-1": 1})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	_, err = inst.FulfillLineItems(ctx, pending.ID, map[string]int64{"li-1": 1})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+
+	// returns not found
+	_, err = inst.ReserveLineItems(ctx, randomID("notfound"), map[string]int64{"li-1": 1})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+	_, err = inst.ReleaseLineItems(ctx, randomID("notfound"), map[string]int64{"li-1": 1}, "")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+	_, err = inst.FulfillLineItems(ctx, randomID("notfound"), map[string]int64{"li-1": 1})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testRefunds(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	order := newOrder(storage.OrderStatusFulfilled)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// adding a refund for line items fills in its ID and amount and leaves it
+	// pending
+	got, err := inst.AddRefund(ctx, order.ID, storage.Refund{
+		LineItems: []storage.RefundLineItem{{ID: "li-2", Quantity: 2}},
+		Reason:    "damaged",
+		CreatedAt: now(),
+	})
+	require.NoError(t, err)
+	require.Len(t, got.Refunds, 1)
+	assert.Equal(t, "rf-1", got.Refunds[0].ID)
+	assert.EqualValues(t, 10000, got.Refunds[0].AmountCents)
+	assert.Equal(t, storage.RefundStatusPending, got.Refunds[0].Status)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	require.Len(t, got.Refunds, 1)
+	assert.Equal(t, "damaged", got.Refunds[0].Reason)
+	assert.EqualValues(t, 10000, got.RefundedCents())
+
+	// pending refunds created before are stale
+	stale, err := inst.GetStaleRefunds(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	if assert.Len(t, stale, 1) {
+		assert.Equal(t, order.ID, stale[0].ID)
+	}
+	stale, err = inst.GetStaleRefunds(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, stale)
+
+	// finishing the refund records the charge service's reference but only once
+	err = inst.SetRefundStatus(ctx, order.ID, "rf-1", storage.RefundStatusSucceeded, "ch_1")
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.RefundStatusSucceeded, got.Refunds[0].Status)
+	assert.Equal(t, "ch_1", got.Refunds[0].ChargeReference)
+	err = inst.SetRefundStatus(ctx, order.ID, "rf-1", storage.RefundStatusFailed, "")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	stale, err = inst.GetStaleRefunds(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, stale)
+
+	// returns invalid refund and leaves the order alone if refunding more than
+	// what's left
+	_, err = inst.AddRefund(ctx, order.ID, storage.Refund{AmountCents: got.NetCents() + 1})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidRefund), "%#v", err)
+	}
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Len(t, got.Refunds, 1)
+
+	// a failed refund doesn't count towards the refunded amount
+	got, err = inst.AddRefund(ctx, order.ID, storage.Refund{AmountCents: 500})
+	require.NoError(t, err)
+	assert.Equal(t, "rf-2", got.Refunds[1].ID)
+	err = inst.SetRefundStatus(ctx, order.ID, "rf-2", storage.RefundStatusFailed, "")
+	require.NoError(t, err)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10000, got.RefundedCents())
+
+	// returns refund not found
+	err = inst.SetRefundStatus(ctx, order.ID, "rf-3", storage.RefundStatusFailed, "")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrRefundNotFound), "%#v", err)
+	}
+
+	// returns invalid transition for orders that haven't been charged
+	pending := newOrder(storage.OrderStatusPending)
+	_, err = inst.InsertOrder(ctx, pending)
+	require.NoError(t, err)
+	_, err = inst.AddRefund(ctx, pending.ID, storage.Refund{AmountCents: 100})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+
+	// gives up once the context is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = inst.AddRefund(cancelled, order.ID, storage.Refund{AmountCents: 100})
+	assert.ErrorIs(t, err, context.Canceled)
+	got, err = inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Len(t, got.Refunds, 2)
+
+	// returns not found
+	_, err = inst.AddRefund(ctx, randomID("notfound"), storage.Refund{AmountCents: 100})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+	err = inst.SetRefundStatus(ctx, randomID("notfound"), "rf-1", storage.RefundStatusFailed, "")
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testPayments(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	order := newOrder(storage.OrderStatusCharged)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// payments are added in order and CreatedAt is filled in
+	charge := storage.Payment{
+		Kind:            storage.PaymentKindCharge,
+		AmountCents:     order.TotalCents(),
+		IdempotencyKey:  order.ID + ":charge:1",
+		CardFingerprint: "abcd",
+		Outcome:         storage.PaymentOutcomeFailed,
+		// this makes sure strings that look like field paths are stored as is
+		Error:     "$declined",
+		CreatedAt: now(),
+	}
+	require.NoError(t, inst.AddPayment(ctx, order.ID, charge))
+	retry := charge
+	retry.IdempotencyKey = order.ID + ":charge:2"
+	retry.Outcome = storage.PaymentOutcomeSucceeded
+	retry.ChargeReference = "ch_1"
+	retry.Error = ""
+	retry.CreatedAt = time.Time{}
+	require.NoError(t, inst.AddPayment(ctx, order.ID, retry))
+
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	if assert.Len(t, got.Payments, 2) {
+		assert.Equal(t, charge, got.Payments[0])
+		assert.WithinDuration(t, time.Now(), got.Payments[1].CreatedAt, time.Minute)
+		retry.CreatedAt = got.Payments[1].CreatedAt
+		assert.Equal(t, retry, got.Payments[1])
+	}
+
+	// returns not found
+	err = inst.AddPayment(ctx, randomID("notfound"), charge)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testAuthorizations(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	order := newOrder(storage.OrderStatusAuthorizing)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// authorizing moves the order to authorized and records the authorization
+	auth := storage.Authorization{ID: "auth_1", AmountCents: order.TotalCents(), ExpiresAt: now().Add(-time.Minute)}
+	require.NoError(t, inst.AuthorizeOrder(ctx, order.ID, auth))
+	got, err := inst.GetOrder(ctx, order.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.OrderStatusAuthorized, got.Status)
+	if assert.NotNil(t, got.Authorization) {
+		assert.Equal(t, auth, *got.Authorization)
+	}
+
+	// only orders that are authorizing can be authorized
+	err = inst.AuthorizeOrder(ctx, order.ID, auth)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrInvalidTransition), "%#v", err)
+	}
+	err = inst.AuthorizeOrder(ctx, randomID("notfound"), auth)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderNotFound), "%#v", err)
+	}
+
+	// an authorization that hasn't expired yet isn't returned
+	fresh := newOrder(storage.OrderStatusAuthorizing)
+	_, err = inst.InsertOrder(ctx, fresh)
+	require.NoError(t, err)
+	require.NoError(t, inst.AuthorizeOrder(ctx, fresh.ID, storage.Authorization{ID: "auth_2", ExpiresAt: now().Add(time.Hour)}))
+
+	expired, err := inst.GetExpiredAuthorizations(ctx, now())
+	require.NoError(t, err)
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, got, expired[0])
+	}
+
+	// orders that aren't authorized anymore aren't returned
+	_, err = inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusAuthorized}, storage.OrderStatusPending, "test")
+	require.NoError(t, err)
+	expired, err = inst.GetExpiredAuthorizations(ctx, now())
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testTimestamps(t *testing.T, inst mocks.StorageInstance) {
+	ctx := storage.WithActor(context.Background(), "test-actor")
+	order := newOrder(storage.OrderStatusCharged)
+	order.CreatedAt = now().Add(-time.Hour)
+	order.UpdatedAt = order.CreatedAt
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// updatedAfter asserts that the order was updated since the last call and
+	// that nothing changed when it was created
+	last := order.UpdatedAt
+	updatedAfter := func() storage.Order {
+		got, err := inst.GetOrder(ctx, order.ID)
+		require.NoError(t, err)
+		assert.True(t, got.UpdatedAt.After(last), "%v isn't after %v", got.UpdatedAt, last)
+		assert.Equal(t, order.CreatedAt, got.CreatedAt)
+		last = got.UpdatedAt
+		return got
+	}
+
+	// every change to the order updates it, not just status changes
+	err = inst.AddPayment(ctx, order.ID, storage.Payment{
+		Kind:        storage.PaymentKindCharge,
+		AmountCents: order.TotalCents(),
+		Outcome:     storage.PaymentOutcomeSucceeded,
+		CreatedAt:   order.CreatedAt,
+	})
+	require.NoError(t, err)
+	updatedAfter()
+
+	// wait so the next change is a different millisecond
+	time.Sleep(2 * time.Millisecond)
+	refunded, err := inst.AddRefund(ctx, order.ID, storage.Refund{AmountCents: 100})
+	require.NoError(t, err)
+	got := updatedAfter()
+	assert.WithinDuration(t, got.UpdatedAt, refunded.UpdatedAt, time.Millisecond)
+
+	time.Sleep(2 * time.Millisecond)
+	err = inst.SetRefundStatus(ctx, order.ID, refunded.Refunds[0].ID, storage.RefundStatusSucceeded, "ref")
+	require.NoError(t, err)
+	updatedAfter()
+
+	// fulfilling only some of the line items changes the status, which is
+	// recorded in the history
+	time.Sleep(2 * time.Millisecond)
+	fulfilled, err := fulfill(ctx, inst, order.ID, map[string]int64{"li-1": 1})
+	require.NoError(t, err)
+	got = updatedAfter()
+	// backends might store times with less precision than they return them
+	assert.WithinDuration(t, got.UpdatedAt, fulfilled.UpdatedAt, time.Millisecond)
+	assert.Len(t, fulfilled.StatusHistory, 2)
+	if assert.Len(t, got.StatusHistory, 2) {
+		change := storage.NewStatusChange(ctx, storage.OrderStatusCharged, storage.OrderStatusPartiallyFulfilled, got.UpdatedAt, "line items fulfilled")
+		assert.Equal(t, change, got.StatusHistory[1])
+	}
+	at, ok := got.EnteredStatusAt(storage.OrderStatusPartiallyFulfilled)
+	assert.True(t, ok)
+	assert.Equal(t, got.StatusUpdatedAt, at)
+
+	// fulfilling more without changing the status still updates the order
+	time.Sleep(2 * time.Millisecond)
+	_, err = fulfill(ctx, inst, order.ID, map[string]int64{"li-2": 1})
+	require.NoError(t, err)
+	got = updatedAfter()
+	assert.Len(t, got.StatusHistory, 2)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testOrderEvents(t *testing.T, inst mocks.StorageInstance) {
+	ctx := storage.WithActor(context.Background(), "test-actor")
+	order := newOrder(storage.OrderStatusPending)
+	_, err := inst.InsertOrder(ctx, order)
+	require.NoError(t, err)
+
+	// every change made through the storage methods is recorded
+	_, err = inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested")
+	require.NoError(t, err)
+	payment := storage.Payment{
+		Kind:            storage.PaymentKindCharge,
+		AmountCents:     order.TotalCents(),
+		Outcome:         storage.PaymentOutcomeSucceeded,
+		ChargeReference: "ch_1",
+		CreatedAt:       now(),
+	}
+	require.NoError(t, inst.AddPayment(ctx, order.ID, payment))
+	require.NoError(t, inst.SetOrderStatus(ctx, order.ID, storage.OrderStatusCharged, "charge succeeded"))
+	refunded, err := inst.AddRefund(ctx, order.ID, storage.Refund{AmountCents: 100, Reason: "damaged"})
+	require.NoError(t, err)
+	refundID := refunded.Refunds[0].ID
+	require.NoError(t, inst.SetRefundStatus(ctx, order.ID, refundID, storage.RefundStatusSucceeded, "ch_2"))
+	// a fulfillment that failed releases what it reserved
+	_, err = inst.ReserveLineItems(ctx, order.ID, map[string]int64{"li-1": 1})
+	require.NoError(t, err)
+	_, err = inst.ReleaseLineItems(ctx, order.ID, map[string]int64{"li-1": 1}, "out of stock")
+	require.NoError(t, err)
+	_, err = fulfill(ctx, inst, order.ID, map[string]int64{"li-1": 1, "li-2": 10})
+	require.NoError(t, err)
+
+	// changes that fail aren't recorded
+	_, err = inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested")
+	require.Error(t, err)
+
+	events, err := inst.GetOrderEvents(ctx, order.ID, "", 0)
+	require.NoError(t, err)
+	var types []storage.OrderEventType
+	for idx, event := range events {
+		types = append(types, event.Type)
+		assert.Equal(t, order.ID, event.OrderID)
+		assert.Equal(t, "test-actor", event.Actor)
+		assert.False(t, event.At.IsZero())
+		if idx > 0 {
+			assert.Greater(t, event.ID, events[idx-1].ID)
+		}
+	}
+	require.Equal(t, []storage.OrderEventType{
+		storage.OrderEventCreated,
+		storage.OrderEventStatusChanged,
+		storage.OrderEventPaymentRecorded,
+		storage.OrderEventStatusChanged,
+		storage.OrderEventRefundAdded,
+		storage.OrderEventRefundStatusChanged,
+		storage.OrderEventLineItemsReserved,
+		storage.OrderEventFulfillmentFailed,
+		storage.OrderEventLineItemsReserved,
+		storage.OrderEventLineItemsFulfilled,
+	}, types)
+	assert.Equal(t, order, *events[0].Order)
+	if change := events[1].StatusChange; assert.NotNil(t, change) {
+		assert.Equal(t, storage.OrderStatusPending, *change.From)
+		assert.Equal(t, storage.OrderStatusCharging, change.To)
+		assert.Equal(t, "charge requested", change.Reason)
+	}
+	assert.Equal(t, payment, *events[2].Payment)
+	if change := events[3].StatusChange; assert.NotNil(t, change) {
+		assert.Equal(t, storage.OrderStatusCharging, *change.From)
+		assert.Equal(t, storage.OrderStatusCharged, change.To)
+	}
+	assert.Equal(t, refundID, events[4].Refund.ID)
+	assert.Equal(t, "damaged", events[4].Refund.Reason)
+	assert.Equal(t, refundID, events[5].Refund.ID)
+	assert.Equal(t, storage.RefundStatusSucceeded, events[5].Refund.Status)
+	assert.Equal(t, "ch_2", events[5].Refund.ChargeReference)
+	assert.Equal(t, map[string]int64{"li-1": 1}, events[6].Quantities)
+	assert.Equal(t, map[string]int64{"li-1": 1}, events[7].Quantities)
+	assert.Equal(t, "out of stock", events[7].Error)
+	assert.Equal(t, map[string]int64{"li-1": 1, "li-2": 10}, events[8].Quantities)
+	assert.Nil(t, events[8].StatusChange)
+	assert.Equal(t, map[string]int64{"li-1": 1, "li-2": 10}, events[9].Quantities)
+	if change := events[9].StatusChange; assert.NotNil(t, change) {
+		assert.Equal(t, storage.OrderStatusFulfilled, change.To)
+	}
+
+	// pages through the events after the given one
+	page, err := inst.GetOrderEvents(ctx, order.ID, "", 3)
+	require.NoError(t, err)
+	assert.Equal(t, events[:3], page)
+	page, err = inst.GetOrderEvents(ctx, order.ID, page[2].ID, 3)
+	require.NoError(t, err)
+	assert.Equal(t, events[3:6], page)
+	page, err = inst.GetOrderEvents(ctx, order.ID, events[len(events)-1].ID, 3)
+	require.NoError(t, err)
+	assert.Empty(t, page)
+
+	// authorizing is recorded with the authorization
+	order2 := newOrder(storage.OrderStatusAuthorizing)
+	_, err = inst.InsertOrder(ctx, order2)
+	require.NoError(t, err)
+	auth := storage.Authorization{ID: "auth_1", AmountCents: order2.TotalCents(), ExpiresAt: now().Add(time.Hour)}
+	require.NoError(t, inst.AuthorizeOrder(ctx, order2.ID, auth))
+	events, err = inst.GetOrderEvents(ctx, order2.ID, "", 0)
+	require.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, storage.OrderEventAuthorized, events[1].Type)
+		assert.Equal(t, auth, *events[1].Authorization)
+		assert.Equal(t, storage.OrderStatusAuthorized, events[1].StatusChange.To)
+	}
+
+	// orders that don't exist have no events
+	events, err = inst.GetOrderEvents(ctx, randomID("notfound"), "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func testOutboxCursors(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	_, err := inst.InsertOrder(ctx, newOrder(storage.OrderStatusPending))
+	require.NoError(t, err)
+	last, err := inst.GetLastOrderEventSeq(ctx)
+	require.NoError(t, err)
+
+	// a new sink's cursor starts after the newest event
+	sink := randomID("sink")
+	start := now()
+	cursor, err := inst.ClaimOutboxCursor(ctx, sink, "owner1", start, start.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, sink, cursor.Sink)
+	assert.Equal(t, last, cursor.Seq)
+	assert.Equal(t, "owner1", cursor.Owner)
+	assert.True(t, start.Add(time.Minute).Equal(cursor.LeaseExpiresAt))
+
+	// nobody else can claim it until the lease expires
+	_, err = inst.ClaimOutboxCursor(ctx, sink, "owner2", start, start.Add(time.Minute))
+	assert.ErrorIs(t, err, storage.ErrOutboxCursorClaimed)
+
+	// the owner can move it and renew the lease
+	cursor.Seq = last + 10
+	cursor.LeaseExpiresAt = start.Add(2 * time.Minute)
+	require.NoError(t, inst.UpdateOutboxCursor(ctx, cursor))
+	cursor, err = inst.ClaimOutboxCursor(ctx, sink, "owner1", start, start.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, last+10, cursor.Seq)
+
+	// once the lease expires someone else can take over where it was left and
+	// the previous owner can't move it anymore
+	later := start.Add(3 * time.Minute)
+	taken, err := inst.ClaimOutboxCursor(ctx, sink, "owner2", later, later.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, last+10, taken.Seq)
+	assert.Equal(t, "owner2", taken.Owner)
+	cursor.Seq = last + 20
+	assert.ErrorIs(t, inst.UpdateOutboxCursor(ctx, cursor), storage.ErrOutboxCursorClaimed)
+
+	// releasing the lease lets someone else take over straight away
+	taken.LeaseExpiresAt = time.Time{}
+	require.NoError(t, inst.UpdateOutboxCursor(ctx, taken))
+	cursor, err = inst.ClaimOutboxCursor(ctx, sink, "owner1", later, later.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, last+10, cursor.Seq)
+
+	// every sink has its own cursor
+	other, err := inst.ClaimOutboxCursor(ctx, randomID("sink"), "owner2", later, later.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, last, other.Seq)
+
+	// a sink that was never claimed can't be updated
+	err = inst.UpdateOutboxCursor(ctx, storage.OutboxCursor{Sink: randomID("sink"), Owner: "owner1"})
+	assert.ErrorIs(t, err, storage.ErrOutboxCursorClaimed)
+}
+
+func testOrderEventsAfterSeq(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+
+	// there's no last event until something happens
+	last, err := inst.GetLastOrderEventSeq(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, last)
+	events, err := inst.GetOrderEventsAfterSeq(ctx, "", 0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	order1 := newOrder(storage.OrderStatusPending)
+	_, err = inst.InsertOrder(ctx, order1)
+	require.NoError(t, err)
+	order2 := newOrder(storage.OrderStatusPending)
+	_, err = inst.InsertOrder(ctx, order2)
+	require.NoError(t, err)
+	require.NoError(t, inst.SetOrderStatus(ctx, order1.ID, storage.OrderStatusCancelled, "cancelled"))
+
+	// events are returned in order of their Seq across orders
+	events, err = inst.GetOrderEventsAfterSeq(ctx, "", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, order1.ID, events[0].OrderID)
+	assert.Equal(t, storage.OrderEventCreated, events[0].Type)
+	assert.Equal(t, order2.ID, events[1].OrderID)
+	assert.Equal(t, storage.OrderEventCreated, events[1].Type)
+	assert.Equal(t, order1.ID, events[2].OrderID)
+	assert.Equal(t, storage.OrderEventStatusChanged, events[2].Type)
+	assert.Positive(t, events[0].Seq)
+	assert.Greater(t, events[1].Seq, events[0].Seq)
+	assert.Greater(t, events[2].Seq, events[1].Seq)
+	last, err = inst.GetLastOrderEventSeq(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, events[2].Seq, last)
+
+	page, err := inst.GetOrderEventsAfterSeq(ctx, "", 0, 2)
+	require.NoError(t, err)
+	if assert.Len(t, page, 2) {
+		assert.Equal(t, events[0].ID, page[0].ID)
+		assert.Equal(t, events[1].ID, page[1].ID)
+	}
+
+	// paging picks up after the cursor
+	page, err = inst.GetOrderEventsAfterSeq(ctx, "", events[1].Seq, 2)
+	require.NoError(t, err)
+	assert.Equal(t, events[2:], page)
+	page, err = inst.GetOrderEventsAfterSeq(ctx, "", last, 0)
+	require.NoError(t, err)
+	assert.Empty(t, page)
+
+	// only the order's own events are returned when it's given
+	page, err = inst.GetOrderEventsAfterSeq(ctx, order1.ID, events[0].Seq, 0)
+	require.NoError(t, err)
+	assert.Equal(t, events[2:], page)
+	page, err = inst.GetOrderEventsAfterSeq(ctx, order2.ID, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, events[1:2], page)
+
+	// events recorded at the same time still each get their own Seq and none
+	// of them are skipped by reading forward from the last one
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := inst.InsertOrder(ctx, newOrder(storage.OrderStatusPending))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	page, err = inst.GetOrderEventsAfterSeq(ctx, "", last, 0)
+	require.NoError(t, err)
+	require.Len(t, page, 10)
+	for n := 1; n < len(page); n++ {
+		assert.Greater(t, page[n].Seq, page[n-1].Seq)
+	}
+	last, err = inst.GetLastOrderEventSeq(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, page[9].Seq, last)
+
+	// every write to any order takes the next Seq from the same counter, so
+	// writes to different orders at once contend on it, but that only makes
+	// them retry and they all succeed without leaving gaps between the Seqs
+	const orders, changes = 20, 5
+	for n := 0; n < orders; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := inst.InsertOrder(ctx, newOrder(storage.OrderStatusPending))
+			if !assert.NoError(t, err) {
+				return
+			}
+			for c := 0; c < changes; c++ {
+				assert.NoError(t, inst.SetOrderStatus(ctx, id, storage.OrderStatusPending, "contention"))
+			}
+		}()
+	}
+	wg.Wait()
+	page, err = inst.GetOrderEventsAfterSeq(ctx, "", last, 0)
+	require.NoError(t, err)
+	require.Len(t, page, orders*(changes+1))
+	for n := 1; n < len(page); n++ {
+		assert.Equal(t, page[n-1].Seq+1, page[n].Seq)
+	}
+}
+
+func testWebhooks(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+
+	// subscriptions get an ID and are returned oldest first
+	sub1 := storage.WebhookSubscription{
+		URL:        "https://example.com/hook1",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated},
+		Secret:     "secret1",
+		CreatedAt:  now(),
+	}
+	id, err := inst.InsertWebhookSubscription(ctx, sub1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+	sub1.ID = id
+	sub2 := storage.WebhookSubscription{
+		ID:         randomID("wh"),
+		URL:        "https://example.com/hook2",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCharged, storage.WebhookEventOrderCancelled},
+		Secret:     "secret2",
+		CreatedAt:  now().Add(time.Millisecond),
+	}
+	_, err = inst.InsertWebhookSubscription(ctx, sub2)
+	require.NoError(t, err)
+	_, err = inst.InsertWebhookSubscription(ctx, sub2)
+	assert.True(t, errors.Is(err, storage.ErrWebhookSubscriptionExists), "%#v", err)
+
+	got, err := inst.GetWebhookSubscription(ctx, sub1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, sub1, got)
+	subs, err := inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookSubscription{sub1, sub2}, subs)
+	_, err = inst.GetWebhookSubscription(ctx, randomID("notfound"))
+	assert.True(t, errors.Is(err, storage.ErrWebhookSubscriptionNotFound), "%#v", err)
+
+	// adding the same delivery twice only keeps the first
+	created := now()
+	newDelivery := func(eventID, subID string) storage.WebhookDelivery {
+		return storage.WebhookDelivery{
+			ID:             storage.WebhookDeliveryID(eventID, subID),
+			SubscriptionID: subID,
+			EventID:        eventID,
+			OrderID:        "order-1",
+			Type:           storage.WebhookEventOrderCharged,
+			Payload:        []byte(`{"id":"` + eventID + `"}`),
+			Status:         storage.WebhookDeliveryStatusPending,
+			NextAttemptAt:  created,
+			CreatedAt:      created,
+			UpdatedAt:      created,
+		}
+	}
+	d1 := newDelivery("ev-1", sub2.ID)
+	d2 := newDelivery("ev-2", sub2.ID)
+	d3 := newDelivery("ev-3", sub2.ID)
+	d3.NextAttemptAt = created.Add(time.Hour)
+	require.NoError(t, inst.AddWebhookDeliveries(ctx, []storage.WebhookDelivery{d2, d1}))
+	dupe := d1
+	dupe.Payload = []byte(`{}`)
+	require.NoError(t, inst.AddWebhookDeliveries(ctx, []storage.WebhookDelivery{dupe, d3}))
+	require.NoError(t, inst.AddWebhookDeliveries(ctx, nil))
+
+	// only pending deliveries that are due are claimed, oldest first, and a
+	// claimed delivery isn't due again until its lease expires
+	lease := created.Add(time.Minute)
+	claimed, err := inst.ClaimDueWebhookDelivery(ctx, created, lease, nil, nil)
+	require.NoError(t, err)
+	want := d1
+	want.NextAttemptAt = lease
+	assert.Equal(t, want, claimed)
+	// deliveries to excluded subscriptions are skipped
+	_, err = inst.ClaimDueWebhookDelivery(ctx, created, lease, []string{sub2.ID}, nil)
+	assert.ErrorIs(t, err, storage.ErrWebhookDeliveryNotFound)
+	claimed, err = inst.ClaimDueWebhookDelivery(ctx, created, lease, []string{randomID("sub")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, d2.ID, claimed.ID)
+	_, err = inst.ClaimDueWebhookDelivery(ctx, created, lease, nil, nil)
+	assert.ErrorIs(t, err, storage.ErrWebhookDeliveryNotFound)
+	// an expired lease makes the delivery due again
+	// skipped deliveries aren't claimed even when they're due
+	claimed, err = inst.ClaimDueWebhookDelivery(ctx, lease, lease.Add(time.Minute), nil, []string{d1.ID})
+	require.NoError(t, err)
+	assert.Equal(t, d2.ID, claimed.ID)
+	claimed, err = inst.ClaimDueWebhookDelivery(ctx, lease, lease.Add(time.Minute), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, d1.ID, claimed.ID)
+
+	// attempts are recorded on the delivery
+	failed := storage.WebhookAttempt{At: created, StatusCode: 500, Error: "unexpected response status 500"}
+	require.NoError(t, inst.RecordWebhookAttempt(ctx, d1.ID, failed, storage.WebhookDeliveryStatusPending, created.Add(time.Minute)))
+	succeeded := storage.WebhookAttempt{At: created.Add(time.Minute), StatusCode: 200}
+	require.NoError(t, inst.RecordWebhookAttempt(ctx, d1.ID, succeeded, storage.WebhookDeliveryStatusSucceeded, created.Add(time.Minute)))
+	require.NoError(t, inst.RecordWebhookAttempt(ctx, d2.ID, failed, storage.WebhookDeliveryStatusDead, created))
+	err = inst.RecordWebhookAttempt(ctx, randomID("notfound"), failed, storage.WebhookDeliveryStatusDead, created)
+	assert.True(t, errors.Is(err, storage.ErrWebhookDeliveryNotFound), "%#v", err)
+	claimed, err = inst.ClaimDueWebhookDelivery(ctx, created.Add(time.Hour), created.Add(2*time.Hour), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, d3.ID, claimed.ID)
+	_, err = inst.ClaimDueWebhookDelivery(ctx, created.Add(time.Hour), created.Add(2*time.Hour), nil, nil)
+	assert.ErrorIs(t, err, storage.ErrWebhookDeliveryNotFound)
+
+	// the delivery log can be filtered by status and paged through
+	deliveries, err := inst.GetWebhookDeliveries(ctx, sub2.ID, "", "", 0)
+	require.NoError(t, err)
+	if assert.Len(t, deliveries, 3) {
+		assert.Equal(t, d1.ID, deliveries[0].ID)
+		assert.Equal(t, d1.Payload, deliveries[0].Payload)
+		assert.Equal(t, storage.WebhookDeliveryStatusSucceeded, deliveries[0].Status)
+		assert.Equal(t, []storage.WebhookAttempt{failed, succeeded}, deliveries[0].Attempts)
+		assert.Equal(t, d2.ID, deliveries[1].ID)
+		assert.Equal(t, d3.ID, deliveries[2].ID)
+		assert.Empty(t, deliveries[2].Attempts)
+	}
+	dead, err := inst.GetWebhookDeliveries(ctx, sub2.ID, storage.WebhookDeliveryStatusDead, "", 0)
+	require.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, d2.ID, dead[0].ID)
+		assert.Equal(t, []storage.WebhookAttempt{failed}, dead[0].Attempts)
+	}
+	page, err := inst.GetWebhookDeliveries(ctx, sub2.ID, "", d1.ID, 1)
+	require.NoError(t, err)
+	if assert.Len(t, page, 1) {
+		assert.Equal(t, d2.ID, page[0].ID)
+	}
+	none, err := inst.GetWebhookDeliveries(ctx, sub1.ID, "", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	// deleting a subscription keeps its deliveries
+	require.NoError(t, inst.DeleteWebhookSubscription(ctx, sub2.ID))
+	err = inst.DeleteWebhookSubscription(ctx, sub2.ID)
+	assert.True(t, errors.Is(err, storage.ErrWebhookSubscriptionNotFound), "%#v", err)
+	subs, err = inst.GetWebhookSubscriptions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WebhookSubscription{sub1}, subs)
+	deliveries, err = inst.GetWebhookDeliveries(ctx, sub2.ID, "", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, deliveries, 3)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testInsertOrder(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	order1 := newOrder(storage.OrderStatusCharged)
+	id, err := inst.InsertOrder(ctx, order1)
+	require.NoError(t, err)
+	assert.Equal(t, order1.ID, id)
+
+	// returns exists
+	_, err = inst.InsertOrder(ctx, order1)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrOrderExists), "%#v", err)
+	}
+
+	// fills in an ID, the line item IDs, the timestamps and the initial status
+	// history
+	order2 := newOrder(storage.OrderStatusPending)
+	order2.ID = ""
+	order2.StatusUpdatedAt = time.Time{}
+	order2.CreatedAt = time.Time{}
+	order2.UpdatedAt = time.Time{}
+	order2.StatusHistory = nil
+	for idx := range order2.LineItems {
+		order2.LineItems[idx].ID = ""
+	}
+	actorCtx := storage.WithActor(ctx, "test-actor")
+	id, err = inst.InsertOrder(actorCtx, order2)
+	require.NoError(t, err)
+	if assert.NotEmpty(t, id) {
+		order2.ID = id
+		got, err := inst.GetOrder(ctx, id)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), got.CreatedAt, time.Minute)
+		order2.CreatedAt = got.CreatedAt
+		order2.UpdatedAt = got.CreatedAt
+		order2.StatusUpdatedAt = got.CreatedAt
+		order2.StatusHistory = []storage.StatusChange{{
+			To:    storage.OrderStatusPending,
+			At:    got.CreatedAt,
+			Actor: "test-actor",
+		}}
+		// the caller's line items aren't modified
+		assert.Empty(t, order2.LineItems[0].ID)
+		order2.LineItems[0].ID = "li-1"
+		order2.LineItems[1].ID = "li-2"
+		assert.Equal(t, order2, got)
+	}
+
+	// generated IDs are unique
+	id2, err := inst.InsertOrder(ctx, storage.Order{CustomerEmail: "test@test"})
+	require.NoError(t, err)
+	assert.NotEqual(t, id, id2)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testIdempotencyKeys(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	rec := storage.IdempotencyRecord{
+		Key:         randomID("key"),
+		Token:       randomID("token"),
+		Fingerprint: "fingerprint",
+		CreatedAt:   now(),
+		ExpiresAt:   now().Add(time.Hour),
+	}
+
+	// returns not found
+	_, err := inst.GetIdempotencyKey(ctx, rec.Key)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	err = inst.CompleteIdempotencyKey(ctx, rec.Key, rec.Token, 200, "application/json", []byte("{}"), now().Add(time.Hour))
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+
+	// reserving stores an uncompleted record
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, rec))
+	got, err := inst.GetIdempotencyKey(ctx, rec.Key)
+	require.NoError(t, err)
+	assert.Equal(t, rec.Fingerprint, got.Fingerprint)
+	assert.Equal(t, rec.Token, got.Token)
+	assert.False(t, got.Completed)
+	assert.True(t, rec.ExpiresAt.Equal(got.ExpiresAt), "%v != %v", rec.ExpiresAt, got.ExpiresAt)
+
+	// returns exists
+	err = inst.ReserveIdempotencyKey(ctx, rec)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyExists), "%#v", err)
+	}
+
+	// only the reservation's token can complete or delete it
+	err = inst.CompleteIdempotencyKey(ctx, rec.Key, randomID("token"), 200, "application/json", []byte("{}"), now().Add(time.Hour))
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, rec.Key, randomID("token")))
+	got, err = inst.GetIdempotencyKey(ctx, rec.Key)
+	require.NoError(t, err)
+	assert.False(t, got.Completed)
+
+	// completing stores the response and replaces the expiration
+	completedExpiresAt := now().Add(24 * time.Hour)
+	require.NoError(t, inst.CompleteIdempotencyKey(ctx, rec.Key, rec.Token, 201, "application/json", []byte(`{"ok":true}`), completedExpiresAt))
+	got, err = inst.GetIdempotencyKey(ctx, rec.Key)
+	require.NoError(t, err)
+	assert.True(t, got.Completed)
+	assert.Equal(t, 201, got.StatusCode)
+	assert.Equal(t, "application/json", got.ContentType)
+	assert.Equal(t, []byte(`{"ok":true}`), got.Body)
+	assert.True(t, completedExpiresAt.Equal(got.ExpiresAt), "%v != %v", completedExpiresAt, got.ExpiresAt)
+
+	// a completed record can't be completed again or deleted
+	err = inst.CompleteIdempotencyKey(ctx, rec.Key, rec.Token, 500, "application/json", []byte("{}"), now().Add(time.Hour))
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, rec.Key, rec.Token))
+	got, err = inst.GetIdempotencyKey(ctx, rec.Key)
+	require.NoError(t, err)
+	assert.Equal(t, 201, got.StatusCode)
+
+	// deleting a reservation lets the key be reserved again and deleting twice
+	// is fine
+	deleted := rec
+	deleted.Key = randomID("key")
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, deleted))
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, deleted.Key, deleted.Token))
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, deleted.Key, deleted.Token))
+	_, err = inst.GetIdempotencyKey(ctx, deleted.Key)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, deleted))
+
+	// expired records aren't returned and can be reserved again
+	expired := storage.IdempotencyRecord{
+		Key:         randomID("key"),
+		Fingerprint: "fingerprint",
+		CreatedAt:   now().Add(-2 * time.Hour),
+		ExpiresAt:   now().Add(-time.Hour),
+	}
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, expired))
+	_, err = inst.GetIdempotencyKey(ctx, expired.Key)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	expired.Fingerprint = "other"
+	expired.ExpiresAt = now().Add(time.Hour)
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, expired))
+	got, err = inst.GetIdempotencyKey(ctx, expired.Key)
+	require.NoError(t, err)
+	assert.Equal(t, "other", got.Fingerprint)
+
+	// a reservation that was never completed can be taken over once its lease
+	// runs out
+	abandoned := storage.IdempotencyRecord{
+		Key:         randomID("key"),
+		Fingerprint: "fingerprint",
+		CreatedAt:   now(),
+		ExpiresAt:   now().Add(50 * time.Millisecond),
+	}
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, abandoned))
+	err = inst.ReserveIdempotencyKey(ctx, abandoned)
+	assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyExists), "%#v", err)
+	time.Sleep(100 * time.Millisecond)
+	takeover := abandoned
+	takeover.Token = randomID("token")
+	takeover.ExpiresAt = now().Add(time.Hour)
+	require.NoError(t, inst.ReserveIdempotencyKey(ctx, takeover))
+	// and the request that abandoned it can't touch the new reservation
+	err = inst.CompleteIdempotencyKey(ctx, abandoned.Key, abandoned.Token, 200, "application/json", []byte("{}"), now().Add(time.Hour))
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, storage.ErrIdempotencyKeyNotFound), "%#v", err)
+	}
+	require.NoError(t, inst.DeleteIdempotencyKey(ctx, abandoned.Key, abandoned.Token))
+	got, err = inst.GetIdempotencyKey(ctx, abandoned.Key)
+	require.NoError(t, err)
+	assert.Equal(t, takeover.Token, got.Token)
+	assert.False(t, got.Completed)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func testConcurrentWrites(t *testing.T, inst mocks.StorageInstance) {
+	ctx := context.Background()
+	const n = 10
+
+	// inserting the same ID concurrently only succeeds once
+	order := newOrder(storage.OrderStatusPending)
+	var inserted, exists int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := inst.InsertOrder(ctx, order)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				inserted++
+			case errors.Is(err, storage.ErrOrderExists):
+				exists++
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, inserted)
+	assert.EqualValues(t, n-1, exists)
+
+	// inserting different orders concurrently doesn't lose any of them
+	ids := make([]string, n)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := inst.InsertOrder(ctx, storage.Order{
+				CustomerEmail: "test@test",
+				Status:        storage.OrderStatusPending,
+			})
+			assert.NoError(t, err)
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		_, err := inst.GetOrder(ctx, id)
+		assert.NoError(t, err, "order %q was lost", id)
+	}
+
+	// updating different orders concurrently only touches each one
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assert.NoError(t, inst.SetOrderStatus(ctx, id, storage.OrderStatusCharged, "test"))
+		}(id)
+	}
+	wg.Wait()
+	got, _, err := inst.GetOrders(ctx, statusQuery(storage.OrderStatusCharged), storage.OrderPage{})
+	require.NoError(t, err)
+	assert.Len(t, got, n)
+
+	// transitioning the same order concurrently only succeeds once
+	var transitioned, invalid int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := inst.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharged, "test")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				transitioned++
+			case errors.Is(err, storage.ErrInvalidTransition):
+				invalid++
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, transitioned)
+	assert.EqualValues(t, n-1, invalid)
+
+	// fulfilling the same order concurrently doesn't lose any progress
+	fulfilling := newOrder(storage.OrderStatusCharged)
+	_, err = inst.InsertOrder(ctx, fulfilling)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fulfill(ctx, inst, fulfilling.ID, map[string]int64{"li-2": 1})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	fulfilled, err := inst.GetOrder(ctx, fulfilling.ID)
+	require.NoError(t, err)
+	assert.EqualValues(t, n, fulfilled.LineItems[1].FulfilledQuantity)
+	assert.EqualValues(t, 0, fulfilled.LineItems[1].ReservedQuantity)
+	assert.Equal(t, storage.OrderStatusPartiallyFulfilled, fulfilled.Status)
+
+	// reserving the same line items concurrently only succeeds once so they
+	// can't be shipped twice
+	reserving := newOrder(storage.OrderStatusCharged)
+	_, err = inst.InsertOrder(ctx, reserving)
+	require.NoError(t, err)
+	var reserved, unavailable int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := inst.ReserveLineItems(ctx, reserving.ID, map[string]int64{"li-2": 10})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				reserved++
+			case errors.Is(err, storage.ErrInvalidFulfillment):
+				unavailable++
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, reserved)
+	assert.EqualValues(t, n-1, unavailable)
+
+	// refunding the same order concurrently never refunds more than its total
+	refunding := newOrder(storage.OrderStatusCharged)
+	_, err = inst.InsertOrder(ctx, refunding)
+	require.NoError(t, err)
+	var added, rejected int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// only half of these fit in the order's total
+			_, err := inst.AddRefund(ctx, refunding.ID, storage.Refund{AmountCents: refunding.TotalCents() * 2 / n})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				added++
+			case errors.Is(err, storage.ErrInvalidRefund):
+				rejected++
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, n/2, added)
+	assert.EqualValues(t, n/2, rejected)
+	refunded, err := inst.GetOrder(ctx, refunding.ID)
+	require.NoError(t, err)
+	assert.Len(t, refunded.Refunds, n/2)
+	assert.EqualValues(t, 0, refunded.NetCents())
+}
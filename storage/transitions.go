@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// orderTransitions is the order state machine. It maps every status to the
+// statuses an order in that status is allowed to move to. Statuses without an
+// entry are final.
+// charging, refunding, authorizing, capturing and voiding are written before
+// calling the charge service and move back to where they came from if the call
+// fails
+// authorized orders move back to pending once their authorization expires
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:            {OrderStatusCharging, OrderStatusAuthorizing, OrderStatusCancelled},
+	OrderStatusCharging:           {OrderStatusCharged, OrderStatusPending},
+	OrderStatusCharged:            {OrderStatusFulfilled, OrderStatusPartiallyFulfilled, OrderStatusRefunding},
+	OrderStatusRefunding:          {OrderStatusCancelled, OrderStatusCharged},
+	OrderStatusPartiallyFulfilled: {OrderStatusFulfilled},
+	OrderStatusAuthorizing:        {OrderStatusAuthorized, OrderStatusPending},
+	OrderStatusAuthorized:         {OrderStatusCapturing, OrderStatusVoiding, OrderStatusPending},
+	OrderStatusCapturing:          {OrderStatusCharged, OrderStatusAuthorized},
+	OrderStatusVoiding:            {OrderStatusCancelled, OrderStatusAuthorized},
+}
+
+// orderStatusNames are the names used for statuses in query parameters and
+// anywhere else a human reads them
+var orderStatusNames = map[OrderStatus]string{
+	OrderStatusPending:            "pending",
+	OrderStatusCharged:            "charged",
+	OrderStatusFulfilled:          "fulfilled",
+	OrderStatusCancelled:          "cancelled",
+	OrderStatusCharging:           "charging",
+	OrderStatusRefunding:          "refunding",
+	OrderStatusPartiallyFulfilled: "partiallyFulfilled",
+	OrderStatusAuthorizing:        "authorizing",
+	OrderStatusAuthorized:         "authorized",
+	OrderStatusCapturing:          "capturing",
+	OrderStatusVoiding:            "voiding",
+}
+
+// String implements the fmt.Stringer interface and returns the status's name
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("OrderStatus(%d)", int64(s))
+}
+
+// ParseOrderStatus returns the status with the given name, which is the value
+// returned by String
+func ParseOrderStatus(name string) (OrderStatus, error) {
+	for status, n := range orderStatusNames {
+		if n == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown order status: %q", name)
+}
+
+// StartsPaymentAttempt returns true if moving an order to the status means
+// we're about to call the charge service, which TransitionOrderStatus counts in
+// the order's PaymentAttempts
+func StartsPaymentAttempt(status OrderStatus) bool {
+	switch status {
+	case OrderStatusCharging, OrderStatusRefunding, OrderStatusAuthorizing, OrderStatusCapturing, OrderStatusVoiding:
+		return true
+	default:
+		return false
+	}
+}
+
+// BlockedByReservations returns true if an order can't be moved to the status
+// while any of its line items are reserved, since those are being shipped and
+// the order can't be refunded or cancelled out from under them
+func BlockedByReservations(status OrderStatus) bool {
+	switch status {
+	case OrderStatusRefunding, OrderStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// CanTransition returns true if an order in the from status is allowed to move
+// to the to status
+func CanTransition(from, to OrderStatus) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStatuses returns every status an order in the from status is allowed to
+// move to. It returns an empty slice for final statuses.
+func NextStatuses(from OrderStatus) []OrderStatus {
+	// copy so callers can't modify the table
+	return append([]OrderStatus{}, orderTransitions[from]...)
+}
+
+// PreviousStatuses returns every status an order is allowed to move to the to
+// status from, sorted from lowest to highest. This is what should be passed as
+// the from statuses to TransitionOrderStatus.
+func PreviousStatuses(to OrderStatus) []OrderStatus {
+	var prev []OrderStatus
+	for from := range orderTransitions {
+		if CanTransition(from, to) {
+			prev = append(prev, from)
+		}
+	}
+	// the map is iterated in a random order so sort to be deterministic
+	sort.Slice(prev, func(i, j int) bool {
+		return prev[i] < prev[j]
+	})
+	return prev
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, CanTransition(OrderStatusPending, OrderStatusCharging))
+	assert.True(t, CanTransition(OrderStatusCharging, OrderStatusCharged))
+	assert.True(t, CanTransition(OrderStatusCharging, OrderStatusPending))
+	assert.True(t, CanTransition(OrderStatusPending, OrderStatusCancelled))
+	assert.True(t, CanTransition(OrderStatusCharged, OrderStatusFulfilled))
+	assert.True(t, CanTransition(OrderStatusCharged, OrderStatusRefunding))
+	assert.True(t, CanTransition(OrderStatusRefunding, OrderStatusCancelled))
+	assert.True(t, CanTransition(OrderStatusRefunding, OrderStatusCharged))
+	assert.True(t, CanTransition(OrderStatusCharged, OrderStatusPartiallyFulfilled))
+	assert.True(t, CanTransition(OrderStatusPartiallyFulfilled, OrderStatusFulfilled))
+	assert.True(t, CanTransition(OrderStatusPending, OrderStatusAuthorizing))
+	assert.True(t, CanTransition(OrderStatusAuthorizing, OrderStatusAuthorized))
+	assert.True(t, CanTransition(OrderStatusAuthorized, OrderStatusCapturing))
+	assert.True(t, CanTransition(OrderStatusCapturing, OrderStatusCharged))
+	assert.True(t, CanTransition(OrderStatusAuthorized, OrderStatusVoiding))
+	assert.True(t, CanTransition(OrderStatusVoiding, OrderStatusCancelled))
+	// expired authorizations go back to pending
+	assert.True(t, CanTransition(OrderStatusAuthorized, OrderStatusPending))
+
+	// can't skip charging or refunding
+	assert.False(t, CanTransition(OrderStatusPending, OrderStatusCharged))
+	assert.False(t, CanTransition(OrderStatusPending, OrderStatusFulfilled))
+	assert.False(t, CanTransition(OrderStatusCharged, OrderStatusCancelled))
+	assert.False(t, CanTransition(OrderStatusAuthorized, OrderStatusCharged))
+	assert.False(t, CanTransition(OrderStatusAuthorized, OrderStatusFulfilled))
+	// can't go backwards
+	assert.False(t, CanTransition(OrderStatusCharged, OrderStatusPending))
+	// final statuses can't go anywhere
+	for status := range orderStatusNames {
+		assert.False(t, CanTransition(OrderStatusFulfilled, status), "%v", status)
+		assert.False(t, CanTransition(OrderStatusCancelled, status), "%v", status)
+	}
+}
+
+func TestNextStatuses(t *testing.T) {
+	assert.ElementsMatch(t, []OrderStatus{OrderStatusCharging, OrderStatusAuthorizing, OrderStatusCancelled}, NextStatuses(OrderStatusPending))
+	assert.Empty(t, NextStatuses(OrderStatusFulfilled))
+
+	// modifying the result doesn't modify the table
+	next := NextStatuses(OrderStatusPending)
+	next[0] = OrderStatusFulfilled
+	assert.False(t, CanTransition(OrderStatusPending, OrderStatusFulfilled))
+}
+
+func TestPreviousStatuses(t *testing.T) {
+	assert.Equal(t, []OrderStatus{OrderStatusPending}, PreviousStatuses(OrderStatusCharging))
+	assert.Equal(t, []OrderStatus{OrderStatusCharging, OrderStatusRefunding, OrderStatusCapturing}, PreviousStatuses(OrderStatusCharged))
+	assert.Equal(t, []OrderStatus{OrderStatusPending, OrderStatusRefunding, OrderStatusVoiding}, PreviousStatuses(OrderStatusCancelled))
+	assert.Equal(t, []OrderStatus{OrderStatusCharging, OrderStatusAuthorizing, OrderStatusAuthorized}, PreviousStatuses(OrderStatusPending))
+	assert.Equal(t, []OrderStatus{OrderStatusPending}, PreviousStatuses(OrderStatusAuthorizing))
+	assert.Equal(t, []OrderStatus{OrderStatusCharged, OrderStatusPartiallyFulfilled}, PreviousStatuses(OrderStatusFulfilled))
+}
+
+func TestParseOrderStatus(t *testing.T) {
+	for status := range orderStatusNames {
+		got, err := ParseOrderStatus(status.String())
+		require.NoError(t, err)
+		assert.Equal(t, status, got)
+	}
+
+	_, err := ParseOrderStatus("unknown")
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrWebhookSubscriptionNotFound is returned when the specified webhook
+	// subscription cannot be found
+	ErrWebhookSubscriptionNotFound = errors.New("webhook subscription not found")
+
+	// ErrWebhookSubscriptionExists is returned when a new webhook subscription is
+	// being inserted but one with the same ID already exists
+	ErrWebhookSubscriptionExists = errors.New("webhook subscription already exists")
+
+	// ErrWebhookDeliveryNotFound is returned when the specified webhook delivery
+	// cannot be found
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// WebhookEventType is the kind of order change a webhook subscription can be
+// notified about
+type WebhookEventType string
+
+const (
+	// WebhookEventOrderCreated is sent when an order is inserted
+	WebhookEventOrderCreated WebhookEventType = "order.created"
+	// WebhookEventOrderCharged is sent when an order moves to charged, which
+	// includes authorized orders being captured
+	WebhookEventOrderCharged WebhookEventType = "order.charged"
+	// WebhookEventOrderFulfilled is sent when every line item of an order has
+	// been fulfilled
+	WebhookEventOrderFulfilled WebhookEventType = "order.fulfilled"
+	// WebhookEventOrderCancelled is sent when an order moves to cancelled
+	WebhookEventOrderCancelled WebhookEventType = "order.cancelled"
+)
+
+// WebhookEventTypes lists every WebhookEventType a subscription can ask for
+var WebhookEventTypes = []WebhookEventType{
+	WebhookEventOrderCreated,
+	WebhookEventOrderCharged,
+	WebhookEventOrderFulfilled,
+	WebhookEventOrderCancelled,
+}
+
+// MaxWebhookDeliveriesLimit is the most deliveries GetWebhookDeliveries and
+// GetDueWebhookDeliveries return at once
+const MaxWebhookDeliveriesLimit = 1000
+
+// WebhookSubscription is a URL that's sent a request whenever one of its
+// EventTypes happens to any order
+type WebhookSubscription struct {
+	ID         string             `json:"id"`
+	URL        string             `json:"url"`
+	EventTypes []WebhookEventType `json:"eventTypes"`
+	// Secret is used to sign every request sent to the URL so the receiver can
+	// tell it came from us. It's never returned by the API after the
+	// subscription is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Wants returns true if the subscription should be sent events of the given
+// type
+func (s WebhookSubscription) Wants(typ WebhookEventType) bool {
+	for _, t := range s.EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeliveryStatus is where a webhook delivery is in being sent
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryStatusPending means the delivery hasn't succeeded yet and
+	// will be tried again at its NextAttemptAt
+	WebhookDeliveryStatusPending WebhookDeliveryStatus = "pending"
+	// WebhookDeliveryStatusSucceeded means the receiver accepted the delivery
+	WebhookDeliveryStatusSucceeded WebhookDeliveryStatus = "succeeded"
+	// WebhookDeliveryStatusDead means every attempt failed and the delivery was
+	// given up on, which puts it on the dead-letter list
+	WebhookDeliveryStatusDead WebhookDeliveryStatus = "dead"
+)
+
+// WebhookAttempt is a single try at sending a webhook delivery
+type WebhookAttempt struct {
+	At time.Time `json:"at"`
+	// StatusCode is the status the receiver responded with, which is 0 if it
+	// couldn't be reached
+	StatusCode int `json:"statusCode,omitempty"`
+	// Error is why the attempt failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// WebhookDelivery is a single order event being sent to a single webhook
+// subscription, along with every attempt at sending it
+type WebhookDelivery struct {
+	// ID uniquely identifies the delivery and IDs sort in the order the events
+	// they're for were recorded
+	ID             string           `json:"id"`
+	SubscriptionID string           `json:"subscriptionId"`
+	EventID        string           `json:"eventId"`
+	OrderID        string           `json:"orderId"`
+	Type           WebhookEventType `json:"type"`
+	// Payload is the exact body that's sent for every attempt so the signature
+	// a receiver verifies doesn't change between retries
+	Payload       []byte                `json:"-"`
+	Status        WebhookDeliveryStatus `json:"status"`
+	Attempts      []WebhookAttempt      `json:"attempts"`
+	NextAttemptAt time.Time             `json:"nextAttemptAt"`
+	CreatedAt     time.Time             `json:"createdAt"`
+	UpdatedAt     time.Time             `json:"updatedAt"`
+}
+
+// WebhookDeliveryID returns the ID of the delivery of the event with the given
+// ID to the subscription with the given ID. The ID is the same every time so
+// adding a delivery for the same event twice doesn't send it twice.
+func WebhookDeliveryID(eventID, subscriptionID string) string {
+	return eventID + "-" + subscriptionID
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// InsertWebhookSubscription fills in the subscription's ID if it's not already
+// set and its CreatedAt, then inserts it and returns its ID. If a subscription
+// with the same ID already exists then ErrWebhookSubscriptionExists is
+// returned.
+func (i *Instance) InsertWebhookSubscription(ctx context.Context, sub WebhookSubscription) (string, error) {
+	if sub.ID == "" {
+		sub.ID = uuid.New().String()
+	}
+	if sub.CreatedAt.IsZero() {
+		sub.CreatedAt = time.Now()
+	}
+	if _, err := i.webhooks.InsertOne(ctx, sub); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return "", ErrWebhookSubscriptionExists
+		}
+		return "", fmt.Errorf("error inserting document: %w", err)
+	}
+	return sub.ID, nil
+}
+
+// GetWebhookSubscription returns the subscription with the given ID. If that
+// ID isn't found then ErrWebhookSubscriptionNotFound is returned.
+func (i *Instance) GetWebhookSubscription(ctx context.Context, id string) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	err := i.webhooks.FindOne(ctx, bson.D{{Key: "id", Value: id}}).Decode(&sub)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return WebhookSubscription{}, ErrWebhookSubscriptionNotFound
+		}
+		return WebhookSubscription{}, err
+	}
+	return sub, nil
+}
+
+// GetWebhookSubscriptions returns every subscription, oldest first
+func (i *Instance) GetWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "id", Value: 1}})
+	cursor, err := i.webhooks.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var subs []WebhookSubscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return subs, nil
+}
+
+// DeleteWebhookSubscription deletes the subscription with the given ID. Its
+// deliveries are kept for the delivery log but any pending ones won't be sent.
+// If that ID isn't found then ErrWebhookSubscriptionNotFound is returned.
+func (i *Instance) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	result, err := i.webhooks.DeleteOne(ctx, bson.D{{Key: "id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookSubscriptionNotFound
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// AddWebhookDeliveries inserts the deliveries, skipping any whose ID already
+// exists so the same event is only ever delivered once to a subscription even
+// if it's added again
+func (i *Instance) AddWebhookDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	// upserting with $setOnInsert leaves existing deliveries alone, unlike an
+	// insert which would fail the whole batch on the first duplicate
+	models := make([]mongo.WriteModel, 0, len(deliveries))
+	for _, d := range deliveries {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "id", Value: d.ID}}).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: d}}).
+			SetUpsert(true))
+	}
+	if _, err := i.webhookDeliveries.BulkWrite(ctx, models); err != nil {
+		return fmt.Errorf("error inserting deliveries: %w", err)
+	}
+	return nil
+}
+
+// ClaimDueWebhookDelivery claims the oldest pending delivery whose
+// NextAttemptAt is at or before now, skipping deliveries to the subscriptions
+// with the IDs in exclude and the deliveries with the IDs in skip, by moving
+// its NextAttemptAt to leaseExpiresAt and returns it. The delivery isn't due again, so no one else claims it, until
+// the lease expires or an attempt is recorded. If no delivery is due then
+// ErrWebhookDeliveryNotFound is returned.
+func (i *Instance) ClaimDueWebhookDelivery(ctx context.Context, now, leaseExpiresAt time.Time, exclude, skip []string) (WebhookDelivery, error) {
+	filter := bson.D{
+		{Key: "status", Value: WebhookDeliveryStatusPending},
+		{Key: "nextattemptat", Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	if len(exclude) > 0 {
+		filter = append(filter, bson.E{Key: "subscriptionid", Value: bson.D{{Key: "$nin", Value: exclude}}})
+	}
+	if len(skip) > 0 {
+		filter = append(filter, bson.E{Key: "id", Value: bson.D{{Key: "$nin", Value: skip}}})
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "nextattemptat", Value: leaseExpiresAt}}}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "id", Value: 1}}).
+		SetReturnDocument(options.After)
+	var d WebhookDelivery
+	if err := i.webhookDeliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&d); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return WebhookDelivery{}, ErrWebhookDeliveryNotFound
+		}
+		return WebhookDelivery{}, fmt.Errorf("error claiming delivery: %w", err)
+	}
+	return d, nil
+}
+
+// RecordWebhookAttempt adds the attempt to the delivery with the given ID and
+// moves it to status. A pending delivery is tried again at nextAttemptAt. If
+// that ID isn't found then ErrWebhookDeliveryNotFound is returned.
+func (i *Instance) RecordWebhookAttempt(ctx context.Context, id string, attempt WebhookAttempt, status WebhookDeliveryStatus, nextAttemptAt time.Time) error {
+	// deliveries are inserted with a null attempts field which $push refuses to
+	// append to so this uses an update pipeline just like AddPayment
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "attempts", Value: appendToArray("attempts", bson.D{{Key: "$literal", Value: attempt}})},
+			{Key: "status", Value: status},
+			{Key: "nextattemptat", Value: nextAttemptAt},
+			{Key: "updatedat", Value: time.Now()},
+		}}},
+	}
+	result, err := i.webhookDeliveries.UpdateOne(ctx, bson.D{{Key: "id", Value: id}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns at most limit deliveries to the subscription
+// with the given ID, oldest first, starting after the delivery with the ID
+// after, or from the beginning if after is empty. Only deliveries with the
+// given status are returned unless status is empty. limit is capped at
+// MaxWebhookDeliveriesLimit.
+func (i *Instance) GetWebhookDeliveries(ctx context.Context, subscriptionID string, status WebhookDeliveryStatus, after string, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 || limit > MaxWebhookDeliveriesLimit {
+		limit = MaxWebhookDeliveriesLimit
+	}
+	filter := bson.D{{Key: "subscriptionid", Value: subscriptionID}}
+	if status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+	if after != "" {
+		filter = append(filter, bson.E{Key: "id", Value: bson.D{{Key: "$gt", Value: after}}})
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := i.webhookDeliveries.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []WebhookDelivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, fmt.Errorf("error decoding documents: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a webhook URL is, or resolves to, an
+// address inside our own network, which partners could otherwise use to make
+// the service send requests to things that aren't meant to be reachable from
+// the outside, like the cloud metadata endpoint
+var ErrForbiddenAddress = errors.New("address isn't allowed for webhooks")
+
+// forbiddenPrefixes are the ranges that aren't covered by the checks in
+// allowedAddr but still aren't on the public internet
+var forbiddenPrefixes = []netip.Prefix{
+	// "this" network
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// shared address space, which some clouds put their metadata endpoint in
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// IETF protocol assignments
+	netip.MustParsePrefix("192.0.0.0/24"),
+	// benchmarking
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// reserved
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64, which can reach any IPv4 address including the ones above
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	// deprecated site-local
+	netip.MustParsePrefix("fec0::/10"),
+}
+
+// allowedAddr returns whether webhooks can be sent to the address, which has to
+// be a public unicast address. That rules out loopback, link-local, which is
+// where the cloud metadata endpoint at 169.254.169.254 is, private and
+// unspecified addresses along with the forbiddenPrefixes.
+func allowedAddr(addr netip.Addr) bool {
+	// an IPv4-mapped IPv6 address reaches the IPv4 address so it's checked as one
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range forbiddenPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolver looks up the addresses of a host. net.DefaultResolver implements
+// it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// CheckURL returns ErrForbiddenAddress if the URL's host is, or resolves to,
+// any address webhooks can't be sent to. The host can still be pointed
+// somewhere else later, which is why the client returned by NewClient checks
+// every address again as it connects.
+func CheckURL(ctx context.Context, resolver Resolver, u *url.URL) error {
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !allowedAddr(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+		return nil
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !allowedAddr(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenAddress, host, addr)
+		}
+	}
+	return nil
+}
+
+// dialControl is called with the address every connection is about to be made
+// to, after the host was resolved, and refuses any that isn't allowed
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !allowedAddr(addr) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+	}
+	return nil
+}
+
+// NewClient returns the client webhooks should be sent with. It refuses to
+// connect to any address CheckURL would reject, including when a subscribed
+// host starts resolving to one or redirects to one. Proxies from the
+// environment aren't used since only the proxy's address would be checked.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves hosts from the map instead of looking them up
+type fakeResolver map[string][]netip.Addr
+
+func (r fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestAllowedAddr(t *testing.T) {
+	for _, addr := range []string{"93.184.216.34", "8.8.8.8", "2606:2800:220:1:248:1893:25c8:1946"} {
+		assert.True(t, allowedAddr(netip.MustParseAddr(addr)), addr)
+	}
+	for _, addr := range []string{
+		"127.0.0.1",
+		"::1",
+		"0.0.0.0",
+		"::",
+		"10.1.2.3",
+		"172.16.0.1",
+		"192.168.1.1",
+		"fd00::1",
+		"169.254.169.254",
+		"fe80::1",
+		"fd00:ec2::254",
+		"100.100.100.200",
+		"224.0.0.1",
+		"255.255.255.255",
+		"::ffff:127.0.0.1",
+		"64:ff9b::a00:1",
+	} {
+		assert.False(t, allowedAddr(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	ctx := context.Background()
+	resolver := fakeResolver{
+		"partner.example.com":  {netip.MustParseAddr("93.184.216.34")},
+		"internal.example.com": {netip.MustParseAddr("10.0.0.5")},
+		"rebind.example.com":   {netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")},
+	}
+	check := func(raw string) error {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		return CheckURL(ctx, resolver, u)
+	}
+
+	assert.NoError(t, check("https://partner.example.com/hooks"))
+	assert.NoError(t, check("https://93.184.216.34:8443/hooks"))
+
+	// every address the host resolves to has to be allowed
+	assert.ErrorIs(t, check("https://internal.example.com/hooks"), ErrForbiddenAddress)
+	assert.ErrorIs(t, check("https://rebind.example.com/hooks"), ErrForbiddenAddress)
+	assert.ErrorIs(t, check("http://169.254.169.254/latest/meta-data"), ErrForbiddenAddress)
+	assert.ErrorIs(t, check("http://[::1]:8080/hooks"), ErrForbiddenAddress)
+
+	// a host that can't be resolved isn't forbidden but isn't allowed either
+	err := check("https://unknown.example.com/hooks")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrForbiddenAddress)
+}
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Fail(t, "unexpected request")
+	}))
+	t.Cleanup(srv.Close)
+
+	// the server is on loopback so the connection is refused before anything
+	// is sent, whatever the URL's host resolved to
+	_, err := NewClient().Post(srv.URL, "application/json", nil)
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	_, err = NewClient().Post("http://localhost:"+u.Port(), "application/json", nil)
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+}
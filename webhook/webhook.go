@@ -0,0 +1,432 @@
+// Package webhook notifies partners about changes to orders by sending signed
+// JSON requests to the URLs they subscribed. It's an outbox sink, so for every
+// order event the outbox delivers it adds a delivery for each subscription
+// that wants the event, and Run sends those deliveries in the background,
+// retrying failures with exponential backoff until they succeed or are given
+// up on and put on the dead-letter list. Every delivery is claimed before it's
+// sent so replicas don't send the same one, and deliveries to different
+// subscriptions are sent concurrently so a slow receiver only holds up its own.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/order-up/mocks"
+	"github.com/levenlabs/order-up/storage"
+)
+
+const (
+	// SignatureHeader holds the signature of every request, see Sign
+	SignatureHeader = "X-Order-Up-Signature"
+	// EventHeader holds the type of the event a request is for
+	EventHeader = "X-Order-Up-Event"
+	// DeliveryHeader holds the ID of the delivery, which is the same for every
+	// attempt at sending it
+	DeliveryHeader = "X-Order-Up-Delivery"
+)
+
+// claimMargin is how much longer than AttemptTimeout a claimed delivery is
+// leased for, which leaves time to get the subscription and record the attempt
+const claimMargin = 30 * time.Second
+
+// Config describes how deliveries are sent. The zero value of any field falls
+// back to the value from DefaultConfig.
+type Config struct {
+	// AttemptTimeout bounds how long a single request can take
+	AttemptTimeout time.Duration
+	// Concurrency is how many requests can be in flight at once. There's never
+	// more than one at a time to the same subscription so a slow receiver can
+	// only take up one of them.
+	Concurrency int
+	// MaxAttempts is how many times a delivery is tried before it's given up on
+	MaxAttempts int
+	// MinBackoff is about how long to wait before the first retry, which doubles
+	// after every failure up to MaxBackoff. Each wait is randomized so that
+	// deliveries that failed together aren't all retried together.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultConfig returns the Config used when a field isn't set
+func DefaultConfig() Config {
+	return Config{
+		AttemptTimeout: 10 * time.Second,
+		Concurrency:    16,
+		MaxAttempts:    8,
+		MinBackoff:     30 * time.Second,
+		MaxBackoff:     time.Hour,
+	}
+}
+
+// withDefaults returns a copy of the config with any unset fields set to their
+// values from DefaultConfig
+func (c Config) withDefaults() Config {
+	def := DefaultConfig()
+	if c.AttemptTimeout == 0 {
+		c.AttemptTimeout = def.AttemptTimeout
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = def.Concurrency
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = def.MaxAttempts
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = def.MinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = def.MaxBackoff
+	}
+	return c
+}
+
+// Payload is the JSON body of every webhook request
+type Payload struct {
+	// ID is the ID of the order event, which is the same for every subscription,
+	// so receivers can skip events they've already handled
+	ID   string                   `json:"id"`
+	Type storage.WebhookEventType `json:"type"`
+	// At is when the order changed
+	At time.Time `json:"at"`
+	// Order is the order as it was when the delivery was added, which might be
+	// after it changed again if the outbox was behind
+	Order storage.Order `json:"order"`
+}
+
+// eventType returns the webhook event type for the order event, if there is
+// one
+func eventType(event storage.OrderEvent) (storage.WebhookEventType, bool) {
+	if event.Type == storage.OrderEventCreated {
+		return storage.WebhookEventOrderCreated, true
+	}
+	// the status can change from more than one kind of event, like fulfilling
+	// line items or capturing through a transition
+	if event.StatusChange == nil {
+		return "", false
+	}
+	switch event.StatusChange.To {
+	case storage.OrderStatusCharged:
+		return storage.WebhookEventOrderCharged, true
+	case storage.OrderStatusFulfilled:
+		return storage.WebhookEventOrderFulfilled, true
+	case storage.OrderStatusCancelled:
+		return storage.WebhookEventOrderCancelled, true
+	}
+	return "", false
+}
+
+// Sign returns the value of the SignatureHeader for a request with the body
+// sent at the given time, which looks like t=1641024000,v1=5257a869... where t
+// is the time in unix seconds and v1 is the hex encoded HMAC-SHA256 of t, a
+// period and the body, keyed with the subscription's secret. Receivers should
+// compute the same HMAC, compare it in constant time and reject requests whose
+// t is too old so they can't be replayed.
+func Sign(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Sender adds and sends webhook deliveries. It implements the outbox.Sink
+// interface.
+type Sender struct {
+	stor   mocks.StorageInstance
+	client *http.Client
+	cfg    Config
+}
+
+// New returns a Sender that sends requests with client, or the client returned
+// by NewClient if it's nil. Anything other than NewClient's client can be made
+// to send requests inside our own network so it should only be used in tests.
+func New(stor mocks.StorageInstance, client *http.Client, cfg Config) *Sender {
+	if client == nil {
+		client = NewClient()
+	}
+	return &Sender{
+		stor:   stor,
+		client: client,
+		cfg:    cfg.withDefaults(),
+	}
+}
+
+// Send adds a delivery of the event for every subscription that wants it. It
+// doesn't make any requests itself so a slow or broken receiver can't hold up
+// the outbox. Adding the same event again doesn't add new deliveries.
+func (s *Sender) Send(ctx context.Context, event storage.OrderEvent) error {
+	typ, ok := eventType(event)
+	if !ok {
+		return nil
+	}
+	subs, err := s.stor.GetWebhookSubscriptions(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting webhook subscriptions: %w", err)
+	}
+	var wanted []storage.WebhookSubscription
+	for _, sub := range subs {
+		if sub.Wants(typ) {
+			wanted = append(wanted, sub)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	payload := Payload{
+		ID:   event.ID,
+		Type: typ,
+		At:   event.At,
+	}
+	if event.Order != nil {
+		payload.Order = *event.Order
+	} else if payload.Order, err = s.stor.GetOrder(ctx, event.OrderID); err != nil {
+		return fmt.Errorf("error getting order: %w", err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding payload: %w", err)
+	}
+
+	now := time.Now()
+	deliveries := make([]storage.WebhookDelivery, 0, len(wanted))
+	for _, sub := range wanted {
+		deliveries = append(deliveries, storage.WebhookDelivery{
+			ID:             storage.WebhookDeliveryID(event.ID, sub.ID),
+			SubscriptionID: sub.ID,
+			EventID:        event.ID,
+			OrderID:        event.OrderID,
+			Type:           typ,
+			Payload:        body,
+			Status:         storage.WebhookDeliveryStatusPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+	if err := s.stor.AddWebhookDeliveries(ctx, deliveries); err != nil {
+		return fmt.Errorf("error adding webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before trying a delivery again after it
+// failed attempts times
+func (s *Sender) backoff(attempts int) time.Duration {
+	backoff := s.cfg.MinBackoff
+	for i := 1; i < attempts && backoff < s.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.cfg.MaxBackoff {
+		backoff = s.cfg.MaxBackoff
+	}
+	// wait somewhere between half and all of the backoff
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// attempt makes a single request for the delivery to the subscription's URL
+func (s *Sender) attempt(ctx context.Context, sub storage.WebhookSubscription, d storage.WebhookDelivery) storage.WebhookAttempt {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.AttemptTimeout)
+	defer cancel()
+
+	now := time.Now()
+	attempt := storage.WebhookAttempt{At: now}
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = fmt.Sprintf("error creating request: %v", err)
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, now, d.Payload))
+	req.Header.Set(EventHeader, string(d.Type))
+	req.Header.Set(DeliveryHeader, d.ID)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("error sending request: %v", err)
+		return attempt
+	}
+	// the body has to be read to the end for the connection to be reused
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected response status %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// deliver sends the delivery and records how it went. A delivery to a
+// subscription that was deleted is given up on without sending it.
+func (s *Sender) deliver(ctx context.Context, d storage.WebhookDelivery) error {
+	sub, err := s.stor.GetWebhookSubscription(ctx, d.SubscriptionID)
+	var attempt storage.WebhookAttempt
+	switch {
+	case errors.Is(err, storage.ErrWebhookSubscriptionNotFound):
+		attempt = storage.WebhookAttempt{At: time.Now(), Error: "subscription was deleted"}
+		return s.stor.RecordWebhookAttempt(ctx, d.ID, attempt, storage.WebhookDeliveryStatusDead, attempt.At)
+	case err != nil:
+		return fmt.Errorf("error getting webhook subscription: %w", err)
+	}
+
+	attempt = s.attempt(ctx, sub, d)
+	status := storage.WebhookDeliveryStatusSucceeded
+	next := attempt.At
+	if attempt.Error != "" {
+		attempts := len(d.Attempts) + 1
+		if attempts >= s.cfg.MaxAttempts {
+			status = storage.WebhookDeliveryStatusDead
+			llog.Warn("giving up on webhook delivery", llog.KV{"id": d.ID, "url": sub.URL, "attempts": attempts, "error": attempt.Error})
+		} else {
+			status = storage.WebhookDeliveryStatusPending
+			next = attempt.At.Add(s.backoff(attempts))
+		}
+	}
+	return s.stor.RecordWebhookAttempt(ctx, d.ID, attempt, status, next)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// delivered is sent by a pool's goroutine once it's done with a delivery
+type delivered struct {
+	id             string
+	subscriptionID string
+	err            error
+}
+
+// pool claims due deliveries and sends each one in its own goroutine, with at
+// most Concurrency in flight and only one at a time to each subscription
+type pool struct {
+	s *Sender
+	// busy holds the IDs of the subscriptions with a delivery in flight
+	busy map[string]bool
+	// claimed holds the IDs of every delivery claimed so far, if it's not nil,
+	// so none of them is claimed again even if it failed and is already due
+	// again
+	claimed map[string]bool
+	done    chan delivered
+	wg      sync.WaitGroup
+}
+
+func (s *Sender) newPool() *pool {
+	return &pool{
+		s:    s,
+		busy: map[string]bool{},
+		// there's never more than Concurrency in flight so finishing never
+		// blocks even once nothing is reading anymore
+		done: make(chan delivered, s.cfg.Concurrency),
+	}
+}
+
+// fill claims deliveries that are due at now and starts sending them until
+// the pool is full or nothing else is due. It returns how many were started.
+func (p *pool) fill(ctx context.Context, now time.Time) (int, error) {
+	var n int
+	for len(p.busy) < p.s.cfg.Concurrency {
+		exclude := make([]string, 0, len(p.busy))
+		for id := range p.busy {
+			exclude = append(exclude, id)
+		}
+		var skip []string
+		for id := range p.claimed {
+			skip = append(skip, id)
+		}
+		lease := now.Add(p.s.cfg.AttemptTimeout + claimMargin)
+		d, err := p.s.stor.ClaimDueWebhookDelivery(ctx, now, lease, exclude, skip)
+		if errors.Is(err, storage.ErrWebhookDeliveryNotFound) {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("error claiming webhook delivery: %w", err)
+		}
+		p.busy[d.SubscriptionID] = true
+		if p.claimed != nil {
+			p.claimed[d.ID] = true
+		}
+		n++
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.done <- delivered{id: d.ID, subscriptionID: d.SubscriptionID, err: p.s.deliver(ctx, d)}
+		}()
+	}
+	return n, nil
+}
+
+// finish frees up the subscription of a delivery that's done and returns the
+// error sending it, if there was one. A delivery that failed to be recorded
+// is sent again once its claim expires.
+func (p *pool) finish(d delivered) error {
+	delete(p.busy, d.subscriptionID)
+	if d.err != nil {
+		return fmt.Errorf("error delivering webhook %s: %w", d.id, d.err)
+	}
+	return nil
+}
+
+// deliverDue sends every delivery that's due at now, each at most once, and
+// returns how many there were. If any of them couldn't be recorded the last
+// error is returned after trying the rest.
+func (s *Sender) deliverDue(ctx context.Context, now time.Time) (int, error) {
+	p := s.newPool()
+	// a delivery that fails could be due again at now, depending on its
+	// backoff, and it shouldn't be tried over and over in one pass
+	p.claimed = map[string]bool{}
+	var n int
+	var lastErr error
+	for {
+		started, err := p.fill(ctx, now)
+		n += started
+		if err != nil {
+			lastErr = err
+		}
+		if len(p.busy) == 0 {
+			return n, lastErr
+		}
+		// one delivery failing to be recorded shouldn't stop the rest
+		if err := p.finish(<-p.done); err != nil {
+			lastErr = err
+		}
+	}
+}
+
+// Run sends the deliveries that are due until the context is cancelled. It
+// looks for due deliveries every interval and whenever a delivery is done,
+// which frees up room for another one and its subscription, and waits for the
+// deliveries in flight before returning.
+func (s *Sender) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	p := s.newPool()
+	defer p.wg.Wait()
+	for {
+		if _, err := p.fill(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			llog.Error("failed to send webhook deliveries", llog.ErrKV(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-p.done:
+			if err := p.finish(d); err != nil && ctx.Err() == nil {
+				llog.Error("failed to send webhook deliveries", llog.ErrKV(err))
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/order-up/outbox"
+	"github.com/levenlabs/order-up/storage"
+	"github.com/levenlabs/order-up/storage/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the sender is added to the outbox's sinks in main
+var _ outbox.Sink = (*Sender)(nil)
+
+// receiver is a local webhook receiver that records every request it gets and
+// responds with status
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// got returns every request received so far and their bodies
+func (r *receiver) got() ([]*http.Request, [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request{}, r.requests...), append([][]byte{}, r.bodies...)
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1641024000, 0)
+	body := []byte(`{"id":"ev-1"}`)
+	sig := Sign("secret", at, body)
+	assert.True(t, strings.HasPrefix(sig, "t=1641024000,v1="), sig)
+	assert.Equal(t, sig, Sign("secret", at, body))
+	assert.NotEqual(t, sig, Sign("other", at, body))
+	assert.NotEqual(t, sig, Sign("secret", at.Add(time.Second), body))
+	assert.NotEqual(t, sig, Sign("secret", at, []byte(`{"id":"ev-2"}`)))
+}
+
+func TestSender(t *testing.T) {
+	ctx := context.Background()
+	stor := memory.New()
+	recv := newReceiver(t)
+	sender := New(stor, recv.Client(), Config{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: time.Hour})
+
+	charged := storage.WebhookSubscription{
+		URL:        recv.URL + "/charged",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCharged},
+		Secret:     "charged-secret",
+	}
+	var err error
+	charged.ID, err = stor.InsertWebhookSubscription(ctx, charged)
+	require.NoError(t, err)
+	created := storage.WebhookSubscription{
+		URL:        recv.URL + "/created",
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated},
+		Secret:     "created-secret",
+	}
+	created.ID, err = stor.InsertWebhookSubscription(ctx, created)
+	require.NoError(t, err)
+
+	order := storage.Order{
+		ID:            "order-1",
+		CustomerEmail: "test@test",
+		LineItems:     []storage.LineItem{{Description: "item 1", Quantity: 1, PriceCents: 100}},
+		Status:        storage.OrderStatusPending,
+	}
+	_, err = stor.InsertOrder(ctx, order)
+	require.NoError(t, err)
+	_, err = stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusPending}, storage.OrderStatusCharging, "charge requested")
+	require.NoError(t, err)
+	_, err = stor.TransitionOrderStatus(ctx, order.ID, []storage.OrderStatus{storage.OrderStatusCharging}, storage.OrderStatusCharged, "charge succeeded")
+	require.NoError(t, err)
+
+	// every event is sent through the sender like the outbox would, twice to
+	// make sure events delivered more than once only get one delivery
+	events, err := stor.GetOrderEvents(ctx, order.ID, "", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for i := 0; i < 2; i++ {
+		for _, event := range events {
+			require.NoError(t, sender.Send(ctx, event))
+		}
+	}
+
+	// the created and charged events each go to the subscription that wants them
+	n, err := sender.deliverDue(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	requests, bodies := recv.got()
+	require.Len(t, requests, 2)
+	// the subscriptions are sent to concurrently so the requests are matched up
+	// by their path
+	byPath := map[string]int{}
+	for idx, req := range requests {
+		byPath[req.URL.Path] = idx
+	}
+	for idx, sub := range []storage.WebhookSubscription{created, charged} {
+		path := strings.TrimPrefix(sub.URL, recv.URL)
+		require.Contains(t, byPath, path)
+		req, body := requests[byPath[path]], bodies[byPath[path]]
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, storage.WebhookDeliveryID(events[idx*2].ID, sub.ID), req.Header.Get(DeliveryHeader))
+
+		// the receiver can check the signature with the subscription's secret
+		sig := req.Header.Get(SignatureHeader)
+		ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, Sign(sub.Secret, time.Unix(ts, 0), body), sig)
+
+		var payload Payload
+		require.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, events[idx*2].ID, payload.ID)
+		assert.Equal(t, order.ID, payload.Order.ID)
+		assert.Equal(t, string(payload.Type), req.Header.Get(EventHeader))
+	}
+	assert.Equal(t, storage.WebhookEventOrderCreated, storage.WebhookEventType(requests[byPath["/created"]].Header.Get(EventHeader)))
+	assert.Equal(t, storage.WebhookEventOrderCharged, storage.WebhookEventType(requests[byPath["/charged"]].Header.Get(EventHeader)))
+
+	deliveries, err := stor.GetWebhookDeliveries(ctx, charged.ID, "", "", 0)
+	require.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, storage.WebhookDeliveryStatusSucceeded, deliveries[0].Status)
+		if assert.Len(t, deliveries[0].Attempts, 1) {
+			assert.Equal(t, http.StatusOK, deliveries[0].Attempts[0].StatusCode)
+			assert.Empty(t, deliveries[0].Attempts[0].Error)
+		}
+	}
+
+	// nothing is due once everything was delivered
+	n, err = sender.deliverDue(ctx, time.Now().Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestSenderRetries(t *testing.T) {
+	ctx := context.Background()
+	stor := memory.New()
+	recv := newReceiver(t)
+	recv.setStatus(http.StatusInternalServerError)
+	sender := New(stor, recv.Client(), Config{MaxAttempts: 3, MinBackoff: time.Minute, MaxBackoff: 90 * time.Second})
+
+	sub := storage.WebhookSubscription{
+		URL:        recv.URL,
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated},
+		Secret:     "secret",
+	}
+	var err error
+	sub.ID, err = stor.InsertWebhookSubscription(ctx, sub)
+	require.NoError(t, err)
+	_, err = stor.InsertOrder(ctx, storage.Order{ID: "order-1", CustomerEmail: "test@test"})
+	require.NoError(t, err)
+	events, err := stor.GetOrderEvents(ctx, "order-1", "", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.NoError(t, sender.Send(ctx, events[0]))
+
+	getDelivery := func() storage.WebhookDelivery {
+		deliveries, err := stor.GetWebhookDeliveries(ctx, sub.ID, "", "", 0)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		return deliveries[0]
+	}
+
+	// a failure is retried after somewhere between half and all of the backoff
+	now := time.Now()
+	_, err = sender.deliverDue(ctx, now)
+	require.NoError(t, err)
+	d := getDelivery()
+	assert.Equal(t, storage.WebhookDeliveryStatusPending, d.Status)
+	if assert.Len(t, d.Attempts, 1) {
+		assert.Equal(t, http.StatusInternalServerError, d.Attempts[0].StatusCode)
+		assert.Equal(t, "unexpected response status 500", d.Attempts[0].Error)
+	}
+	wait := d.NextAttemptAt.Sub(d.Attempts[0].At)
+	assert.True(t, wait >= 30*time.Second && wait <= time.Minute, wait.String())
+	n, err := sender.deliverDue(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the backoff doubles up to the max, and even if the next attempt is
+	// already due again it waits for the next pass
+	n, err = sender.deliverDue(ctx, d.NextAttemptAt.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	d = getDelivery()
+	assert.Equal(t, storage.WebhookDeliveryStatusPending, d.Status)
+	require.Len(t, d.Attempts, 2)
+	wait = d.NextAttemptAt.Sub(d.Attempts[1].At)
+	assert.True(t, wait >= 45*time.Second && wait <= 90*time.Second, wait.String())
+
+	// once every attempt failed the delivery is dead
+	_, err = sender.deliverDue(ctx, d.NextAttemptAt)
+	require.NoError(t, err)
+	d = getDelivery()
+	assert.Equal(t, storage.WebhookDeliveryStatusDead, d.Status)
+	assert.Len(t, d.Attempts, 3)
+	requests, _ := recv.got()
+	assert.Len(t, requests, 3)
+	dead, err := stor.GetWebhookDeliveries(ctx, sub.ID, storage.WebhookDeliveryStatusDead, "", 0)
+	require.NoError(t, err)
+	assert.Len(t, dead, 1)
+	n, err = sender.deliverDue(ctx, d.NextAttemptAt.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestSenderDeletedSubscription(t *testing.T) {
+	ctx := context.Background()
+	stor := memory.New()
+	recv := newReceiver(t)
+	sender := New(stor, recv.Client(), Config{})
+
+	sub := storage.WebhookSubscription{
+		URL:        recv.URL,
+		EventTypes: []storage.WebhookEventType{storage.WebhookEventOrderCreated},
+		Secret:     "secret",
+	}
+	var err error
+	sub.ID, err = stor.InsertWebhookSubscription(ctx, sub)
+	require.NoError(t, err)
+	_, err = stor.InsertOrder(ctx, storage.Order{ID: "order-1", CustomerEmail: "test@test"})
+	require.NoError(t, err)
+	events, err := stor.GetOrderEvents(ctx, "order-1", "", 0)
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(ctx, events[0]))
+	require.NoError(t, stor.DeleteWebhookSubscription(ctx, sub.ID))
+
+	// the delivery is given up on without being sent
+	_, err = sender.deliverDue(ctx, time.Now())
+	require.NoError(t, err)
+	requests, _ := recv.got()
+	assert.Empty(t, requests)
+	dead, err := stor.GetWebhookDeliveries(ctx, sub.ID, storage.WebhookDeliveryStatusDead, "", 0)
+	require.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "subscription was deleted", dead[0].Attempts[0].Error)
+	}
+}
+
+func TestSenderConcurrency(t *testing.T) {
+	ctx := context.Background()
+	stor := memory.New()
+
+	// the slow receiver holds every request until it's released and records how
+	// many it had at once
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	t.Cleanup(slow.Close)
+	fast := newReceiver(t)
+
+	var err error
+	created := []storage.WebhookEventType{storage.WebhookEventOrderCreated}
+	slowSub := storage.WebhookSubscription{URL: slow.URL, EventTypes: created, Secret: "secret"}
+	slowSub.ID, err = stor.InsertWebhookSubscription(ctx, slowSub)
+	require.NoError(t, err)
+	fastSub := storage.WebhookSubscription{URL: fast.URL, EventTypes: created, Secret: "secret"}
+	fastSub.ID, err = stor.InsertWebhookSubscription(ctx, fastSub)
+	require.NoError(t, err)
+
+	sender := New(stor, new(http.Client), Config{})
+	for n := 0; n < 3; n++ {
+		id, err := stor.InsertOrder(ctx, storage.Order{CustomerEmail: "test@test"})
+		require.NoError(t, err)
+		events, err := stor.GetOrderEvents(ctx, id, "", 0)
+		require.NoError(t, err)
+		require.NoError(t, sender.Send(ctx, events[0]))
+	}
+
+	// two replicas sending at once claim different deliveries
+	now := time.Now()
+	results := make(chan int, 2)
+	for r := 0; r < 2; r++ {
+		go func() {
+			n, err := sender.deliverDue(ctx, now)
+			assert.NoError(t, err)
+			results <- n
+		}()
+	}
+
+	// the slow receiver doesn't hold up the fast one
+	require.Eventually(t, func() bool {
+		requests, _ := fast.got()
+		return len(requests) == 3
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	assert.Equal(t, 6, <-results+<-results)
+
+	// every delivery was sent exactly once and each replica only sent the slow
+	// receiver one request at a time
+	requests, _ := fast.got()
+	seen := map[string]bool{}
+	for _, req := range requests {
+		id := req.Header.Get(DeliveryHeader)
+		assert.False(t, seen[id], id)
+		seen[id] = true
+	}
+	assert.LessOrEqual(t, maxInFlight, 2)
+	for _, sub := range []storage.WebhookSubscription{slowSub, fastSub} {
+		deliveries, err := stor.GetWebhookDeliveries(ctx, sub.ID, storage.WebhookDeliveryStatusSucceeded, "", 0)
+		require.NoError(t, err)
+		for _, d := range deliveries {
+			assert.Len(t, d.Attempts, 1)
+		}
+		assert.Len(t, deliveries, 3)
+	}
+}
+
+func TestEventType(t *testing.T) {
+	change := func(to storage.OrderStatus) *storage.StatusChange {
+		return &storage.StatusChange{To: to}
+	}
+	tests := []struct {
+		event storage.OrderEvent
+		typ   storage.WebhookEventType
+		ok    bool
+	}{
+		{storage.OrderEvent{Type: storage.OrderEventCreated}, storage.WebhookEventOrderCreated, true},
+		{storage.OrderEvent{Type: storage.OrderEventStatusChanged, StatusChange: change(storage.OrderStatusCharged)}, storage.WebhookEventOrderCharged, true},
+		{storage.OrderEvent{Type: storage.OrderEventStatusChanged, StatusChange: change(storage.OrderStatusCancelled)}, storage.WebhookEventOrderCancelled, true},
+		{storage.OrderEvent{Type: storage.OrderEventLineItemsFulfilled, StatusChange: change(storage.OrderStatusFulfilled)}, storage.WebhookEventOrderFulfilled, true},
+		{storage.OrderEvent{Type: storage.OrderEventLineItemsFulfilled, StatusChange: change(storage.OrderStatusPartiallyFulfilled)}, "", false},
+		{storage.OrderEvent{Type: storage.OrderEventLineItemsFulfilled}, "", false},
+		{storage.OrderEvent{Type: storage.OrderEventStatusChanged, StatusChange: change(storage.OrderStatusCharging)}, "", false},
+		{storage.OrderEvent{Type: storage.OrderEventPaymentRecorded}, "", false},
+	}
+	for _, test := range tests {
+		typ, ok := eventType(test.event)
+		assert.Equal(t, test.typ, typ)
+		assert.Equal(t, test.ok, ok)
+	}
+}